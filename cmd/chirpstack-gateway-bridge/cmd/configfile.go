@@ -79,6 +79,14 @@ type="{{ .Backend.Type }}"
   # packet-forwarder matches this port.
   udp_bind = "{{ .Backend.SemtechUDP.UDPBind }}"
 
+  # ip:port to bind the TCP listener to (leave blank to disable)
+  #
+  # The TCP listener accepts the same packets as the UDP listener, e.g. from
+  # a relay tunneling the packet-forwarder traffic over TCP. Each packet must
+  # be prefixed by its length (2 bytes, big-endian). Responses are sent back
+  # over the same TCP connection, the downlink_port setting is ignored.
+  tcp_bind = "{{ .Backend.SemtechUDP.TCPBind }}"
+
   # Skip the CRC status-check of received packets
   #
   # This is only has effect when the packet-forwarder is configured to forward
@@ -91,6 +99,629 @@ type="{{ .Backend.Type }}"
   # the time would otherwise be unset.
   fake_rx_time={{ .Backend.SemtechUDP.FakeRxTime }}
 
+  # Ignore stats time.
+  #
+  # Always use the time of receiving the stats instead of the time reported
+  # by the packet-forwarder. Note that when the packet-forwarder does not
+  # report a time, the time of receiving the stats is always used.
+  ignore_stats_time={{ .Backend.SemtechUDP.IgnoreStatsTime }}
+
+  # Gateway location validation.
+  #
+  # When set, the location reported by the gateway stats is rejected when the
+  # latitude is outside -90..90, the longitude is outside -180..180 or when
+  # the gateway reports 0,0 after a valid location was reported before
+  # (e.g. a GPS glitch). A rejected location is dropped, it is not clamped to
+  # the valid range nor replaced by the previous location.
+  #
+  # Valid options are:
+  #   * ""              no validation
+  #   * drop_location   remove the location from the stats
+  #   * drop_stats      drop the complete stats message
+  location_validation="{{ .Backend.SemtechUDP.LocationValidation }}"
+
+  # Bridge stats.
+  #
+  # When enabled, the counters as seen by the ChirpStack Gateway Bridge
+  # (since the previous stats) are added to the gateway stats meta-data.
+  # These are independent of the counters reported by the packet-forwarder:
+  #   * bridge_rx_received       uplinks received
+  #   * bridge_rx_forwarded      uplinks forwarded (CRC and filters passed)
+  #   * bridge_tx_sent           downlinks sent to the gateway
+  #   * bridge_tx_ack_ok         downlinks acknowledged by the gateway
+  #   * bridge_tx_ack_failed     downlinks rejected by the gateway
+  #   * bridge_bytes_in          UDP bytes received (including ACKs)
+  #   * bridge_bytes_out         UDP bytes sent (including ACKs)
+  #   * bridge_rxpk_batch_last   uplinks in the last PushData with uplinks
+  #   * bridge_rxpk_batch_max    max. uplinks in a single PushData (since the
+  #                              gateway connected)
+  #   * bridge_rx_forward_ratio  moving average of rxfw / rxnb of the stats
+  #                              (0..1), when the gateway received packets
+  bridge_stats={{ .Backend.SemtechUDP.BridgeStats }}
+
+  # Frequency stats max.
+  #
+  # When set, the number of uplinks received per frequency (since the
+  # previous stats) are added to the gateway stats meta-data as
+  # bridge_rx_freq_<frequency Hz>. At most this number of frequencies are
+  # tracked per gateway, uplinks on other frequencies are counted as
+  # bridge_rx_freq_other. Set to 0 to disable.
+  frequency_stats_max={{ .Backend.SemtechUDP.FrequencyStatsMax }}
+
+  # Downlink port.
+  #
+  # By default, downlinks (PULL_RESP) are sent to the ip:port from which the
+  # gateway sent its PULL_DATA. When set, downlinks are sent to this port
+  # (using the gateway ip), e.g. for gateways behind a NAT which listen for
+  # downlinks on a known port. Set to 0 to use the source port.
+  downlink_port={{ .Backend.SemtechUDP.DownlinkPort }}
+
+  # Downlink bind.
+  #
+  # By default, downlinks (PULL_RESP) are sent from the listener on which the
+  # gateway sent its PULL_DATA. When set, downlinks are sent from a separate
+  # UDP socket bound to this ip:port instead, e.g. for gateways which expect
+  # downlinks from a specific source port. The ACKs are still sent from the
+  # listener. Note that a gateway using a connected UDP socket only accepts
+  # packets from the address it sends to. Leave blank to disable.
+  downlink_bind="{{ .Backend.SemtechUDP.DownlinkBind }}"
+
+  # Allowed networks.
+  #
+  # When set, only UDP packets originating from the given networks (CIDR)
+  # are handled. Packets from other source addresses are dropped before
+  # parsing. When left blank, packets from all networks are allowed.
+  #
+  # Example:
+  # allowed_networks=[
+  #   "10.0.0.0/8",
+  #   "192.168.1.0/24",
+  # ]
+  allowed_networks=[{{ range $index, $elm := .Backend.SemtechUDP.AllowedNetworks }}
+    "{{ $elm }}",{{ end }}
+  ]
+
+  # Max. gateways.
+  #
+  # When set, the max. number of gateways tracked by the ChirpStack Gateway
+  # Bridge. PullData packets from new gateways are dropped when this number
+  # is reached, until inactive gateways have been cleaned up. This protects
+  # against a flood of spoofed Gateway IDs. Set to 0 to disable.
+  max_gateways={{ .Backend.SemtechUDP.MaxGateways }}
+
+  # Suspect grace.
+  #
+  # When set, a gateway that did not send a PullData within the cleanup
+  # window (1 minute) is first marked as suspect, instead of being removed
+  # directly. A suspect gateway is only removed (and the disconnect event is
+  # only triggered) once it has been inactive for this additional duration.
+  # Downlinks to suspect gateways are still sent, but logged as a warning.
+  # This reduces the (dis)connect churn of gateways with an unreliable
+  # backhaul. Set to 0 to disable.
+  suspect_grace="{{ .Backend.SemtechUDP.SuspectGrace }}"
+
+  # Require pull data.
+  #
+  # When enabled, PushData packets are only acknowledged when the source IP
+  # address has completed a valid PullData for the same Gateway ID. PullData
+  # packets with an all-zero Gateway ID are dropped. This prevents the
+  # ChirpStack Gateway Bridge from replying to spoofed source addresses.
+  require_pull_data={{ .Backend.SemtechUDP.RequirePullData }}
+
+  # PushData ACK after processing.
+  #
+  # By default, the PushACK is sent before handling the stats and uplinks of
+  # the PushData. When enabled, it is sent after handling these and only when
+  # this succeeded, e.g. to apply backpressure to the packet-forwarder when
+  # the integration is slow. Note that the forwarder might retransmit the
+  # PushData when the ACK is late (or missing).
+  push_data_ack_after_processing={{ .Backend.SemtechUDP.PushDataACKAfterProcessing }}
+
+  # ACK rate limit.
+  #
+  # When set, the max. number of ACKs (PullACK and PushACK) per second sent
+  # to a single source IP address. ACKs exceeding this limit are not sent.
+  # Set to 0 to disable.
+  ack_rate_limit={{ .Backend.SemtechUDP.ACKRateLimit }}
+
+  # PullData debounce.
+  #
+  # When set, the events of a PullData of a known gateway (address change,
+  # subscribe event) are emitted at most once per this interval. In between,
+  # only the address and last-seen timestamp of the gateway are updated and
+  # the PullData is acknowledged. Note that an address change is therefore
+  # reported with a delay of up to this interval. Set to 0 to disable.
+  pull_data_debounce="{{ .Backend.SemtechUDP.PullDataDebounce }}"
+
+  # Gateway conflict window.
+  #
+  # When a PullData of a known gateway is received from a different IP
+  # address within this window after the last PullData, this is reported as
+  # a conflict (e.g. multiple gateways using the same Gateway ID). Note that
+  # a change of the source port only (e.g. NAT) is not a conflict. Set to 0
+  # to disable.
+  gateway_conflict_window="{{ .Backend.SemtechUDP.GatewayConflictWindow }}"
+
+  # Gateway conflict policy.
+  #
+  # The policy applied to conflicting PullData packets:
+  #   * accept  log a warning and accept the new address (default)
+  #   * reject  log a warning and drop the PullData
+  gateway_conflict_policy="{{ .Backend.SemtechUDP.GatewayConflictPolicy }}"
+
+  # Uplink buffer size.
+  #
+  # The number of uplinks that can be buffered before they are consumed by
+  # the integration. Set to 0 for an unbuffered channel.
+  uplink_buffer_size={{ .Backend.SemtechUDP.UplinkBufferSize }}
+
+  # Drop uplinks when full.
+  #
+  # By default, the packet handler blocks until the uplink is consumed by the
+  # integration. When enabled, uplinks are dropped when the uplink buffer is
+  # full (e.g. when the integration is stalled), instead of blocking.
+  uplink_drop_when_full={{ .Backend.SemtechUDP.UplinkDropWhenFull }}
+
+  # Uplink stall timeout.
+  #
+  # When sending an uplink to the integration blocks longer than this timeout
+  # (e.g. the consumer died without closing), an error is logged and the stall
+  # is counted, after which the uplink stall policy is applied. Set to 0 to
+  # disable. This has no effect when uplink_drop_when_full is enabled.
+  uplink_stall_timeout="{{ .Backend.SemtechUDP.UplinkStallTimeout }}"
+
+  # Uplink stall policy.
+  #
+  # The policy applied to stalled uplinks:
+  #   * wait  keep waiting until the uplink is consumed (default)
+  #   * drop  drop the uplink, so that the packet handler makes progress
+  uplink_stall_policy="{{ .Backend.SemtechUDP.UplinkStallPolicy }}"
+
+  # Discard uplinks.
+  #
+  # When enabled, all received uplinks are discarded (and counted) instead of
+  # being forwarded, e.g. for monitoring-only deployments. Gateway stats are
+  # still forwarded.
+  discard_uplinks={{ .Backend.SemtechUDP.DiscardUplinks }}
+
+  # Uplink sample rate.
+  #
+  # When set to N (> 1), only 1 in N unconfirmed data uplinks is forwarded per
+  # DevAddr and gateway, e.g. to reduce the costs of a metered backhaul in
+  # dense deployments. Join-requests, confirmed data uplinks and other frames
+  # are always forwarded. Note that this is not a de-duplication, the dropped
+  # uplinks are lost. Set to 0 to disable.
+  uplink_sample_rate={{ .Backend.SemtechUDP.UplinkSampleRate }}
+
+  # Read buffer size.
+  #
+  # The size (in bytes) of the buffer used for reading UDP packets. Packets
+  # exceeding this size are truncated. The max. (and default) value is 65507.
+  read_buffer_size={{ .Backend.SemtechUDP.ReadBufferSize }}
+
+  # Read timeout.
+  #
+  # When set, reading from the UDP listener times out after this duration,
+  # after which the read is retried unless the backend is closing. This
+  # provides a shutdown path which does not depend on the OS unblocking a
+  # pending read when the socket is closed. Set to 0 to disable.
+  read_timeout="{{ .Backend.SemtechUDP.ReadTimeout }}"
+
+  # Close timeout.
+  #
+  # When set, closing the backend waits at most this duration for the read,
+  # packet handler and send goroutines to return (e.g. when one is blocked
+  # by a misbehaving callback). On expiry the backend is still closed, but the close returns
+  # an error and the goroutines which are still running are logged. Set to 0
+  # to wait indefinitely.
+  close_timeout="{{ .Backend.SemtechUDP.CloseTimeout }}"
+
+  # Socket buffers.
+  #
+  # The size (in bytes) of the kernel receive and send buffers of the UDP
+  # socket. Set to 0 to use the OS default.
+  socket_read_buffer={{ .Backend.SemtechUDP.SocketReadBuffer }}
+  socket_write_buffer={{ .Backend.SemtechUDP.SocketWriteBuffer }}
+
+  # Socket DSCP.
+  #
+  # When set, the packets sent by the UDP socket (PULL_RESP downlinks and the
+  # ACKs) are marked with this DSCP value (0 - 63, e.g. 46 for Expedited
+  # Forwarding), so that a congested backhaul can prioritize the
+  # time-sensitive downlinks. Set to 0 to use the OS default.
+  #
+  # Note that this is not supported on all platforms, in which case the
+  # backend fails to start. For example Windows ignores the marking unless it
+  # is allowed by a QoS policy. Networks might also ignore or rewrite the
+  # marking.
+  socket_dscp={{ .Backend.SemtechUDP.SocketDSCP }}
+
+  # Send retries.
+  #
+  # When set, the write is retried (up to the given number of times) when
+  # sending a packet to a gateway fails. When the failure is caused by the
+  # UDP listener (e.g. the socket has been closed), the listener is re-opened
+  # but errors of a single gateway (e.g. ICMP unreachable) do not affect the
+  # listener. The interval is the backoff between retries, which is increased
+  # with each retry. Other packets are sent while a packet is waiting for its
+  # retry. Set send_retries to 0 to disable.
+  send_retries={{ .Backend.SemtechUDP.SendRetries }}
+  send_retry_interval="{{ .Backend.SemtechUDP.SendRetryInterval }}"
+
+  # JIT lead time.
+  #
+  # When set, timestamped (tmst) downlinks are held by the ChirpStack Gateway
+  # Bridge and sent to the gateway this duration before their transmit time,
+  # instead of being sent immediately. The gateway counter is estimated using
+  # the tmst of the last uplink received from the gateway. Downlinks of which
+  # the transmit time has already passed are rejected. The lead time must
+  # cover the network latency to the gateway. Set to 0 to disable.
+  jit_lead_time="{{ .Backend.SemtechUDP.JITLeadTime }}"
+
+  # JIT margins.
+  #
+  # To compensate for the network latency and clock skew between the gateway
+  # and the ChirpStack Gateway Bridge, downlinks of which the (estimated)
+  # transmit time passed less than jit_past_margin ago are still sent to the
+  # gateway (the gateway will report TOO_LATE if it really is too late). When
+  # jit_future_margin is set, downlinks of which the transmit time is more
+  # than this duration ahead are rejected. The drift of the gateway counter
+  # is estimated from the uplinks and is applied before these checks. These
+  # only apply when jit_lead_time is set and can be overridden per gateway
+  # below. Set to 0 to disable.
+  jit_past_margin="{{ .Backend.SemtechUDP.JITPastMargin }}"
+  jit_future_margin="{{ .Backend.SemtechUDP.JITFutureMargin }}"
+
+  # Reboot tmst threshold.
+  #
+  # When set, a gateway is considered rebooted when the concentrator counter
+  # (tmst) of its uplinks jumps back by more than this duration (compared to
+  # the counter estimated from the previous uplinks). On a reboot, the
+  # timestamped downlinks for the gateway which are held by the JIT queue are
+  # dropped, as these are no longer valid (gateway rebooted error). Set to 0
+  # to disable.
+  reboot_tmst_threshold="{{ .Backend.SemtechUDP.RebootTmstThreshold }}"
+
+  # TX ack retries.
+  #
+  # When set, a downlink for which the gateway did not send a TXACK within
+  # the tx_ack_timeout (e.g. because the gateway is offline, but has not yet
+  # been removed) is sent again, up to the given number of times. After the
+  # last retry, the downlink is reported as unconfirmed in the downlink tx ack
+  # (tx unconfirmed error). Note that only gateways using protocol version 2
+  # send a TXACK. Set tx_ack_retries to 0 to disable.
+  tx_ack_timeout="{{ .Backend.SemtechUDP.TXAckTimeout }}"
+  tx_ack_retries={{ .Backend.SemtechUDP.TXAckRetries }}
+
+  # Max. ack latency.
+  #
+  # When set, timestamped downlinks (e.g. Class-A) are rejected for gateways
+  # of which the estimated round-trip between sending a downlink and
+  # receiving its TXACK exceeds this duration, as these downlinks would most
+  # likely miss their transmit time. This makes it possible to fall back to
+  # a different gateway. Set to 0 to disable.
+  max_ack_latency="{{ .Backend.SemtechUDP.MaxAckLatency }}"
+
+  # Downlink replay window.
+  #
+  # When set, a PULL_RESP which is identical (same gateway and txpk, thus
+  # including the tmst) to a PULL_RESP queued within this window is dropped,
+  # e.g. when a scheduler accidentally issues the same downlink twice, which
+  # could violate the duty-cycle. The TXACK retries (see tx_ack_retries) are
+  # not affected. Set to 0 to disable (default), as legitimate retransmissions
+  # of identical downlinks would be dropped too.
+  downlink_replay_window="{{ .Backend.SemtechUDP.DownlinkReplayWindow }}"
+
+  # Region.
+  #
+  # When set, the data-rate and TX power of downlinks are validated against
+  # this region when performing a downlink validation (e.g. EU_863_870).
+  # Please refer to the LoRaWAN Regional Parameters specification for the
+  # complete list of common region names. Leave blank to disable.
+  region="{{ .Backend.SemtechUDP.Region }}"
+
+  # Check downlink payload size.
+  #
+  # When enabled, downlinks of which the PHYPayload exceeds the max. payload
+  # size of the data-rate for the above region are rejected, instead of being
+  # sent to the gateway. This requires the region to be set.
+  check_downlink_payload_size={{ .Backend.SemtechUDP.CheckDownlinkPayloadSize }}
+
+  # Check downlink data-rate.
+  #
+  # When enabled, downlinks of which the data-rate is not a downlink data-rate
+  # of the above region (e.g. an uplink-only data-rate), or of which the
+  # frequency is not a downlink, RX2 or uplink channel of the region, are
+  # rejected instead of being sent to the gateway. Note that only the default
+  # channels of the region are known. This requires the region to be set.
+  check_downlink_data_rate={{ .Backend.SemtechUDP.CheckDownlinkDataRate }}
+
+  # Bind resolve interval.
+  #
+  # When set, the udp_bind (and listener) addresses are periodically resolved
+  # again and the listeners are re-created when the resolved address changed
+  # (e.g. a hostname of which the IP address rotates). The listeners of which
+  # the address did not change are kept, as is the gateway registry. Set to 0
+  # to disable.
+  bind_resolve_interval="{{ .Backend.SemtechUDP.BindResolveInterval }}"
+
+  # TX audit buffer size.
+  #
+  # When set, every PullResp sent to a gateway is made available for auditing
+  # through the TX audit channel, which can buffer the given number of items.
+  # Items are dropped when the buffer is full. Set to 0 to disable.
+  tx_audit_buffer_size={{ .Backend.SemtechUDP.TXAuditBufferSize }}
+
+  # Raw stats buffer size.
+  #
+  # When set, the stat JSON object of every PushData is made available as-is
+  # (including vendor-specific fields) through the raw stats channel, which
+  # can buffer the given number of items. Items are dropped when the buffer
+  # is full. Set to 0 to disable.
+  raw_stats_buffer_size={{ .Backend.SemtechUDP.RawStatsBufferSize }}
+
+  # Raw uplink buffer size.
+  #
+  # When set, the data of every forwarded uplink frame is made available
+  # as sent by the gateway (base64, e.g. for signature verification or exact
+  # re-encoding) through the raw uplink channel, which can buffer the given
+  # number of items. Items are dropped when the buffer is full. Set to 0 to
+  # disable.
+  raw_uplink_buffer_size={{ .Backend.SemtechUDP.RawUplinkBufferSize }}
+
+  # Mirror buffer size.
+  #
+  # When set, every forwarded uplink frame and gateway stats is also made
+  # available through the mirror channels (e.g. to tee the traffic to a second
+  # network server during a migration), which can each buffer the given number
+  # of items. Items are dropped when the buffer is full, this never blocks the
+  # primary channels. Downlinks are not mirrored. Set to 0 to disable.
+  mirror_buffer_size={{ .Backend.SemtechUDP.MirrorBufferSize }}
+
+  # Subscriber buffer size.
+  #
+  # The number of uplink frames that can be buffered per subscriber, when
+  # the uplinks are fanned out to multiple consumers (e.g. a network server
+  # and an analytics pipeline). The subscribers receive every forwarded uplink
+  # frame, next to the primary uplink channel.
+  subscriber_buffer_size={{ .Backend.SemtechUDP.SubscriberBufferSize }}
+
+  # Subscriber policy.
+  #
+  # The policy applied when the buffer of a subscriber is full:
+  #   * drop   drop the uplink frame for this subscriber (default)
+  #   * block  block until the subscriber has consumed an uplink frame
+  subscriber_policy="{{ .Backend.SemtechUDP.SubscriberPolicy }}"
+
+  # Max. TX power.
+  #
+  # When set, the max. TX power (dBm) of downlinks. This can be overridden
+  # per gateway below. Set to 0 to disable.
+  max_tx_power={{ .Backend.SemtechUDP.MaxTXPower }}
+
+  # TX power policy.
+  #
+  # The policy applied to downlinks exceeding the max. TX power:
+  #   * clamp   send the downlink using the max. TX power (default)
+  #   * reject  reject the downlink
+  tx_power_policy="{{ .Backend.SemtechUDP.TXPowerPolicy }}"
+
+  # Min. RSSI and SNR.
+  #
+  # When set, uplinks received with a RSSI (dBm) or LoRa SNR (dB) below the
+  # given value are dropped (e.g. to drop receptions that are likely noise).
+  # These can be overridden per gateway below. By default these are not set.
+  {{ with .Backend.SemtechUDP.MinRSSI }}min_rssi={{ . }}{{ else }}# min_rssi=-130{{ end }}
+  {{ with .Backend.SemtechUDP.MinSNR }}min_snr={{ . }}{{ else }}# min_snr=-20.0{{ end }}
+
+  # Size mismatch policy.
+  #
+  # The policy applied to received packets of which the size does not match
+  # the length of the decoded payload, indicating a truncated or corrupt frame
+  # (often caused by buggy packet-forwarder firmware):
+  #   * forward  forward the packet and log a warning (default)
+  #   * drop     drop the packet
+  # Mismatches are counted by the uplink_size_mismatch_count metric.
+  size_mismatch_policy="{{ .Backend.SemtechUDP.SizeMismatchPolicy }}"
+
+  # Synthetic stats interval.
+  #
+  # When set, stats are generated by the ChirpStack Gateway Bridge for each
+  # gateway that did not send stats within this interval (e.g. because its
+  # packet-forwarder never sends a stat object). These stats are based on
+  # the counters as seen by the ChirpStack Gateway Bridge and contain the
+  # meta-data bridge_generated=true, bridge_last_seen and bridge_uptime
+  # (seconds). Set to 0 to disable.
+  synthetic_stats_interval="{{ .Backend.SemtechUDP.SyntheticStatsInterval }}"
+
+  # Summary log interval.
+  #
+  # When set, a single log line is logged at this interval containing the
+  # number of connected gateways and the RX / TX counts, drops and errors
+  # since the previous summary. This is useful for environments without a
+  # metrics system. Set to 0 to disable.
+  summary_log_interval="{{ .Backend.SemtechUDP.SummaryLogInterval }}"
+
+  # Gateways file.
+  #
+  # When set, the connected gateways (Gateway ID, address and last-seen
+  # timestamp) are persisted to this file when gateways connect or
+  # disconnect (at most once per 5 seconds), on every registry cleanup and
+  # on shutdown. They are loaded on startup, so that downlinks can be sent
+  # to the last-known address of a gateway before it sends its next
+  # PULL_DATA. Expired gateways are not loaded. Loaded gateways are
+  # subscribed, but do not trigger the gateway connect callbacks. Leave
+  # blank to disable.
+  gateways_file="{{ .Backend.SemtechUDP.GatewaysFile }}"
+
+  # Traffic log file.
+  #
+  # When set, every received and sent UDP datagram is written to this file
+  # (binary, see the TrafficRecord framing), e.g. for debugging and replaying
+  # the gateway traffic. Records are dropped when the file can not be written
+  # fast enough. Leave blank to disable.
+  traffic_log_file="{{ .Backend.SemtechUDP.TrafficLogFile }}"
+
+  # Traffic log max. size.
+  #
+  # When set, the traffic log file is rotated (to <traffic_log_file>.1) when
+  # it would exceed this size (bytes). Set to 0 to disable rotation.
+  traffic_log_max_size={{ .Backend.SemtechUDP.TrafficLogMaxSize }}
+
+  # Log frames.
+  #
+  # When enabled, the decoded uplink and downlink frames (frequency,
+  # data-rate, RSSI, MType, DevAddr, ...) are logged. As these are logged at
+  # debug level, this also requires log_level=5. Do not enable this in
+  # production.
+  log_frames={{ .Backend.SemtechUDP.LogFrames }}
+
+  # Redact the logged frames.
+  #
+  # When enabled, the PHYPayload is not included in the logged frames.
+  log_frames_redact={{ .Backend.SemtechUDP.LogFramesRedact }}
+
+  # Admin server.
+  #
+  # When a bind address is set, a HTTP server is started which serves the
+  # connected gateways (/gateways), the backend stats (/stats) and the
+  # backend health (/healthz) as JSON.
+  [backend.semtech_udp.admin_server]
+  # ip:port to bind the admin server to (leave blank to disable).
+  bind="{{ .Backend.SemtechUDP.AdminServer.Bind }}"
+
+  # Bearer token.
+  #
+  # When set, requests to /gateways and /stats must contain the
+  # "Authorization: Bearer <token>" header.
+  bearer_token="{{ .Backend.SemtechUDP.AdminServer.BearerToken }}"
+
+  # Gateway health.
+  #
+  # The gateway stats are evaluated against the thresholds below. When a
+  # metric starts failing, the health function (see SetHealthFunc) is called
+  # and a warning is logged. Set a threshold to 0 to disable it.
+  [backend.semtech_udp.health]
+  # Min. ratio (0 - 1) of upstream datagrams acknowledged (ackr).
+  min_ack_ratio={{ .Backend.SemtechUDP.Health.MinACKRatio }}
+
+  # Min. ratio (0 - 1) of received packets with a valid CRC (rxok / rxnb).
+  min_rx_ok_ratio={{ .Backend.SemtechUDP.Health.MinRXOKRatio }}
+
+  # Max. number of consecutive stats intervals without forwarded uplinks
+  # (rxfw).
+  max_idle_intervals={{ .Backend.SemtechUDP.Health.MaxIdleIntervals }}
+
+  # TX RF chains.
+  #
+  # By default, all downlinks are sent using RF chain 0. When configured, the
+  # RF chain is selected by matching the downlink frequency against the
+  # frequency range and the downlink TX power (after applying the max. TX
+  # power of the gateway) against the max. TX power (dBm, 0 = no limit) of
+  # each RF chain, in the configured order. Downlinks for which no RF chain
+  # matches are rejected. The RF chain can not be selected per downlink.
+  # Example:
+  # [[backend.semtech_udp.tx_rf_chains]]
+  # rf_chain=0
+  # frequency_min=863000000
+  # frequency_max=867000000
+  # max_power=14
+  #
+  # [[backend.semtech_udp.tx_rf_chains]]
+  # rf_chain=1
+  # frequency_min=863000000
+  # frequency_max=870000000
+{{ range $i, $rfChain := .Backend.SemtechUDP.TXRFChains }}
+  [[backend.semtech_udp.tx_rf_chains]]
+  rf_chain={{ $rfChain.RFChain }}
+  frequency_min={{ $rfChain.FrequencyMin }}
+  frequency_max={{ $rfChain.FrequencyMax }}
+  max_power={{ $rfChain.MaxPower }}
+{{ end }}
+
+  # Duty-cycle sub-bands.
+  #
+  # When configured, the estimated time-on-air of the downlinks is accounted
+  # per gateway and sub-band. Downlinks which would exceed the max. duty-cycle
+  # (in percent) of the sub-band within the last hour are rejected.
+  # Downlinks outside the configured sub-bands are not accounted, neither are
+  # downlinks which were rejected by the gateway (TXACK error) or which could
+  # not be sent to the gateway.
+  # Example:
+  # [[backend.semtech_udp.duty_cycle_sub_bands]]
+  # frequency_min=869400000
+  # frequency_max=869650000
+  # duty_cycle=10
+{{ range $i, $subBand := .Backend.SemtechUDP.DutyCycleSubBands }}
+  [[backend.semtech_udp.duty_cycle_sub_bands]]
+  frequency_min={{ $subBand.FrequencyMin }}
+  frequency_max={{ $subBand.FrequencyMax }}
+  duty_cycle={{ $subBand.DutyCycle }}
+{{ end }}
+
+  # Additional listeners.
+  #
+  # Besides the above udp_bind, additional UDP listeners can be configured.
+  # Each listener has an ID, which is passed to the gateway (dis)connect
+  # event handler, so that the gateways of each listener can be handled
+  # separately (e.g. one listener per tenant).
+  # Example:
+  # [[backend.semtech_udp.listeners]]
+  # id="tenant-a"
+  # bind="0.0.0.0:1701"
+{{ range $i, $listener := .Backend.SemtechUDP.Listeners }}
+  [[backend.semtech_udp.listeners]]
+  id="{{ $listener.ID }}"
+  bind="{{ $listener.Bind }}"
+{{ end }}
+
+  # Per-gateway configuration overrides.
+  #
+  # This makes it possible to override the above settings for individual
+  # gateways (by Gateway ID). Settings which are not set fall back to the
+  # above values. When a gateway is disabled, its uplinks and stats are
+  # dropped and downlinks to the gateway are rejected. When ignore_rx_time
+  # is set, the RX time reported by the gateway is replaced by the time of
+  # receiving the uplink (e.g. for gateways with an unreliable clock).
+  # When downlink_frequencies (Hz) is set, downlinks on other frequencies are
+  # rejected (e.g. for single-channel gateways). By default, all frequencies
+  # are accepted.
+  # The labels (e.g. site name or owner) are added to the meta-data of the
+  # gateway stats, without overwriting the meta-data set by the bridge.
+  # Example:
+  # [backend.semtech_udp.gateways.0102030405060708]
+  # disabled=false
+  # skip_crc_check=true
+  # fake_rx_time=true
+  # max_tx_power=14
+  # ignore_rx_time=false
+  # min_rssi=-120
+  # min_snr=-15.0
+  # jit_past_margin="50ms"
+  # jit_future_margin="10s"
+  # downlink_frequencies=[869525000]
+  #
+  # [backend.semtech_udp.gateways.0102030405060708.labels]
+  # site="rooftop-1"
+  # owner="acme"
+{{ range $k, $v := .Backend.SemtechUDP.Gateways }}
+  [backend.semtech_udp.gateways.{{ $k }}]
+  disabled={{ $v.Disabled }}
+  {{ with $v.SkipCRCCheck }}skip_crc_check={{ . }}{{ end }}
+  {{ with $v.FakeRxTime }}fake_rx_time={{ . }}{{ end }}
+  {{ with $v.MaxTXPower }}max_tx_power={{ . }}{{ end }}
+  ignore_rx_time={{ $v.IgnoreRxTime }}
+  {{ with $v.MinRSSI }}min_rssi={{ . }}{{ end }}
+  {{ with $v.MinSNR }}min_snr={{ . }}{{ end }}
+  {{ with $v.JITPastMargin }}jit_past_margin="{{ . }}"{{ end }}
+  {{ with $v.JITFutureMargin }}jit_future_margin="{{ . }}"{{ end }}
+  {{ with $v.DownlinkFrequencies }}downlink_frequencies=[{{ range $i, $f := . }}{{ if $i }}, {{ end }}{{ $f }}{{ end }}]{{ end }}
+  {{ with $v.Labels }}
+  [backend.semtech_udp.gateways.{{ $k }}.labels]
+  {{ range $lk, $lv := . }}{{ $lk }}="{{ $lv }}"
+  {{ end }}{{ end }}
+{{ end }}
+
 
   # ChirpStack Concentratord backend.
   [backend.concentratord]
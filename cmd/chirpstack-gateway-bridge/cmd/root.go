@@ -39,6 +39,9 @@ func init() {
 	viper.SetDefault("general.log_level", 4)
 	viper.SetDefault("backend.type", "semtech_udp")
 	viper.SetDefault("backend.semtech_udp.udp_bind", "0.0.0.0:1700")
+	viper.SetDefault("backend.semtech_udp.read_buffer_size", 65507)
+	viper.SetDefault("backend.semtech_udp.send_retry_interval", 100*time.Millisecond)
+	viper.SetDefault("backend.semtech_udp.gateway_conflict_window", 30*time.Second)
 
 	viper.SetDefault("backend.concentratord.crc_check", true)
 	viper.SetDefault("backend.concentratord.event_url", "ipc:///tmp/concentratord_event")
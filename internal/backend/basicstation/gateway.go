@@ -10,7 +10,8 @@ import (
 )
 
 var (
-	errGatewayDoesNotExist = errors.New("gateway does not exist")
+	// ErrGatewayUnknown is returned when the gateway is not connected.
+	ErrGatewayUnknown = errors.New("gateway does not exist")
 )
 
 type gateway struct {
@@ -31,7 +32,7 @@ func (g *gateways) get(id lorawan.EUI64) (gateway, error) {
 
 	gw, ok := g.gateways[id]
 	if !ok {
-		return gw, errGatewayDoesNotExist
+		return gw, ErrGatewayUnknown
 	}
 	return gw, nil
 }
@@ -0,0 +1,46 @@
+package semtechudp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ackLimiter limits the number of ACKs per second per source IP, so that the
+// backend can't be used to amplify a flood of packets with spoofed source
+// addresses.
+type ackLimiter struct {
+	sync.Mutex
+
+	limit       int
+	windowStart time.Time
+	counts      map[string]int
+}
+
+func newACKLimiter(limit int) *ackLimiter {
+	return &ackLimiter{
+		limit:  limit,
+		counts: make(map[string]int),
+	}
+}
+
+// allow returns true when an ACK can be sent to the given IP. The counts are
+// reset every second, so that the memory usage is bounded by the number of
+// source IPs within a single window.
+func (l *ackLimiter) allow(ip net.IP, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.windowStart) >= time.Second {
+		l.windowStart = now
+		l.counts = make(map[string]int)
+	}
+
+	key := ip.String()
+	if l.counts[key] >= l.limit {
+		return false
+	}
+	l.counts[key]++
+
+	return true
+}
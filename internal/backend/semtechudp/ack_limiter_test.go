@@ -0,0 +1,28 @@
+package semtechudp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACKLimiter(t *testing.T) {
+	assert := require.New(t)
+
+	l := newACKLimiter(2)
+	now := time.Now()
+	ipA := net.ParseIP("10.0.0.1")
+	ipB := net.ParseIP("10.0.0.2")
+
+	assert.True(l.allow(ipA, now))
+	assert.True(l.allow(ipA, now))
+	assert.False(l.allow(ipA, now))
+
+	// the limit is per IP
+	assert.True(l.allow(ipB, now))
+
+	// the counts are reset after a second
+	assert.True(l.allow(ipA, now.Add(time.Second)))
+}
@@ -0,0 +1,160 @@
+package semtechudp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminServer implements a HTTP handler serving the connected gateways and
+// the backend stats as JSON:
+//   - /gateways  the connected gateways (see GetGateways)
+//   - /stats     the aggregated backend stats (see Stats)
+//   - /healthz   the health of the backend
+//
+// When a bearer token is set, it is required for /gateways and /stats.
+type AdminServer struct {
+	backend *Backend
+	token   string
+	mux     *http.ServeMux
+}
+
+// NewAdminServer creates a new admin server for the given backend. Leave the
+// bearer token blank to disable authentication.
+func NewAdminServer(b *Backend, token string) *AdminServer {
+	s := AdminServer{
+		backend: b,
+		token:   token,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/gateways", s.authenticated(s.handleGateways))
+	s.mux.HandleFunc("/stats", s.authenticated(s.handleStats))
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+
+	return &s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+type adminGateway struct {
+	GatewayID       string    `json:"gateway_id"`
+	Addr            string    `json:"addr"`
+	LastSeen        time.Time `json:"last_seen"`
+	ProtocolVersion uint8     `json:"protocol_version"`
+	AckLatency      string    `json:"ack_latency"`
+	RXPKBatchLast   int       `json:"rxpk_batch_last"`
+	RXPKBatchMax    int       `json:"rxpk_batch_max"`
+
+	DownlinkErrors []adminDownlinkError `json:"downlink_errors"`
+	BytesIn        uint64               `json:"bytes_in"`
+	BytesOut       uint64               `json:"bytes_out"`
+	ForwardRatio   *float64             `json:"forward_ratio"`
+	Labels         map[string]string    `json:"labels,omitempty"`
+	JSONVersion    int                  `json:"jver"`
+}
+
+type adminDownlinkError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+type adminStats struct {
+	GatewaysConnected int    `json:"gateways_connected"`
+	RXReceived        uint64 `json:"rx_received"`
+	RXForwarded       uint64 `json:"rx_forwarded"`
+	RXDropped         uint64 `json:"rx_dropped"`
+	DownlinksQueued   uint64 `json:"downlinks_queued"`
+	DownlinksSent     uint64 `json:"downlinks_sent"`
+	DownlinksFailed   uint64 `json:"downlinks_failed"`
+	UnknownPackets    uint64 `json:"unknown_packets"`
+	BytesIn           uint64 `json:"bytes_in"`
+	BytesOut          uint64 `json:"bytes_out"`
+	Uptime            string `json:"uptime"`
+}
+
+func (s *AdminServer) handleGateways(w http.ResponseWriter, r *http.Request) {
+	out := []adminGateway{}
+	for _, gw := range s.backend.GetGateways() {
+		g := adminGateway{
+			GatewayID:       gw.GatewayID.String(),
+			LastSeen:        gw.LastSeen,
+			ProtocolVersion: gw.ProtocolVersion,
+			AckLatency:      gw.AckLatency.String(),
+			RXPKBatchLast:   gw.RXPKBatchLast,
+			RXPKBatchMax:    gw.RXPKBatchMax,
+			DownlinkErrors:  []adminDownlinkError{},
+			BytesIn:         gw.BytesIn,
+			BytesOut:        gw.BytesOut,
+			ForwardRatio:    gw.ForwardRatio,
+			Labels:          gw.Labels,
+			JSONVersion:     gw.JSONVersion,
+		}
+		for _, e := range gw.DownlinkErrors {
+			g.DownlinkErrors = append(g.DownlinkErrors, adminDownlinkError{Time: e.Time, Error: e.Error})
+		}
+		if gw.Addr != nil {
+			g.Addr = gw.Addr.String()
+		}
+		out = append(out, g)
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *AdminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := s.backend.Stats()
+
+	writeJSON(w, http.StatusOK, adminStats{
+		GatewaysConnected: stats.GatewaysConnected,
+		RXReceived:        stats.RXReceived,
+		RXForwarded:       stats.RXForwarded,
+		RXDropped:         stats.RXDropped,
+		DownlinksQueued:   stats.DownlinksQueued,
+		DownlinksSent:     stats.DownlinksSent,
+		DownlinksFailed:   stats.DownlinksFailed,
+		UnknownPackets:    stats.UnknownPackets,
+		BytesIn:           stats.BytesIn,
+		BytesOut:          stats.BytesOut,
+		Uptime:            stats.Uptime.String(),
+	})
+}
+
+func (s *AdminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if s.backend.isClosed() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "closed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// authenticated wraps the given handler, validating the bearer token (when
+// set).
+func (s *AdminServer) authenticated(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			expected := "Bearer " + s.token
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing bearer token"})
+				return
+			}
+		}
+
+		fn(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("backend/semtechudp: write admin response error")
+	}
+}
@@ -0,0 +1,116 @@
+package semtechudp
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestAdminServer(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	go func() {
+		for range b.GetSubscribeEventChan() {
+		}
+	}()
+
+	lastSeen := time.Now().UTC().Round(0)
+	assert.NoError(b.gateways.set(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, gateway{
+		addr:            &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700},
+		lastSeen:        lastSeen,
+		protocolVersion: 2,
+		rxpkBatchLast:   3,
+		rxpkBatchMax:    5,
+	}))
+
+	server := httptest.NewServer(NewAdminServer(b, "secret"))
+	defer server.Close()
+
+	get := func(path, token string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		assert.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+
+	t.Run("Invalid token", func(t *testing.T) {
+		assert := require.New(t)
+
+		for _, path := range []string{"/gateways", "/stats"} {
+			resp := get(path, "")
+			resp.Body.Close()
+			assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+			resp = get(path, "foo")
+			resp.Body.Close()
+			assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	t.Run("Gateways", func(t *testing.T) {
+		assert := require.New(t)
+
+		resp := get("/gateways", "secret")
+		defer resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+
+		var gws []adminGateway
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&gws))
+		assert.Equal([]adminGateway{
+			{
+				GatewayID:       "0102030405060708",
+				Addr:            "127.0.0.1:1700",
+				LastSeen:        lastSeen,
+				ProtocolVersion: 2,
+				AckLatency:      "0s",
+				RXPKBatchLast:   3,
+				RXPKBatchMax:    5,
+				DownlinkErrors:  []adminDownlinkError{},
+			},
+		}, gws)
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		assert := require.New(t)
+
+		resp := get("/stats", "secret")
+		defer resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+
+		var stats adminStats
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&stats))
+		assert.Equal(1, stats.GatewaysConnected)
+	})
+
+	t.Run("Healthz", func(t *testing.T) {
+		assert := require.New(t)
+
+		// no token required
+		resp := get("/healthz", "")
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+
+		assert.NoError(b.Close())
+
+		resp = get("/healthz", "")
+		resp.Body.Close()
+		assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	})
+}
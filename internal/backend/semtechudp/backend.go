@@ -2,29 +2,351 @@ package semtechudp
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 
+	"github.com/brocaar/chirpstack-api/go/v3/common"
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
 	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
 )
 
+// maxUDPDataSize defines the max UDP data size.
+const maxUDPDataSize = 65507
+
+// tx power policies
+const (
+	txPowerPolicyClamp  = "clamp"
+	txPowerPolicyReject = "reject"
+)
+
+// ErrBackendClosed is returned when sending a downlink after the backend has
+// been closed.
+var ErrBackendClosed = errors.New("backend is closed")
+
+// ErrGatewayDisabled is returned when sending a downlink to a gateway which
+// is disabled in the per-gateway configuration.
+var ErrGatewayDisabled = errors.New("gateway is disabled")
+
+// ErrUnknownPacketType is returned when handling an UDP packet of which the
+// packet type is unknown.
+var ErrUnknownPacketType = errors.New("unknown packet type")
+
+// ErrCloseTimeout is returned by Close when the read, packet handler and send
+// goroutines did not return within the close timeout. The backend is closed regardless.
+var ErrCloseTimeout = errors.New("close timeout")
+
+// ErrFrequencyUnsupported is returned when the downlink frequency is not one
+// of the configured downlink frequencies of the gateway (see
+// downlink_frequencies) or is not covered by the tx_rf_chains.
+var ErrFrequencyUnsupported = errors.New("frequency unsupported")
+
+// ErrPowerTooHigh is returned when the downlink TX power exceeds the max. TX
+// power of the gateway and the TX power policy is set to reject, when it
+// exceeds the max. TX power of the tx_rf_chains which cover the frequency, or
+// by ValidateDownlinkFrame when it exceeds the max. TX power of the band.
+var ErrPowerTooHigh = errors.New("tx power too high")
+
+// ErrGatewayLatencyTooHigh is returned when sending a timestamped downlink
+// to a gateway of which the estimated ack latency exceeds the max. ack
+// latency, as the downlink would most likely miss its transmit time.
+var ErrGatewayLatencyTooHigh = errors.New("gateway latency too high")
+
+// ErrDuplicateDownlink is returned when an identical PullResp was queued
+// for the gateway within the downlink replay window.
+var ErrDuplicateDownlink = errors.New("duplicate downlink")
+
+// ErrInvalidDownlinkDatarate is returned when the downlink data-rate or
+// frequency is not valid for downlink in the configured region (see
+// check_downlink_data_rate).
+var ErrInvalidDownlinkDatarate = errors.New("invalid downlink data-rate")
+
+// ErrPayloadTooLarge is returned when the downlink PHYPayload exceeds the
+// max. payload size of the data-rate (see check_downlink_payload_size).
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// gateway conflict policies
+const (
+	gatewayConflictPolicyAccept = "accept"
+	gatewayConflictPolicyReject = "reject"
+)
+
+// uplink stall policies
+const (
+	uplinkStallPolicyWait = "wait"
+	uplinkStallPolicyDrop = "drop"
+)
+
+// size mismatch policies
+const (
+	sizeMismatchPolicyForward = "forward"
+	sizeMismatchPolicyDrop    = "drop"
+)
+
+// location validation modes
+const (
+	locationValidationDropLocation = "drop_location"
+	locationValidationDropStats    = "drop_stats"
+)
+
+// UplinkFilterFunc defines the function signature of an uplink filter.
+// When it returns false, the uplink frame is dropped.
+type UplinkFilterFunc func(gw.UplinkFrame) bool
+
+// UplinkIngress contains the listener which received an uplink.
+type UplinkIngress struct {
+	// ListenerID contains the ID of the listener (see listeners), it is
+	// blank for the udp_bind listener and the TCP listener.
+	ListenerID string
+
+	// LocalAddr contains the local address of the listener.
+	LocalAddr net.Addr
+}
+
+// UplinkIngressFunc defines the function signature of the uplink ingress
+// handler. It is called for every forwarded uplink frame.
+type UplinkIngressFunc func(gw.UplinkFrame, UplinkIngress)
+
+// MACRewriteFunc defines the function signature of the Gateway ID rewrite
+// function.
+type MACRewriteFunc func(lorawan.EUI64) lorawan.EUI64
+
+// AddressChangeEvent is emitted when a known gateway sends a PullData from a
+// different source address (e.g. because of NAT re-mapping).
+type AddressChangeEvent struct {
+	GatewayID lorawan.EUI64
+	OldAddr   *net.UDPAddr
+	NewAddr   *net.UDPAddr
+}
+
+// AddressChangeFunc defines the function signature of the address change
+// event handler.
+type AddressChangeFunc func(AddressChangeEvent)
+
+// GatewayVersion contains the protocol version and the platform, brand,
+// model and firmware as reported in the stats of a gateway. The latter are
+// blank when not reported.
+type GatewayVersion struct {
+	ProtocolVersion uint8
+	Platform        string
+	Brand           string
+	Model           string
+	Firmware        string
+}
+
+// VersionChangeEvent is emitted when the GatewayVersion of a gateway changes
+// between consecutive stats (e.g. because of a firmware update).
+type VersionChangeEvent struct {
+	GatewayID  lorawan.EUI64
+	OldVersion GatewayVersion
+	NewVersion GatewayVersion
+}
+
+// VersionChangeFunc defines the function signature of the version change
+// event handler.
+type VersionChangeFunc func(VersionChangeEvent)
+
+// RebootEvent is emitted when the concentrator counter (tmst) of a gateway
+// jumps back, which indicates that the gateway (or its concentrator) was
+// restarted (see reboot_tmst_threshold).
+type RebootEvent struct {
+	GatewayID lorawan.EUI64
+
+	// ExpectedTmst contains the counter value as estimated from the previous
+	// uplinks, Tmst the counter value of the uplink.
+	ExpectedTmst uint32
+	Tmst         uint32
+
+	// DroppedDownlinks contains the number of timestamped downlinks which
+	// were dropped from the JIT queue.
+	DroppedDownlinks int
+}
+
+// RebootFunc defines the function signature of the reboot event handler.
+type RebootFunc func(RebootEvent)
+
+// TXAckDeviationEvent is emitted when the TXACK of a gateway reports a TX
+// power or frequency which deviates from the PullResp, e.g. when the gateway
+// reduces the TX power because of thermal limits.
+type TXAckDeviationEvent struct {
+	GatewayID  lorawan.EUI64
+	Token      uint16
+	DownlinkID []byte
+
+	// RequestedPower contains the TX power (dBm) of the PullResp and
+	// ActualPower the TX power reported by the gateway (nil when not
+	// reported).
+	RequestedPower int
+	ActualPower    *int
+
+	// RequestedFrequency contains the frequency (Hz) of the PullResp and
+	// ActualFrequency the frequency reported by the gateway (nil when not
+	// reported).
+	RequestedFrequency uint32
+	ActualFrequency    *uint32
+}
+
+// TXAckDeviationFunc defines the function signature of the TXACK deviation
+// event handler.
+type TXAckDeviationFunc func(TXAckDeviationEvent)
+
+// PacketWriter defines the interface for writing the UDP datagrams to the
+// gateways. It is implemented by *net.UDPConn.
+type PacketWriter interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+}
+
+// TXAudit contains the PullResp of a downlink sent to a gateway.
+type TXAudit struct {
+	GatewayID lorawan.EUI64
+	TXPK      packets.TXPK
+
+	// Data contains the PullResp as sent over the wire.
+	Data []byte
+}
+
+// RawStats contains the stat JSON object of a PushData as sent by the
+// gateway, including vendor-specific fields.
+type RawStats struct {
+	GatewayID lorawan.EUI64
+	Stat      json.RawMessage
+}
+
+// RawUplink contains the data of a forwarded uplink frame as sent by the
+// gateway.
+type RawUplink struct {
+	GatewayID lorawan.EUI64
+	UplinkID  uuid.UUID
+
+	// Data contains the base64 encoded data of the rxpk, as-is.
+	Data string
+}
+
+// GatewayInfo contains the information of a connected gateway.
+type GatewayInfo struct {
+	GatewayID       lorawan.EUI64
+	Addr            *net.UDPAddr
+	LastSeen        time.Time
+	ProtocolVersion uint8
+
+	// AckLatency contains the estimated round-trip time between sending a
+	// downlink and receiving its TXACK. It is 0 when unknown.
+	AckLatency time.Duration
+
+	// Suspect is set when the gateway did not send a PullData within the
+	// cleanup window, but is kept during the suspect grace duration.
+	Suspect bool
+
+	// RXPKBatchLast contains the number of uplinks (RXPK) in the last
+	// PushData containing uplinks and RXPKBatchMax the max. number of uplinks
+	// in a single PushData. Heavy batching may indicate backhaul congestion
+	// on the packet-forwarder side.
+	RXPKBatchLast int
+	RXPKBatchMax  int
+
+	// DownlinkErrors contains the last downlink errors (oldest first, see
+	// downlinkErrorHistorySize), e.g. to see why recent downlinks to the
+	// gateway failed.
+	DownlinkErrors []DownlinkError
+
+	// BytesIn and BytesOut contain the number of UDP bytes received from and
+	// sent to the gateway (including ACKs) since it was added to the
+	// registry.
+	BytesIn  uint64
+	BytesOut uint64
+
+	// ForwardRatio contains the (smoothed) ratio of the packets forwarded to
+	// the packets received by the gateway (rxfw / rxnb of the stats), between
+	// 0 and 1. It is nil until the first stats with received packets.
+	ForwardRatio *float64
+
+	// Labels contains the labels of the gateway, as configured in the
+	// per-gateway configuration. It is shared, thus it must not be modified.
+	Labels map[string]string
+
+	// JSONVersion contains the JSON version (jver) of the last PushData of
+	// the gateway, it is packets.JSONVersionLegacy when absent. It is 0
+	// until the first PushData.
+	JSONVersion int
+}
+
+// DownlinkError contains a downlink to a gateway which was rejected by the
+// backend (e.g. because it is too late or exceeds the duty-cycle).
+type DownlinkError struct {
+	Time  time.Time
+	Error string
+}
+
 // udpPacket represents a raw UDP packet.
 type udpPacket struct {
 	addr *net.UDPAddr
 	data []byte
+
+	// conn holds the listener on which the packet was received, or the
+	// listener which must be used for sending the packet.
+	conn *net.UDPConn
+
+	// downlinkGatewayID is set for downlink packets. The address of these
+	// packets is resolved again when sending, as the gateway address could
+	// have changed since the packet was queued.
+	downlinkGatewayID *lorawan.EUI64
+
+	// fixedAddr is set when the address of the downlink packet must not be
+	// resolved again (see SendToAddr).
+	fixedAddr bool
+
+	// result (optional) receives the result of writing the packet to the
+	// UDP connection. It must be buffered.
+	result chan error
+
+	// gatewayID (optional) contains the Gateway ID of the gateway to which
+	// the packet is sent (e.g. for ACKs), for the per gateway byte counters.
+	gatewayID *lorawan.EUI64
+
+	// buf (optional) holds the pooled read buffer backing data. It is
+	// returned to the pool once the packet has been handled, data must not
+	// be used after that.
+	buf *[]byte
+
+	// retry contains the number of the send retry (see send_retries).
+	retry int
+
+	// dutyCycle (optional) holds the time-on-air accounted for the
+	// downlink, which is released when the write fails.
+	dutyCycle *dutyCycleReservation
+}
+
+// setResult sends the given write result to the result channel (if set).
+func (p udpPacket) setResult(err error) {
+	if p.result != nil {
+		p.result <- err
+	}
 }
 
 // Backend implements a Semtech packet-forwarder (UDP) gateway backend.
@@ -39,310 +361,2876 @@ type Backend struct {
 	downlinkTXAckChan chan gw.DownlinkTXAck
 	uplinkFrameChan   chan gw.UplinkFrame
 	gatewayStatsChan  chan gw.GatewayStats
+	txAuditChan       chan TXAudit
+	rawStatsChan      chan RawStats
+	rawUplinkChan     chan RawUplink
 	udpSendChan       chan udpPacket
 
-	wg           sync.WaitGroup
-	conn         *net.UDPConn
-	closed       bool
-	gateways     gateways
-	fakeRxTime   bool
+	mirrorUplinkFrameChan  chan gw.UplinkFrame
+	mirrorGatewayStatsChan chan gw.GatewayStats
+
+	goroutines   goroutineGroup
+	closeTimeout time.Duration
+
+	// conns holds the UDP listeners. This has its own lock as it is used by
+	// the send loop, which must not wait for the packet handlers.
+	connsMux sync.RWMutex
+	conns    []*net.UDPConn
+
+	// rebindMux serializes the rebinds of the UDP listeners.
+	rebindMux sync.Mutex
+
+	// located holds the gateways which reported a valid location (see
+	// isValidLocation). This is not part of the registry, as the stats of
+	// unregistered gateways (which did not send a PullData yet) are
+	// validated as well.
+	locatedMux sync.Mutex
+	located    map[lorawan.EUI64]struct{}
+
+	// downlinkConn (optional) holds the UDP socket from which the PullResp
+	// packets are sent (see downlink_bind).
+	downlinkConn *net.UDPConn
+
+	// listenerIDs holds the (optional) listener ID of each conn.
+	listenerIDs []string
+
+	// connsClosed is set when the conns have been closed on Close.
+	connsClosed bool
+
+	// tcp holds the (optional) TCP listener.
+	tcp *tcpListener
+
+	// packetWriter (optional) overrides the conns for sending packets.
+	packetWriter PacketWriter
+
+	// traffic (optional) records all UDP traffic. This has its own lock for
+	// the same reason as conns. trafficFile is set when the backend manages
+	// the traffic log file.
+	trafficMux  sync.RWMutex
+	traffic     *trafficSink
+	trafficFile *rotatingFile
+
+	// hooks holds the callbacks. This has its own lock, as the packet
+	// handlers hold the read lock while calling the callbacks and while
+	// sending to the (possibly blocking) uplink channel.
+	hooksMux sync.RWMutex
+	hooks    backendHooks
+
+	// closed is set (atomically) on Close. It does not use the backend lock,
+	// as the packet handlers hold the read lock while calling the callbacks.
+	// done is closed on Close.
+	closed             uint32
+	done               chan struct{}
+	gateways           gateways
+	fakeRxTime         bool
+	skipCRCCheck       bool
+	locationValidation string
+	bridgeStats        bool
+	downlinkPort       int
+	health             healthConfig
+	allowedNetworks    []*net.IPNet
+	requirePullData    bool
+
+	// pushDataACKAfterProcessing is set when the PushACK must be sent after
+	// (successfully) handling the PushData instead of before.
+	pushDataACKAfterProcessing bool
+
+	pullDataDebounce   time.Duration
+	conflictWindow     time.Duration
+	conflictPolicy     string
+	logFrames          bool
+	logFramesRedact    bool
+	jitLeadTime        time.Duration
+	jitPastMargin      time.Duration
+	jitFutureMargin    time.Duration
+	rebootThreshold    time.Duration
+	jit                *jitQueue
+	txAcks             *txAckTracker
+	maxAckLatency      time.Duration
+	replayWindow       time.Duration
+	ackLimiter         *ackLimiter
+	uplinkDropWhenFull bool
+	uplinkStallTimeout time.Duration
+	uplinkStallPolicy  string
+	sizeMismatchPolicy string
+	discardUplinks     bool
+	uplinkSampler      *uplinkSampler
+	uplinkSubscribers  *uplinkSubscribers
+	sendBacklog        *sendBacklog
+	readBufferSize     int
+	readBufferPool     sync.Pool
+	readTimeout        time.Duration
+	band               band.Band
+	checkPayloadSize   bool
+	checkDataRate      bool
+	maxTXPower         int
+	txPowerPolicy      string
+	minRSSI            *int
+	ignoreStatsTime    bool
+	sendRetries        int
+	sendRetryInterval  time.Duration
+	frequencyStatsMax  int
+	minSNR             *float64
+	gatewaysFile       string
+	socketOptions      udpSocketOptions
+	txRFChains         []config.SemtechUDPTXRFChain
+	dutyCycle          *dutyCycleTracker
+	gatewayConfigs     map[lorawan.EUI64]gatewayConfig
+
+	// adminServer (optional) serves the admin endpoints.
+	adminServer *http.Server
+
+	// counters and startTime are used for the aggregated stats.
+	counters  *backendCounters
+	startTime time.Time
+}
+
+// gatewayConfig holds the (resolved) configuration of a single gateway.
+type gatewayConfig struct {
+	disabled     bool
 	skipCRCCheck bool
+	fakeRxTime   bool
+	maxTXPower   int
+	ignoreRxTime bool
+	minRSSI      *int
+	minSNR       *float64
+
+	// jitPastMargin and jitFutureMargin contain the margins of the JIT
+	// transmit time check (see getJITReleaseTime).
+	jitPastMargin   time.Duration
+	jitFutureMargin time.Duration
+
+	// downlinkFrequencies contains the supported downlink frequencies (Hz)
+	// of the gateway. When empty, all frequencies are supported.
+	downlinkFrequencies []uint32
+
+	// labels contains the static labels of the gateway (see
+	// addGatewayLabels).
+	labels map[string]string
 }
 
 // NewBackend creates a new backend.
 func NewBackend(conf config.Config) (*Backend, error) {
-	addr, err := net.ResolveUDPAddr("udp", conf.Backend.SemtechUDP.UDPBind)
-	if err != nil {
-		return nil, errors.Wrap(err, "resolve udp addr error")
+	switch conf.Backend.SemtechUDP.LocationValidation {
+	case "", locationValidationDropLocation, locationValidationDropStats:
+	default:
+		return nil, fmt.Errorf("invalid location_validation: %s", conf.Backend.SemtechUDP.LocationValidation)
 	}
 
-	log.WithField("addr", addr).Info("backend/semtechudp: starting gateway udp listener")
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return nil, errors.Wrap(err, "listen udp error")
+	if conf.Backend.SemtechUDP.DownlinkPort < 0 || conf.Backend.SemtechUDP.DownlinkPort > 65535 {
+		return nil, fmt.Errorf("invalid downlink_port: %d", conf.Backend.SemtechUDP.DownlinkPort)
 	}
 
-	b := &Backend{
-		conn:              conn,
-		downlinkTXAckChan: make(chan gw.DownlinkTXAck),
-		uplinkFrameChan:   make(chan gw.UplinkFrame),
-		gatewayStatsChan:  make(chan gw.GatewayStats),
-		udpSendChan:       make(chan udpPacket),
-		gateways: gateways{
-			gateways:           make(map[lorawan.EUI64]gateway),
-			subscribeEventChan: make(chan events.Subscribe),
-		},
-		fakeRxTime:   conf.Backend.SemtechUDP.FakeRxTime,
-		skipCRCCheck: conf.Backend.SemtechUDP.SkipCRCCheck,
-		cache:        cache.New(15*time.Second, 15*time.Second),
+	if conf.Backend.SemtechUDP.FrequencyStatsMax < 0 {
+		return nil, fmt.Errorf("invalid frequency_stats_max: %d", conf.Backend.SemtechUDP.FrequencyStatsMax)
 	}
 
-	go func() {
-		for {
-			log.Debug("backend/semtechudp: cleanup gateway registry")
-			if err := b.gateways.cleanup(); err != nil {
-				log.WithError(err).Error("backend/semtechudp: gateway registry cleanup failed")
-			}
-			time.Sleep(time.Minute)
-		}
-	}()
-
-	// Add the waitgroups before the goroutines or a race occurs with closing
-	b.wg.Add(2)
-	go func() {
-		err := b.readPackets()
-		if !b.isClosed() {
-			log.WithError(err).Error("backend/semtechudp: read udp packets error")
-		}
-		b.wg.Done()
-	}()
+	if conf.Backend.SemtechUDP.SendRetries < 0 {
+		return nil, fmt.Errorf("invalid send_retries: %d", conf.Backend.SemtechUDP.SendRetries)
+	}
 
-	go func() {
-		err := b.sendPackets()
-		if !b.isClosed() {
-			log.WithError(err).Error("backend/semtechudp: send udp packets error")
-		}
-		b.wg.Done()
-	}()
+	if conf.Backend.SemtechUDP.TXAckRetries < 0 {
+		return nil, fmt.Errorf("invalid tx_ack_retries: %d", conf.Backend.SemtechUDP.TXAckRetries)
+	}
 
-	return b, nil
-}
+	if conf.Backend.SemtechUDP.TXAckRetries > 0 && conf.Backend.SemtechUDP.TXAckTimeout <= 0 {
+		return nil, fmt.Errorf("invalid tx_ack_timeout: %s", conf.Backend.SemtechUDP.TXAckTimeout)
+	}
 
-// Close closes the backend.
-func (b *Backend) Close() error {
-	b.Lock()
-	b.closed = true
+	if conf.Backend.SemtechUDP.MaxAckLatency < 0 {
+		return nil, fmt.Errorf("invalid max_ack_latency: %s", conf.Backend.SemtechUDP.MaxAckLatency)
+	}
 
-	log.Info("backend/semtechudp: closing gateway backend")
+	if conf.Backend.SemtechUDP.DownlinkReplayWindow < 0 {
+		return nil, fmt.Errorf("invalid downlink_replay_window: %s", conf.Backend.SemtechUDP.DownlinkReplayWindow)
+	}
 
-	if err := b.conn.Close(); err != nil {
-		return errors.Wrap(err, "close udp listener error")
+	if conf.Backend.SemtechUDP.JITPastMargin < 0 {
+		return nil, fmt.Errorf("invalid jit_past_margin: %s", conf.Backend.SemtechUDP.JITPastMargin)
 	}
 
-	log.Info("backend/semtechudp: handling last packets")
-	close(b.udpSendChan)
-	b.Unlock()
-	b.wg.Wait()
-	return nil
-}
+	if conf.Backend.SemtechUDP.JITFutureMargin < 0 {
+		return nil, fmt.Errorf("invalid jit_future_margin: %s", conf.Backend.SemtechUDP.JITFutureMargin)
+	}
 
-// GetDownlinkTXAckChan returns the downlink tx ack channel.
-func (b *Backend) GetDownlinkTXAckChan() chan gw.DownlinkTXAck {
-	return b.downlinkTXAckChan
-}
+	if conf.Backend.SemtechUDP.RebootTmstThreshold < 0 {
+		return nil, fmt.Errorf("invalid reboot_tmst_threshold: %s", conf.Backend.SemtechUDP.RebootTmstThreshold)
+	}
 
-// GetGatewayStatsChan returns the gateway stats channel.
-func (b *Backend) GetGatewayStatsChan() chan gw.GatewayStats {
-	return b.gatewayStatsChan
-}
+	if conf.Backend.SemtechUDP.MaxGateways < 0 {
+		return nil, fmt.Errorf("invalid max_gateways: %d", conf.Backend.SemtechUDP.MaxGateways)
+	}
 
-// GetUplinkFrameChan returns the uplink frame channel.
-func (b *Backend) GetUplinkFrameChan() chan gw.UplinkFrame {
-	return b.uplinkFrameChan
-}
+	if conf.Backend.SemtechUDP.ACKRateLimit < 0 {
+		return nil, fmt.Errorf("invalid ack_rate_limit: %d", conf.Backend.SemtechUDP.ACKRateLimit)
+	}
 
-// GetSubscribeEventChan return the (un)subscribe event channel.
-func (b *Backend) GetSubscribeEventChan() chan events.Subscribe {
-	return b.gateways.subscribeEventChan
-}
+	if r := conf.Backend.SemtechUDP.Health.MinACKRatio; r < 0 || r > 1 {
+		return nil, fmt.Errorf("invalid health min_ack_ratio: %f", r)
+	}
 
-// GetRawPacketForwarderEventChan returns the raw packet-forwarder command channel.
-func (b *Backend) GetRawPacketForwarderEventChan() chan gw.RawPacketForwarderEvent {
-	// not provided by the Semtech packet-forwarder.
-	return nil
-}
+	if r := conf.Backend.SemtechUDP.Health.MinRXOKRatio; r < 0 || r > 1 {
+		return nil, fmt.Errorf("invalid health min_rx_ok_ratio: %f", r)
+	}
 
-// SendDownlinkFrame sends the given downlink frame to the gateway.
-func (b *Backend) SendDownlinkFrame(frame gw.DownlinkFrame) error {
-	// if Token == 0, generate it in order to be backwards compatible.
-	if frame.Token == 0 {
-		tokenB := make([]byte, 2)
-		if _, err := rand.Read(tokenB); err != nil {
-			return errors.Wrap(err, "read random bytes error")
-		}
-		frame.Token = uint32(binary.BigEndian.Uint16(tokenB))
+	if conf.Backend.SemtechUDP.Health.MaxIdleIntervals < 0 {
+		return nil, fmt.Errorf("invalid health max_idle_intervals: %d", conf.Backend.SemtechUDP.Health.MaxIdleIntervals)
 	}
 
-	acks := make([]*gw.DownlinkTXAckItem, len(frame.Items))
-	for i := range acks {
-		acks[i] = &gw.DownlinkTXAckItem{
-			Status: gw.TxAckStatus_IGNORED,
-		}
+	if conf.Backend.SemtechUDP.SuspectGrace < 0 {
+		return nil, fmt.Errorf("invalid suspect_grace: %s", conf.Backend.SemtechUDP.SuspectGrace)
 	}
 
-	return b.sendDownlinkFrame(frame, 0, acks)
-}
+	if conf.Backend.SemtechUDP.PullDataDebounce < 0 {
+		return nil, fmt.Errorf("invalid pull_data_debounce: %s", conf.Backend.SemtechUDP.PullDataDebounce)
+	}
 
-func (b *Backend) sendDownlinkFrame(frame gw.DownlinkFrame, i int, txAckItems []*gw.DownlinkTXAckItem) error {
-	if i > len(frame.Items)-1 {
-		return errors.New("invalid downlink frame item index")
+	if conf.Backend.SemtechUDP.UplinkBufferSize < 0 {
+		return nil, fmt.Errorf("invalid uplink_buffer_size: %d", conf.Backend.SemtechUDP.UplinkBufferSize)
 	}
 
-	// create cache items
-	b.cache.Set(fmt.Sprintf("%d:ack", frame.Token), txAckItems, cache.DefaultExpiration)
-	b.cache.Set(fmt.Sprintf("%d:frame", frame.Token), frame, cache.DefaultExpiration)
-	b.cache.Set(fmt.Sprintf("%d:index", frame.Token), i, cache.DefaultExpiration)
+	if conf.Backend.SemtechUDP.JITLeadTime < 0 {
+		return nil, fmt.Errorf("invalid jit_lead_time: %s", conf.Backend.SemtechUDP.JITLeadTime)
+	}
 
-	var gatewayID lorawan.EUI64
-	copy(gatewayID[:], frame.GetGatewayId())
+	if conf.Backend.SemtechUDP.GatewayConflictWindow < 0 {
+		return nil, fmt.Errorf("invalid gateway_conflict_window: %s", conf.Backend.SemtechUDP.GatewayConflictWindow)
+	}
 
-	gw, err := b.gateways.get(gatewayID)
-	if err != nil {
-		return errors.Wrap(err, "get gateway error")
+	switch conf.Backend.SemtechUDP.GatewayConflictPolicy {
+	case "", gatewayConflictPolicyAccept, gatewayConflictPolicyReject:
+	default:
+		return nil, fmt.Errorf("invalid gateway_conflict_policy: %s", conf.Backend.SemtechUDP.GatewayConflictPolicy)
 	}
 
-	pullResp, err := packets.GetPullRespPacket(gw.protocolVersion, uint16(frame.Token), frame, i)
-	if err != nil {
-		return errors.Wrap(err, "get PullRespPacket error")
+	if conf.Backend.SemtechUDP.UplinkStallTimeout < 0 {
+		return nil, fmt.Errorf("invalid uplink_stall_timeout: %s", conf.Backend.SemtechUDP.UplinkStallTimeout)
 	}
 
-	bytes, err := pullResp.MarshalBinary()
-	if err != nil {
-		return errors.Wrap(err, "backend/semtechudp: marshal PullRespPacket error")
+	switch conf.Backend.SemtechUDP.UplinkStallPolicy {
+	case "", uplinkStallPolicyWait, uplinkStallPolicyDrop:
+	default:
+		return nil, fmt.Errorf("invalid uplink_stall_policy: %s", conf.Backend.SemtechUDP.UplinkStallPolicy)
 	}
 
-	b.udpSendChan <- udpPacket{
-		data: bytes,
-		addr: gw.addr,
+	switch conf.Backend.SemtechUDP.SizeMismatchPolicy {
+	case "", sizeMismatchPolicyForward, sizeMismatchPolicyDrop:
+	default:
+		return nil, fmt.Errorf("invalid size_mismatch_policy: %s", conf.Backend.SemtechUDP.SizeMismatchPolicy)
 	}
-	return nil
-}
 
-// ApplyConfiguration is not implemented.
-func (b *Backend) ApplyConfiguration(config gw.GatewayConfiguration) error {
-	return nil
-}
+	if conf.Backend.SemtechUDP.SubscriberBufferSize < 0 {
+		return nil, fmt.Errorf("invalid subscriber_buffer_size: %d", conf.Backend.SemtechUDP.SubscriberBufferSize)
+	}
 
-// RawPacketForwarderCommand sends the given raw command to the packet-forwarder.
-func (b *Backend) RawPacketForwarderCommand(gw.RawPacketForwarderCommand) error {
-	return errors.New("raw packet-forwarder command not implemented by Semtech packet-forwarder")
-}
+	switch conf.Backend.SemtechUDP.SubscriberPolicy {
+	case "", subscriberPolicyDrop, subscriberPolicyBlock:
+	default:
+		return nil, fmt.Errorf("invalid subscriber_policy: %s", conf.Backend.SemtechUDP.SubscriberPolicy)
+	}
 
-func (b *Backend) isClosed() bool {
-	b.RLock()
-	defer b.RUnlock()
-	return b.closed
-}
+	switch conf.Backend.SemtechUDP.TXPowerPolicy {
+	case "", txPowerPolicyClamp, txPowerPolicyReject:
+	default:
+		return nil, fmt.Errorf("invalid tx_power_policy: %s", conf.Backend.SemtechUDP.TXPowerPolicy)
+	}
 
-func (b *Backend) readPackets() error {
-	buf := make([]byte, 65507) // max udp data size
-	for {
-		i, addr, err := b.conn.ReadFromUDP(buf)
-		if err != nil {
-			if b.isClosed() {
-				return nil
-			}
+	readBufferSize := conf.Backend.SemtechUDP.ReadBufferSize
+	if readBufferSize == 0 {
+		readBufferSize = maxUDPDataSize
+	}
+	if readBufferSize < 0 || readBufferSize > maxUDPDataSize {
+		return nil, fmt.Errorf("invalid read_buffer_size: %d", readBufferSize)
+	}
 
-			log.WithError(err).Error("gateway: read from udp error")
-			continue
+	for _, sb := range conf.Backend.SemtechUDP.DutyCycleSubBands {
+		if sb.DutyCycle <= 0 || sb.DutyCycle > 100 {
+			return nil, fmt.Errorf("invalid duty_cycle_sub_bands duty_cycle: %f", sb.DutyCycle)
+		}
+		if sb.FrequencyMin > sb.FrequencyMax {
+			return nil, fmt.Errorf("invalid duty_cycle_sub_bands frequency range: %d - %d", sb.FrequencyMin, sb.FrequencyMax)
 		}
-		data := make([]byte, i)
-		copy(data, buf[:i])
-		up := udpPacket{data: data, addr: addr}
+	}
 
-		// handle packet async
-		go func(up udpPacket) {
-			if err := b.handlePacket(up); err != nil {
-				log.WithError(err).WithFields(log.Fields{
-					"data_base64": base64.StdEncoding.EncodeToString(up.data),
-					"addr":        up.addr,
-				}).Error("backend/semtechudp: could not handle packet")
-			}
-		}(up)
+	if conf.Backend.SemtechUDP.UplinkSampleRate < 0 {
+		return nil, fmt.Errorf("invalid uplink_sample_rate: %d", conf.Backend.SemtechUDP.UplinkSampleRate)
 	}
-}
 
-func (b *Backend) sendPackets() error {
-	for p := range b.udpSendChan {
-		pt, err := packets.GetPacketType(p.data)
+	if conf.Backend.SemtechUDP.ReadTimeout < 0 {
+		return nil, fmt.Errorf("invalid read_timeout: %s", conf.Backend.SemtechUDP.ReadTimeout)
+	}
+
+	if conf.Backend.SemtechUDP.CloseTimeout < 0 {
+		return nil, fmt.Errorf("invalid close_timeout: %s", conf.Backend.SemtechUDP.CloseTimeout)
+	}
+
+	socketOptions := udpSocketOptions{
+		readBuffer:  conf.Backend.SemtechUDP.SocketReadBuffer,
+		writeBuffer: conf.Backend.SemtechUDP.SocketWriteBuffer,
+		dscp:        conf.Backend.SemtechUDP.SocketDSCP,
+	}
+	if socketOptions.readBuffer < 0 || socketOptions.writeBuffer < 0 {
+		return nil, errors.New("socket_read_buffer and socket_write_buffer must not be negative")
+	}
+	if socketOptions.dscp < 0 || socketOptions.dscp > 63 {
+		return nil, fmt.Errorf("invalid socket_dscp: %d", socketOptions.dscp)
+	}
+
+	var bb band.Band
+	if conf.Backend.SemtechUDP.Region != "" {
+		var err error
+		bb, err = band.GetConfig(band.Name(conf.Backend.SemtechUDP.Region), false, lorawan.DwellTimeNoLimit)
 		if err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"addr":        p.addr,
-				"data_base64": base64.StdEncoding.EncodeToString(p.data),
-			}).Error("backend/semtechudp: get packet-type error")
-			continue
+			return nil, errors.Wrap(err, "get band config error")
 		}
+	}
 
-		log.WithFields(log.Fields{
-			"addr":             p.addr,
-			"type":             pt,
-			"protocol_version": p.data[0],
-		}).Debug("backend/semtechudp: sending udp packet to gateway")
+	if conf.Backend.SemtechUDP.CheckDownlinkPayloadSize && bb == nil {
+		return nil, errors.New("check_downlink_payload_size requires a region")
+	}
+
+	if conf.Backend.SemtechUDP.CheckDownlinkDataRate && bb == nil {
+		return nil, errors.New("check_downlink_data_rate requires a region")
+	}
 
-		_, err = b.conn.WriteToUDP(p.data, p.addr)
+	var rawStatsChan chan RawStats
+	if conf.Backend.SemtechUDP.RawStatsBufferSize > 0 {
+		rawStatsChan = make(chan RawStats, conf.Backend.SemtechUDP.RawStatsBufferSize)
+	}
+
+	var rawUplinkChan chan RawUplink
+	if conf.Backend.SemtechUDP.RawUplinkBufferSize > 0 {
+		rawUplinkChan = make(chan RawUplink, conf.Backend.SemtechUDP.RawUplinkBufferSize)
+	}
+
+	var mirrorUplinkFrameChan chan gw.UplinkFrame
+	var mirrorGatewayStatsChan chan gw.GatewayStats
+	if conf.Backend.SemtechUDP.MirrorBufferSize > 0 {
+		mirrorUplinkFrameChan = make(chan gw.UplinkFrame, conf.Backend.SemtechUDP.MirrorBufferSize)
+		mirrorGatewayStatsChan = make(chan gw.GatewayStats, conf.Backend.SemtechUDP.MirrorBufferSize)
+	}
+
+	var txAuditChan chan TXAudit
+	if conf.Backend.SemtechUDP.TXAuditBufferSize > 0 {
+		txAuditChan = make(chan TXAudit, conf.Backend.SemtechUDP.TXAuditBufferSize)
+	}
+
+	var allowedNetworks []*net.IPNet
+	for _, cidr := range conf.Backend.SemtechUDP.AllowedNetworks {
+		_, ipNet, err := net.ParseCIDR(cidr)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"addr":             p.addr,
-				"type":             pt,
-				"protocol_version": p.data[0],
-			}).WithError(err).Error("backend/semtechudp: write to udp error")
+			return nil, errors.Wrapf(err, "invalid allowed_networks entry: %s", cidr)
 		}
+		allowedNetworks = append(allowedNetworks, ipNet)
+	}
 
-		udpWriteCounter(pt.String()).Inc()
+	gatewayConfigs := make(map[lorawan.EUI64]gatewayConfig)
+	for k, v := range conf.Backend.SemtechUDP.Gateways {
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(k)); err != nil {
+			return nil, errors.Wrapf(err, "invalid gateway id: %s", k)
+		}
+
+		gc := gatewayConfig{
+			disabled:     v.Disabled,
+			ignoreRxTime: v.IgnoreRxTime,
+			skipCRCCheck: conf.Backend.SemtechUDP.SkipCRCCheck,
+			fakeRxTime:   conf.Backend.SemtechUDP.FakeRxTime,
+			maxTXPower:   conf.Backend.SemtechUDP.MaxTXPower,
+			minRSSI:      conf.Backend.SemtechUDP.MinRSSI,
+			minSNR:       conf.Backend.SemtechUDP.MinSNR,
+
+			jitPastMargin:   conf.Backend.SemtechUDP.JITPastMargin,
+			jitFutureMargin: conf.Backend.SemtechUDP.JITFutureMargin,
+
+			downlinkFrequencies: v.DownlinkFrequencies,
+			labels:              v.Labels,
+		}
+		if v.SkipCRCCheck != nil {
+			gc.skipCRCCheck = *v.SkipCRCCheck
+		}
+		if v.FakeRxTime != nil {
+			gc.fakeRxTime = *v.FakeRxTime
+		}
+		if v.MaxTXPower != nil {
+			gc.maxTXPower = *v.MaxTXPower
+		}
+		if v.MinRSSI != nil {
+			gc.minRSSI = v.MinRSSI
+		}
+		if v.MinSNR != nil {
+			gc.minSNR = v.MinSNR
+		}
+		if v.JITPastMargin != nil {
+			gc.jitPastMargin = *v.JITPastMargin
+		}
+		if v.JITFutureMargin != nil {
+			gc.jitFutureMargin = *v.JITFutureMargin
+		}
+		if gc.jitPastMargin < 0 || gc.jitFutureMargin < 0 {
+			return nil, fmt.Errorf("invalid jit margins for gateway %s", gatewayID)
+		}
+		gatewayConfigs[gatewayID] = gc
 	}
-	return nil
-}
 
-func (b *Backend) handlePacket(up udpPacket) error {
-	b.RLock()
+	registry := make(map[lorawan.EUI64]gateway)
+	if conf.Backend.SemtechUDP.GatewaysFile != "" {
+		// the stale duration can only be changed once the backend has been
+		// created (see SetStaleDuration)
+		var err error
+		registry, err = loadGateways(conf.Backend.SemtechUDP.GatewaysFile, time.Now(), defaultGatewayStaleDuration, conf.Backend.SemtechUDP.SuspectGrace)
+		if err != nil {
+			return nil, errors.Wrap(err, "load gateways error")
+		}
+	}
+
+	addrs := []string{conf.Backend.SemtechUDP.UDPBind}
+	listenerIDs := []string{""}
+	for _, l := range conf.Backend.SemtechUDP.Listeners {
+		if l.ID == "" {
+			return nil, fmt.Errorf("listener id must be set for listener %s", l.Bind)
+		}
+		addrs = append(addrs, l.Bind)
+		listenerIDs = append(listenerIDs, l.ID)
+	}
+
+	var trafficFile *rotatingFile
+	if conf.Backend.SemtechUDP.TrafficLogFile != "" {
+		var err error
+		trafficFile, err = openRotatingFile(conf.Backend.SemtechUDP.TrafficLogFile, conf.Backend.SemtechUDP.TrafficLogMaxSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "open traffic log file error")
+		}
+	}
+
+	conns, err := listenUDP(addrs, socketOptions)
+	if err != nil {
+		if trafficFile != nil {
+			trafficFile.Close()
+		}
+		return nil, err
+	}
+
+	var downlinkConn *net.UDPConn
+	if conf.Backend.SemtechUDP.DownlinkBind != "" {
+		downlinkConns, err := listenUDP([]string{conf.Backend.SemtechUDP.DownlinkBind}, socketOptions)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			if trafficFile != nil {
+				trafficFile.Close()
+			}
+			return nil, errors.Wrap(err, "listen downlink_bind error")
+		}
+		downlinkConn = downlinkConns[0]
+	}
+
+	var tcp *tcpListener
+	if conf.Backend.SemtechUDP.TCPBind != "" {
+		tcp, err = listenTCP(conf.Backend.SemtechUDP.TCPBind)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			if downlinkConn != nil {
+				downlinkConn.Close()
+			}
+			if trafficFile != nil {
+				trafficFile.Close()
+			}
+			return nil, err
+		}
+	}
+
+	b := &Backend{
+		conns:             conns,
+		downlinkConn:      downlinkConn,
+		tcp:               tcp,
+		listenerIDs:       listenerIDs,
+		downlinkTXAckChan: make(chan gw.DownlinkTXAck),
+		uplinkFrameChan:   make(chan gw.UplinkFrame, conf.Backend.SemtechUDP.UplinkBufferSize),
+		gatewayStatsChan:  make(chan gw.GatewayStats),
+		txAuditChan:       txAuditChan,
+		rawStatsChan:      rawStatsChan,
+		rawUplinkChan:     rawUplinkChan,
+		udpSendChan:       make(chan udpPacket),
+		done:              make(chan struct{}),
+
+		mirrorUplinkFrameChan:  mirrorUplinkFrameChan,
+		mirrorGatewayStatsChan: mirrorGatewayStatsChan,
+		gateways: gateways{
+			gateways:           registry,
+			subscribeEventChan: make(chan events.Subscribe),
+			maxGateways:        conf.Backend.SemtechUDP.MaxGateways,
+			suspectGrace:       conf.Backend.SemtechUDP.SuspectGrace,
+			changed:            make(chan struct{}, 1),
+		},
+		gatewaysFile:       conf.Backend.SemtechUDP.GatewaysFile,
+		fakeRxTime:         conf.Backend.SemtechUDP.FakeRxTime,
+		skipCRCCheck:       conf.Backend.SemtechUDP.SkipCRCCheck,
+		locationValidation: conf.Backend.SemtechUDP.LocationValidation,
+		located:            make(map[lorawan.EUI64]struct{}),
+		bridgeStats:        conf.Backend.SemtechUDP.BridgeStats,
+		downlinkPort:       conf.Backend.SemtechUDP.DownlinkPort,
+		txRFChains:         conf.Backend.SemtechUDP.TXRFChains,
+		gatewayConfigs:     gatewayConfigs,
+		allowedNetworks:    allowedNetworks,
+		requirePullData:    conf.Backend.SemtechUDP.RequirePullData,
+		pullDataDebounce:   conf.Backend.SemtechUDP.PullDataDebounce,
+		conflictWindow:     conf.Backend.SemtechUDP.GatewayConflictWindow,
+		conflictPolicy:     conf.Backend.SemtechUDP.GatewayConflictPolicy,
+		logFrames:          conf.Backend.SemtechUDP.LogFrames,
+		logFramesRedact:    conf.Backend.SemtechUDP.LogFramesRedact,
+		jitLeadTime:        conf.Backend.SemtechUDP.JITLeadTime,
+		maxAckLatency:      conf.Backend.SemtechUDP.MaxAckLatency,
+		replayWindow:       conf.Backend.SemtechUDP.DownlinkReplayWindow,
+		jitPastMargin:      conf.Backend.SemtechUDP.JITPastMargin,
+		jitFutureMargin:    conf.Backend.SemtechUDP.JITFutureMargin,
+		rebootThreshold:    conf.Backend.SemtechUDP.RebootTmstThreshold,
+		health: healthConfig{
+			minACKRatio:      conf.Backend.SemtechUDP.Health.MinACKRatio,
+			minRXOKRatio:     conf.Backend.SemtechUDP.Health.MinRXOKRatio,
+			maxIdleIntervals: conf.Backend.SemtechUDP.Health.MaxIdleIntervals,
+		},
+		uplinkDropWhenFull: conf.Backend.SemtechUDP.UplinkDropWhenFull,
+		uplinkStallTimeout: conf.Backend.SemtechUDP.UplinkStallTimeout,
+		uplinkStallPolicy:  conf.Backend.SemtechUDP.UplinkStallPolicy,
+		sizeMismatchPolicy: conf.Backend.SemtechUDP.SizeMismatchPolicy,
+		sendBacklog:        newSendBacklog(),
+		uplinkSubscribers:  newUplinkSubscribers(conf.Backend.SemtechUDP.SubscriberBufferSize, conf.Backend.SemtechUDP.SubscriberPolicy),
+		discardUplinks:     conf.Backend.SemtechUDP.DiscardUplinks,
+		readBufferSize:     readBufferSize,
+		readTimeout:        conf.Backend.SemtechUDP.ReadTimeout,
+		closeTimeout:       conf.Backend.SemtechUDP.CloseTimeout,
+		band:               bb,
+		checkPayloadSize:   conf.Backend.SemtechUDP.CheckDownlinkPayloadSize,
+		checkDataRate:      conf.Backend.SemtechUDP.CheckDownlinkDataRate,
+		maxTXPower:         conf.Backend.SemtechUDP.MaxTXPower,
+		txPowerPolicy:      conf.Backend.SemtechUDP.TXPowerPolicy,
+		minRSSI:            conf.Backend.SemtechUDP.MinRSSI,
+		ignoreStatsTime:    conf.Backend.SemtechUDP.IgnoreStatsTime,
+		sendRetries:        conf.Backend.SemtechUDP.SendRetries,
+		sendRetryInterval:  conf.Backend.SemtechUDP.SendRetryInterval,
+		frequencyStatsMax:  conf.Backend.SemtechUDP.FrequencyStatsMax,
+		minSNR:             conf.Backend.SemtechUDP.MinSNR,
+		socketOptions:      socketOptions,
+		cache:              cache.New(15*time.Second, 15*time.Second),
+		counters:           &backendCounters{},
+		startTime:          time.Now(),
+		trafficFile:        trafficFile,
+
+		pushDataACKAfterProcessing: conf.Backend.SemtechUDP.PushDataACKAfterProcessing,
+	}
+
+	if trafficFile != nil {
+		b.traffic = newTrafficSink(trafficFile)
+	}
+
+	b.readBufferPool.New = func() interface{} {
+		buf := make([]byte, readBufferSize)
+		return &buf
+	}
+
+	if conf.Backend.SemtechUDP.UplinkSampleRate > 1 {
+		b.uplinkSampler = newUplinkSampler(conf.Backend.SemtechUDP.UplinkSampleRate)
+	}
+
+	if len(conf.Backend.SemtechUDP.DutyCycleSubBands) != 0 {
+		b.dutyCycle = newDutyCycleTracker(conf.Backend.SemtechUDP.DutyCycleSubBands)
+	}
+
+	if conf.Backend.SemtechUDP.JITLeadTime > 0 {
+		b.jit = newJITQueue(b.sendJITPacket)
+	}
+
+	if conf.Backend.SemtechUDP.TXAckRetries > 0 {
+		b.txAcks = newTXAckTracker(conf.Backend.SemtechUDP.TXAckTimeout, conf.Backend.SemtechUDP.TXAckRetries, b.retryPullResp, b.expireTXAck)
+	}
+
+	if conf.Backend.SemtechUDP.ACKRateLimit > 0 {
+		b.ackLimiter = newACKLimiter(conf.Backend.SemtechUDP.ACKRateLimit)
+	}
+
+	// subscribe the gateways loaded from disk, so that downlinks can be
+	// sent to their last-known address. The IDs are copied as the registry
+	// is updated concurrently once the readers are started.
+	var loaded []lorawan.EUI64
+	for gatewayID := range registry {
+		loaded = append(loaded, gatewayID)
+	}
+	go func() {
+		for _, gatewayID := range loaded {
+			connectCounter().Inc()
+			b.gateways.subscribeEventChan <- events.Subscribe{Subscribe: true, GatewayID: gatewayID}
+		}
+	}()
+
+	if b.gatewaysFile != "" {
+		go b.saveGatewaysLoop()
+	}
+
+	go func() {
+		for {
+			log.Debug("backend/semtechudp: cleanup gateway registry")
+			if err := b.gateways.cleanup(); err != nil {
+				log.WithError(err).Error("backend/semtechudp: gateway registry cleanup failed")
+			}
+			b.saveGateways()
+
+			select {
+			case <-time.After(b.GetCleanupInterval()):
+			case <-b.done:
+				return
+			}
+		}
+	}()
+
+	for _, conn := range b.conns {
+		b.startReadPackets(conn)
+	}
+
+	// the gateway might send the TXACK to the downlink socket
+	if b.downlinkConn != nil {
+		b.startReadPackets(b.downlinkConn)
+	}
+
+	if b.tcp != nil {
+		go b.acceptTCP()
+	}
+
+	if conf.Backend.SemtechUDP.BindResolveInterval != 0 {
+		go b.resolveBindLoop(addrs, listenerIDs, conf.Backend.SemtechUDP.BindResolveInterval)
+	}
+
+	if conf.Backend.SemtechUDP.SyntheticStatsInterval != 0 {
+		go b.syntheticStatsLoop(conf.Backend.SemtechUDP.SyntheticStatsInterval)
+	}
+
+	if conf.Backend.SemtechUDP.SummaryLogInterval != 0 {
+		go b.summaryLogLoop(conf.Backend.SemtechUDP.SummaryLogInterval)
+	}
+
+	if conf.Backend.SemtechUDP.AdminServer.Bind != "" {
+		b.startAdminServer(conf.Backend.SemtechUDP.AdminServer.Bind, conf.Backend.SemtechUDP.AdminServer.BearerToken)
+	}
+
+	// Add the waitgroups before the goroutines or a race occurs with closing
+	b.goroutines.add("send udp packets")
+	go func() {
+		err := b.sendPackets()
+		if !b.isClosed() {
+			log.WithError(err).Error("backend/semtechudp: send udp packets error")
+		}
+		b.goroutines.done("send udp packets")
+	}()
+
+	return b, nil
+}
+
+// Close closes the backend.
+func (b *Backend) Close() error {
+	if !atomic.CompareAndSwapUint32(&b.closed, 0, 1) {
+		return nil
+	}
+	close(b.done)
+
+	log.Info("backend/semtechudp: closing gateway backend")
+
+	// on error, the remaining resources are still closed and the first
+	// error is returned
+	var closeErr error
+	setCloseErr := func(err error) {
+		log.WithError(err).Error("backend/semtechudp: close error")
+		if closeErr == nil {
+			closeErr = err
+		}
+	}
+
+	b.connsMux.Lock()
+	b.connsClosed = true
+	for _, conn := range b.conns {
+		if err := conn.Close(); err != nil {
+			setCloseErr(errors.Wrap(err, "close udp listener error"))
+		}
+	}
+	if b.downlinkConn != nil {
+		if err := b.downlinkConn.Close(); err != nil {
+			setCloseErr(errors.Wrap(err, "close downlink udp socket error"))
+		}
+	}
+	b.connsMux.Unlock()
+
+	if b.tcp != nil {
+		if err := b.tcp.close(); err != nil {
+			setCloseErr(errors.Wrap(err, "close tcp listener error"))
+		}
+	}
+
+	if b.jit != nil {
+		b.jit.close()
+	}
+
+	if b.txAcks != nil {
+		b.txAcks.close()
+	}
+
+	// the packet handlers might still send to the send goroutine, thus the
+	// udpSendChan can only be closed once these have returned
+	deadline := time.Now().Add(b.closeTimeout)
+	getTimeout := func() time.Duration {
+		if b.closeTimeout == 0 {
+			return 0
+		}
+		if d := time.Until(deadline); d > 0 {
+			return d
+		}
+		return time.Nanosecond
+	}
+
+	if b.goroutines.wait(getTimeout(), "handle udp packet") {
+		log.Info("backend/semtechudp: handling last packets")
+		b.Lock()
+		close(b.udpSendChan)
+		b.Unlock()
+	}
+
+	if !b.goroutines.wait(getTimeout()) {
+		log.WithFields(log.Fields{
+			"close_timeout": b.closeTimeout,
+			"goroutines":    b.goroutines.list(),
+		}).Error("backend/semtechudp: goroutines did not return within close timeout")
+		if closeErr == nil {
+			closeErr = ErrCloseTimeout
+		}
+	}
+	b.saveGateways()
+
+	if b.adminServer != nil {
+		if err := b.adminServer.Close(); err != nil {
+			setCloseErr(errors.Wrap(err, "close admin server error"))
+		}
+	}
+
+	b.SetTrafficSink(nil)
+	if b.trafficFile != nil {
+		if err := b.trafficFile.Close(); err != nil {
+			setCloseErr(errors.Wrap(err, "close traffic log file error"))
+		}
+	}
+
+	return closeErr
+}
+
+// startAdminServer starts the admin server (see AdminServer) on the given
+// address.
+func (b *Backend) startAdminServer(bind, token string) {
+	log.WithFields(log.Fields{
+		"bind": bind,
+	}).Info("backend/semtechudp: starting admin server")
+
+	b.adminServer = &http.Server{
+		Handler: NewAdminServer(b, token),
+		Addr:    bind,
+	}
+
+	go func(server *http.Server) {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.WithError(err).Error("backend/semtechudp: admin server error")
+		}
+	}(b.adminServer)
+}
+
+// SetTrafficSink sets the writer to which all received and sent UDP
+// datagrams are written, encoded as traffic records (see
+// WriteTrafficRecord). Records are written in the background and are dropped
+// when the writer can not keep up. Set it to nil to disable. Note that the
+// writer is not closed by the backend.
+func (b *Backend) SetTrafficSink(w io.Writer) {
+	var sink *trafficSink
+	if w != nil {
+		sink = newTrafficSink(w)
+	}
+
+	b.trafficMux.Lock()
+	old := b.traffic
+	b.traffic = sink
+	b.trafficMux.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+// recordTraffic records the given datagram in the traffic sink (if set).
+func (b *Backend) recordTraffic(dir TrafficDirection, addr *net.UDPAddr, data []byte) {
+	b.trafficMux.RLock()
+	defer b.trafficMux.RUnlock()
+
+	if b.traffic != nil {
+		b.traffic.record(dir, addr, data)
+	}
+}
+
+// recordReceivedTraffic records the given received packet. As the traffic is
+// recorded async, the data of a pooled read buffer is copied.
+func (b *Backend) recordReceivedTraffic(up udpPacket) {
+	b.trafficMux.RLock()
+	defer b.trafficMux.RUnlock()
+
+	if b.traffic == nil {
+		return
+	}
+
+	data := up.data
+	if up.buf != nil {
+		data = append([]byte(nil), up.data...)
+	}
+	b.traffic.record(TrafficIn, up.addr, data)
+}
+
+// releaseReadBuffer returns the read buffer of the given packet (if any) to
+// the pool.
+func (b *Backend) releaseReadBuffer(up udpPacket) {
+	if up.buf != nil {
+		b.readBufferPool.Put(up.buf)
+	}
+}
+
+// saveGatewaysLoop saves the gateway registry when it has changed, at most
+// once per gatewaysSaveInterval.
+func (b *Backend) saveGatewaysLoop() {
+	for {
+		time.Sleep(gatewaysSaveInterval)
+		if b.isClosed() {
+			return
+		}
+
+		select {
+		case <-b.gateways.changed:
+			b.saveGateways()
+		default:
+		}
+	}
+}
+
+// saveGateways persists the gateway registry (when configured).
+func (b *Backend) saveGateways() {
+	if b.gatewaysFile == "" {
+		return
+	}
+
+	if err := b.gateways.save(b.gatewaysFile); err != nil {
+		log.WithError(err).WithField("file", b.gatewaysFile).Error("backend/semtechudp: save gateways error")
+	}
+}
+
+// Rebind replaces the current UDP listener(s) by listeners for the given
+// addresses. The listeners of the addresses which are already bound (port 0
+// excluded) are kept, the other listeners are started before the old
+// listeners are closed, so that no packets are missed. The gateway registry
+// is kept, so that downlinks can still be sent to the already known
+// gateways. Note that the new listeners do not have a listener ID.
+//
+// As the old listeners are still open, an address can not overlap with an
+// address which is replaced, e.g. 0.0.0.0:1700 can not be replaced by
+// 127.0.0.1:1700. In this case an error is returned and the current
+// listeners are kept.
+func (b *Backend) Rebind(addrs []string) error {
+	if len(addrs) == 0 {
+		return errors.New("at least one address is expected")
+	}
+
+	return b.rebind(addrs, make([]string, len(addrs)))
+}
+
+// rebind replaces the current UDP listener(s) by listeners for the given
+// addresses and listener IDs.
+func (b *Backend) rebind(addrs []string, listenerIDs []string) error {
+	b.rebindMux.Lock()
+	defer b.rebindMux.Unlock()
+
+	b.connsMux.RLock()
+	oldConns := append([]*net.UDPConn(nil), b.conns...)
+	b.connsMux.RUnlock()
+
+	// keep the listeners which are already bound to the address, binding
+	// these again would fail
+	conns := make([]*net.UDPConn, len(addrs))
+	var newAddrs []string
+	var newIndexes []int
+	for i, a := range addrs {
+		if j := findUDPConn(oldConns, a); j != -1 {
+			conns[i] = oldConns[j]
+			oldConns = append(oldConns[:j:j], oldConns[j+1:]...)
+			continue
+		}
+		newAddrs = append(newAddrs, a)
+		newIndexes = append(newIndexes, i)
+	}
+
+	newConns, err := listenUDP(newAddrs, b.socketOptions)
+	if err != nil {
+		return err
+	}
+	for i, conn := range newConns {
+		conns[newIndexes[i]] = conn
+	}
+
+	b.Lock()
+	if b.isClosed() {
+		b.Unlock()
+		closeUDP(newConns)
+		return ErrBackendClosed
+	}
+
+	b.connsMux.Lock()
+	b.conns = conns
+	b.listenerIDs = listenerIDs
+	b.connsMux.Unlock()
+
+	for _, conn := range newConns {
+		b.startReadPackets(conn)
+	}
+	b.Unlock()
+
+	for _, conn := range oldConns {
+		log.WithField("addr", conn.LocalAddr()).Info("backend/semtechudp: closing gateway udp listener")
+		if err := conn.Close(); err != nil {
+			log.WithError(err).Error("backend/semtechudp: close udp listener error")
+		}
+	}
+
+	return nil
+}
+
+// backendHooks holds the (optional) callbacks of the backend.
+type backendHooks struct {
+	uplinkFilter       UplinkFilterFunc
+	addressChangeFunc  AddressChangeFunc
+	versionChangeFunc  VersionChangeFunc
+	rebootFunc         RebootFunc
+	txAckDeviationFunc TXAckDeviationFunc
+	uplinkIngressFunc  UplinkIngressFunc
+	macRewriteFunc     MACRewriteFunc
+	healthFunc         HealthFunc
+}
+
+// getHooks returns (a copy of) the callbacks, so that these can be called
+// without holding the lock.
+func (b *Backend) getHooks() backendHooks {
+	b.hooksMux.RLock()
+	defer b.hooksMux.RUnlock()
+	return b.hooks
+}
+
+// SetUplinkFilter sets the uplink filter function. It is called for every
+// received uplink frame (after the CRC check and the configured filters).
+// Note that it is called from the packet handler goroutine, so it must
+// return fast. Set it to nil to forward all uplinks.
+func (b *Backend) SetUplinkFilter(fn UplinkFilterFunc) {
+	b.hooksMux.Lock()
+	defer b.hooksMux.Unlock()
+	b.hooks.uplinkFilter = fn
+}
+
+// SetMACRewriteFunc sets the function which rewrites the Gateway ID of every
+// received packet, e.g. to normalize a vendor-specific byte order. It is
+// applied before the gateway is added to the registry, thus downlinks must
+// use the rewritten Gateway ID. Set it to nil to disable.
+func (b *Backend) SetMACRewriteFunc(fn MACRewriteFunc) {
+	b.hooksMux.Lock()
+	defer b.hooksMux.Unlock()
+	b.hooks.macRewriteFunc = fn
+}
+
+// rewriteMAC returns the Gateway ID, rewritten by the MAC rewrite function
+// (when set).
+func (b *Backend) rewriteMAC(mac lorawan.EUI64) lorawan.EUI64 {
+	fn := b.getHooks().macRewriteFunc
+	if fn == nil {
+		return mac
+	}
+	return fn(mac)
+}
+
+// SetAddressChangeFunc sets the function which is called when a gateway
+// changes its source address. Like the uplink filter, it is called from the
+// packet handler goroutine. Set it to nil to disable.
+func (b *Backend) SetAddressChangeFunc(fn AddressChangeFunc) {
+	b.hooksMux.Lock()
+	defer b.hooksMux.Unlock()
+	b.hooks.addressChangeFunc = fn
+}
+
+// SetVersionChangeFunc sets the function which is called when the version
+// (see GatewayVersion) reported in the stats of a gateway changes, e.g. to
+// track firmware rollouts. It is not called for the first stats of a
+// gateway. Like the uplink filter, it is called from the packet handler
+// goroutine. Set it to nil to disable.
+func (b *Backend) SetVersionChangeFunc(fn VersionChangeFunc) {
+	b.hooksMux.Lock()
+	defer b.hooksMux.Unlock()
+	b.hooks.versionChangeFunc = fn
+}
+
+// SetRebootFunc sets the function which is called when a gateway reboot is
+// detected (see reboot_tmst_threshold). Like the uplink filter, it is called
+// from the packet handler goroutine. Set it to nil to disable.
+func (b *Backend) SetRebootFunc(fn RebootFunc) {
+	b.hooksMux.Lock()
+	defer b.hooksMux.Unlock()
+	b.hooks.rebootFunc = fn
+}
+
+// SetTXAckDeviationFunc sets the function which is called when the TXACK of
+// a gateway reports a TX power or frequency deviating from the PullResp. It
+// is called from the packet handler goroutine, before the downlink tx ack is
+// sent to the tx ack channel. Set it to nil to disable.
+func (b *Backend) SetTXAckDeviationFunc(fn TXAckDeviationFunc) {
+	b.hooksMux.Lock()
+	defer b.hooksMux.Unlock()
+	b.hooks.txAckDeviationFunc = fn
+}
+
+// SetUplinkIngressFunc sets the function which is called with the listener
+// which received each forwarded uplink, e.g. to route the uplinks by
+// ingress path when using multiple listeners. It is called from the packet
+// handler goroutine, before the uplink is forwarded. Set it to nil to
+// disable.
+func (b *Backend) SetUplinkIngressFunc(fn UplinkIngressFunc) {
+	b.hooksMux.Lock()
+	defer b.hooksMux.Unlock()
+	b.hooks.uplinkIngressFunc = fn
+}
+
+// getUplinkIngress returns the listener which received the given packet.
+func (b *Backend) getUplinkIngress(up udpPacket) UplinkIngress {
+	if up.conn != nil {
+		return UplinkIngress{
+			ListenerID: b.getListenerID(up.conn),
+			LocalAddr:  up.conn.LocalAddr(),
+		}
+	}
+
+	if conn := b.getTCPConn(up.addr); conn != nil {
+		return UplinkIngress{LocalAddr: conn.LocalAddr()}
+	}
+
+	return UplinkIngress{}
+}
+
+// GetGateways returns the gateways which are currently connected to the
+// backend, sorted by Gateway ID.
+func (b *Backend) GetGateways() []GatewayInfo {
+	var out []GatewayInfo
+	for gatewayID, gw := range b.gateways.list() {
+		out = append(out, GatewayInfo{
+			GatewayID:       gatewayID,
+			Addr:            gw.addr,
+			LastSeen:        gw.lastSeen,
+			ProtocolVersion: gw.protocolVersion,
+			AckLatency:      gw.ackLatency,
+			Suspect:         gw.suspect,
+			RXPKBatchLast:   gw.rxpkBatchLast,
+			RXPKBatchMax:    gw.rxpkBatchMax,
+			DownlinkErrors:  gw.downlinkErrors,
+			BytesIn:         gw.bytesIn,
+			BytesOut:        gw.bytesOut,
+			ForwardRatio:    gw.forwardRatio,
+			Labels:          b.getGatewayConfig(gatewayID).labels,
+			JSONVersion:     gw.jsonVersion,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].GatewayID.String() < out[j].GatewayID.String()
+	})
+
+	return out
+}
+
+// CanSend returns true when a downlink can be sent to the given gateway,
+// thus when the gateway is known, not disabled and has sent a PullData
+// within the cleanup window. It has no side effects, so that it can be used
+// to pre-filter gateways before calling SendDownlinkFrame.
+func (b *Backend) CanSend(gatewayID lorawan.EUI64) bool {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.isClosed() || b.getGatewayConfig(gatewayID).disabled {
+		return false
+	}
+
+	gw, err := b.gateways.get(gatewayID)
+	if err != nil {
+		return false
+	}
+
+	b.gateways.RLock()
+	defer b.gateways.RUnlock()
+	return !b.gateways.isStale(gw, b.gateways.getNow())
+}
+
+// BestGatewayFor returns the best gateway of the given candidates for sending
+// a downlink. Candidates are ranked by their average uplink SNR (highest
+// first) and then by the number of downlinks sent since their last stats
+// (lowest first). Remaining ties are broken by the lowest Gateway ID.
+// Candidates which are not connected are excluded. ErrGatewayUnknown is
+// returned when none of the candidates is connected.
+func (b *Backend) BestGatewayFor(candidates []lorawan.EUI64) (lorawan.EUI64, error) {
+	var best lorawan.EUI64
+	var bestGW gateway
+	var found bool
+
+	for _, gatewayID := range candidates {
+		gw, err := b.gateways.get(gatewayID)
+		if err != nil {
+			continue
+		}
+
+		if !found || isBetterGateway(gatewayID, gw, best, bestGW) {
+			best = gatewayID
+			bestGW = gw
+			found = true
+		}
+	}
+
+	if !found {
+		return best, ErrGatewayUnknown
+	}
+
+	return best, nil
+}
+
+// isBetterGateway returns true when gateway a is a better downlink candidate
+// than gateway b.
+func isBetterGateway(aID lorawan.EUI64, a gateway, bID lorawan.EUI64, b gateway) bool {
+	if a.hasUplinkSNR != b.hasUplinkSNR {
+		return a.hasUplinkSNR
+	}
+	if a.hasUplinkSNR && a.uplinkSNR != b.uplinkSNR {
+		return a.uplinkSNR > b.uplinkSNR
+	}
+	if a.counters.txSent != b.counters.txSent {
+		return a.counters.txSent < b.counters.txSent
+	}
+	return aID.String() < bID.String()
+}
+
+// SetGatewayEventFunc sets the function which is called when a gateway
+// connects to or disconnects from the backend, with the ID of the listener
+// on which the gateway sent its PullData. This makes it possible to route
+// the gateway events of each listener to a different handler. On connect,
+// the function is called without holding the gateway registry lock, only
+// the PullData of the connecting gateway waits for it to return. On
+// disconnect, it is called while holding the lock, thus it must return fast
+// and it must not call the backend. Set it to nil to disable.
+func (b *Backend) SetGatewayEventFunc(fn GatewayEventFunc) {
+	b.gateways.Lock()
+	defer b.gateways.Unlock()
+	b.gateways.gatewayEventFunc = fn
+}
+
+// OnGatewayNew adds a subscriber which is called when a gateway connects to
+// the backend. The subscribers are called in the order in which they were
+// added, after the gateway event function (see SetGatewayEventFunc). Like
+// the gateway event function, they are called without holding the gateway
+// registry lock. The gateway is added to the registry after the subscribers
+// have returned. The gateways loaded from the gateways file on startup do
+// not trigger the connect subscribers nor the gateway event function, as
+// these can only be set once the backend has been created. Only their
+// subscribe event is sent (see GetSubscribeEventChan).
+func (b *Backend) OnGatewayNew(fn GatewaySubscriberFunc) {
+	b.gateways.Lock()
+	defer b.gateways.Unlock()
+	b.gateways.onNew = append(b.gateways.onNew, fn)
+}
+
+// OnGatewayDelete adds a subscriber which is called when a gateway is
+// removed from the backend because of inactivity, see OnGatewayNew.
+func (b *Backend) OnGatewayDelete(fn GatewaySubscriberFunc) {
+	b.gateways.Lock()
+	defer b.gateways.Unlock()
+	b.gateways.onDelete = append(b.gateways.onDelete, fn)
+}
+
+// SetAbortOnGatewaySubscriberError sets if the remaining gateway subscribers
+// must be skipped after a subscriber returns an error. By default, the error
+// is logged and the remaining subscribers are called. Note that the gateway
+// is (dis)connected regardless of subscriber errors.
+func (b *Backend) SetAbortOnGatewaySubscriberError(abort bool) {
+	b.gateways.Lock()
+	defer b.gateways.Unlock()
+	b.gateways.abortOnSubscriberError = abort
+}
+
+// SetStaleDuration sets the duration of inactivity after which a gateway is
+// removed from the registry (default 1 minute), e.g. to temporarily extend
+// it during a known backhaul outage. It is applied on the next cleanup.
+func (b *Backend) SetStaleDuration(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid stale duration: %s", d)
+	}
+
+	b.gateways.Lock()
+	defer b.gateways.Unlock()
+	b.gateways.staleDuration = d
+	return nil
+}
+
+// GetStaleDuration returns the duration of inactivity after which a gateway
+// is removed from the registry.
+func (b *Backend) GetStaleDuration() time.Duration {
+	b.gateways.RLock()
+	defer b.gateways.RUnlock()
+	return b.gateways.getStaleDuration()
+}
+
+// SetCleanupInterval sets the interval of the gateway registry cleanup
+// (default 1 minute). It is applied after the current interval.
+func (b *Backend) SetCleanupInterval(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid cleanup interval: %s", d)
+	}
+
+	b.gateways.Lock()
+	defer b.gateways.Unlock()
+	b.gateways.cleanupInterval = d
+	return nil
+}
+
+// GetCleanupInterval returns the interval of the gateway registry cleanup.
+func (b *Backend) GetCleanupInterval() time.Duration {
+	b.gateways.RLock()
+	defer b.gateways.RUnlock()
+	return b.gateways.getCleanupInterval()
+}
+
+// GetDownlinkTXAckChan returns the downlink tx ack channel.
+func (b *Backend) GetDownlinkTXAckChan() chan gw.DownlinkTXAck {
+	return b.downlinkTXAckChan
+}
+
+// GetGatewayStatsChan returns the gateway stats channel.
+func (b *Backend) GetGatewayStatsChan() chan gw.GatewayStats {
+	return b.gatewayStatsChan
+}
+
+// GetUplinkFrameChan returns the uplink frame channel.
+func (b *Backend) GetUplinkFrameChan() chan gw.UplinkFrame {
+	return b.uplinkFrameChan
+}
+
+// GetRawStatsChan returns the raw stats channel, which receives the stat JSON
+// object of every PushData containing stats, e.g. to extract vendor-specific
+// fields. The parsed stats are still sent on the stats channel. It returns
+// nil when disabled. When the channel is full, items are dropped.
+func (b *Backend) GetRawStatsChan() chan RawStats {
+	return b.rawStatsChan
+}
+
+// GetMirrorUplinkFrameChan returns the mirror uplink frame channel, which
+// receives a copy of every uplink frame sent on the uplink frame channel.
+// It returns nil when mirroring is disabled. When the channel is full, items
+// are dropped. Note that the frames are shared with the uplink frame
+// channel, they must not be modified.
+func (b *Backend) GetMirrorUplinkFrameChan() chan gw.UplinkFrame {
+	return b.mirrorUplinkFrameChan
+}
+
+// GetMirrorGatewayStatsChan returns the mirror gateway stats channel, which
+// receives a copy of every gateway stats sent on the gateway stats channel.
+// It returns nil when mirroring is disabled. When the channel is full, items
+// are dropped.
+func (b *Backend) GetMirrorGatewayStatsChan() chan gw.GatewayStats {
+	return b.mirrorGatewayStatsChan
+}
+
+// mirrorUplinkFrame sends the given uplink frame to the mirror uplink frame
+// channel (if enabled).
+func (b *Backend) mirrorUplinkFrame(uplinkFrame gw.UplinkFrame) {
+	if b.mirrorUplinkFrameChan == nil {
+		return
+	}
+
+	select {
+	case b.mirrorUplinkFrameChan <- uplinkFrame:
+	default:
+		mirrorDroppedCounter("uplink").Inc()
+	}
+}
+
+// sendGatewayStats sends the given stats to the gateway stats channel and
+// the mirror gateway stats channel (if enabled).
+func (b *Backend) sendGatewayStats(stats gw.GatewayStats) {
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], stats.GatewayId)
+	b.addGatewayLabels(gatewayID, &stats)
+
+	b.gatewayStatsChan <- stats
+
+	if b.mirrorGatewayStatsChan == nil {
+		return
+	}
+
+	select {
+	case b.mirrorGatewayStatsChan <- stats:
+	default:
+		mirrorDroppedCounter("stats").Inc()
+	}
+}
+
+// addGatewayLabels adds the labels of the given gateway to the meta-data of
+// the given stats. Meta-data which is already set (e.g. the bridge stats)
+// is not overwritten.
+func (b *Backend) addGatewayLabels(gatewayID lorawan.EUI64, stats *gw.GatewayStats) {
+	labels := b.getGatewayConfig(gatewayID).labels
+	if len(labels) == 0 {
+		return
+	}
+
+	if stats.MetaData == nil {
+		stats.MetaData = make(map[string]string)
+	}
+	for k, v := range labels {
+		if _, ok := stats.MetaData[k]; !ok {
+			stats.MetaData[k] = v
+		}
+	}
+}
+
+// GetRawUplinkChan returns the raw uplink channel, which receives the data
+// as sent by the gateway of every uplink frame sent on the uplink frame
+// channel, matched by uplink ID. It returns nil when disabled. When the
+// channel is full, items are dropped.
+func (b *Backend) GetRawUplinkChan() chan RawUplink {
+	return b.rawUplinkChan
+}
+
+// sendRawUplink sends the raw data of the given uplink frame to the raw
+// uplink channel (if enabled).
+func (b *Backend) sendRawUplink(uplinkFrame gw.UplinkFrame, rawData map[uuid.UUID]string) {
+	if b.rawUplinkChan == nil {
+		return
+	}
+
+	uplinkID := uuid.FromBytesOrNil(uplinkFrame.GetRxInfo().GetUplinkId())
+	data, ok := rawData[uplinkID]
+	if !ok {
+		return
+	}
+
+	item := RawUplink{UplinkID: uplinkID, Data: data}
+	copy(item.GatewayID[:], uplinkFrame.GetRxInfo().GetGatewayId())
+
+	select {
+	case b.rawUplinkChan <- item:
+	default:
+		rawUplinkDroppedCounter().Inc()
+	}
+}
+
+// sendRawStats sends the stat object of the given PushData JSON payload to
+// the raw stats channel.
+func (b *Backend) sendRawStats(gatewayID lorawan.EUI64, payload []byte) {
+	var pl struct {
+		Stat json.RawMessage `json:"stat"`
+	}
+	if err := json.Unmarshal(payload, &pl); err != nil || len(pl.Stat) == 0 {
+		return
+	}
+
+	select {
+	case b.rawStatsChan <- RawStats{GatewayID: gatewayID, Stat: pl.Stat}:
+	default:
+		rawStatsDroppedCounter().Inc()
+	}
+}
+
+// GetTXAuditChan returns the TX audit channel, which receives every
+// PullResp sent to a gateway. It returns nil when TX auditing is disabled.
+// When the channel is full, audit items are dropped so that the downlink
+// path is never blocked.
+func (b *Backend) GetTXAuditChan() chan TXAudit {
+	return b.txAuditChan
+}
+
+// GetSubscribeEventChan return the (un)subscribe event channel.
+func (b *Backend) GetSubscribeEventChan() chan events.Subscribe {
+	return b.gateways.subscribeEventChan
+}
+
+// GetRawPacketForwarderEventChan returns the raw packet-forwarder command channel.
+func (b *Backend) GetRawPacketForwarderEventChan() chan gw.RawPacketForwarderEvent {
+	// not provided by the Semtech packet-forwarder.
+	return nil
+}
+
+// SendDownlinkFrame sends the given downlink frame to the gateway. After the
+// backend has been closed, ErrBackendClosed is returned.
+func (b *Backend) SendDownlinkFrame(frame gw.DownlinkFrame) error {
+	_, err := b.SendDownlinkFrameWithResult(frame)
+	return err
+}
+
+// SendDownlinkFrameWithResult sends the given downlink frame to the gateway.
+// On success, it returns a channel which receives the result of writing the
+// (first) downlink datagram to the UDP connection. Note that this does not
+// confirm that the gateway received or transmitted the downlink, this is
+// reported by the downlink tx ack.
+func (b *Backend) SendDownlinkFrameWithResult(frame gw.DownlinkFrame) (<-chan error, error) {
+	// hold the read-lock so that Close can't close the udpSendChan while
+	// the downlink is being queued
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.isClosed() {
+		return nil, ErrBackendClosed
+	}
+
+	// if Token == 0, generate it in order to be backwards compatible.
+	if frame.Token == 0 {
+		tokenB := make([]byte, 2)
+		if _, err := rand.Read(tokenB); err != nil {
+			return nil, errors.Wrap(err, "read random bytes error")
+		}
+		frame.Token = uint32(binary.BigEndian.Uint16(tokenB))
+	}
+
+	acks := make([]*gw.DownlinkTXAckItem, len(frame.Items))
+	for i := range acks {
+		acks[i] = &gw.DownlinkTXAckItem{
+			Status: gw.TxAckStatus_IGNORED,
+		}
+	}
+
+	result := make(chan error, 1)
+	if err := b.sendDownlinkFrame(frame, 0, acks, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (b *Backend) sendDownlinkFrame(frame gw.DownlinkFrame, i int, txAckItems []*gw.DownlinkTXAckItem, result chan error) error {
+	if i > len(frame.Items)-1 {
+		return errors.New("invalid downlink frame item index")
+	}
+
+	// create cache items
+	b.cache.Set(fmt.Sprintf("%d:ack", frame.Token), txAckItems, cache.DefaultExpiration)
+	b.cache.Set(fmt.Sprintf("%d:frame", frame.Token), frame, cache.DefaultExpiration)
+	b.cache.Set(fmt.Sprintf("%d:index", frame.Token), i, cache.DefaultExpiration)
+	b.cache.Delete(fmt.Sprintf("%d:sent", frame.Token))
+	b.cache.Delete(fmt.Sprintf("%d:txpk", frame.Token))
+
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], frame.GetGatewayId())
+
+	if b.getGatewayConfig(gatewayID).disabled {
+		return errors.Wrapf(ErrGatewayDisabled, "gateway %s", gatewayID)
+	}
+
+	gw, err := b.gateways.get(gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get gateway error")
+	}
+
+	pullResp, err := b.getPullRespPacket(gw.protocolVersion, frame, i)
+	if err != nil {
+		b.gateways.addDownlinkError(gatewayID, err, time.Now())
+		return err
+	}
+	b.cache.Set(fmt.Sprintf("%d:txpk", frame.Token), pullResp.Payload.TXPK, cache.DefaultExpiration)
+
+	bytes, err := pullResp.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "backend/semtechudp: marshal PullRespPacket error")
+	}
+
+	// the TXACK is only sent by gateways using protocol version 2
+	confirm := b.txAcks != nil && gw.protocolVersion == packets.ProtocolVersion2
+	if confirm {
+		b.txAcks.add(pullResp.RandomToken, gatewayID, bytes)
+	}
+
+	if err := b.queueDownlink(gatewayID, gw, pullResp.Payload.TXPK, bytes, result, nil); err != nil {
+		if confirm {
+			b.txAcks.ack(pullResp.RandomToken)
+		}
+		b.gateways.addDownlinkError(gatewayID, err, time.Now())
+		return err
+	}
+
+	return nil
+}
+
+// SendRaw sends the given txpk JSON object as-is (in a PullResp) to the
+// gateway, bypassing the downlink frame conversion. This can be used for
+// testing, replay or to send vendor-specific txpk fields. As there is no
+// downlink frame, the TXACK of the gateway is not forwarded.
+func (b *Backend) SendRaw(gatewayID lorawan.EUI64, txpk json.RawMessage) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.isClosed() {
+		return ErrBackendClosed
+	}
+
+	if b.getGatewayConfig(gatewayID).disabled {
+		return errors.Wrapf(ErrGatewayDisabled, "gateway %s", gatewayID)
+	}
+
+	gw, err := b.gateways.get(gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get gateway error")
+	}
+
+	tokenB := make([]byte, 2)
+	if _, err := rand.Read(tokenB); err != nil {
+		return errors.Wrap(err, "read random bytes error")
+	}
+
+	pullResp := packets.RawPullRespPacket{
+		ProtocolVersion: gw.protocolVersion,
+		RandomToken:     binary.BigEndian.Uint16(tokenB),
+		TXPK:            txpk,
+	}
+	bytes, err := pullResp.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "backend/semtechudp: marshal RawPullRespPacket error")
+	}
+
+	// the txpk might contain fields unknown to packets.TXPK, Data of the
+	// audit item always contains the PullResp as sent
+	var auditTXPK packets.TXPK
+	_ = json.Unmarshal(txpk, &auditTXPK)
+
+	if err := b.queueDownlink(gatewayID, gw, auditTXPK, bytes, nil, nil); err != nil {
+		b.gateways.addDownlinkError(gatewayID, err, time.Now())
+		return err
+	}
+
+	return nil
+}
+
+// SendToAddr sends the first item of the given downlink frame (in a
+// PullResp of the given protocol version) to the given address, bypassing
+// the gateway registry. This is an escape hatch for tooling and relays which
+// know the address of the gateway, but not (necessarily) its Gateway ID.
+// Normal code must use SendDownlinkFrame. The downlink passes the same
+// checks as SendDownlinkFrame (e.g. the duty-cycle and the replay window)
+// and is counted in the send backlog of the Gateway ID of the frame. When
+// the Gateway ID is unknown, there is no ack latency and no concentrator
+// counter estimate, thus the max_ack_latency and the JIT queue do not apply.
+// The downlink_port is not applied and the TXACK of the gateway is not
+// forwarded.
+func (b *Backend) SendToAddr(addr *net.UDPAddr, protocolVersion uint8, frame gw.DownlinkFrame) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.isClosed() {
+		return ErrBackendClosed
+	}
+
+	if addr == nil {
+		return errors.New("addr must not be nil")
+	}
+
+	if protocolVersion != packets.ProtocolVersion1 && protocolVersion != packets.ProtocolVersion2 {
+		return fmt.Errorf("unsupported protocol version: %d", protocolVersion)
+	}
+
+	if len(frame.Items) == 0 {
+		return errors.New("downlink frame has no items")
+	}
+
+	if frame.Token == 0 {
+		tokenB := make([]byte, 2)
+		if _, err := rand.Read(tokenB); err != nil {
+			return errors.Wrap(err, "read random bytes error")
+		}
+		frame.Token = uint32(binary.BigEndian.Uint16(tokenB))
+	}
+
+	pullResp, err := b.getPullRespPacket(protocolVersion, frame, 0)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := pullResp.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "backend/semtechudp: marshal PullRespPacket error")
+	}
+
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], frame.GetGatewayId())
+
+	if b.getGatewayConfig(gatewayID).disabled {
+		return errors.Wrapf(ErrGatewayDisabled, "gateway %s", gatewayID)
+	}
+
+	// the registry (when the gateway is known) only provides the ack
+	// latency and the concentrator counter estimate
+	gw, err := b.gateways.get(gatewayID)
+	if err != nil {
+		gw = gateway{}
+	}
+
+	return b.queueDownlink(gatewayID, gw, pullResp.Payload.TXPK, bytes, nil, addr)
+}
+
+// queueDownlink queues the given PullResp for sending to the gateway. When
+// the JIT queue is enabled, timestamped downlinks are held until just before
+// their transmit time. When addr is set, the PullResp is sent to addr instead
+// of the (current) address of the gateway.
+func (b *Backend) queueDownlink(gatewayID lorawan.EUI64, gw gateway, txpk packets.TXPK, bytes []byte, result chan error, addr *net.UDPAddr) (err error) {
+	if b.maxAckLatency != 0 && txpk.Tmst != nil && gw.ackLatency > b.maxAckLatency {
+		gatewayLatencyTooHighCounter().Inc()
+		return errors.Wrapf(ErrGatewayLatencyTooHigh, "ack latency %s exceeds max ack latency %s", gw.ackLatency, b.maxAckLatency)
+	}
+
+	replayKey, replayed := b.isReplayedDownlink(gatewayID, bytes)
+	if replayed {
+		downlinkReplaySuppressedCounter().Inc()
+		return errors.Wrapf(ErrDuplicateDownlink, "identical downlink queued within %s", b.replayWindow)
+	}
+	if replayKey != "" {
+		// only a queued downlink counts as sent, a rejected downlink may
+		// be retried within the replay window
+		defer func() {
+			if err != nil {
+				b.cache.Delete(replayKey)
+			}
+		}()
+	}
+
+	releaseAt := time.Now()
+	if b.jit != nil && txpk.Tmst != nil {
+		releaseAt, err = b.getJITReleaseTime(b.getGatewayConfig(gatewayID), gw, *txpk.Tmst, releaseAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if gw.suspect {
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"last_seen":  gw.lastSeen,
+		}).Warning("backend/semtechudp: sending downlink to suspect gateway")
+	}
+
+	var dutyCycle *dutyCycleReservation
+	if b.dutyCycle != nil {
+		r, err := b.dutyCycle.reserveTXPK(gatewayID, txpk, time.Now())
+		if err != nil {
+			if err == ErrDutyCycleExceeded {
+				dutyCycleExceededCounter().Inc()
+			}
+			return err
+		}
+
+		// the time-on-air is released when the write fails, or when the
+		// TXACK reports an error (see releaseDutyCycle), which only
+		// protocol version 2 uses (version 1 does not set the token)
+		dutyCycle = r
+		if r != nil && bytes[0] == packets.ProtocolVersion2 {
+			token := binary.LittleEndian.Uint16(bytes[1:3])
+			b.cache.Set(fmt.Sprintf("%d:dutycycle", token), r, cache.DefaultExpiration)
+		}
+	}
+
+	b.logDownlinkFrame(gatewayID, txpk)
+
+	if b.txAuditChan != nil {
+		select {
+		case b.txAuditChan <- TXAudit{GatewayID: gatewayID, TXPK: txpk, Data: bytes}:
+		default:
+			txAuditDroppedCounter().Inc()
+		}
+	}
+
+	p := udpPacket{
+		data:   bytes,
+		addr:   addr,
+		result: result,
+
+		downlinkGatewayID: &gatewayID,
+		fixedAddr:         addr != nil,
+		dutyCycle:         dutyCycle,
+	}
+	if !p.fixedAddr {
+		p.addr = b.getDownlinkAddr(gw.addr)
+		p.conn = gw.conn
+	}
+
+	if b.jit != nil && releaseAt.After(time.Now()) {
+		b.jit.add(releaseAt, p)
+	} else {
+		b.sendDownlinkPacket(p)
+	}
+
+	b.gateways.updateCounters(gatewayID, func(c *gatewayCounters) {
+		c.txSent++
+	})
+	atomic.AddUint64(&b.counters.downlinksQueued, 1)
+
+	return nil
+}
+
+// isReplayedDownlink returns true when an identical PullResp was queued for
+// the given gateway within the replay window. Otherwise it records the
+// PullResp and returns its cache key, which is empty when the replay window
+// is disabled. The header is not compared, as the random token differs for
+// every downlink frame.
+func (b *Backend) isReplayedDownlink(gatewayID lorawan.EUI64, bytes []byte) (string, bool) {
+	if b.replayWindow == 0 || len(bytes) < 4 {
+		return "", false
+	}
+
+	key := fmt.Sprintf("%s:pullresp:%x", gatewayID, sha256.Sum256(bytes[4:]))
+	if b.cache.Add(key, struct{}{}, b.replayWindow) != nil {
+		return "", true
+	}
+	return key, false
+}
+
+// ApplyConfiguration is not implemented.
+func (b *Backend) ApplyConfiguration(config gw.GatewayConfiguration) error {
+	return nil
+}
+
+// getPullRespPacket returns the PullResp packet for the given downlink frame
+// item, using the configured TX RF chains and max. TX power.
+func (b *Backend) getPullRespPacket(protocolVersion uint8, frame gw.DownlinkFrame, i int) (packets.PullRespPacket, error) {
+	pullResp, err := packets.GetPullRespPacket(protocolVersion, uint16(frame.Token), frame, i)
+	if err != nil {
+		return pullResp, errors.Wrap(err, "get PullRespPacket error")
+	}
+
+	if b.checkDataRate && b.band != nil {
+		if err := validateDownlinkDataRate(b.band, frame.Items[i].GetTxInfo()); err != nil {
+			return pullResp, err
+		}
+	}
+
+	if b.checkPayloadSize && b.band != nil {
+		if err := validatePayloadSize(b.band, frame.Items[i]); err != nil {
+			return pullResp, err
+		}
+	}
+
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], frame.GetGatewayId())
+	gc := b.getGatewayConfig(gatewayID)
+	power := frame.Items[i].GetTxInfo().GetPower()
+
+	if freq := frame.Items[i].GetTxInfo().GetFrequency(); !gc.supportsDownlinkFrequency(freq) {
+		return pullResp, errors.Wrapf(ErrFrequencyUnsupported, "frequency %d is not supported by gateway %s", freq, gatewayID)
+	}
+
+	if maxPower := gc.maxTXPower; maxPower != 0 && int(power) > maxPower {
+		if b.txPowerPolicy == txPowerPolicyReject {
+			return pullResp, errors.Wrapf(ErrPowerTooHigh, "tx power %d exceeds max tx power %d", power, maxPower)
+		}
+
+		log.WithFields(log.Fields{
+			"gateway_id":   gatewayID,
+			"tx_power":     power,
+			"max_tx_power": maxPower,
+		}).Warning("backend/semtechudp: tx power exceeds max tx power, clamping tx power")
+		pullResp.Payload.TXPK.Powe = uint8(maxPower)
+	}
+
+	// the RF chain is selected using the (clamped) TX power
+	if len(b.txRFChains) != 0 {
+		rfChain, err := b.getTXRFChain(frame.Items[i].GetTxInfo().GetFrequency(), int(pullResp.Payload.TXPK.Powe))
+		if err != nil {
+			return pullResp, errors.Wrap(err, "get tx rf chain error")
+		}
+		pullResp.Payload.TXPK.RFCh = rfChain
+	}
+
+	return pullResp, nil
+}
+
+// SetBand sets the band used by ValidateDownlinkFrame for validating the
+// data-rate and TX power. This overrides the band of the configured region.
+// Set it to nil to disable these checks.
+func (b *Backend) SetBand(bb band.Band) {
+	b.Lock()
+	defer b.Unlock()
+	b.band = bb
+}
+
+// ValidateDownlinkFrame validates that each item of the given downlink frame
+// results in a valid PullResp packet, without sending it to the gateway.
+// When a band is configured, it also validates that the data-rate is a
+// valid downlink data-rate and that the TX power does not exceed the
+// downlink TX power of the band.
+func (b *Backend) ValidateDownlinkFrame(frame gw.DownlinkFrame) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	for i := range frame.Items {
+		if _, err := b.getPullRespPacket(packets.ProtocolVersion2, frame, i); err != nil {
+			return errors.Wrapf(err, "item %d", i)
+		}
+
+		if b.band == nil {
+			continue
+		}
+
+		if err := validateTXInfo(b.band, frame.Items[i].GetTxInfo()); err != nil {
+			return errors.Wrapf(err, "item %d", i)
+		}
+	}
+
+	return nil
+}
+
+// validateTXInfo validates the given TX info against the given band.
+func validateTXInfo(bb band.Band, txInfo *gw.DownlinkTXInfo) error {
+	if _, err := bb.GetDataRateIndex(false, getDownlinkDataRate(txInfo)); err != nil {
+		return errors.Wrap(err, "invalid data-rate")
+	}
+
+	if maxPower := bb.GetDownlinkTXPower(int(txInfo.GetFrequency())); int(txInfo.GetPower()) > maxPower {
+		return errors.Wrapf(ErrPowerTooHigh, "tx power %d exceeds max tx power %d", txInfo.GetPower(), maxPower)
+	}
+
+	return nil
+}
+
+// UplinkIndices contains the data-rate and channel index of an uplink frame
+// for the configured region.
+type UplinkIndices struct {
+	// Data-rate index.
+	DR int
+
+	// Channel index. This is set to -1 when the frequency is not one of the
+	// default channels of the region.
+	Channel int
+}
+
+// GetUplinkIndices returns the data-rate and channel index of the given
+// uplink frame, using the band of the configured region (see SetBand). An
+// error is returned when no region is configured or when the data-rate is
+// not valid for the region.
+func (b *Backend) GetUplinkIndices(frame gw.UplinkFrame) (UplinkIndices, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.band == nil {
+		return UplinkIndices{}, errors.New("no region configured")
+	}
+
+	var dr band.DataRate
+	switch frame.GetTxInfo().GetModulation() {
+	case common.Modulation_LORA:
+		modInfo := frame.GetTxInfo().GetLoraModulationInfo()
+		dr = band.DataRate{
+			Modulation:   band.LoRaModulation,
+			SpreadFactor: int(modInfo.GetSpreadingFactor()),
+			Bandwidth:    int(modInfo.GetBandwidth()),
+		}
+	case common.Modulation_FSK:
+		modInfo := frame.GetTxInfo().GetFskModulationInfo()
+		dr = band.DataRate{
+			Modulation: band.FSKModulation,
+			BitRate:    int(modInfo.GetDatarate()),
+		}
+	}
+
+	var out UplinkIndices
+	var err error
+
+	out.DR, err = b.band.GetDataRateIndex(true, dr)
+	if err != nil {
+		return out, errors.Wrap(err, "get data-rate index error")
+	}
+
+	out.Channel, err = b.band.GetUplinkChannelIndex(int(frame.GetTxInfo().GetFrequency()), true)
+	if err != nil {
+		out.Channel = -1
+	}
+
+	return out, nil
+}
+
+// getDownlinkDataRate returns the data-rate of the given TX info.
+func getDownlinkDataRate(txInfo *gw.DownlinkTXInfo) band.DataRate {
+	var dr band.DataRate
+	switch txInfo.GetModulation() {
+	case common.Modulation_LORA:
+		modInfo := txInfo.GetLoraModulationInfo()
+		dr = band.DataRate{
+			Modulation:   band.LoRaModulation,
+			SpreadFactor: int(modInfo.GetSpreadingFactor()),
+			Bandwidth:    int(modInfo.GetBandwidth()),
+		}
+	case common.Modulation_FSK:
+		modInfo := txInfo.GetFskModulationInfo()
+		dr = band.DataRate{
+			Modulation: band.FSKModulation,
+			BitRate:    int(modInfo.GetDatarate()),
+		}
+	}
+	return dr
+}
+
+// validateDownlinkDataRate returns ErrInvalidDownlinkDatarate when the
+// data-rate of the given TX info is not a downlink data-rate of the given
+// band, or when the frequency is not one of the downlink, RX2 or uplink
+// (e.g. RX1 in EU868) channels of the band.
+func validateDownlinkDataRate(bb band.Band, txInfo *gw.DownlinkTXInfo) error {
+	if _, err := bb.GetDataRateIndex(false, getDownlinkDataRate(txInfo)); err != nil {
+		return errors.Wrapf(ErrInvalidDownlinkDatarate, "data-rate is not a downlink data-rate of %s", bb.Name())
+	}
+
+	freq := int(txInfo.GetFrequency())
+	if freq == bb.GetDefaults().RX2Frequency {
+		return nil
+	}
+	for i := 0; ; i++ {
+		c, err := bb.GetDownlinkChannel(i)
+		if err != nil {
+			break
+		}
+		if c.Frequency == freq {
+			return nil
+		}
+	}
+	if _, err := bb.GetUplinkChannelIndex(freq, false); err == nil {
+		return nil
+	}
+
+	return errors.Wrapf(ErrInvalidDownlinkDatarate, "frequency %d is not a downlink channel of %s", freq, bb.Name())
+}
+
+// validatePayloadSize returns ErrPayloadTooLarge when the PHYPayload of the
+// given downlink item exceeds the max. payload size of its data-rate for the
+// given band. The max. PHYPayload size is the max. MACPayload size plus the
+// MHDR and MIC.
+func validatePayloadSize(bb band.Band, item *gw.DownlinkFrameItem) error {
+	dr, err := bb.GetDataRateIndex(false, getDownlinkDataRate(item.GetTxInfo()))
+	if err != nil {
+		return errors.Wrap(err, "invalid data-rate")
+	}
+
+	ps, err := bb.GetMaxPayloadSizeForDataRateIndex(band.LoRaWAN_1_1_0, band.RegParamRevB, dr)
+	if err != nil {
+		return errors.Wrap(err, "get max payload size error")
+	}
+
+	if maxSize := ps.M + 5; len(item.PhyPayload) > maxSize {
+		return errors.Wrapf(ErrPayloadTooLarge, "phypayload size %d exceeds max size %d for data-rate %d", len(item.PhyPayload), maxSize, dr)
+	}
+
+	return nil
+}
+
+// getTXRFChain returns the first configured TX RF chain which supports the
+// given frequency and TX power.
+func (b *Backend) getTXRFChain(frequency uint32, power int) (uint8, error) {
+	var frequencySupported bool
+	for _, rfChain := range b.txRFChains {
+		if frequency < rfChain.FrequencyMin || frequency > rfChain.FrequencyMax {
+			continue
+		}
+		frequencySupported = true
+
+		if rfChain.MaxPower == 0 || power <= rfChain.MaxPower {
+			return rfChain.RFChain, nil
+		}
+	}
+
+	if frequencySupported {
+		return 0, errors.Wrapf(ErrPowerTooHigh, "no tx rf chain supports tx power %d at frequency %d", power, frequency)
+	}
+	return 0, errors.Wrapf(ErrFrequencyUnsupported, "no tx rf chain supports frequency %d", frequency)
+}
+
+// supportsDownlinkFrequency returns true when the given downlink frequency
+// (Hz) is supported by the gateway.
+func (gc gatewayConfig) supportsDownlinkFrequency(freq uint32) bool {
+	if len(gc.downlinkFrequencies) == 0 {
+		return true
+	}
+
+	for _, f := range gc.downlinkFrequencies {
+		if f == freq {
+			return true
+		}
+	}
+	return false
+}
+
+// getGatewayConfig returns the configuration for the given gateway. Gateways
+// without overrides use the global configuration.
+func (b *Backend) getGatewayConfig(gatewayID lorawan.EUI64) gatewayConfig {
+	if gc, ok := b.gatewayConfigs[gatewayID]; ok {
+		return gc
+	}
+
+	return gatewayConfig{
+		skipCRCCheck: b.skipCRCCheck,
+		fakeRxTime:   b.fakeRxTime,
+		maxTXPower:   b.maxTXPower,
+		minRSSI:      b.minRSSI,
+		minSNR:       b.minSNR,
+
+		jitPastMargin:   b.jitPastMargin,
+		jitFutureMargin: b.jitFutureMargin,
+	}
+}
+
+// getDownlinkAddr returns the address to which downlinks must be sent, given
+// the address from which the gateway sent its PullData.
+func (b *Backend) getDownlinkAddr(addr *net.UDPAddr) *net.UDPAddr {
+	if b.downlinkPort == 0 || b.getTCPConn(addr) != nil {
+		return addr
+	}
+
+	return &net.UDPAddr{
+		IP:   addr.IP,
+		Port: b.downlinkPort,
+		Zone: addr.Zone,
+	}
+}
+
+// RawPacketForwarderCommand sends the given raw command to the packet-forwarder.
+func (b *Backend) RawPacketForwarderCommand(gw.RawPacketForwarderCommand) error {
+	return errors.New("raw packet-forwarder command not implemented by Semtech packet-forwarder")
+}
+
+func (b *Backend) isClosed() bool {
+	return atomic.LoadUint32(&b.closed) == 1
+}
+
+// syntheticStatsLoop periodically sends bridge-generated stats for the
+// gateways which did not send any stats within the given interval.
+func (b *Backend) syntheticStatsLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if b.isClosed() {
+			return
+		}
+
+		now := b.gateways.getNow()
+		for gatewayID, g := range b.gateways.list() {
+			if g.lastStats.After(now.Add(-interval)) {
+				continue
+			}
+
+			stats, err := b.getSyntheticStats(gatewayID, g, now)
+			if err != nil {
+				log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/semtechudp: get synthetic stats error")
+				continue
+			}
+
+			log.WithField("gateway_id", gatewayID).Debug("backend/semtechudp: sending synthetic gateway stats")
+			b.sendGatewayStats(stats)
+		}
+	}
+}
+
+// getSyntheticStats returns the bridge-generated stats for the given gateway,
+// based on the bridge-side counters (which are reset).
+func (b *Backend) getSyntheticStats(gatewayID lorawan.EUI64, g gateway, now time.Time) (gw.GatewayStats, error) {
+	ts, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return gw.GatewayStats{}, errors.Wrap(err, "timestamp proto error")
+	}
+
+	statsID, err := uuid.NewV4()
+	if err != nil {
+		return gw.GatewayStats{}, errors.Wrap(err, "new uuid error")
+	}
+
+	counters := b.gateways.resetCounters(gatewayID)
+
+	stats := gw.GatewayStats{
+		GatewayId:           gatewayID[:],
+		Time:                ts,
+		StatsId:             statsID[:],
+		RxPacketsReceived:   counters.rxReceived,
+		RxPacketsReceivedOk: counters.rxForwarded,
+		TxPacketsReceived:   counters.txSent,
+		TxPacketsEmitted:    counters.txAckOK,
+		MetaData: map[string]string{
+			"bridge_generated": "true",
+			"bridge_last_seen": g.lastSeen.UTC().Format(time.RFC3339),
+			"bridge_uptime":    strconv.FormatInt(int64(now.Sub(g.firstSeen)/time.Second), 10),
+		},
+	}
+	counters.addFrequenciesToMetaData(stats.MetaData)
+
+	return stats, nil
+}
+
+// resolveBindLoop periodically resolves the given bind addresses and rebinds
+// the listeners when the resolved addresses have changed (e.g. when a
+// hostname resolves to a new IP address).
+func (b *Backend) resolveBindLoop(addrs []string, listenerIDs []string, interval time.Duration) {
+	resolved, err := resolveUDPAddrs(addrs)
+	if err != nil {
+		log.WithError(err).Error("backend/semtechudp: resolve bind addresses error")
+	}
+
+	for {
+		time.Sleep(interval)
+		if b.isClosed() {
+			return
+		}
+
+		current, err := resolveUDPAddrs(addrs)
+		if err != nil {
+			log.WithError(err).Error("backend/semtechudp: resolve bind addresses error")
+			continue
+		}
+
+		if strings.Join(current, ",") == strings.Join(resolved, ",") {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"old_addrs": resolved,
+			"new_addrs": current,
+		}).Info("backend/semtechudp: bind addresses changed, rebinding udp listeners")
+
+		if err := b.rebind(addrs, listenerIDs); err != nil {
+			log.WithError(err).Error("backend/semtechudp: rebind udp listeners error")
+			continue
+		}
+		resolved = current
+	}
+}
+
+// ListenAddr returns the address to which the udp_bind listener is bound.
+// This makes it possible to discover the port when binding to port 0.
+func (b *Backend) ListenAddr() *net.UDPAddr {
+	return b.ListenAddrs()[0]
+}
+
+// ListenAddrs returns the addresses to which the UDP listeners are bound,
+// starting with the udp_bind listener, followed by the additional listeners
+// (in the configured order).
+func (b *Backend) ListenAddrs() []*net.UDPAddr {
+	b.connsMux.RLock()
+	defer b.connsMux.RUnlock()
+
+	out := make([]*net.UDPAddr, 0, len(b.conns))
+	for _, conn := range b.conns {
+		out = append(out, conn.LocalAddr().(*net.UDPAddr))
+	}
+	return out
+}
+
+// getListenerID returns the listener ID of the given conn.
+func (b *Backend) getListenerID(conn *net.UDPConn) string {
+	b.connsMux.RLock()
+	defer b.connsMux.RUnlock()
+
+	for i, c := range b.conns {
+		if c == conn {
+			return b.listenerIDs[i]
+		}
+	}
+	return ""
+}
+
+// isActiveConn returns true when the given conn is one of the current
+// listeners.
+func (b *Backend) isActiveConn(conn *net.UDPConn) bool {
+	b.connsMux.RLock()
+	defer b.connsMux.RUnlock()
+
+	if b.downlinkConn != nil && conn == b.downlinkConn {
+		return true
+	}
+	for _, c := range b.conns {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// getDownlinkConn returns the conn from which the PullResp packets must be
+// sent, it returns nil when downlink_bind is not set.
+func (b *Backend) getDownlinkConn() *net.UDPConn {
+	b.connsMux.RLock()
+	defer b.connsMux.RUnlock()
+	return b.downlinkConn
+}
+
+// getSendConn returns the conn that must be used for sending to a gateway.
+// When the given conn has been replaced (see Rebind), the first current
+// listener is returned.
+func (b *Backend) getSendConn(conn *net.UDPConn) *net.UDPConn {
+	b.connsMux.RLock()
+	defer b.connsMux.RUnlock()
+
+	if conn != nil && conn == b.downlinkConn {
+		return conn
+	}
+	for _, c := range b.conns {
+		if c == conn {
+			return c
+		}
+	}
+	return b.conns[0]
+}
+
+func (b *Backend) startReadPackets(conn *net.UDPConn) {
+	// Add the waitgroups before the goroutines or a race occurs with closing
+	b.goroutines.add("read udp packets")
+	go func() {
+		err := b.readPackets(conn)
+		if !b.isClosed() && b.isActiveConn(conn) {
+			log.WithError(err).Error("backend/semtechudp: read udp packets error")
+		}
+		b.goroutines.done("read udp packets")
+	}()
+}
+
+func (b *Backend) readPackets(conn *net.UDPConn) error {
+	// the packets are read directly into a pooled buffer, which is handed
+	// over to the packet handler
+	var buf *[]byte
+	for {
+		if buf == nil {
+			buf = b.readBufferPool.Get().(*[]byte)
+		}
+
+		if b.readTimeout != 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(b.readTimeout)); err != nil {
+				if b.isClosed() || !b.isActiveConn(conn) {
+					return nil
+				}
+				return errors.Wrap(err, "set read deadline error")
+			}
+		}
+
+		i, addr, err := conn.ReadFromUDP(*buf)
+		if err != nil {
+			if b.isClosed() || !b.isActiveConn(conn) {
+				return nil
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+
+			log.WithError(err).Error("gateway: read from udp error")
+			continue
+		}
+		b.handleReceivedPacket(udpPacket{data: (*buf)[:i], addr: addr, conn: conn, buf: buf})
+		buf = nil
+	}
+}
+
+// handleReceivedPacket handles the given received packet async.
+func (b *Backend) handleReceivedPacket(up udpPacket) {
+	atomic.AddUint64(&b.counters.bytesIn, uint64(len(up.data)))
+	b.recordReceivedTraffic(up)
+
+	b.goroutines.add("handle udp packet")
+	go func(up udpPacket) {
+		defer b.goroutines.done("handle udp packet")
+		defer b.releaseReadBuffer(up)
+
+		if err := b.handlePacket(up); err != nil {
+			atomic.AddUint64(&b.counters.handleErrors, 1)
+
+			if errors.Cause(err) == packets.ErrTooShort {
+				udpTruncatedCounter("received").Inc()
+				log.WithFields(log.Fields{
+					"addr": up.addr,
+					"size": len(up.data),
+				}).Debug("backend/semtechudp: dropping truncated packet")
+				return
+			}
+
+			log.WithError(err).WithFields(log.Fields{
+				"data_base64": base64.StdEncoding.EncodeToString(up.data),
+				"addr":        up.addr,
+			}).Error("backend/semtechudp: could not handle packet")
+		}
+	}(up)
+}
+
+func (b *Backend) sendPackets() error {
+	for p := range b.udpSendChan {
+		if p.downlinkGatewayID != nil {
+			b.sendBacklog.add(*p.downlinkGatewayID, -1)
+
+			// retarget the downlink in case the gateway address has changed
+			if gw, err := b.gateways.get(*p.downlinkGatewayID); err == nil && !p.fixedAddr {
+				p.addr = b.getDownlinkAddr(gw.addr)
+				p.conn = gw.conn
+			}
+		}
+
+		pt, err := packets.GetPacketType(p.data)
+		if err == packets.ErrTooShort {
+			udpTruncatedCounter("sent").Inc()
+			log.WithFields(log.Fields{
+				"addr": p.addr,
+				"size": len(p.data),
+			}).Error("backend/semtechudp: dropping truncated packet")
+			p.setResult(err)
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"addr":        p.addr,
+				"data_base64": base64.StdEncoding.EncodeToString(p.data),
+			}).Error("backend/semtechudp: get packet-type error")
+			p.setResult(err)
+			continue
+		}
+
+		if pt == packets.PullResp {
+			if conn := b.getDownlinkConn(); conn != nil {
+				p.conn = conn
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"addr":             p.addr,
+			"type":             pt,
+			"protocol_version": p.data[0],
+		}).Debug("backend/semtechudp: sending udp packet to gateway")
+
+		err = b.writeUDP(&p)
+		if err != nil && p.retry < b.sendRetries {
+			log.WithError(err).WithFields(log.Fields{
+				"addr":  p.addr,
+				"type":  pt,
+				"retry": p.retry + 1,
+			}).Warning("backend/semtechudp: write to udp error, retrying")
+			b.retryPacket(p)
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"addr":             p.addr,
+				"type":             pt,
+				"protocol_version": p.data[0],
+			}).WithError(err).Error("backend/semtechudp: write to udp error")
+		} else {
+			atomic.AddUint64(&b.counters.bytesOut, uint64(len(p.data)))
+			b.recordTraffic(TrafficOut, p.addr, p.data)
+
+			if p.gatewayID != nil {
+				b.addGatewayBytes(*p.gatewayID, "out", len(p.data))
+			} else if p.downlinkGatewayID != nil {
+				b.addGatewayBytes(*p.downlinkGatewayID, "out", len(p.data))
+			}
+		}
+		p.setResult(err)
+
+		if pt == packets.PullResp {
+			token := binary.LittleEndian.Uint16(p.data[1:3])
+
+			// a failed write is retried as well
+			if b.txAcks != nil {
+				b.txAcks.sent(token)
+			}
+
+			if err != nil {
+				atomic.AddUint64(&b.counters.downlinksFailed, 1)
+
+				// without tx acks, the failed downlink is not sent again
+				if b.txAcks == nil && b.dutyCycle != nil {
+					b.dutyCycle.release(p.dutyCycle)
+				}
+			} else {
+				atomic.AddUint64(&b.counters.downlinksSent, 1)
+
+				// the ack latency is measured from the (last) write, thus
+				// excluding the JIT queue and the send retries
+				b.cache.Set(fmt.Sprintf("%d:sent", token), time.Now(), cache.DefaultExpiration)
+			}
+		}
+
+		udpWriteCounter(pt.String()).Inc()
+	}
+	return nil
+}
+
+// writeUDP writes the given packet to the gateway. When sending retries are
+// enabled and the write failed because of the UDP listener (see
+// isSocketError), the listener is re-opened and the packet is updated to use
+// the new listener.
+func (b *Backend) writeUDP(p *udpPacket) error {
+	if w := b.getPacketWriter(); w != nil {
+		_, err := w.WriteTo(p.data, p.addr)
+		return err
+	}
+
+	if tcpConn := b.getTCPConn(p.addr); tcpConn != nil {
+		return writeTCP(tcpConn, p.data)
+	}
+
+	conn := b.getSendConn(p.conn)
+	_, err := conn.WriteToUDP(p.data, p.addr)
+	if err == nil || b.sendRetries == 0 || !isSocketError(err) {
+		return err
+	}
+
+	log.WithError(err).WithField("addr", conn.LocalAddr()).Warning("backend/semtechudp: udp listener error, re-opening udp listener")
+	newConn, reopenErr := b.reopenConn(conn)
+	if reopenErr != nil {
+		if reopenErr != ErrBackendClosed {
+			log.WithError(reopenErr).Error("backend/semtechudp: re-open udp listener error")
+		}
+		return err
+	}
+	p.conn = newConn
+
+	return err
+}
+
+// isSocketError returns true when the given write error is caused by the
+// local UDP socket (e.g. it has been closed), instead of by the destination
+// (e.g. an ICMP unreachable reported for a single gateway).
+func isSocketError(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	opErr, ok := err.(*net.OpError)
+	if !ok || opErr.Temporary() {
+		return false
+	}
+
+	// e.g. a *net.AddrError for an invalid destination address
+	var errno syscall.Errno
+	if !errors.As(opErr.Err, &errno) {
+		return false
+	}
+
+	switch errno {
+	case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.EHOSTDOWN, syscall.ENETUNREACH,
+		syscall.EADDRNOTAVAIL, syscall.EAFNOSUPPORT, syscall.EMSGSIZE, syscall.EACCES,
+		syscall.EPERM, syscall.ENOBUFS:
+		return false
+	}
+	return true
+}
+
+// retryPacket sends the given packet again to the send goroutine after the
+// backoff of the next retry (send_retry_interval, increased with each
+// retry). The retry is not handled by the send goroutine so that the packets
+// to other gateways are not delayed. The packet is dropped when the backend
+// has been closed in the meantime.
+func (b *Backend) retryPacket(p udpPacket) {
+	p.retry++
+	time.AfterFunc(time.Duration(p.retry)*b.sendRetryInterval, func() {
+		b.RLock()
+		defer b.RUnlock()
+
+		if b.isClosed() {
+			p.setResult(ErrBackendClosed)
+			return
+		}
+
+		if p.downlinkGatewayID != nil {
+			b.sendDownlinkPacket(p)
+		} else {
+			b.udpSendChan <- p
+		}
+	})
+}
+
+// SetPacketWriter sets the writer used for sending the UDP datagrams to the
+// gateways, instead of the UDP listener(s). This makes it possible to capture
+// the outgoing packets (e.g. in tests). Set it to nil to use the UDP
+// listener(s).
+func (b *Backend) SetPacketWriter(w PacketWriter) {
+	b.connsMux.Lock()
+	defer b.connsMux.Unlock()
+	b.packetWriter = w
+}
+
+func (b *Backend) getPacketWriter() PacketWriter {
+	b.connsMux.RLock()
+	defer b.connsMux.RUnlock()
+	return b.packetWriter
+}
+
+// reopenConn closes the given UDP listener and replaces it by a new listener
+// on the same address. The gateway registry is not updated, downlinks for
+// gateways using the old listener are sent using the first listener until
+// the gateway sends its next PullData.
+func (b *Backend) reopenConn(conn *net.UDPConn) (*net.UDPConn, error) {
+	b.connsMux.Lock()
+	defer b.connsMux.Unlock()
+
+	if b.connsClosed {
+		return nil, ErrBackendClosed
+	}
+
+	if b.downlinkConn != nil && conn == b.downlinkConn {
+		addr := conn.LocalAddr().String()
+		conn.Close()
+
+		conns, err := listenUDP([]string{addr}, b.socketOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		b.downlinkConn = conns[0]
+		b.startReadPackets(conns[0])
+
+		return conns[0], nil
+	}
+
+	i := -1
+	for j, c := range b.conns {
+		if c == conn {
+			i = j
+		}
+	}
+	if i == -1 {
+		// the listener has already been replaced
+		return b.conns[0], nil
+	}
+
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	conns, err := listenUDP([]string{addr}, b.socketOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	b.conns[i] = conns[0]
+	b.startReadPackets(conns[0])
+
+	return conns[0], nil
+}
+
+func (b *Backend) handlePacket(up udpPacket) error {
+	b.RLock()
 	defer b.RUnlock()
 
-	if b.closed {
-		return nil
+	if b.isClosed() {
+		return nil
+	}
+
+	if !b.isAllowedAddr(up.addr) {
+		udpDeniedCounter().Inc()
+		log.WithField("addr", up.addr).Debug("backend/semtechudp: dropping packet from disallowed network")
+		return nil
+	}
+
+	pt, err := packets.GetPacketType(up.data)
+	if err != nil {
+		if err == packets.ErrInvalidProtocolVersion {
+			atomic.AddUint64(&b.counters.unknownPackets, 1)
+		}
+		return err
+	}
+	log.WithFields(log.Fields{
+		"addr":             up.addr,
+		"type":             pt,
+		"protocol_version": up.data[0],
+	}).Debug("backend/semtechudp: received udp packet from gateway")
+
+	udpReadCounter(pt.String()).Inc()
+
+	switch pt {
+	case packets.PushData:
+		err = b.handlePushData(up)
+	case packets.PullData:
+		err = b.handlePullData(up)
+	case packets.TXACK:
+		err = b.handleTXACK(up)
+	default:
+		atomic.AddUint64(&b.counters.unknownPackets, 1)
+		malformedPacketCounter(pt.String(), "unknown_packet_type").Inc()
+		return errors.Wrapf(ErrUnknownPacketType, "backend/semtechudp: packet type %s", pt)
+	}
+
+	switch errors.Cause(err).(type) {
+	case *packets.HeaderError:
+		malformedPacketCounter(pt.String(), "header").Inc()
+	case *packets.PayloadError:
+		malformedPacketCounter(pt.String(), "json").Inc()
+	}
+
+	// this is done after handling the packet, so that the PullData of a new
+	// gateway is counted too
+	if len(up.data) >= 12 {
+		var gatewayID lorawan.EUI64
+		copy(gatewayID[:], up.data[4:12])
+		b.addGatewayBytes(b.rewriteMAC(gatewayID), "in", len(up.data))
+	}
+
+	return err
+}
+
+// addGatewayBytes adds the given number of bytes received from ("in") or
+// sent to ("out") the given gateway to the byte counters of the gateway.
+// Bytes of unknown gateways are not tracked.
+func (b *Backend) addGatewayBytes(gatewayID lorawan.EUI64, direction string, n int) {
+	err := b.gateways.update(gatewayID, func(gw *gateway) {
+		if direction == "in" {
+			gw.bytesIn += uint64(n)
+			gw.counters.bytesIn += uint64(n)
+		} else {
+			gw.bytesOut += uint64(n)
+			gw.counters.bytesOut += uint64(n)
+		}
+	})
+	if err == nil {
+		gatewayBytesCounter(gatewayID, direction).Add(float64(n))
+	}
+}
+
+// isAllowedAddr returns true when the given address is within one of the
+// allowed networks, or when no allowed networks are configured.
+func (b *Backend) isAllowedAddr(addr *net.UDPAddr) bool {
+	if len(b.allowedNetworks) == 0 {
+		return true
+	}
+
+	for _, ipNet := range b.allowedNetworks {
+		if ipNet.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Backend) handlePullData(up udpPacket) error {
+	var p packets.PullDataPacket
+	if err := p.UnmarshalBinary(up.data); err != nil {
+		return err
+	}
+	p.GatewayMAC = b.rewriteMAC(p.GatewayMAC)
+
+	if b.requirePullData && p.GatewayMAC == (lorawan.EUI64{}) {
+		ackDroppedCounter("invalid_gateway_id").Inc()
+		log.WithField("addr", up.addr).Debug("backend/semtechudp: dropping pull data with invalid gateway id")
+		return nil
+	}
+
+	ack := packets.PullACKPacket{
+		ProtocolVersion: p.ProtocolVersion,
+		RandomToken:     p.RandomToken,
+	}
+	bytes, err := ack.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "marshal pull ack packet error")
+	}
+
+	now := b.gateways.getNow().UTC()
+
+	if existing, err := b.gateways.get(p.GatewayMAC); err == nil {
+		if b.isGatewayConflict(existing, up.addr, now) {
+			gatewayConflictCounter().Inc()
+			log.WithFields(log.Fields{
+				"gateway_id": p.GatewayMAC,
+				"addr":       existing.addr,
+				"new_addr":   up.addr,
+			}).Warning("backend/semtechudp: gateway id used from different ip addresses, possible duplicate gateway id")
+
+			if b.conflictPolicy == gatewayConflictPolicyReject {
+				return nil
+			}
+		}
+
+		if existing.protocolVersion != p.ProtocolVersion {
+			logProtocolVersionChange(p.GatewayMAC, existing.protocolVersion, p.ProtocolVersion)
+		}
+
+		// within the debounce interval the connection details are updated,
+		// but no events are emitted
+		if b.pullDataDebounce > 0 && now.Sub(existing.lastPullData) < b.pullDataDebounce {
+			err := b.gateways.update(p.GatewayMAC, func(gw *gateway) {
+				gw.addr = up.addr
+				gw.conn = up.conn
+				gw.listenerID = b.getListenerID(up.conn)
+				gw.lastSeen = now
+				gw.protocolVersion = p.ProtocolVersion
+				gw.suspect = false
+			})
+			if err == nil {
+				b.sendACK(up, p.GatewayMAC, bytes)
+				return nil
+			}
+		}
+
+		// the address is compared to the address of the last fully handled
+		// PullData, so that changes within the debounce interval are reported
+		oldAddr := existing.pullDataAddr
+		if oldAddr == nil {
+			oldAddr = existing.addr
+		}
+		if oldAddr.String() != up.addr.String() {
+			b.handleAddressChange(AddressChangeEvent{
+				GatewayID: p.GatewayMAC,
+				OldAddr:   oldAddr,
+				NewAddr:   up.addr,
+			})
+		}
+	}
+
+	err = b.gateways.set(p.GatewayMAC, gateway{
+		addr:            up.addr,
+		conn:            up.conn,
+		listenerID:      b.getListenerID(up.conn),
+		lastSeen:        now,
+		lastPullData:    now,
+		pullDataAddr:    up.addr,
+		protocolVersion: p.ProtocolVersion,
+	})
+	if err == ErrTooManyGateways {
+		// this is logged at debug level, as this might be caused by a flood
+		// of spoofed Gateway IDs
+		gatewayRejectedCounter().Inc()
+		log.WithFields(log.Fields{
+			"gateway_id": p.GatewayMAC,
+			"addr":       up.addr,
+		}).Debug("backend/semtechudp: max. number of gateways reached, dropping pull data")
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "set gateway error")
+	}
+
+	b.sendACK(up, p.GatewayMAC, bytes)
+	return nil
+}
+
+// sendACK sends the given ACK to the source of the given packet, unless the
+// ACK rate limit for the source IP has been exceeded.
+func (b *Backend) sendACK(up udpPacket, gatewayID lorawan.EUI64, data []byte) {
+	if b.ackLimiter != nil && !b.ackLimiter.allow(up.addr.IP, time.Now()) {
+		ackDroppedCounter("rate_limit").Inc()
+		return
+	}
+
+	b.udpSendChan <- udpPacket{
+		addr: up.addr,
+		data: data,
+		conn: up.conn,
+
+		gatewayID: &gatewayID,
+	}
+}
+
+// isPullDataCompleted returns true when the given source address has
+// completed a PullData for the given gateway.
+func (b *Backend) isPullDataCompleted(gatewayID lorawan.EUI64, addr *net.UDPAddr) bool {
+	g, err := b.gateways.get(gatewayID)
+	if err != nil || g.addr == nil {
+		return false
 	}
 
-	pt, err := packets.GetPacketType(up.data)
-	if err != nil {
-		return err
+	// only the IP is compared, as the packet-forwarder uses different
+	// sockets (thus source ports) for PushData and PullData
+	return g.addr.IP.Equal(addr.IP)
+}
+
+// isGatewayConflict returns true when the given address has a different IP
+// than the gateway and the gateway sent a PullData within the conflict
+// window. Port changes (e.g. NAT re-mapping) are not a conflict.
+func (b *Backend) isGatewayConflict(existing gateway, addr *net.UDPAddr, now time.Time) bool {
+	if b.conflictWindow == 0 || existing.addr == nil || existing.addr.IP.Equal(addr.IP) {
+		return false
 	}
+
+	return now.Sub(existing.lastSeen) < b.conflictWindow
+}
+
+func (b *Backend) handleAddressChange(e AddressChangeEvent) {
 	log.WithFields(log.Fields{
-		"addr":             up.addr,
-		"type":             pt,
-		"protocol_version": up.data[0],
-	}).Debug("backend/semtechudp: received udp packet from gateway")
+		"gateway_id": e.GatewayID,
+		"old_addr":   e.OldAddr,
+		"new_addr":   e.NewAddr,
+	}).Warning("backend/semtechudp: gateway address changed")
 
-	udpReadCounter(pt.String()).Inc()
+	addressChangeCounter().Inc()
 
-	switch pt {
-	case packets.PushData:
-		return b.handlePushData(up)
-	case packets.PullData:
-		return b.handlePullData(up)
-	case packets.TXACK:
-		return b.handleTXACK(up)
-	default:
-		return fmt.Errorf("backend/semtechudp: unknown packet type: %s", pt)
+	if fn := b.getHooks().addressChangeFunc; fn != nil {
+		fn(e)
 	}
 }
 
-func (b *Backend) handlePullData(up udpPacket) error {
-	var p packets.PullDataPacket
-	if err := p.UnmarshalBinary(up.data); err != nil {
-		return err
-	}
-	ack := packets.PullACKPacket{
-		ProtocolVersion: p.ProtocolVersion,
-		RandomToken:     p.RandomToken,
-	}
-	bytes, err := ack.MarshalBinary()
-	if err != nil {
-		return errors.Wrap(err, "marshal pull ack packet error")
+func (b *Backend) handleVersionChange(e VersionChangeEvent) {
+	log.WithFields(log.Fields{
+		"gateway_id":           e.GatewayID,
+		"old_protocol_version": e.OldVersion.ProtocolVersion,
+		"new_protocol_version": e.NewVersion.ProtocolVersion,
+		"old_platform":         e.OldVersion.Platform,
+		"new_platform":         e.NewVersion.Platform,
+		"old_brand":            e.OldVersion.Brand,
+		"new_brand":            e.NewVersion.Brand,
+		"old_model":            e.OldVersion.Model,
+		"new_model":            e.NewVersion.Model,
+		"old_firmware":         e.OldVersion.Firmware,
+		"new_firmware":         e.NewVersion.Firmware,
+	}).Info("backend/semtechudp: gateway version changed")
+
+	versionChangeCounter().Inc()
+
+	if fn := b.getHooks().versionChangeFunc; fn != nil {
+		fn(e)
 	}
+}
 
-	err = b.gateways.set(p.GatewayMAC, gateway{
-		addr:            up.addr,
-		lastSeen:        time.Now().UTC(),
-		protocolVersion: p.ProtocolVersion,
+// updateAckLatency updates the ack latency estimate of the given gateway
+// using the measured PullResp / TXACK round-trip. The estimate is a moving
+// average, so that a single slow ack does not dominate.
+func (b *Backend) updateAckLatency(gatewayID lorawan.EUI64, rtt time.Duration) {
+	ackLatencyHistogram().Observe(rtt.Seconds())
+
+	_ = b.gateways.update(gatewayID, func(gw *gateway) {
+		if gw.ackLatency == 0 {
+			gw.ackLatency = rtt
+		} else {
+			gw.ackLatency = (7*gw.ackLatency + rtt) / 8
+		}
 	})
-	if err != nil {
-		return errors.Wrap(err, "set gateway error")
-	}
+}
 
-	b.udpSendChan <- udpPacket{
-		addr: up.addr,
-		data: bytes,
-	}
-	return nil
+// updateUplinkSNR updates the uplink SNR average of the given gateway using
+// the LoRa SNR of the given uplink frames.
+func (b *Backend) updateUplinkSNR(gatewayID lorawan.EUI64, uplinkFrames []gw.UplinkFrame) {
+	_ = b.gateways.update(gatewayID, func(gw *gateway) {
+		for i := range uplinkFrames {
+			if uplinkFrames[i].GetTxInfo().GetModulation() != common.Modulation_LORA {
+				continue
+			}
+
+			snr := uplinkFrames[i].GetRxInfo().GetLoraSnr()
+			if !gw.hasUplinkSNR {
+				gw.uplinkSNR = snr
+				gw.hasUplinkSNR = true
+			} else {
+				gw.uplinkSNR = (7*gw.uplinkSNR + snr) / 8
+			}
+		}
+	})
+}
+
+// logProtocolVersionChange logs a change of the protocol version used by a
+// gateway, which is likely caused by a firmware update or by a second
+// packet-forwarder using the same Gateway ID.
+func logProtocolVersionChange(gatewayID lorawan.EUI64, oldVersion, newVersion uint8) {
+	log.WithFields(log.Fields{
+		"gateway_id":           gatewayID,
+		"old_protocol_version": oldVersion,
+		"new_protocol_version": newVersion,
+	}).Warning("backend/semtechudp: gateway protocol version changed")
 }
 
 func (b *Backend) handleTXACK(up udpPacket) error {
@@ -350,11 +3238,28 @@ func (b *Backend) handleTXACK(up udpPacket) error {
 	if err := p.UnmarshalBinary(up.data); err != nil {
 		return err
 	}
+	p.GatewayMAC = b.rewriteMAC(p.GatewayMAC)
+
+	acked := b.txAcks != nil && b.txAcks.ack(p.RandomToken)
+	failed := p.Payload != nil && p.Payload.TXPKACK.Error != "" && p.Payload.TXPKACK.Error != "NONE"
+
+	// the downlink was not transmitted (this also applies to SendRaw, which
+	// does not cache the downlink frame)
+	if failed && (b.txAcks == nil || acked) {
+		b.releaseDutyCycle(p.RandomToken)
+	}
 
 	// get downlink frame from cache
 	var frame gw.DownlinkFrame
 	v, ok := b.cache.Get(fmt.Sprintf("%d:frame", p.RandomToken))
 	if !ok {
+		if b.txAcks != nil && !acked {
+			log.WithFields(log.Fields{
+				"gateway_id": p.GatewayMAC,
+				"token":      p.RandomToken,
+			}).Warning("backend/semtechudp: ignoring tx ack of expired downlink")
+			return nil
+		}
 		return fmt.Errorf("no internal frame cache for token %d", p.RandomToken)
 	}
 	if df, ok := v.(gw.DownlinkFrame); ok {
@@ -392,8 +3297,20 @@ func (b *Backend) handleTXACK(up udpPacket) error {
 		return errors.New("cache items are out of sync")
 	}
 
+	// update the ack latency estimate
+	if v, ok := b.cache.Get(fmt.Sprintf("%d:sent", p.RandomToken)); ok {
+		if sent, ok := v.(time.Time); ok {
+			b.updateAckLatency(p.GatewayMAC, time.Since(sent))
+		}
+	}
+
 	// did the received ack contain an error?
-	if p.Payload != nil && p.Payload.TXPKACK.Error != "" && p.Payload.TXPKACK.Error != "NONE" {
+	if failed {
+		b.gateways.updateCounters(p.GatewayMAC, func(c *gatewayCounters) {
+			c.txAckFailed++
+		})
+		atomic.AddUint64(&b.counters.downlinksFailed, 1)
+
 		// set tx ack error
 		if v, ok := gw.TxAckStatus_value[p.Payload.TXPKACK.Error]; ok {
 			txAckItems[itemIndex] = &gw.DownlinkTXAckItem{
@@ -406,7 +3323,7 @@ func (b *Backend) handleTXACK(up udpPacket) error {
 		// can we retry?
 		if itemIndex < len(frame.Items)-1 {
 			// retry with next option
-			return b.sendDownlinkFrame(frame, itemIndex+1, txAckItems)
+			return b.sendDownlinkFrame(frame, itemIndex+1, txAckItems, nil)
 		}
 
 		// report acks
@@ -418,10 +3335,18 @@ func (b *Backend) handleTXACK(up udpPacket) error {
 		}
 	} else {
 		// no error
+		b.gateways.updateCounters(p.GatewayMAC, func(c *gatewayCounters) {
+			c.txAckOK++
+		})
+
 		txAckItems[itemIndex] = &gw.DownlinkTXAckItem{
 			Status: gw.TxAckStatus_OK,
 		}
 
+		if p.Payload != nil {
+			b.handleTXAckDeviation(p, frame)
+		}
+
 		b.downlinkTXAckChan <- gw.DownlinkTXAck{
 			GatewayId:  p.GatewayMAC[:],
 			Token:      uint32(p.RandomToken),
@@ -438,8 +3363,26 @@ func (b *Backend) handlePushData(up udpPacket) error {
 	if err := p.UnmarshalBinary(up.data); err != nil {
 		return err
 	}
+	p.GatewayMAC = b.rewriteMAC(p.GatewayMAC)
+
+	if !b.pushDataACKAfterProcessing {
+		if err := b.ackPushData(up, p); err != nil {
+			return err
+		}
+		return b.processPushData(up, p)
+	}
+
+	// the forwarder retransmits (or keeps the data) until it receives the
+	// ack, which applies backpressure
+	if err := b.processPushData(up, p); err != nil {
+		ackDroppedCounter("processing_error").Inc()
+		return err
+	}
+	return b.ackPushData(up, p)
+}
 
-	// ack the packet
+// ackPushData sends the PushACK for the given PushData packet.
+func (b *Backend) ackPushData(up udpPacket, p packets.PushDataPacket) error {
 	ack := packets.PushACKPacket{
 		ProtocolVersion: p.ProtocolVersion,
 		RandomToken:     p.RandomToken,
@@ -448,9 +3391,82 @@ func (b *Backend) handlePushData(up udpPacket) error {
 	if err != nil {
 		return err
 	}
-	b.udpSendChan <- udpPacket{
-		addr: up.addr,
-		data: bytes,
+	if b.requirePullData && !b.isPullDataCompleted(p.GatewayMAC, up.addr) {
+		ackDroppedCounter("pull_data_required").Inc()
+		log.WithFields(log.Fields{
+			"gateway_id": p.GatewayMAC,
+			"addr":       up.addr,
+		}).Debug("backend/semtechudp: no pull data received from source address, not acknowledging push data")
+	} else {
+		b.sendACK(up, p.GatewayMAC, bytes)
+	}
+
+	return nil
+}
+
+// processPushData handles the stats and uplinks of the given PushData packet.
+func (b *Backend) processPushData(up udpPacket, p packets.PushDataPacket) error {
+	var reboot *RebootEvent
+	_ = b.gateways.update(p.GatewayMAC, func(gw *gateway) {
+		if gw.protocolVersion != p.ProtocolVersion {
+			logProtocolVersionChange(p.GatewayMAC, gw.protocolVersion, p.ProtocolVersion)
+			gw.protocolVersion = p.ProtocolVersion
+		}
+		gw.jsonVersion = p.Payload.JSONVersion()
+
+		// used for estimating the gateway counter (see jit_lead_time)
+		if n := len(p.Payload.RXPK); n != 0 {
+			now := time.Now()
+			tmst := p.Payload.RXPK[n-1].Tmst
+			if b.rebootThreshold != 0 {
+				if expected, ok := getTmstReset(*gw, tmst, now, b.rebootThreshold); ok {
+					reboot = &RebootEvent{GatewayID: p.GatewayMAC, ExpectedTmst: expected, Tmst: tmst}
+
+					// the previous measurements are no longer valid
+					gw.driftTmstTime = time.Time{}
+				}
+			}
+			updateTmstDrift(gw, tmst, now)
+			gw.lastTmst = tmst
+			gw.lastTmstTime = now
+
+			gw.rxpkBatchLast = n
+			if n > gw.rxpkBatchMax {
+				gw.rxpkBatchMax = n
+			}
+		}
+	})
+
+	if reboot != nil {
+		b.handleReboot(*reboot)
+	}
+
+	// the received rxpk are counted before any of them are dropped, so that
+	// the global and per gateway counters match
+	received := p.Payload.RXPK
+	atomic.AddUint64(&b.counters.rxReceived, uint64(len(received)))
+	if len(received) != 0 {
+		b.gateways.updateCounters(p.GatewayMAC, func(c *gatewayCounters) {
+			c.rxReceived += uint32(len(received))
+
+			if b.frequencyStatsMax > 0 {
+				for _, rxpk := range received {
+					c.addRXFrequency(uint32(math.Round(rxpk.Freq*1000000)), b.frequencyStatsMax)
+				}
+			}
+		})
+	}
+
+	gc := b.getGatewayConfig(p.GatewayMAC)
+	if gc.disabled {
+		log.WithFields(log.Fields{
+			"gateway_id": p.GatewayMAC,
+		}).Debug("backend/semtechudp: gateway is disabled, dropping push data")
+		return nil
+	}
+
+	if b.rawStatsChan != nil && p.Payload.Stat != nil {
+		b.sendRawStats(p.GatewayMAC, up.data[12:])
 	}
 
 	// gateway stats
@@ -458,6 +3474,54 @@ func (b *Backend) handlePushData(up udpPacket) error {
 	if err != nil {
 		return errors.Wrap(err, "get stats error")
 	}
+	if stats != nil {
+		version := GatewayVersion{
+			ProtocolVersion: p.ProtocolVersion,
+			Platform:        p.Payload.Stat.Pfrm,
+			Brand:           p.Payload.Stat.Brand,
+			Model:           p.Payload.Stat.Model,
+			Firmware:        p.Payload.Stat.Firmware,
+		}
+
+		var versionChange *VersionChangeEvent
+		_ = b.gateways.update(p.GatewayMAC, func(gw *gateway) {
+			gw.lastStats = b.gateways.getNow()
+			updateForwardRatio(gw, p.Payload.Stat.RXNb, p.Payload.Stat.RXFW)
+
+			if gw.version != nil && *gw.version != version {
+				versionChange = &VersionChangeEvent{
+					GatewayID:  p.GatewayMAC,
+					OldVersion: *gw.version,
+					NewVersion: version,
+				}
+			}
+			gw.version = &version
+		})
+
+		if versionChange != nil {
+			b.handleVersionChange(*versionChange)
+		}
+
+		if b.ignoreStatsTime || time.Time(p.Payload.Stat.Time).IsZero() {
+			if !b.ignoreStatsTime {
+				log.WithFields(log.Fields{
+					"gateway_id": p.GatewayMAC,
+				}).Debug("backend/semtechudp: stats without time, using bridge time")
+			}
+
+			stats.Time, err = ptypes.TimestampProto(time.Now())
+			if err != nil {
+				return errors.Wrap(err, "timestamp proto error")
+			}
+		}
+	}
+	if stats != nil && !b.isValidLocation(p.GatewayMAC, *p.Payload.Stat) {
+		if b.locationValidation == locationValidationDropStats {
+			stats = nil
+		} else {
+			stats.Location = nil
+		}
+	}
 	if stats != nil {
 		// set gateway ip
 		if up.addr.IP.IsLoopback() {
@@ -472,36 +3536,405 @@ func (b *Backend) handlePushData(up udpPacket) error {
 		}
 
 		b.handleStats(p.GatewayMAC, *stats)
+		b.evaluateHealth(p.GatewayMAC, *p.Payload.Stat)
 	}
 
 	// uplink frames
-	uplinkFrames, err := p.GetUplinkFrames(b.skipCRCCheck, b.fakeRxTime)
-	if err != nil {
-		return errors.Wrap(err, "get uplink frames error")
+	fakeRxTime := gc.fakeRxTime
+	if gc.ignoreRxTime {
+		// the gateway clock is unreliable, use the bridge time instead. Note
+		// that the concentrator counter (tmst) is not affected.
+		for i := range p.Payload.RXPK {
+			p.Payload.RXPK[i].Time = nil
+		}
+		fakeRxTime = true
+	}
+	p.Payload.RXPK = b.checkRXPKSize(p.GatewayMAC, p.Payload.RXPK)
+
+	// the frames are decoded per rxpk, as an rxpk with rsig results in a
+	// frame per antenna while the forwarded rxpk are counted. The frames are
+	// filtered below, thus the rxpk and raw data are matched by uplink id.
+	var uplinkFrames []gw.UplinkFrame
+	rxpkIndex := make(map[uuid.UUID]int)
+	var rawData map[uuid.UUID]string
+	if b.rawUplinkChan != nil {
+		rawData = make(map[uuid.UUID]string)
+	}
+	for i := range p.Payload.RXPK {
+		single := p
+		single.Payload.RXPK = p.Payload.RXPK[i : i+1]
+
+		frames, rxpks, err := single.GetUplinkFramesWithRXPK(gc.skipCRCCheck, fakeRxTime)
+		if err != nil {
+			if decodeErr, ok := errors.Cause(err).(*packets.UplinkFrameError); ok {
+				uplinkDecodeErrorCounter(decodeErr.Field).Inc()
+			}
+			return errors.Wrap(err, "get uplink frames error")
+		}
+
+		for j := range frames {
+			uplinkID := uuid.FromBytesOrNil(frames[j].GetRxInfo().GetUplinkId())
+			rxpkIndex[uplinkID] = i
+			if rawData != nil {
+				rawData[uplinkID] = rxpks[j].RawData
+			}
+		}
+		uplinkFrames = append(uplinkFrames, frames...)
+	}
+
+	b.updateUplinkSNR(p.GatewayMAC, uplinkFrames)
+	uplinkFrames = filterWeakUplinkFrames(gc, uplinkFrames)
+
+	// an rxpk is forwarded when at least one of its frames is forwarded
+	forwardedRXPK := make(map[int]struct{})
+	for _, uplinkID := range b.handleUplinkFrames(uplinkFrames, b.getUplinkIngress(up), rawData) {
+		forwardedRXPK[rxpkIndex[uplinkID]] = struct{}{}
+	}
+	forwarded := len(forwardedRXPK)
+	atomic.AddUint64(&b.counters.rxForwarded, uint64(forwarded))
+
+	if forwarded != 0 {
+		b.gateways.updateCounters(p.GatewayMAC, func(c *gatewayCounters) {
+			c.rxForwarded += uint32(forwarded)
+		})
 	}
-	b.handleUplinkFrames(uplinkFrames)
 
 	return nil
 }
 
+// isValidLocation returns false when location validation is enabled and the
+// location reported by the given stat is invalid.
+func (b *Backend) isValidLocation(gatewayID lorawan.EUI64, stat packets.Stat) bool {
+	if b.locationValidation == "" {
+		return true
+	}
+
+	if stat.Lati < -90 || stat.Lati > 90 || stat.Long < -180 || stat.Long > 180 {
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"latitude":   stat.Lati,
+			"longitude":  stat.Long,
+		}).Debug("backend/semtechudp: gateway location rejected, out of range")
+		return false
+	}
+
+	noFix := stat.Lati == 0 && stat.Long == 0
+	b.locatedMux.Lock()
+	_, hadLocation := b.located[gatewayID]
+	if !noFix {
+		b.located[gatewayID] = struct{}{}
+	}
+	b.locatedMux.Unlock()
+
+	if noFix && hadLocation {
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+		}).Debug("backend/semtechudp: gateway location rejected, 0,0 reported after valid location")
+		return false
+	}
+
+	return true
+}
+
 func (b *Backend) handleStats(gatewayID lorawan.EUI64, stats gw.GatewayStats) {
-	b.gatewayStatsChan <- stats
+	counters := b.gateways.resetCounters(gatewayID)
+	if b.bridgeStats || b.frequencyStatsMax > 0 {
+		if stats.MetaData == nil {
+			stats.MetaData = make(map[string]string)
+		}
+	}
+	if b.bridgeStats {
+		counters.addToMetaData(stats.MetaData)
+		if gw, err := b.gateways.get(gatewayID); err == nil {
+			gw.addRXPKBatchToMetaData(stats.MetaData)
+			gw.addForwardRatioToMetaData(stats.MetaData)
+		}
+	}
+	if b.frequencyStatsMax > 0 {
+		counters.addFrequenciesToMetaData(stats.MetaData)
+	}
+
+	b.sendGatewayStats(stats)
+}
+
+// checkRXPKSize compares the size of the given rxpk with the length of the
+// decoded payload and applies the size mismatch policy on mismatch. The rxpk
+// without size are not checked.
+func (b *Backend) checkRXPKSize(gatewayID lorawan.EUI64, rxpk []packets.RXPK) []packets.RXPK {
+	var out []packets.RXPK
+	for i := range rxpk {
+		if rxpk[i].Size == 0 || int(rxpk[i].Size) == len(rxpk[i].Data) {
+			out = append(out, rxpk[i])
+			continue
+		}
+
+		uplinkSizeMismatchCounter().Inc()
+		logger := log.WithFields(log.Fields{
+			"gateway_id":  gatewayID,
+			"size":        rxpk[i].Size,
+			"data_size":   len(rxpk[i].Data),
+			"data_base64": base64.StdEncoding.EncodeToString(rxpk[i].Data),
+		})
+
+		if b.sizeMismatchPolicy == sizeMismatchPolicyDrop {
+			logger.Warning("backend/semtechudp: frame dropped because of size mismatch")
+			continue
+		}
+
+		logger.Warning("backend/semtechudp: frame size mismatch, frame might be truncated or corrupt")
+		out = append(out, rxpk[i])
+	}
+
+	return out
 }
 
-func (b *Backend) handleUplinkFrames(uplinkFrames []gw.UplinkFrame) error {
+// filterWeakUplinkFrames returns the uplink frames which are not below the
+// min. RSSI or (LoRa) SNR of the given gateway configuration.
+func filterWeakUplinkFrames(gc gatewayConfig, uplinkFrames []gw.UplinkFrame) []gw.UplinkFrame {
+	if gc.minRSSI == nil && gc.minSNR == nil {
+		return uplinkFrames
+	}
+
+	var out []gw.UplinkFrame
 	for i := range uplinkFrames {
-		if filters.MatchFilters(uplinkFrames[i].PhyPayload) {
-			b.uplinkFrameChan <- uplinkFrames[i]
-		} else {
+		rxInfo := uplinkFrames[i].GetRxInfo()
+
+		if gc.minRSSI != nil && int(rxInfo.GetRssi()) < *gc.minRSSI {
+			log.WithFields(log.Fields{
+				"data_base64": base64.StdEncoding.EncodeToString(uplinkFrames[i].PhyPayload),
+				"rssi":        rxInfo.GetRssi(),
+			}).Debug("backend/semtechudp: frame dropped because of min. rssi")
+			uplinkBelowThresholdCounter("rssi").Inc()
+			continue
+		}
+
+		if gc.minSNR != nil && uplinkFrames[i].GetTxInfo().GetModulation() == common.Modulation_LORA && rxInfo.GetLoraSnr() < *gc.minSNR {
+			log.WithFields(log.Fields{
+				"data_base64": base64.StdEncoding.EncodeToString(uplinkFrames[i].PhyPayload),
+				"snr":         rxInfo.GetLoraSnr(),
+			}).Debug("backend/semtechudp: frame dropped because of min. snr")
+			uplinkBelowThresholdCounter("snr").Inc()
+			continue
+		}
+
+		out = append(out, uplinkFrames[i])
+	}
+
+	return out
+}
+
+// handleUplinkFrames forwards the given uplink frames and returns the uplink
+// ids of the forwarded frames.
+func (b *Backend) handleUplinkFrames(uplinkFrames []gw.UplinkFrame, ingress UplinkIngress, rawData map[uuid.UUID]string) []uuid.UUID {
+	var forwarded []uuid.UUID
+	for i := range uplinkFrames {
+		b.logUplinkFrame(uplinkFrames[i])
+
+		if !filters.MatchFilters(uplinkFrames[i].PhyPayload) {
 			log.WithFields(log.Fields{
 				"data_base64": base64.StdEncoding.EncodeToString(uplinkFrames[i].PhyPayload),
 			}).Debug("backend/semtechudp: frame dropped because of configured filters")
+			continue
+		}
+
+		if fn := b.getHooks().uplinkFilter; fn != nil && !fn(uplinkFrames[i]) {
+			log.WithFields(log.Fields{
+				"data_base64": base64.StdEncoding.EncodeToString(uplinkFrames[i].PhyPayload),
+			}).Debug("backend/semtechudp: frame dropped by uplink filter function")
+			uplinkFilteredCounter().Inc()
+			continue
+		}
+
+		if b.discardUplinks {
+			uplinkDiscardedCounter().Inc()
+			continue
+		}
+
+		if b.uplinkSampler != nil {
+			var gatewayID lorawan.EUI64
+			copy(gatewayID[:], uplinkFrames[i].GetRxInfo().GetGatewayId())
+			if !b.uplinkSampler.forward(gatewayID, uplinkFrames[i].PhyPayload) {
+				uplinkSampledCounter().Inc()
+				continue
+			}
+		}
+
+		if fn := b.getHooks().uplinkIngressFunc; fn != nil {
+			fn(uplinkFrames[i], ingress)
+		}
+
+		// the frame is shared with the receivers once sent
+		uplinkID := uuid.FromBytesOrNil(uplinkFrames[i].GetRxInfo().GetUplinkId())
+
+		// the uplink frame channel is independent of the subscribers
+		b.uplinkSubscribers.publish(uplinkFrames[i])
+
+		if !b.sendUplinkFrame(uplinkFrames[i]) {
+			continue
+		}
+		b.mirrorUplinkFrame(uplinkFrames[i])
+		b.sendRawUplink(uplinkFrames[i], rawData)
+		forwarded = append(forwarded, uplinkID)
+	}
+
+	return forwarded
+}
+
+// sendUplinkFrame sends the given frame to the uplink channel, applying the
+// uplink_drop_when_full and uplink_stall_timeout settings. It returns false
+// when the frame was dropped.
+func (b *Backend) sendUplinkFrame(frame gw.UplinkFrame) bool {
+	if b.uplinkDropWhenFull {
+		select {
+		case b.uplinkFrameChan <- frame:
+			return true
+		default:
+			log.WithFields(log.Fields{
+				"data_base64": base64.StdEncoding.EncodeToString(frame.PhyPayload),
+			}).Warning("backend/semtechudp: uplink channel is full, frame dropped")
+			uplinkDroppedCounter().Inc()
+			return false
+		}
+	}
+
+	if b.uplinkStallTimeout == 0 {
+		b.uplinkFrameChan <- frame
+		return true
+	}
+
+	timer := time.NewTimer(b.uplinkStallTimeout)
+	defer timer.Stop()
+
+	select {
+	case b.uplinkFrameChan <- frame:
+		return true
+	case <-timer.C:
+	}
+
+	uplinkStalledCounter().Inc()
+	logFields := log.Fields{
+		"stall_timeout": b.uplinkStallTimeout,
+		"data_base64":   base64.StdEncoding.EncodeToString(frame.PhyPayload),
+	}
+
+	if b.uplinkStallPolicy == uplinkStallPolicyDrop {
+		log.WithFields(logFields).Error("backend/semtechudp: uplink consumer is stalled, frame dropped")
+		return false
+	}
+
+	log.WithFields(logFields).Error("backend/semtechudp: uplink consumer is stalled, waiting")
+	b.uplinkFrameChan <- frame
+	return true
+}
+
+// udpSocketOptions contains the (kernel) socket options of the UDP
+// listeners. A value of 0 keeps the OS default.
+type udpSocketOptions struct {
+	readBuffer  int
+	writeBuffer int
+	dscp        int
+}
+
+// listenUDP starts an UDP listener for each of the given addresses.
+func listenUDP(addrs []string, opts udpSocketOptions) ([]*net.UDPConn, error) {
+	var conns []*net.UDPConn
+
+	for _, a := range addrs {
+		addr, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			closeUDP(conns)
+			return nil, errors.Wrap(err, "resolve udp addr error")
+		}
+
+		log.WithField("addr", addr).Info("backend/semtechudp: starting gateway udp listener")
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			closeUDP(conns)
+			return nil, errors.Wrap(err, "listen udp error")
+		}
+		conns = append(conns, conn)
+
+		if opts.readBuffer != 0 {
+			if err := conn.SetReadBuffer(opts.readBuffer); err != nil {
+				closeUDP(conns)
+				return nil, errors.Wrap(err, "set read buffer error")
+			}
+		}
+		if opts.writeBuffer != 0 {
+			if err := conn.SetWriteBuffer(opts.writeBuffer); err != nil {
+				closeUDP(conns)
+				return nil, errors.Wrap(err, "set write buffer error")
+			}
+		}
+		if opts.dscp != 0 {
+			if err := setDSCP(conn, opts.dscp); err != nil {
+				closeUDP(conns)
+				return nil, err
+			}
+		}
+	}
+
+	return conns, nil
+}
+
+// findUDPConn returns the index of the listener which is bound to the given
+// address, or -1. An address with port 0 never matches, as it binds a new
+// (random) port.
+func findUDPConn(conns []*net.UDPConn, a string) int {
+	addr, err := net.ResolveUDPAddr("udp", a)
+	if err != nil || addr.Port == 0 {
+		return -1
+	}
+
+	for i, conn := range conns {
+		local, ok := conn.LocalAddr().(*net.UDPAddr)
+		if !ok || local.Port != addr.Port {
+			continue
+		}
+
+		if local.IP.Equal(addr.IP) || (local.IP.IsUnspecified() && (addr.IP == nil || addr.IP.IsUnspecified())) {
+			return i
 		}
 	}
+	return -1
+}
+
+// setDSCP sets the DSCP of the packets sent by the given socket. Both the
+// IPv4 TOS and the IPv6 traffic class are set, as a dual-stack socket sends
+// both. Only one of these needs to succeed.
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	// the DSCP is stored in the upper six bits, the lower two are used by ECN
+	tos := dscp << 2
+
+	err4 := ipv4.NewConn(conn).SetTOS(tos)
+	err6 := ipv6.NewConn(conn).SetTrafficClass(tos)
+	if err4 != nil && err6 != nil {
+		return errors.Wrap(err4, "set tos error")
+	}
 
 	return nil
 }
 
+// resolveUDPAddrs resolves the given addresses.
+func resolveUDPAddrs(addrs []string) ([]string, error) {
+	var out []string
+	for _, a := range addrs {
+		addr, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve udp addr error")
+		}
+		out = append(out, addr.String())
+	}
+	return out, nil
+}
+
+// closeUDP closes the given listeners.
+func closeUDP(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
 func getOutboundIP() (net.IP, error) {
 	// this does not actually connect to 8.8.8.8, unless the connection is
 	// used to send UDP frames
@@ -1,10 +1,15 @@
 package semtechudp
 
 import (
-	"errors"
+	"bytes"
+	"encoding/binary"
+
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -12,15 +17,20 @@ import (
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/duration"
 	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/ipv4"
 
 	"github.com/brocaar/chirpstack-api/go/v3/common"
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
 )
 
 type BackendTestSuite struct {
@@ -43,27 +53,43 @@ func (ts *BackendTestSuite) SetupTest() {
 	ts.tempDir, err = ioutil.TempDir("", "test")
 	assert.NoError(err)
 
-	var conf config.Config
-	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	ts.backend = nil
+	ts.setupBackend(func(conf *config.Config) {})
 
-	ts.backend, err = NewBackend(conf)
+	gwAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	assert.NoError(err)
 
-	ts.backendUDPAddr, err = net.ResolveUDPAddr("udp", ts.backend.conn.LocalAddr().String())
+	ts.gwUDPConn, err = net.ListenUDP("udp", gwAddr)
 	assert.NoError(err)
+	assert.NoError(ts.gwUDPConn.SetDeadline(time.Now().Add(time.Second)))
+}
 
-	gwAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+// setupBackend replaces the backend by a new backend, of which the test
+// configuration is modified by the given function. Tests must use this
+// instead of modifying the fields of the running backend, as these are read
+// by its goroutines.
+func (ts *BackendTestSuite) setupBackend(fn func(conf *config.Config)) {
+	assert := require.New(ts.T())
+
+	if ts.backend != nil {
+		assert.NoError(ts.backend.Close())
+	}
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	fn(&conf)
+
+	var err error
+	ts.backend, err = NewBackend(conf)
 	assert.NoError(err)
 
-	ts.gwUDPConn, err = net.ListenUDP("udp", gwAddr)
+	ts.backendUDPAddr, err = net.ResolveUDPAddr("udp", ts.backend.conns[0].LocalAddr().String())
 	assert.NoError(err)
-	assert.NoError(ts.gwUDPConn.SetDeadline(time.Now().Add(time.Second)))
 
-	go func() {
-		for {
-			<-ts.backend.GetSubscribeEventChan()
+	go func(c chan events.Subscribe) {
+		for range c {
 		}
-	}()
+	}(ts.backend.GetSubscribeEventChan())
 }
 
 func (ts *BackendTestSuite) TearDownTest() {
@@ -101,6 +127,289 @@ func (ts *BackendTestSuite) TestPullData() {
 	})
 }
 
+func (ts *BackendTestSuite) TestTruncatedPacket() {
+	assert := require.New(ts.T())
+
+	before := counterValue(udpTruncatedCounter("received"))
+
+	_, err := ts.gwUDPConn.WriteToUDP([]byte{2, 1, 3}, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	for i := 0; i < 100 && counterValue(udpTruncatedCounter("received")) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(before+1, counterValue(udpTruncatedCounter("received")))
+}
+
+func (ts *BackendTestSuite) TestMalformedPacket() {
+	tests := []struct {
+		Name       string
+		Data       []byte
+		PacketType string
+		Reason     string
+	}{
+		{
+			Name:       "invalid json",
+			Data:       []byte{2, 1, 2, 0, 1, 2, 3, 4, 5, 6, 7, 8, 123, 34},
+			PacketType: "PushData",
+			Reason:     "json",
+		},
+		{
+			Name:       "invalid header",
+			Data:       []byte{2, 1, 2, 2, 1, 2, 3, 4},
+			PacketType: "PullData",
+			Reason:     "header",
+		},
+		{
+			Name:       "unknown packet type",
+			Data:       []byte{2, 1, 2, 99},
+			PacketType: packets.PacketType(99).String(),
+			Reason:     "unknown_packet_type",
+		},
+	}
+
+	for _, test := range tests {
+		ts.T().Run(test.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			c := malformedPacketCounter(test.PacketType, test.Reason)
+			before := counterValue(c)
+			assert.Error(ts.backend.handlePacket(udpPacket{
+				data: test.Data,
+				addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700},
+			}))
+			assert.Equal(before+1, counterValue(c))
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestAllowedNetworks() {
+	assert := require.New(ts.T())
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.AllowedNetworks = []string{"10.0.0.0/8"}
+	})
+
+	assert.True(ts.backend.isAllowedAddr(&net.UDPAddr{IP: net.ParseIP("10.1.2.3")}))
+	assert.False(ts.backend.isAllowedAddr(&net.UDPAddr{IP: net.ParseIP("192.168.1.1")}))
+
+	before := counterValue(udpDeniedCounter())
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	for i := 0; i < 100 && counterValue(udpDeniedCounter()) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(before+1, counterValue(udpDeniedCounter()))
+
+	_, err = ts.backend.gateways.get(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+	assert.Equal(ErrGatewayUnknown, err)
+}
+
+func (ts *BackendTestSuite) TestRequirePullData() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.RequirePullData = true
+	})
+
+	ts.T().Run("PullData with invalid Gateway ID", func(t *testing.T) {
+		assert := require.New(t)
+		before := counterValue(ackDroppedCounter("invalid_gateway_id"))
+
+		p := packets.PullDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     123,
+		}
+		b, err := p.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+
+		for i := 0; i < 100 && counterValue(ackDroppedCounter("invalid_gateway_id")) == before; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(before+1, counterValue(ackDroppedCounter("invalid_gateway_id")))
+
+		_, err = ts.backend.gateways.get(lorawan.EUI64{})
+		assert.Equal(ErrGatewayUnknown, err)
+	})
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	pushDataB, err := pushData.MarshalBinary()
+	assert.NoError(err)
+
+	ts.T().Run("PushData without PullData", func(t *testing.T) {
+		assert := require.New(t)
+		before := counterValue(ackDroppedCounter("pull_data_required"))
+
+		_, err = ts.gwUDPConn.WriteToUDP(pushDataB, ts.backendUDPAddr)
+		assert.NoError(err)
+
+		for i := 0; i < 100 && counterValue(ackDroppedCounter("pull_data_required")) == before; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(before+1, counterValue(ackDroppedCounter("pull_data_required")))
+	})
+
+	ts.T().Run("PushData after PullData", func(t *testing.T) {
+		assert := require.New(t)
+
+		pullData := packets.PullDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     123,
+			GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		}
+		b, err := pullData.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+
+		i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		var pullACK packets.PullACKPacket
+		assert.NoError(pullACK.UnmarshalBinary(buf[:i]))
+
+		_, err = ts.gwUDPConn.WriteToUDP(pushDataB, ts.backendUDPAddr)
+		assert.NoError(err)
+
+		i, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		var pushACK packets.PushACKPacket
+		assert.NoError(pushACK.UnmarshalBinary(buf[:i]))
+		assert.Equal(pushData.RandomToken, pushACK.RandomToken)
+	})
+}
+
+func (ts *BackendTestSuite) TestPushDataACKAfterProcessing() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.PushDataACKAfterProcessing = true
+	})
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1, 2, 3}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	// the uplink has not been consumed yet, thus no ack
+	assert.NoError(ts.gwUDPConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.Error(err)
+
+	<-ts.backend.GetUplinkFrameChan()
+
+	assert.NoError(ts.gwUDPConn.SetReadDeadline(time.Now().Add(time.Second)))
+	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	var pushACK packets.PushACKPacket
+	assert.NoError(pushACK.UnmarshalBinary(buf[:i]))
+	assert.Equal(pushData.RandomToken, pushACK.RandomToken)
+}
+
+func (ts *BackendTestSuite) TestACKRateLimit() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.ACKRateLimit = 1
+	})
+	before := counterValue(ackDroppedCounter("rate_limit"))
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     123,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	for i := 0; i < 100 && counterValue(ackDroppedCounter("rate_limit")) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(before+1, counterValue(ackDroppedCounter("rate_limit")))
+}
+
+func (ts *BackendTestSuite) TestGetGateways() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	assert.Len(ts.backend.GetGateways(), 0)
+
+	pullData := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion1,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := pullData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	gws := ts.backend.GetGateways()
+	assert.Len(gws, 1)
+	assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, gws[0].GatewayID)
+	assert.Equal(ts.gwUDPConn.LocalAddr().String(), gws[0].Addr.String())
+	assert.Equal(packets.ProtocolVersion1, gws[0].ProtocolVersion)
+
+	ts.T().Run("PushData updates protocol version", func(t *testing.T) {
+		assert := require.New(t)
+
+		pushData := packets.PushDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     1234,
+			GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		}
+		b, err := pushData.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+		_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		// the ack is sent before the registry is updated
+		for i := 0; i < 100 && ts.backend.GetGateways()[0].ProtocolVersion != packets.ProtocolVersion2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(packets.ProtocolVersion2, ts.backend.GetGateways()[0].ProtocolVersion)
+	})
+}
+
 func (ts *BackendTestSuite) TestTXAck() {
 	testTable := []struct {
 		Name          string
@@ -200,68 +509,476 @@ func (ts *BackendTestSuite) TestTXAck() {
 	}
 }
 
-func (ts *BackendTestSuite) TestTXAckRetryFailOK() {
+func (ts *BackendTestSuite) TestTXAckDeviation() {
 	assert := require.New(ts.T())
+
+	var events []TXAckDeviationEvent
+	ts.backend.SetTXAckDeviationFunc(func(e TXAckDeviationEvent) {
+		events = append(events, e)
+	})
+	defer ts.backend.SetTXAckDeviationFunc(nil)
+
 	id, err := uuid.NewV4()
 	assert.NoError(err)
-	buf := make([]byte, 65507)
 
-	// register gateway
-	p := packets.PullDataPacket{
-		ProtocolVersion: packets.ProtocolVersion2,
-		RandomToken:     12345,
-		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	send := func(ack packets.TXPKACK) gw.DownlinkTXAck {
+		ts.backend.cache.Set("12345:ack", make([]*gw.DownlinkTXAckItem, 1), cache.DefaultExpiration)
+		ts.backend.cache.Set("12345:frame", gw.DownlinkFrame{
+			Token:      12345,
+			DownlinkId: id.Bytes(),
+			Items: []*gw.DownlinkFrameItem{
+				{},
+			},
+		}, cache.DefaultExpiration)
+		ts.backend.cache.Set("12345:index", 0, cache.DefaultExpiration)
+		ts.backend.cache.Set("12345:txpk", packets.TXPK{Powe: 14, Freq: 868.1}, cache.DefaultExpiration)
+
+		b, err := packets.TXACKPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     12345,
+			GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Payload:         &packets.TXACKPayload{TXPKACK: ack},
+		}.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+
+		return <-ts.backend.GetDownlinkTXAckChan()
 	}
-	b, err := p.MarshalBinary()
-	assert.NoError(err)
-	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
-	assert.NoError(err)
-	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
-	assert.NoError(err)
-	var ack packets.PullACKPacket
-	assert.NoError(ack.UnmarshalBinary(buf[:i]))
-	assert.Equal(p.RandomToken, ack.RandomToken)
-	assert.Equal(p.ProtocolVersion, ack.ProtocolVersion)
 
-	// set cache
-	ts.backend.cache.Set("12345:frame", gw.DownlinkFrame{
-		Items: []*gw.DownlinkFrameItem{
+	ts.T().Run("No deviation", func(t *testing.T) {
+		assert := require.New(t)
+		powe := 14
+		freq := 868.1
+
+		ack := send(packets.TXPKACK{Warn: "TX_POWER", Value: &powe, Freq: &freq})
+		assert.Equal(gw.TxAckStatus_OK, ack.Items[0].Status)
+		assert.Len(events, 0)
+	})
+
+	ts.T().Run("Power and frequency deviation", func(t *testing.T) {
+		assert := require.New(t)
+		powe := 10
+		freq := 868.3
+		beforePower := counterValue(txAckDeviationCounter("power"))
+		beforeFreq := counterValue(txAckDeviationCounter("frequency"))
+
+		ack := send(packets.TXPKACK{Warn: "TX_POWER", Value: &powe, Freq: &freq})
+		assert.Equal(gw.TxAckStatus_OK, ack.Items[0].Status)
+
+		actualFreq := uint32(868300000)
+		assert.Equal([]TXAckDeviationEvent{
 			{
-				PhyPayload: []byte{1, 2, 3, 4},
-				TxInfo: &gw.DownlinkTXInfo{
-					Frequency:  868100000,
-					Power:      14,
-					Modulation: common.Modulation_LORA,
-					ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
-						LoraModulationInfo: &gw.LoRaModulationInfo{
-							Bandwidth:             125,
-							SpreadingFactor:       7,
-							CodeRate:              "4/5",
-							PolarizationInversion: true,
-						},
-					},
-					Timing: gw.DownlinkTiming_DELAY,
-					TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
-						DelayTimingInfo: &gw.DelayTimingInfo{
-							Delay: ptypes.DurationProto(time.Second),
-						},
-					},
-					Context: []byte{0x00, 0x0f, 0x42, 0x40},
-				},
+				GatewayID:          lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+				Token:              12345,
+				DownlinkID:         id.Bytes(),
+				RequestedPower:     14,
+				ActualPower:        &powe,
+				RequestedFrequency: 868100000,
+				ActualFrequency:    &actualFreq,
 			},
-			{
-				PhyPayload: []byte{1, 2, 3, 4, 5},
-				TxInfo: &gw.DownlinkTXInfo{
-					Frequency:  868100000,
-					Power:      14,
-					Modulation: common.Modulation_LORA,
-					ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
-						LoraModulationInfo: &gw.LoRaModulationInfo{
-							Bandwidth:             125,
-							SpreadingFactor:       7,
-							CodeRate:              "4/5",
-							PolarizationInversion: true,
-						},
+		}, events)
+		assert.Equal(beforePower+1, counterValue(txAckDeviationCounter("power")))
+		assert.Equal(beforeFreq+1, counterValue(txAckDeviationCounter("frequency")))
+	})
+}
+
+func (ts *BackendTestSuite) TestAckLatency() {
+	assert := require.New(ts.T())
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	assert.NoError(ts.backend.gateways.set(gatewayID, gateway{
+		addr:     ts.gwUDPConn.LocalAddr().(*net.UDPAddr),
+		lastSeen: time.Now(),
+	}))
+
+	ts.backend.updateAckLatency(gatewayID, 100*time.Millisecond)
+	assert.Equal(100*time.Millisecond, ts.backend.GetGateways()[0].AckLatency)
+
+	ts.backend.updateAckLatency(gatewayID, 200*time.Millisecond)
+	assert.Equal(112500*time.Microsecond, ts.backend.GetGateways()[0].AckLatency)
+
+	// ack from an unknown gateway
+	ts.backend.updateAckLatency(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, time.Second)
+	assert.Len(ts.backend.GetGateways(), 1)
+}
+
+func (ts *BackendTestSuite) TestMaxAckLatency() {
+	assert := require.New(ts.T())
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.MaxAckLatency = 200 * time.Millisecond
+	})
+	rec := packetRecorder{packets: make(chan recordedPacket, 1)}
+	ts.backend.SetPacketWriter(&rec)
+
+	assert.NoError(ts.backend.gateways.set(gatewayID, gateway{
+		addr:            ts.gwUDPConn.LocalAddr().(*net.UDPAddr),
+		lastSeen:        time.Now(),
+		protocolVersion: packets.ProtocolVersion2,
+	}))
+	ts.backend.updateAckLatency(gatewayID, 500*time.Millisecond)
+
+	frame := func(timing gw.DownlinkTiming) gw.DownlinkFrame {
+		txInfo := gw.DownlinkTXInfo{
+			Frequency:  868100000,
+			Modulation: common.Modulation_FSK,
+			ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+				FskModulationInfo: &gw.FSKModulationInfo{
+					Datarate: 50000,
+				},
+			},
+			Timing: timing,
+		}
+		if timing == gw.DownlinkTiming_DELAY {
+			txInfo.TimingInfo = &gw.DownlinkTXInfo_DelayTimingInfo{
+				DelayTimingInfo: &gw.DelayTimingInfo{
+					Delay: ptypes.DurationProto(time.Second),
+				},
+			}
+			txInfo.Context = []byte{0x00, 0x0f, 0x42, 0x40}
+		}
+
+		return gw.DownlinkFrame{
+			Token:     123,
+			GatewayId: gatewayID[:],
+			Items: []*gw.DownlinkFrameItem{
+				{PhyPayload: []byte{1, 2, 3, 4}, TxInfo: &txInfo},
+			},
+		}
+	}
+
+	err := ts.backend.SendDownlinkFrame(frame(gw.DownlinkTiming_DELAY))
+	assert.Equal(ErrGatewayLatencyTooHigh, errors.Cause(err))
+
+	// the error is tracked
+	downlinkErrors := ts.backend.GetGateways()[0].DownlinkErrors
+	assert.Len(downlinkErrors, 1)
+	assert.Equal(err.Error(), downlinkErrors[0].Error)
+
+	// the latency does not affect immediate downlinks
+	assert.NoError(ts.backend.SendDownlinkFrame(frame(gw.DownlinkTiming_IMMEDIATELY)))
+	<-rec.packets
+}
+
+func (ts *BackendTestSuite) TestMaxAckLatencyJIT() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.JITLeadTime = 100 * time.Millisecond
+		conf.Backend.SemtechUDP.MaxAckLatency = 200 * time.Millisecond
+	})
+	rec := packetRecorder{packets: make(chan recordedPacket, 1)}
+	ts.backend.SetPacketWriter(&rec)
+
+	assert.NoError(ts.backend.gateways.set(gatewayID, gateway{
+		addr:            ts.gwUDPConn.LocalAddr().(*net.UDPAddr),
+		lastSeen:        time.Now(),
+		protocolVersion: packets.ProtocolVersion2,
+		lastTmst:        100000000,
+		lastTmstTime:    time.Now(),
+	}))
+
+	frame := func(token uint32, delay time.Duration) gw.DownlinkFrame {
+		return gw.DownlinkFrame{
+			Token:     token,
+			GatewayId: gatewayID[:],
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: []byte{1, 2, 3, 4},
+					TxInfo: &gw.DownlinkTXInfo{
+						Frequency:  868100000,
+						Modulation: common.Modulation_FSK,
+						ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+							FskModulationInfo: &gw.FSKModulationInfo{
+								Datarate: 50000,
+							},
+						},
+						Timing: gw.DownlinkTiming_DELAY,
+						TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+							DelayTimingInfo: &gw.DelayTimingInfo{
+								Delay: ptypes.DurationProto(delay),
+							},
+						},
+						Context: []byte{0x05, 0xf5, 0xe1, 0x00},
+					},
+				},
+			},
+		}
+	}
+
+	// the downlink is held by the JIT queue for about 900ms
+	assert.NoError(ts.backend.SendDownlinkFrame(frame(123, time.Second)))
+	assert.Equal(1, ts.backend.jit.len())
+	<-rec.packets
+
+	txAck := packets.TXACKPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     123,
+		GatewayMAC:      gatewayID,
+	}
+	b, err := txAck.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	assert.NoError(ts.gwUDPConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, _, _ = ts.gwUDPConn.ReadFromUDP(buf)
+	<-ts.backend.GetDownlinkTXAckChan()
+
+	// the hold time is not part of the ack latency, thus the next
+	// timestamped downlink is not rejected
+	g, err := ts.backend.gateways.get(gatewayID)
+	assert.NoError(err)
+	assert.NotZero(g.ackLatency)
+	assert.True(g.ackLatency < 200*time.Millisecond, g.ackLatency.String())
+	assert.NoError(ts.backend.SendDownlinkFrame(frame(124, 5*time.Second)))
+}
+
+func (ts *BackendTestSuite) TestAckLatencyMeasurement() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// the write blocks until the packet is read
+	rec := packetRecorder{packets: make(chan recordedPacket)}
+	ts.backend.SetPacketWriter(&rec)
+
+	assert.NoError(ts.backend.gateways.set(gatewayID, gateway{
+		addr:            ts.gwUDPConn.LocalAddr().(*net.UDPAddr),
+		lastSeen:        time.Now(),
+		protocolVersion: packets.ProtocolVersion2,
+	}))
+
+	assert.NoError(ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: gatewayID[:],
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	}))
+
+	// the time until the write is not part of the latency
+	time.Sleep(200 * time.Millisecond)
+	<-rec.packets
+
+	txAck := packets.TXACKPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     123,
+		GatewayMAC:      gatewayID,
+	}
+	b, err := txAck.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	assert.NoError(ts.gwUDPConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, _, _ = ts.gwUDPConn.ReadFromUDP(buf)
+	<-ts.backend.GetDownlinkTXAckChan()
+
+	g, err := ts.backend.gateways.get(gatewayID)
+	assert.NoError(err)
+	assert.NotZero(g.ackLatency)
+	assert.True(g.ackLatency < 100*time.Millisecond, g.ackLatency.String())
+}
+
+func (ts *BackendTestSuite) TestCanSend() {
+	assert := require.New(ts.T())
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.False(ts.backend.CanSend(gatewayID))
+
+	assert.NoError(ts.backend.gateways.set(gatewayID, gateway{
+		addr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700},
+		lastSeen: time.Now(),
+	}))
+	assert.True(ts.backend.CanSend(gatewayID))
+
+	// stale gateway
+	assert.NoError(ts.backend.gateways.update(gatewayID, func(gw *gateway) {
+		gw.lastSeen = time.Now().Add(-2 * time.Minute)
+	}))
+	assert.False(ts.backend.CanSend(gatewayID))
+
+	// disabled gateway
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.Gateways = map[string]config.SemtechUDPGateway{
+			"0102030405060708": {Disabled: true},
+		}
+	})
+	assert.NoError(ts.backend.gateways.set(gatewayID, gateway{
+		addr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700},
+		lastSeen: time.Now(),
+	}))
+	assert.False(ts.backend.CanSend(gatewayID))
+}
+
+func (ts *BackendTestSuite) TestBestGatewayFor() {
+	assert := require.New(ts.T())
+	addr := ts.gwUDPConn.LocalAddr().(*net.UDPAddr)
+
+	gw1 := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+	gw2 := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+	gw3 := lorawan.EUI64{3, 3, 3, 3, 3, 3, 3, 3}
+	gw4 := lorawan.EUI64{4, 4, 4, 4, 4, 4, 4, 4}
+	unknown := lorawan.EUI64{9, 9, 9, 9, 9, 9, 9, 9}
+
+	assert.NoError(ts.backend.gateways.set(gw1, gateway{addr: addr, lastSeen: time.Now()}))
+	assert.NoError(ts.backend.gateways.set(gw2, gateway{addr: addr, lastSeen: time.Now(), uplinkSNR: 5, hasUplinkSNR: true}))
+	assert.NoError(ts.backend.gateways.set(gw3, gateway{addr: addr, lastSeen: time.Now(), uplinkSNR: 5, hasUplinkSNR: true}))
+	assert.NoError(ts.backend.gateways.set(gw4, gateway{addr: addr, lastSeen: time.Now(), uplinkSNR: -5, hasUplinkSNR: true}))
+
+	tests := []struct {
+		name       string
+		candidates []lorawan.EUI64
+		txSent     map[lorawan.EUI64]uint32
+		expected   lorawan.EUI64
+		err        error
+	}{
+		{"highest snr", []lorawan.EUI64{gw1, gw4, gw2}, nil, gw2, nil},
+		{"snr tie, lowest gateway id", []lorawan.EUI64{gw3, gw2}, nil, gw2, nil},
+		{"snr tie, lowest load", []lorawan.EUI64{gw2, gw3}, map[lorawan.EUI64]uint32{gw2: 2}, gw3, nil},
+		{"unknown snr ranks last", []lorawan.EUI64{gw1, gw4}, nil, gw4, nil},
+		{"unknown candidate excluded", []lorawan.EUI64{unknown, gw1}, nil, gw1, nil},
+		{"no known candidates", []lorawan.EUI64{unknown}, nil, lorawan.EUI64{}, ErrGatewayUnknown},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			for _, gatewayID := range []lorawan.EUI64{gw1, gw2, gw3, gw4} {
+				ts.backend.gateways.resetCounters(gatewayID)
+				ts.backend.gateways.updateCounters(gatewayID, func(c *gatewayCounters) {
+					c.txSent = tst.txSent[gatewayID]
+				})
+			}
+
+			gatewayID, err := ts.backend.BestGatewayFor(tst.candidates)
+			assert.Equal(tst.err, err)
+			assert.Equal(tst.expected, gatewayID)
+		})
+	}
+
+	// the uplink snr is a moving average
+	ts.backend.updateUplinkSNR(gw1, []gw.UplinkFrame{
+		{TxInfo: &gw.UplinkTXInfo{Modulation: common.Modulation_LORA}, RxInfo: &gw.UplinkRXInfo{LoraSnr: 8}},
+		{TxInfo: &gw.UplinkTXInfo{Modulation: common.Modulation_FSK}, RxInfo: &gw.UplinkRXInfo{LoraSnr: -20}},
+		{TxInfo: &gw.UplinkTXInfo{Modulation: common.Modulation_LORA}, RxInfo: &gw.UplinkRXInfo{LoraSnr: 0}},
+	})
+	g, err := ts.backend.gateways.get(gw1)
+	assert.NoError(err)
+	assert.True(g.hasUplinkSNR)
+	assert.Equal(7.0, g.uplinkSNR)
+}
+
+func (ts *BackendTestSuite) TestSyntheticStats() {
+	assert := require.New(ts.T())
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	now := time.Now()
+
+	assert.NoError(ts.backend.gateways.set(gatewayID, gateway{
+		addr:     ts.gwUDPConn.LocalAddr().(*net.UDPAddr),
+		lastSeen: now.Add(-30 * time.Second),
+	}))
+	ts.backend.gateways.updateCounters(gatewayID, func(c *gatewayCounters) {
+		c.rxReceived = 3
+		c.rxForwarded = 2
+		c.txSent = 1
+		c.txAckOK = 1
+	})
+
+	go ts.backend.syntheticStatsLoop(10 * time.Millisecond)
+
+	stats := <-ts.backend.GetGatewayStatsChan()
+	assert.Equal(gatewayID[:], stats.GatewayId)
+	assert.Equal(uint32(3), stats.RxPacketsReceived)
+	assert.Equal(uint32(2), stats.RxPacketsReceivedOk)
+	assert.Equal(uint32(1), stats.TxPacketsReceived)
+	assert.Equal(uint32(1), stats.TxPacketsEmitted)
+	assert.Equal("true", stats.MetaData["bridge_generated"])
+	assert.Equal(now.Add(-30*time.Second).UTC().Format(time.RFC3339), stats.MetaData["bridge_last_seen"])
+	assert.Equal("30", stats.MetaData["bridge_uptime"])
+
+	// the counters have been reset
+	assert.Equal(gatewayCounters{}, ts.backend.gateways.resetCounters(gatewayID))
+}
+
+func (ts *BackendTestSuite) TestTXAckRetryFailOK() {
+	assert := require.New(ts.T())
+	id, err := uuid.NewV4()
+	assert.NoError(err)
+	buf := make([]byte, 65507)
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	var ack packets.PullACKPacket
+	assert.NoError(ack.UnmarshalBinary(buf[:i]))
+	assert.Equal(p.RandomToken, ack.RandomToken)
+	assert.Equal(p.ProtocolVersion, ack.ProtocolVersion)
+
+	// set cache
+	ts.backend.cache.Set("12345:frame", gw.DownlinkFrame{
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Power:      14,
+					Modulation: common.Modulation_LORA,
+					ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+						LoraModulationInfo: &gw.LoRaModulationInfo{
+							Bandwidth:             125,
+							SpreadingFactor:       7,
+							CodeRate:              "4/5",
+							PolarizationInversion: true,
+						},
+					},
+					Timing: gw.DownlinkTiming_DELAY,
+					TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+						DelayTimingInfo: &gw.DelayTimingInfo{
+							Delay: ptypes.DurationProto(time.Second),
+						},
+					},
+					Context: []byte{0x00, 0x0f, 0x42, 0x40},
+				},
+			},
+			{
+				PhyPayload: []byte{1, 2, 3, 4, 5},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Power:      14,
+					Modulation: common.Modulation_LORA,
+					ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+						LoraModulationInfo: &gw.LoRaModulationInfo{
+							Bandwidth:             125,
+							SpreadingFactor:       7,
+							CodeRate:              "4/5",
+							PolarizationInversion: true,
+						},
 					},
 					Timing: gw.DownlinkTiming_DELAY,
 					TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
@@ -819,144 +1536,261 @@ func (ts *BackendTestSuite) TestPushData() {
 	}
 }
 
-func (ts *BackendTestSuite) TestSendDownlinkFrame() {
-	assert := require.New(ts.T())
-	id, err := uuid.NewV4()
-	assert.NoError(err)
-
-	tmst := uint32(2000000)
+func (ts *BackendTestSuite) TestLocationValidation() {
+	buf := make([]byte, 65507)
 
 	testTable := []struct {
-		Name          string
-		DownlinkFrame gw.DownlinkFrame
-		GatewayPacket packets.PullRespPacket
-		Error         error
+		Name               string
+		LocationValidation string
+		Unregistered       bool
+		PreviousStat       *packets.Stat
+		Stat               packets.Stat
+		ExpectedStats      bool
+		ExpectedLocation   *common.Location
 	}{
 		{
-			Name: "Gateway not registered",
-			DownlinkFrame: gw.DownlinkFrame{
-				Items: []*gw.DownlinkFrameItem{
-					{
-						TxInfo: &gw.DownlinkTXInfo{
-							GatewayId: []byte{1, 1, 1, 1, 1, 1, 1, 1},
-						},
-					},
-				},
+			Name:               "valid location",
+			LocationValidation: locationValidationDropLocation,
+			Stat:               packets.Stat{Lati: 1.123, Long: 2.123, Alti: 10},
+			ExpectedStats:      true,
+			ExpectedLocation: &common.Location{
+				Latitude:  1.123,
+				Longitude: 2.123,
+				Altitude:  10,
+				Source:    common.LocationSource_GPS,
 			},
-			Error: errors.New("get gateway error: gateway does not exist"),
 		},
 		{
-			Name: "LORA",
-			DownlinkFrame: gw.DownlinkFrame{
-				Items: []*gw.DownlinkFrameItem{
-					{
-						PhyPayload: []byte{1, 2, 3, 4},
-						TxInfo: &gw.DownlinkTXInfo{
-							Frequency:  868100000,
-							Power:      14,
-							Modulation: common.Modulation_LORA,
-							ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
-								LoraModulationInfo: &gw.LoRaModulationInfo{
-									Bandwidth:             125,
-									SpreadingFactor:       7,
-									CodeRate:              "4/5",
-									PolarizationInversion: true,
-								},
-							},
-							Timing: gw.DownlinkTiming_DELAY,
-							TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
-								DelayTimingInfo: &gw.DelayTimingInfo{
-									Delay: ptypes.DurationProto(time.Second),
-								},
-							},
-							Board:   1,
-							Antenna: 2,
-							Context: []byte{0x00, 0x0f, 0x42, 0x40},
-						},
-					},
-				},
-				Token:      123,
-				DownlinkId: id[:],
-				GatewayId:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
-			},
-			GatewayPacket: packets.PullRespPacket{
-				ProtocolVersion: packets.ProtocolVersion2,
-				RandomToken:     123,
-				Payload: packets.PullRespPayload{
-					TXPK: packets.TXPK{
-						Tmst: &tmst,
-						Freq: 868.1,
-						RFCh: 0,
-						Powe: 14,
-						Modu: "LORA",
-						DatR: packets.DatR{
-							LoRa: "SF7BW125",
-						},
-						CodR: "4/5",
-						IPol: true,
-						Size: 4,
-						Data: []byte{1, 2, 3, 4},
-						Brd:  1,
-						Ant:  2,
-					},
-				},
-			},
+			Name:               "latitude out of range - drop location",
+			LocationValidation: locationValidationDropLocation,
+			Stat:               packets.Stat{Lati: 91, Long: 2.123, Alti: 10},
+			ExpectedStats:      true,
 		},
 		{
-			Name: "FSK",
-			DownlinkFrame: gw.DownlinkFrame{
-				Items: []*gw.DownlinkFrameItem{
-					{
-						PhyPayload: []byte{1, 2, 3, 4},
-						TxInfo: &gw.DownlinkTXInfo{
-							Frequency:  868100000,
-							Power:      14,
-							Modulation: common.Modulation_FSK,
-							ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
-								FskModulationInfo: &gw.FSKModulationInfo{
-									Datarate:           50000,
-									FrequencyDeviation: 25000,
-								},
-							},
-							Board:   1,
-							Antenna: 2,
-							Timing:  gw.DownlinkTiming_DELAY,
-							TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
-								DelayTimingInfo: &gw.DelayTimingInfo{
-									Delay: ptypes.DurationProto(time.Second),
-								},
-							},
-							Context: []byte{0x00, 0x0f, 0x42, 0x40},
-						},
-					},
-				},
-				Token:      123,
-				DownlinkId: id[:],
-				GatewayId:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Name:               "longitude out of range - drop stats",
+			LocationValidation: locationValidationDropStats,
+			Stat:               packets.Stat{Lati: 1.123, Long: -181, Alti: 10},
+		},
+		{
+			Name:               "0,0 after valid location - drop stats",
+			LocationValidation: locationValidationDropStats,
+			PreviousStat:       &packets.Stat{Lati: 1.123, Long: 2.123, Alti: 10},
+			Stat:               packets.Stat{Alti: 10},
+		},
+		{
+			Name:               "0,0 after valid location - unregistered gateway",
+			LocationValidation: locationValidationDropStats,
+			Unregistered:       true,
+			PreviousStat:       &packets.Stat{Lati: 1.123, Long: 2.123, Alti: 10},
+			Stat:               packets.Stat{Alti: 10},
+		},
+		{
+			Name:               "out of range - validation disabled",
+			LocationValidation: "",
+			Stat:               packets.Stat{Lati: 91, Long: 2.123, Alti: 10},
+			ExpectedStats:      true,
+			ExpectedLocation: &common.Location{
+				Latitude:  91,
+				Longitude: 2.123,
+				Altitude:  10,
+				Source:    common.LocationSource_GPS,
 			},
-			GatewayPacket: packets.PullRespPacket{
-				ProtocolVersion: packets.ProtocolVersion2,
-				RandomToken:     123,
-				Payload: packets.PullRespPayload{
-					TXPK: packets.TXPK{
-						Tmst: &tmst,
-						Freq: 868.1,
-						RFCh: 0,
-						Powe: 14,
-						Modu: "FSK",
-						FDev: 25000,
-						DatR: packets.DatR{
-							FSK: 50000,
-						},
-						Size: 4,
-						Data: []byte{1, 2, 3, 4},
-						Brd:  1,
-						Ant:  2,
+		},
+	}
+
+	for _, test := range testTable {
+		ts.T().Run(test.Name, func(t *testing.T) {
+			assert := require.New(t)
+			ts.setupBackend(func(conf *config.Config) {
+				conf.Backend.SemtechUDP.LocationValidation = test.LocationValidation
+			})
+
+			sendPacket := func(p interface{ MarshalBinary() ([]byte, error) }) {
+				b, err := p.MarshalBinary()
+				assert.NoError(err)
+				_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+				assert.NoError(err)
+				_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+				assert.NoError(err)
+			}
+			getPushData := func(stat packets.Stat) packets.PushDataPacket {
+				return packets.PushDataPacket{
+					ProtocolVersion: packets.ProtocolVersion2,
+					RandomToken:     1234,
+					GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+					Payload: packets.PushDataPayload{
+						Stat: &stat,
 					},
-				},
+				}
+			}
+
+			// register gateway
+			if !test.Unregistered {
+				sendPacket(packets.PullDataPacket{
+					ProtocolVersion: packets.ProtocolVersion2,
+					RandomToken:     12345,
+					GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+				})
+			}
+
+			if test.PreviousStat != nil {
+				sendPacket(getPushData(*test.PreviousStat))
+				<-ts.backend.GetGatewayStatsChan()
+			}
+
+			sendPacket(getPushData(test.Stat))
+
+			select {
+			case stats := <-ts.backend.GetGatewayStatsChan():
+				assert.True(test.ExpectedStats)
+				assert.Equal(test.ExpectedLocation, stats.Location)
+			case <-time.After(100 * time.Millisecond):
+				assert.False(test.ExpectedStats)
+			}
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestBridgeStats() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.BridgeStats = true
+	})
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	// uplinks, one with CRC error and one received by two antennas (a frame
+	// per antenna, counted once)
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1, 2, 3}},
+				{Stat: -1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1, 2, 3}},
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{4, 5, 6}, RSig: []packets.RSig{{Ant: 0}, {Ant: 1}}},
 			},
 		},
 	}
+	b, err = pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	for i := 0; i < 3; i++ {
+		<-ts.backend.GetUplinkFrameChan()
+	}
+
+	// stats
+	for i := 0; i < 2; i++ {
+		pushData = packets.PushDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     1234,
+			GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Payload: packets.PushDataPayload{
+				Stat: &packets.Stat{},
+			},
+		}
+		b, err = pushData.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+		_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		stats := <-ts.backend.GetGatewayStatsChan()
+		if i == 0 {
+			assert.Equal(map[string]string{
+				"bridge_rx_received":     "3",
+				"bridge_rx_forwarded":    "2",
+				"bridge_tx_sent":         "0",
+				"bridge_tx_ack_ok":       "0",
+				"bridge_tx_ack_failed":   "0",
+				"bridge_rxpk_batch_last": "3",
+				"bridge_rxpk_batch_max":  "3",
+				"bridge_bytes_in":        stats.MetaData["bridge_bytes_in"],
+				"bridge_bytes_out":       stats.MetaData["bridge_bytes_out"],
+			}, stats.MetaData)
+			assert.NotEqual("0", stats.MetaData["bridge_bytes_in"])
+		} else {
+			// counters are reset after each stats, the batch sizes are not
+			assert.Equal("0", stats.MetaData["bridge_rx_received"])
+			assert.Equal("3", stats.MetaData["bridge_rxpk_batch_last"])
+		}
+	}
+
+	gws := ts.backend.GetGateways()
+	assert.Len(gws, 1)
+	assert.Equal(3, gws[0].RXPKBatchLast)
+	assert.Equal(3, gws[0].RXPKBatchMax)
+}
+
+func (ts *BackendTestSuite) TestGatewayBytes() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	n, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	bytesIn, bytesOut := uint64(len(b)), uint64(n)
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			Stat: &packets.Stat{},
+		},
+	}
+	b, err = pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	n, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	bytesIn, bytesOut = bytesIn+uint64(len(b)), bytesOut+uint64(n)
+	<-ts.backend.GetGatewayStatsChan()
+
+	// the counters are updated after the write of the ACK
+	var gws []GatewayInfo
+	for i := 0; i < 10; i++ {
+		gws = ts.backend.GetGateways()
+		if len(gws) == 1 && gws[0].BytesIn == bytesIn && gws[0].BytesOut == bytesOut {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Len(gws, 1)
+	assert.Equal(bytesIn, gws[0].BytesIn)
+	assert.Equal(bytesOut, gws[0].BytesOut)
+}
+
+func (ts *BackendTestSuite) TestJSONVersion() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
 
 	// register gateway
 	p := packets.PullDataPacket{
@@ -968,37 +1802,3733 @@ func (ts *BackendTestSuite) TestSendDownlinkFrame() {
 	assert.NoError(err)
 	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
 	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	tests := []struct {
+		name        string
+		jver        string
+		uplinks     int
+		jsonVersion int
+	}{
+		{"rsig jver", `"jver":2,`, 2, packets.JSONVersionRSig},
+		{"legacy jver", `"jver":1,`, 1, packets.JSONVersionLegacy},
+		{"no jver", ``, 2, packets.JSONVersionLegacy},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			payload := `{` + tst.jver + `"rxpk":[{"stat":1,"freq":868.1,"datr":"SF7BW125","modu":"LORA","codr":"4/5","rssi":-50,"data":"AQ==","rsig":[{"ant":0,"rssic":-60},{"ant":1,"rssic":-70}]}]}`
+			b := append([]byte{packets.ProtocolVersion2, 1, 2, byte(packets.PushData), 1, 2, 3, 4, 5, 6, 7, 8}, payload...)
+			_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+			assert.NoError(err)
+			_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+			assert.NoError(err)
+
+			for i := 0; i < tst.uplinks; i++ {
+				<-ts.backend.GetUplinkFrameChan()
+			}
+			assert.Equal(0, len(ts.backend.GetUplinkFrameChan()))
+
+			gws := ts.backend.GetGateways()
+			assert.Len(gws, 1)
+			assert.Equal(tst.jsonVersion, gws[0].JSONVersion)
+		})
+	}
+}
 
+func (ts *BackendTestSuite) TestFrequencyStats() {
+	assert := require.New(ts.T())
 	buf := make([]byte, 65507)
-	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.FrequencyStatsMax = 2
+	})
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
 	assert.NoError(err)
-	var ack packets.PullACKPacket
-	assert.NoError(ack.UnmarshalBinary(buf[:i]))
-	assert.Equal(p.RandomToken, ack.RandomToken)
-	assert.Equal(p.ProtocolVersion, ack.ProtocolVersion)
 
-	for _, test := range testTable {
-		ts.T().Run(test.Name, func(t *testing.T) {
+	// uplinks (with CRC error, so that these are not forwarded)
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: -1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+				{Stat: -1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{2}},
+				{Stat: -1, Freq: 868.3, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{3}},
+				{Stat: -1, Freq: 868.5, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{4}},
+			},
+		},
+	}
+	b, err = pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	pushData.Payload = packets.PushDataPayload{
+		Stat: &packets.Stat{},
+	}
+	b, err = pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	stats := <-ts.backend.GetGatewayStatsChan()
+	assert.Equal(map[string]string{
+		"bridge_rx_freq_868100000": "2",
+		"bridge_rx_freq_868300000": "1",
+		"bridge_rx_freq_other":     "1",
+	}, stats.MetaData)
+}
+
+func (ts *BackendTestSuite) TestStatsTime() {
+	buf := make([]byte, 65507)
+	statsTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		ignoreStatsTime bool
+		statTime        time.Time
+		expectBridgeTS  bool
+	}{
+		{"forwarder time", false, statsTime, false},
+		{"no forwarder time", false, time.Time{}, true},
+		{"ignore stats time", true, statsTime, true},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
 			assert := require.New(t)
+			ts.setupBackend(func(conf *config.Config) {
+				conf.Backend.SemtechUDP.IgnoreStatsTime = tst.ignoreStatsTime
+			})
 
-			err := ts.backend.SendDownlinkFrame(test.DownlinkFrame)
-			if test.Error != nil {
-				assert.Error(err)
-				assert.Equal(test.Error.Error(), err.Error())
-				return
+			pushData := packets.PushDataPacket{
+				ProtocolVersion: packets.ProtocolVersion2,
+				RandomToken:     1234,
+				GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+				Payload: packets.PushDataPayload{
+					Stat: &packets.Stat{
+						Time: packets.ExpandedTime(tst.statTime),
+					},
+				},
 			}
+			b, err := pushData.MarshalBinary()
+			assert.NoError(err)
+			_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+			assert.NoError(err)
+			_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
 			assert.NoError(err)
 
-			i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+			stats := <-ts.backend.GetGatewayStatsChan()
+			statsTS, err := ptypes.Timestamp(stats.Time)
 			assert.NoError(err)
 
-			var pullResp packets.PullRespPacket
-			assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
-			assert.Equal(test.GatewayPacket, pullResp)
+			if tst.expectBridgeTS {
+				assert.True(time.Since(statsTS) < time.Minute)
+			} else {
+				assert.True(statsTime.Equal(statsTS))
+			}
 		})
 	}
 }
 
-func TestBackend(t *testing.T) {
-	suite.Run(t, new(BackendTestSuite))
+func (ts *BackendTestSuite) TestReplay() {
+	assert := require.New(ts.T())
+
+	pullData := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	pullDataB, err := pullData.MarshalBinary()
+	assert.NoError(err)
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1, 2, 3}},
+			},
+		},
+	}
+	pushDataB, err := pushData.MarshalBinary()
+	assert.NoError(err)
+
+	var buf bytes.Buffer
+	now := time.Now()
+	assert.NoError(WriteReplayRecord(&buf, now, pullDataB))
+	assert.NoError(WriteReplayRecord(&buf, now.Add(10*time.Millisecond), pushDataB))
+	assert.NoError(WriteReplayRecord(&buf, now.Add(20*time.Millisecond), []byte{1, 2}))
+
+	go func() {
+		<-ts.backend.GetUplinkFrameChan()
+	}()
+
+	stats, err := ts.backend.Replay(&buf, ts.gwUDPConn.LocalAddr().(*net.UDPAddr), true)
+	assert.NoError(err)
+	assert.Equal(ReplayStats{
+		Packets: 3,
+		Errors:  1,
+		PacketTypes: map[packets.PacketType]int{
+			packets.PullData: 1,
+			packets.PushData: 1,
+		},
+	}, stats)
+
+	_, err = ts.backend.gateways.get(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+	assert.NoError(err)
+}
+
+func (ts *BackendTestSuite) TestTrafficSink() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+	gwAddr := ts.gwUDPConn.LocalAddr().(*net.UDPAddr)
+
+	var traffic lockedBuffer
+	ts.backend.SetTrafficSink(&traffic)
+
+	pullData := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	pullDataB, err := pullData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(pullDataB, ts.backendUDPAddr)
+	assert.NoError(err)
+	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	pullACKB := buf[:i]
+
+	// pull data + pull ack
+	size := 2*trafficHeaderSize + len(pullDataB) + len(pullACKB)
+	for i := 0; i < 100 && traffic.Len() < size; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.backend.SetTrafficSink(nil)
+
+	rec, err := ReadTrafficRecord(&traffic.buf)
+	assert.NoError(err)
+	assert.Equal(TrafficIn, rec.Direction)
+	assert.Equal(gwAddr.String(), rec.Addr.String())
+	assert.Equal(pullDataB, rec.Data)
+
+	rec, err = ReadTrafficRecord(&traffic.buf)
+	assert.NoError(err)
+	assert.Equal(TrafficOut, rec.Direction)
+	assert.Equal(gwAddr.String(), rec.Addr.String())
+	assert.Equal(pullACKB, rec.Data)
+
+	_, err = ReadTrafficRecord(&traffic.buf)
+	assert.Equal(io.EOF, err)
+
+	// replay the recorded traffic
+	var replay bytes.Buffer
+	assert.NoError(WriteTrafficRecord(&replay, TrafficRecord{Time: time.Now(), Direction: TrafficIn, Addr: gwAddr, Data: pullDataB}))
+	assert.NoError(WriteTrafficRecord(&replay, TrafficRecord{Time: time.Now(), Direction: TrafficOut, Addr: gwAddr, Data: pullACKB}))
+
+	stats, err := ts.backend.ReplayTraffic(&replay, gwAddr, false)
+	assert.NoError(err)
+	assert.Equal(ReplayStats{
+		Packets: 1,
+		PacketTypes: map[packets.PacketType]int{
+			packets.PullData: 1,
+		},
+	}, stats)
+}
+
+func (ts *BackendTestSuite) TestInject() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+	addr := ts.gwUDPConn.LocalAddr().(*net.UDPAddr)
+
+	assert.NoError(ts.backend.InjectPullData(addr, packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}))
+	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	var pullACK packets.PullACKPacket
+	assert.NoError(pullACK.UnmarshalBinary(buf[:i]))
+
+	uplinkChan := make(chan gw.UplinkFrame, 1)
+	go func() {
+		uplinkChan <- <-ts.backend.GetUplinkFrameChan()
+	}()
+
+	assert.NoError(ts.backend.InjectPushData(addr, packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1, 2, 3}},
+			},
+		},
+	}))
+
+	uf := <-uplinkChan
+	assert.Equal([]byte{1, 2, 3}, uf.PhyPayload)
+
+	i, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	var pushACK packets.PushACKPacket
+	assert.NoError(pushACK.UnmarshalBinary(buf[:i]))
+	assert.Equal(uint16(1234), pushACK.RandomToken)
+}
+
+func (ts *BackendTestSuite) TestStats() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	pullData := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := pullData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+				{Stat: -1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{2}},
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{3}, RSig: []packets.RSig{{Ant: 0}, {Ant: 1}}},
+			},
+		},
+	}
+	b, err = pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	uf := <-ts.backend.GetUplinkFrameChan()
+	assert.Equal([]byte{1}, uf.PhyPayload)
+
+	// the rxpk received by two antennas results in two frames
+	for i := 0; i < 2; i++ {
+		uf = <-ts.backend.GetUplinkFrameChan()
+		assert.Equal([]byte{3}, uf.PhyPayload)
+	}
+
+	// unknown packet-type
+	_, err = ts.gwUDPConn.WriteToUDP([]byte{2, 1, 2, 99}, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	assert.NoError(ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	}))
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	for i := 0; i < 100 && ts.backend.Stats().UnknownPackets == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := ts.backend.Stats()
+	assert.Equal(1, stats.GatewaysConnected)
+	assert.EqualValues(3, stats.RXReceived)
+	assert.EqualValues(2, stats.RXForwarded)
+	assert.EqualValues(1, stats.RXDropped)
+	assert.EqualValues(1, stats.DownlinksQueued)
+	assert.EqualValues(1, stats.DownlinksSent)
+	assert.EqualValues(0, stats.DownlinksFailed)
+	assert.EqualValues(1, stats.UnknownPackets)
+	assert.True(stats.BytesIn > 0)
+	assert.True(stats.BytesOut > 0)
+	assert.True(stats.Uptime > 0)
+}
+
+func (ts *BackendTestSuite) TestSummaryLog() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	level := log.GetLevel()
+	log.SetLevel(log.InfoLevel)
+	defer log.SetLevel(level)
+
+	getSummary := func() *log.Entry {
+		for _, e := range hook.AllEntries() {
+			if e.Message == "backend/semtechudp: summary" {
+				return e
+			}
+		}
+		return nil
+	}
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	go ts.backend.summaryLogLoop(10 * time.Millisecond)
+
+	// unknown packet-type
+	_, err = ts.gwUDPConn.WriteToUDP([]byte{2, 1, 2, 99}, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	var e *log.Entry
+	for i := 0; i < 100; i++ {
+		if e = getSummary(); e != nil && e.Data["errors"] == uint64(1) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(e)
+	assert.Equal(1, e.Data["gateways_connected"])
+	assert.Equal(uint64(1), e.Data["errors"])
+	assert.Equal(uint64(1), e.Data["unknown_packets"])
+
+	ts.T().Run("Interval counters", func(t *testing.T) {
+		assert := require.New(t)
+
+		fields := getSummaryFields(BackendStats{
+			RXReceived:  10,
+			RXForwarded: 5,
+			RXDropped:   5,
+		}, BackendStats{
+			RXReceived:  12,
+			RXForwarded: 10,
+			RXDropped:   2,
+		})
+		assert.Equal(uint64(2), fields["rx_received"])
+		assert.Equal(uint64(5), fields["rx_forwarded"])
+		assert.Equal(uint64(0), fields["rx_dropped"])
+
+		fields = getSummaryFields(BackendStats{
+			RXReceived:  10,
+			RXForwarded: 5,
+			RXDropped:   5,
+		}, BackendStats{
+			RXReceived:  20,
+			RXForwarded: 12,
+			RXDropped:   8,
+		})
+		assert.Equal(uint64(3), fields["rx_dropped"])
+	})
+}
+
+// recordedPacket contains a packet written to a packetRecorder.
+type recordedPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// packetRecorder implements PacketWriter, recording the written packets.
+type packetRecorder struct {
+	packets chan recordedPacket
+
+	// err (optional) is returned for the recorded packets.
+	err error
+}
+
+func (r *packetRecorder) WriteTo(b []byte, addr net.Addr) (int, error) {
+	err := r.err
+	r.packets <- recordedPacket{data: b, addr: addr}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (ts *BackendTestSuite) TestPacketWriter() {
+	assert := require.New(ts.T())
+
+	rec := packetRecorder{packets: make(chan recordedPacket, 1)}
+	ts.backend.SetPacketWriter(&rec)
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1700}
+	assert.NoError(ts.backend.InjectPullData(addr, packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}))
+
+	p := <-rec.packets
+	assert.Equal(addr, p.addr)
+	assert.Equal([]byte{packets.ProtocolVersion2, 0x39, 0x30, byte(packets.PullACK)}, p.data)
+}
+
+func (ts *BackendTestSuite) TestSendRaw() {
+	assert := require.New(ts.T())
+
+	assert.Equal(ErrGatewayUnknown, errors.Cause(ts.backend.SendRaw(lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}, []byte(`{}`))))
+
+	rec := packetRecorder{packets: make(chan recordedPacket, 1)}
+	ts.backend.SetPacketWriter(&rec)
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1700}
+	assert.NoError(ts.backend.InjectPullData(addr, packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}))
+	<-rec.packets
+
+	assert.NoError(ts.backend.SendRaw(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, []byte(`{"imme":true,"vendor":1}`)))
+
+	p := <-rec.packets
+	assert.Equal(addr, p.addr)
+	assert.Equal(byte(packets.PullResp), p.data[3])
+	assert.Equal(`{"txpk":{"imme":true,"vendor":1}}`, string(p.data[4:]))
+}
+
+func (ts *BackendTestSuite) TestDutyCycle() {
+	assert := require.New(ts.T())
+
+	// 0.05% of an hour is 1.8s, which fits a single SF12 downlink
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.DutyCycleSubBands = []config.SemtechUDPDutyCycleSubBand{
+			{FrequencyMin: 869400000, FrequencyMax: 869650000, DutyCycle: 0.05},
+		}
+	})
+	rec := packetRecorder{packets: make(chan recordedPacket, 1)}
+	ts.backend.SetPacketWriter(&rec)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.NoError(ts.backend.InjectPullData(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1700}, packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      gatewayID,
+	}))
+	<-rec.packets
+
+	txpk := []byte(`{"imme":true,"freq":869.525,"modu":"LORA","datr":"SF12BW125","codr":"4/5","size":13}`)
+
+	before := counterValue(dutyCycleExceededCounter())
+	assert.NoError(ts.backend.SendRaw(gatewayID, txpk))
+	p := <-rec.packets
+
+	assert.Equal(ErrDutyCycleExceeded, ts.backend.SendRaw(gatewayID, txpk))
+	assert.Equal(before+1, counterValue(dutyCycleExceededCounter()))
+
+	// a downlink which was not transmitted does not use the budget
+	ack := packets.TXACKPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     binary.LittleEndian.Uint16(p.data[1:3]),
+		GatewayMAC:      gatewayID,
+		Payload: &packets.TXACKPayload{
+			TXPKACK: packets.TXPKACK{
+				Error: "TOO_LATE",
+			},
+		},
+	}
+	ackB, err := ack.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(ackB, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	sendRaw := func() error {
+		var err error
+		for i := 0; i < 100; i++ {
+			if err = ts.backend.SendRaw(gatewayID, txpk); err != ErrDutyCycleExceeded {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return err
+	}
+
+	// neither does a failed write
+	rec.err = errors.New("write error")
+	assert.NoError(sendRaw())
+	<-rec.packets
+
+	rec.err = nil
+	assert.NoError(sendRaw())
+	<-rec.packets
+	assert.Equal(ErrDutyCycleExceeded, ts.backend.SendRaw(gatewayID, txpk))
+}
+
+func (ts *BackendTestSuite) TestSendToAddr() {
+	assert := require.New(ts.T())
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.DownlinkReplayWindow = time.Minute
+	})
+	rec := packetRecorder{packets: make(chan recordedPacket, 1)}
+	ts.backend.SetPacketWriter(&rec)
+
+	// the gateway does not need to be known
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1700}
+	frame := gw.DownlinkFrame{
+		Token: 12345,
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Power:      14,
+					Modulation: common.Modulation_LORA,
+					ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+						LoraModulationInfo: &gw.LoRaModulationInfo{
+							Bandwidth:             125,
+							SpreadingFactor:       7,
+							CodeRate:              "4/5",
+							PolarizationInversion: true,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	}
+	assert.NoError(ts.backend.SendToAddr(addr, packets.ProtocolVersion2, frame))
+
+	p := <-rec.packets
+	assert.Equal(addr, p.addr)
+
+	var pullResp packets.PullRespPacket
+	assert.NoError(pullResp.UnmarshalBinary(p.data))
+	assert.Equal(packets.ProtocolVersion2, pullResp.ProtocolVersion)
+	assert.Equal(uint16(12345), pullResp.RandomToken)
+	assert.Equal([]byte{1, 2, 3, 4}, pullResp.Payload.TXPK.Data)
+
+	// the downlink passes the same checks as SendDownlinkFrame
+	assert.Equal(ErrDuplicateDownlink, errors.Cause(ts.backend.SendToAddr(addr, packets.ProtocolVersion2, frame)))
+
+	// the address is not replaced by the address of a known gateway
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	ts.backend.gateways.set(gatewayID, gateway{
+		addr:            &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1700},
+		protocolVersion: packets.ProtocolVersion2,
+		lastSeen:        time.Now(),
+	})
+	frame.GatewayId = gatewayID[:]
+	frame.Items[0].PhyPayload = []byte{5, 6, 7, 8}
+	assert.NoError(ts.backend.SendToAddr(addr, packets.ProtocolVersion1, frame))
+
+	p = <-rec.packets
+	assert.Equal(addr, p.addr)
+	assert.Equal(packets.ProtocolVersion1, p.data[0])
+
+	assert.EqualError(ts.backend.SendToAddr(addr, 3, frame), "unsupported protocol version: 3")
+	assert.EqualError(ts.backend.SendToAddr(addr, packets.ProtocolVersion2, gw.DownlinkFrame{}), "downlink frame has no items")
+}
+
+func (ts *BackendTestSuite) TestTXRFChains() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.TXRFChains = []config.SemtechUDPTXRFChain{
+			{RFChain: 0, FrequencyMin: 863000000, FrequencyMax: 867000000},
+			{RFChain: 1, FrequencyMin: 867000001, FrequencyMax: 870000000, MaxPower: 14},
+			{RFChain: 2, FrequencyMin: 867000001, FrequencyMax: 870000000},
+			{RFChain: 3, FrequencyMin: 902000000, FrequencyMax: 928000000, MaxPower: 20},
+		}
+	})
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	testTable := []struct {
+		Name      string
+		Frequency uint32
+		Power     int32
+		RFChain   uint8
+		Error     string
+	}{
+		{
+			Name:      "rf chain 0",
+			Frequency: 865000000,
+			Power:     27,
+			RFChain:   0,
+		},
+		{
+			Name:      "rf chain 1",
+			Frequency: 868100000,
+			Power:     14,
+			RFChain:   1,
+		},
+		{
+			Name:      "rf chain 2, tx power exceeds rf chain 1",
+			Frequency: 868100000,
+			Power:     20,
+			RFChain:   2,
+		},
+		{
+			Name:      "unsupported tx power",
+			Frequency: 915000000,
+			Power:     27,
+			Error:     "get tx rf chain error: no tx rf chain supports tx power 27 at frequency 915000000: tx power too high",
+		},
+		{
+			Name:      "unsupported frequency",
+			Frequency: 433175000,
+			Error:     "get tx rf chain error: no tx rf chain supports frequency 433175000: frequency unsupported",
+		},
+	}
+
+	for _, test := range testTable {
+		ts.T().Run(test.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			err := ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+				Token:     123,
+				GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: []byte{1, 2, 3, 4},
+						TxInfo: &gw.DownlinkTXInfo{
+							Frequency:  test.Frequency,
+							Power:      test.Power,
+							Modulation: common.Modulation_FSK,
+							ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+								FskModulationInfo: &gw.FSKModulationInfo{
+									Datarate: 50000,
+								},
+							},
+							Timing: gw.DownlinkTiming_IMMEDIATELY,
+						},
+					},
+				},
+			})
+			if test.Error != "" {
+				assert.Error(err)
+				assert.Equal(test.Error, err.Error())
+				return
+			}
+			assert.NoError(err)
+
+			i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+			assert.NoError(err)
+			var pullResp packets.PullRespPacket
+			assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
+			assert.Equal(test.RFChain, pullResp.Payload.TXPK.RFCh)
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestUplinkFilter() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.backend.SetUplinkFilter(func(uf gw.UplinkFrame) bool {
+		return uf.TxInfo.Frequency == 868100000
+	})
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.3, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{2}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	uf := <-ts.backend.GetUplinkFrameChan()
+	assert.Equal([]byte{2}, uf.PhyPayload)
+}
+
+func (ts *BackendTestSuite) TestMACRewrite() {
+	assert := require.New(ts.T())
+
+	rec := packetRecorder{packets: make(chan recordedPacket, 1)}
+	ts.backend.SetPacketWriter(&rec)
+
+	// reverse the byte order
+	ts.backend.SetMACRewriteFunc(func(mac lorawan.EUI64) lorawan.EUI64 {
+		var out lorawan.EUI64
+		for i := range mac {
+			out[len(mac)-1-i] = mac[i]
+		}
+		return out
+	})
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1700}
+	assert.NoError(ts.backend.InjectPullData(addr, packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}))
+	<-rec.packets
+
+	_, err := ts.backend.gateways.get(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1})
+	assert.NoError(err)
+	_, err = ts.backend.gateways.get(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+	assert.Error(err)
+
+	go func() {
+		assert.NoError(ts.backend.InjectPushData(addr, packets.PushDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     1234,
+			GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			Payload: packets.PushDataPayload{
+				RXPK: []packets.RXPK{
+					{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+				},
+			},
+		}))
+	}()
+	<-rec.packets
+
+	uf := <-ts.backend.GetUplinkFrameChan()
+	assert.Equal([]byte{8, 7, 6, 5, 4, 3, 2, 1}, uf.RxInfo.GatewayId)
+
+	// downlinks use the rewritten Gateway ID
+	assert.NoError(ts.backend.SendRaw(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, []byte(`{"imme":true}`)))
+	assert.Equal(addr, (<-rec.packets).addr)
+}
+
+func (ts *BackendTestSuite) TestUplinkIngress() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ingressChan := make(chan UplinkIngress, 1)
+	ts.backend.SetUplinkIngressFunc(func(uf gw.UplinkFrame, ingress UplinkIngress) {
+		ingressChan <- ingress
+	})
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	<-ts.backend.GetUplinkFrameChan()
+	ingress := <-ingressChan
+	assert.Equal("", ingress.ListenerID)
+	assert.Equal(ts.backendUDPAddr.String(), ingress.LocalAddr.String())
+}
+
+func (ts *BackendTestSuite) TestMinRSSISNR() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	minRSSI := -120
+	minSNR := -10.0
+
+	// the gateway override lowers the rssi threshold
+	gatewayMinRSSI := -130
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.MinRSSI = &minRSSI
+		conf.Backend.SemtechUDP.MinSNR = &minSNR
+		conf.Backend.SemtechUDP.Gateways = map[string]config.SemtechUDPGateway{
+			"0202020202020202": {MinRSSI: &gatewayMinRSSI},
+		}
+	})
+
+	rssiBefore := counterValue(uplinkBelowThresholdCounter("rssi"))
+	snrBefore := counterValue(uplinkBelowThresholdCounter("snr"))
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, RSSI: -125, LSNR: 5, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+				{Stat: 1, Freq: 868.1, RSSI: -100, LSNR: -15, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{2}},
+				{Stat: 1, Freq: 868.1, RSSI: -100, LSNR: -5, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{3}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	uf := <-ts.backend.GetUplinkFrameChan()
+	assert.Equal([]byte{3}, uf.PhyPayload)
+	assert.Equal(rssiBefore+1, counterValue(uplinkBelowThresholdCounter("rssi")))
+	assert.Equal(snrBefore+1, counterValue(uplinkBelowThresholdCounter("snr")))
+
+	pushData.GatewayMAC = [8]byte{2, 2, 2, 2, 2, 2, 2, 2}
+	pushData.Payload.RXPK = pushData.Payload.RXPK[:1]
+	b, err = pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	uf = <-ts.backend.GetUplinkFrameChan()
+	assert.Equal([]byte{1}, uf.PhyPayload)
+}
+
+func (ts *BackendTestSuite) TestSubscribe() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.SubscriberBufferSize = 1
+	})
+	a, cancelA := ts.backend.Subscribe()
+	defer cancelA()
+	b, cancelB := ts.backend.Subscribe()
+	defer cancelB()
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1, 2, 3}},
+			},
+		},
+	}
+	pb, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(pb, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	// the uplink frame channel and all subscribers receive the frame
+	assert.Equal([]byte{1, 2, 3}, (<-ts.backend.GetUplinkFrameChan()).PhyPayload)
+	assert.Equal([]byte{1, 2, 3}, (<-a).PhyPayload)
+	assert.Equal([]byte{1, 2, 3}, (<-b).PhyPayload)
+}
+
+func (ts *BackendTestSuite) TestSizeMismatch() {
+	buf := make([]byte, 65507)
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, Size: 3, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1, 2}},
+				{Stat: 1, Freq: 868.1, Size: 2, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{3, 4}},
+			},
+		},
+	}
+
+	ts.T().Run("Forward", func(t *testing.T) {
+		assert := require.New(t)
+		before := counterValue(uplinkSizeMismatchCounter())
+
+		b, err := pushData.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+		_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		uf := <-ts.backend.GetUplinkFrameChan()
+		assert.Equal([]byte{1, 2}, uf.PhyPayload)
+		uf = <-ts.backend.GetUplinkFrameChan()
+		assert.Equal([]byte{3, 4}, uf.PhyPayload)
+		assert.Equal(before+1, counterValue(uplinkSizeMismatchCounter()))
+	})
+
+	ts.T().Run("Drop", func(t *testing.T) {
+		assert := require.New(t)
+		ts.setupBackend(func(conf *config.Config) {
+			conf.Backend.SemtechUDP.SizeMismatchPolicy = sizeMismatchPolicyDrop
+		})
+		before := counterValue(uplinkSizeMismatchCounter())
+		assert.NoError(ts.backend.gateways.set(pushData.GatewayMAC, gateway{
+			addr:     ts.gwUDPConn.LocalAddr().(*net.UDPAddr),
+			lastSeen: time.Now(),
+		}))
+
+		b, err := pushData.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+		_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		uf := <-ts.backend.GetUplinkFrameChan()
+		assert.Equal([]byte{3, 4}, uf.PhyPayload)
+		assert.Equal(before+1, counterValue(uplinkSizeMismatchCounter()))
+
+		// the dropped rxpk is counted as received
+		for i := 0; i < 100; i++ {
+			if g, _ := ts.backend.gateways.get(pushData.GatewayMAC); g.counters.rxForwarded != 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		counters := ts.backend.gateways.resetCounters(pushData.GatewayMAC)
+		assert.Equal(uint32(2), counters.rxReceived)
+		assert.Equal(uint32(1), counters.rxForwarded)
+	})
+}
+
+func (ts *BackendTestSuite) TestUplinkDropWhenFull() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.UplinkDropWhenFull = true
+	})
+	before := counterValue(uplinkDroppedCounter())
+
+	// nobody is reading from the (unbuffered) uplink channel
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	for i := 0; i < 100 && counterValue(uplinkDroppedCounter()) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(before+1, counterValue(uplinkDroppedCounter()))
+}
+
+func (ts *BackendTestSuite) TestUplinkStallTimeout() {
+	assert := require.New(ts.T())
+	setupBackend := func(policy string) {
+		ts.setupBackend(func(conf *config.Config) {
+			conf.Backend.SemtechUDP.UplinkStallTimeout = 10 * time.Millisecond
+			conf.Backend.SemtechUDP.UplinkStallPolicy = policy
+		})
+	}
+
+	// nobody is reading from the (unbuffered) uplink channel
+	frame := gw.UplinkFrame{PhyPayload: []byte{1, 2, 3}}
+
+	ts.T().Run("Drop", func(t *testing.T) {
+		assert := require.New(t)
+		setupBackend(uplinkStallPolicyDrop)
+		before := counterValue(uplinkStalledCounter())
+
+		assert.False(ts.backend.sendUplinkFrame(frame))
+		assert.Equal(before+1, counterValue(uplinkStalledCounter()))
+	})
+
+	ts.T().Run("Wait", func(t *testing.T) {
+		assert := require.New(t)
+		setupBackend(uplinkStallPolicyWait)
+		before := counterValue(uplinkStalledCounter())
+
+		sent := make(chan bool)
+		go func() {
+			sent <- ts.backend.sendUplinkFrame(frame)
+		}()
+
+		for i := 0; i < 100 && counterValue(uplinkStalledCounter()) == before; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(before+1, counterValue(uplinkStalledCounter()))
+
+		// the frame is still sent once consumed
+		assert.Equal(frame.PhyPayload, (<-ts.backend.GetUplinkFrameChan()).PhyPayload)
+		assert.True(<-sent)
+	})
+
+	assert.Equal(0, len(ts.backend.GetUplinkFrameChan()))
+}
+
+func (ts *BackendTestSuite) TestDiscardUplinks() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.DiscardUplinks = true
+	})
+	before := counterValue(uplinkDiscardedCounter())
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			Stat: &packets.Stat{
+				Time: packets.ExpandedTime(time.Now().UTC()),
+			},
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	// stats are still forwarded
+	stats := <-ts.backend.GetGatewayStatsChan()
+	assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8}, stats.GatewayId)
+
+	for i := 0; i < 100 && counterValue(uplinkDiscardedCounter()) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(before+1, counterValue(uplinkDiscardedCounter()))
+}
+
+func (ts *BackendTestSuite) TestGatewayConfig() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	skipCRCCheck := true
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.Gateways = map[string]config.SemtechUDPGateway{
+			"0102030405060708": {SkipCRCCheck: &skipCRCCheck},
+			"0807060504030201": {Disabled: true},
+			"0202020202020202": {IgnoreRxTime: true},
+		}
+	})
+
+	ts.T().Run("Disabled gateway", func(t *testing.T) {
+		assert := require.New(t)
+
+		pushData := packets.PushDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     1234,
+			GatewayMAC:      [8]byte{8, 7, 6, 5, 4, 3, 2, 1},
+			Payload: packets.PushDataPayload{
+				RXPK: []packets.RXPK{
+					{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+				},
+			},
+		}
+		b, err := pushData.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+		_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		err = ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+			Token:     123,
+			GatewayId: []byte{8, 7, 6, 5, 4, 3, 2, 1},
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: []byte{1, 2, 3, 4},
+					TxInfo: &gw.DownlinkTXInfo{
+						Frequency:  868100000,
+						Modulation: common.Modulation_FSK,
+						ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+							FskModulationInfo: &gw.FSKModulationInfo{
+								Datarate: 50000,
+							},
+						},
+						Timing: gw.DownlinkTiming_IMMEDIATELY,
+					},
+				},
+			},
+		})
+		assert.EqualError(err, "gateway 0807060504030201: gateway is disabled")
+		assert.True(errors.Is(err, ErrGatewayDisabled))
+	})
+
+	ts.T().Run("Skip CRC check override", func(t *testing.T) {
+		assert := require.New(t)
+
+		pushData := packets.PushDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     1234,
+			GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Payload: packets.PushDataPayload{
+				RXPK: []packets.RXPK{
+					{Stat: -1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{2}},
+				},
+			},
+		}
+		b, err := pushData.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+		_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		// the uplink of the disabled gateway must not be forwarded
+		uf := <-ts.backend.GetUplinkFrameChan()
+		assert.Equal([]byte{2}, uf.PhyPayload)
+	})
+
+	ts.T().Run("Ignore RX time", func(t *testing.T) {
+		assert := require.New(t)
+
+		rxTime := packets.CompactTime(time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC))
+		pushData := packets.PushDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     1234,
+			GatewayMAC:      [8]byte{2, 2, 2, 2, 2, 2, 2, 2},
+			Payload: packets.PushDataPayload{
+				RXPK: []packets.RXPK{
+					{Time: &rxTime, Tmst: 5000, Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{3}},
+				},
+			},
+		}
+		b, err := pushData.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+		_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		uf := <-ts.backend.GetUplinkFrameChan()
+		assert.Equal([]byte{3}, uf.PhyPayload)
+		assert.Equal([]byte{0x00, 0x00, 0x13, 0x88}, uf.RxInfo.Context)
+
+		ufTime, err := ptypes.Timestamp(uf.RxInfo.Time)
+		assert.NoError(err)
+		assert.True(time.Since(ufTime) < time.Minute)
+	})
+
+	assert.Equal(gatewayConfig{}, ts.backend.getGatewayConfig(lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}))
+}
+
+func (ts *BackendTestSuite) TestSendDownlinkFrameWithResult() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	result, err := ts.backend.SendDownlinkFrameWithResult(gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	})
+	assert.NoError(err)
+
+	select {
+	case err := <-result:
+		assert.NoError(err)
+	case <-time.After(time.Second):
+		assert.Fail("timeout waiting for send result")
+	}
+
+	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	var pullResp packets.PullRespPacket
+	assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
+	assert.Equal(uint16(123), pullResp.RandomToken)
+}
+
+func (ts *BackendTestSuite) TestAddressChange() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	eventChan := make(chan AddressChangeEvent, 1)
+	ts.backend.SetAddressChangeFunc(func(e AddressChangeEvent) {
+		eventChan <- e
+	})
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	// the gateway re-appears from a different source address
+	newAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	assert.NoError(err)
+	newConn, err := net.ListenUDP("udp", newAddr)
+	assert.NoError(err)
+	defer newConn.Close()
+	assert.NoError(newConn.SetDeadline(time.Now().Add(time.Second)))
+
+	_, err = newConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = newConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	e := <-eventChan
+	assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, e.GatewayID)
+	assert.Equal(ts.gwUDPConn.LocalAddr().String(), e.OldAddr.String())
+	assert.Equal(newConn.LocalAddr().String(), e.NewAddr.String())
+
+	// downlinks are sent to the new address
+	err = ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	})
+	assert.NoError(err)
+
+	i, _, err := newConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	var pullResp packets.PullRespPacket
+	assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
+}
+
+func (ts *BackendTestSuite) TestGatewayConflict() {
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      gatewayID,
+	}
+	addrA := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1700}
+	addrAPort := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1701}
+	addrB := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1700}
+
+	// setupBackend sets up the backend using the given conflict policy and
+	// registers the gateway using addrA.
+	setupBackend := func(assert *require.Assertions, policy string) *packetRecorder {
+		ts.setupBackend(func(conf *config.Config) {
+			conf.Backend.SemtechUDP.GatewayConflictWindow = time.Minute
+			conf.Backend.SemtechUDP.GatewayConflictPolicy = policy
+		})
+
+		rec := packetRecorder{packets: make(chan recordedPacket, 1)}
+		ts.backend.SetPacketWriter(&rec)
+
+		assert.NoError(ts.backend.InjectPullData(addrA, p))
+		<-rec.packets
+		return &rec
+	}
+
+	ts.T().Run("Port change", func(t *testing.T) {
+		assert := require.New(t)
+		rec := setupBackend(assert, gatewayConflictPolicyReject)
+		before := counterValue(gatewayConflictCounter())
+
+		assert.NoError(ts.backend.InjectPullData(addrAPort, p))
+		<-rec.packets
+		assert.Equal(before, counterValue(gatewayConflictCounter()))
+	})
+
+	ts.T().Run("Reject", func(t *testing.T) {
+		assert := require.New(t)
+		rec := setupBackend(assert, gatewayConflictPolicyReject)
+		before := counterValue(gatewayConflictCounter())
+
+		assert.NoError(ts.backend.InjectPullData(addrB, p))
+		assert.Equal(before+1, counterValue(gatewayConflictCounter()))
+		assert.Len(rec.packets, 0)
+
+		gw, err := ts.backend.gateways.get(gatewayID)
+		assert.NoError(err)
+		assert.Equal(addrA, gw.addr)
+	})
+
+	ts.T().Run("Accept", func(t *testing.T) {
+		assert := require.New(t)
+		rec := setupBackend(assert, gatewayConflictPolicyAccept)
+		before := counterValue(gatewayConflictCounter())
+
+		assert.NoError(ts.backend.InjectPullData(addrB, p))
+		<-rec.packets
+		assert.Equal(before+1, counterValue(gatewayConflictCounter()))
+
+		gw, err := ts.backend.gateways.get(gatewayID)
+		assert.NoError(err)
+		assert.Equal(addrB, gw.addr)
+	})
+}
+
+func (ts *BackendTestSuite) TestPullDataDebounce() {
+	assert := require.New(ts.T())
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.PullDataDebounce = time.Minute
+	})
+
+	eventChan := make(chan AddressChangeEvent, 1)
+	ts.backend.SetAddressChangeFunc(func(e AddressChangeEvent) {
+		eventChan <- e
+	})
+
+	rec := packetRecorder{packets: make(chan recordedPacket, 1)}
+	ts.backend.SetPacketWriter(&rec)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      gatewayID,
+	}
+	addrA := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1700}
+	addrB := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1700}
+
+	assert.NoError(ts.backend.InjectPullData(addrA, p))
+	<-rec.packets
+	gwA, err := ts.backend.gateways.get(gatewayID)
+	assert.NoError(err)
+
+	// within the debounce interval, the address is updated without events
+	time.Sleep(time.Millisecond)
+	assert.NoError(ts.backend.InjectPullData(addrB, p))
+	assert.Equal(addrB, (<-rec.packets).addr)
+	gwB, err := ts.backend.gateways.get(gatewayID)
+	assert.NoError(err)
+	assert.Equal(addrB, gwB.addr)
+	assert.True(gwB.lastSeen.After(gwA.lastSeen))
+	assert.Equal(gwA.lastPullData, gwB.lastPullData)
+	assert.Len(eventChan, 0)
+
+	// after the debounce interval, the PullData is fully handled
+	assert.NoError(ts.backend.gateways.update(gatewayID, func(gw *gateway) {
+		gw.lastPullData = gw.lastPullData.Add(-time.Minute)
+	}))
+	assert.NoError(ts.backend.InjectPullData(addrB, p))
+	<-rec.packets
+
+	e := <-eventChan
+	assert.Equal(addrA, e.OldAddr)
+	assert.Equal(addrB, e.NewAddr)
+}
+
+func (ts *BackendTestSuite) TestGetUplinkIndices() {
+	assert := require.New(ts.T())
+
+	loraFrame := func(freq uint32, sf uint32) gw.UplinkFrame {
+		return gw.UplinkFrame{
+			TxInfo: &gw.UplinkTXInfo{
+				Frequency:  freq,
+				Modulation: common.Modulation_LORA,
+				ModulationInfo: &gw.UplinkTXInfo_LoraModulationInfo{
+					LoraModulationInfo: &gw.LoRaModulationInfo{
+						Bandwidth:       125,
+						SpreadingFactor: sf,
+					},
+				},
+			},
+		}
+	}
+
+	_, err := ts.backend.GetUplinkIndices(loraFrame(868100000, 7))
+	assert.EqualError(err, "no region configured")
+
+	eu868, err := band.GetConfig(band.EU_863_870, false, lorawan.DwellTimeNoLimit)
+	assert.NoError(err)
+	ts.backend.SetBand(eu868)
+
+	tests := []struct {
+		name     string
+		frame    gw.UplinkFrame
+		expected UplinkIndices
+		err      string
+	}{
+		{"default channel", loraFrame(868300000, 7), UplinkIndices{DR: 5, Channel: 1}, ""},
+		{"extra channel", loraFrame(867100000, 12), UplinkIndices{DR: 0, Channel: -1}, ""},
+		{"fsk", gw.UplinkFrame{
+			TxInfo: &gw.UplinkTXInfo{
+				Frequency:  868800000,
+				Modulation: common.Modulation_FSK,
+				ModulationInfo: &gw.UplinkTXInfo_FskModulationInfo{
+					FskModulationInfo: &gw.FSKModulationInfo{
+						Datarate: 50000,
+					},
+				},
+			},
+		}, UplinkIndices{DR: 7, Channel: -1}, ""},
+		{"invalid data-rate", loraFrame(868100000, 6), UplinkIndices{}, "get data-rate index error: lorawan/band: data-rate not found"},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			indices, err := ts.backend.GetUplinkIndices(tst.frame)
+			if tst.err != "" {
+				assert.EqualError(err, tst.err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tst.expected, indices)
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestCheckDownlinkPayloadSize() {
+	assert := require.New(ts.T())
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.Region = string(band.EU_863_870)
+		conf.Backend.SemtechUDP.CheckDownlinkPayloadSize = true
+	})
+
+	frame := func(sf uint32, size int) gw.DownlinkFrame {
+		return gw.DownlinkFrame{
+			Token: 123,
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: make([]byte, size),
+					TxInfo: &gw.DownlinkTXInfo{
+						Frequency:  868100000,
+						Power:      14,
+						Modulation: common.Modulation_LORA,
+						ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+							LoraModulationInfo: &gw.LoRaModulationInfo{
+								Bandwidth:             125,
+								SpreadingFactor:       sf,
+								CodeRate:              "4/5",
+								PolarizationInversion: true,
+							},
+						},
+						Timing: gw.DownlinkTiming_IMMEDIATELY,
+					},
+				},
+			},
+		}
+	}
+
+	// DR0 (SF12): max. MACPayload of 59 bytes
+	assert.NoError(ts.backend.ValidateDownlinkFrame(frame(12, 64)))
+	err := ts.backend.ValidateDownlinkFrame(frame(12, 65))
+	assert.Equal(ErrPayloadTooLarge, errors.Cause(err))
+	assert.EqualError(err, "item 0: phypayload size 65 exceeds max size 64 for data-rate 0: payload too large")
+
+	// DR5 (SF7): max. MACPayload of 250 bytes
+	assert.NoError(ts.backend.ValidateDownlinkFrame(frame(7, 65)))
+
+	// the check is also applied when sending
+	assert.NoError(ts.backend.gateways.set(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, gateway{
+		addr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700},
+		lastSeen: time.Now(),
+	}))
+	f := frame(12, 65)
+	f.GatewayId = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.Equal(ErrPayloadTooLarge, errors.Cause(ts.backend.SendDownlinkFrame(f)))
+}
+
+func (ts *BackendTestSuite) TestCheckDownlinkDataRate() {
+	assert := require.New(ts.T())
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.Region = string(band.US_902_928)
+		conf.Backend.SemtechUDP.CheckDownlinkDataRate = true
+	})
+
+	frame := func(freq uint32, sf, bw uint32) gw.DownlinkFrame {
+		return gw.DownlinkFrame{
+			Token:     123,
+			GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: []byte{1, 2, 3},
+					TxInfo: &gw.DownlinkTXInfo{
+						Frequency:  freq,
+						Power:      20,
+						Modulation: common.Modulation_LORA,
+						ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+							LoraModulationInfo: &gw.LoRaModulationInfo{
+								Bandwidth:             bw,
+								SpreadingFactor:       sf,
+								CodeRate:              "4/5",
+								PolarizationInversion: true,
+							},
+						},
+						Timing: gw.DownlinkTiming_IMMEDIATELY,
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		frame gw.DownlinkFrame
+		error string
+	}{
+		{
+			name:  "valid rx1",
+			frame: frame(923900000, 10, 500),
+		},
+		{
+			name:  "valid rx2",
+			frame: frame(923300000, 12, 500),
+		},
+		{
+			name:  "uplink only data-rate",
+			frame: frame(923300000, 10, 125),
+			error: "data-rate is not a downlink data-rate of US915: invalid downlink data-rate",
+		},
+		{
+			name:  "invalid frequency",
+			frame: frame(868100000, 12, 500),
+			error: "frequency 868100000 is not a downlink channel of US915: invalid downlink data-rate",
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			err := ts.backend.ValidateDownlinkFrame(tst.frame)
+			if tst.error == "" {
+				assert.NoError(err)
+				return
+			}
+
+			assert.Equal(ErrInvalidDownlinkDatarate, errors.Cause(err))
+			assert.EqualError(err, "item 0: "+tst.error)
+		})
+	}
+
+	// the check is also applied when sending
+	assert.NoError(ts.backend.gateways.set(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, gateway{
+		addr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700},
+		lastSeen: time.Now(),
+	}))
+	assert.Equal(ErrInvalidDownlinkDatarate, errors.Cause(ts.backend.SendDownlinkFrame(frame(923300000, 10, 125))))
+}
+
+func (ts *BackendTestSuite) TestValidateDownlinkFrame() {
+	eu868, err := band.GetConfig(band.EU_863_870, false, lorawan.DwellTimeNoLimit)
+	require.NoError(ts.T(), err)
+
+	loraTXInfo := func(freq uint32, power int32, sf uint32) *gw.DownlinkTXInfo {
+		return &gw.DownlinkTXInfo{
+			Frequency:  freq,
+			Power:      power,
+			Modulation: common.Modulation_LORA,
+			ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+				LoraModulationInfo: &gw.LoRaModulationInfo{
+					Bandwidth:             125,
+					SpreadingFactor:       sf,
+					CodeRate:              "4/5",
+					PolarizationInversion: true,
+				},
+			},
+			Timing: gw.DownlinkTiming_IMMEDIATELY,
+		}
+	}
+
+	tests := []struct {
+		Name   string
+		Band   band.Band
+		TXInfo *gw.DownlinkTXInfo
+		Error  string
+	}{
+		{
+			Name:   "valid without band",
+			TXInfo: loraTXInfo(868100000, 30, 13),
+		},
+		{
+			Name:   "valid",
+			Band:   eu868,
+			TXInfo: loraTXInfo(868100000, 14, 7),
+		},
+		{
+			Name:   "invalid data-rate",
+			Band:   eu868,
+			TXInfo: loraTXInfo(868100000, 14, 13),
+			Error:  "item 0: invalid data-rate: lorawan/band: data-rate not found",
+		},
+		{
+			Name:   "invalid tx power",
+			Band:   eu868,
+			TXInfo: loraTXInfo(868100000, 20, 7),
+			Error:  "item 0: tx power 20 exceeds max tx power 14: tx power too high",
+		},
+		{
+			Name:   "invalid modulation info",
+			TXInfo: &gw.DownlinkTXInfo{Modulation: common.Modulation_LORA},
+			Error:  "item 0: get PullRespPacket error: gateway: lora_modulation_info must not be nil",
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+			ts.backend.SetBand(tst.Band)
+
+			err := ts.backend.ValidateDownlinkFrame(gw.DownlinkFrame{
+				Token: 123,
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: []byte{1, 2, 3, 4},
+						TxInfo:     tst.TXInfo,
+					},
+				},
+			})
+			if tst.Error != "" {
+				assert.EqualError(err, tst.Error)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestTXAckRetries() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.TXAckTimeout = 50 * time.Millisecond
+		conf.Backend.SemtechUDP.TXAckRetries = 1
+	})
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	err = ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+		Token:      123,
+		DownlinkId: []byte{1, 2, 3, 4},
+		GatewayId:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	})
+	assert.NoError(err)
+
+	// the gateway does not send a TXACK, the PullResp is sent again
+	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	first := append([]byte(nil), buf[:i]...)
+
+	i, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	assert.Equal(first, buf[:i])
+
+	ack := <-ts.backend.GetDownlinkTXAckChan()
+	assert.Equal(ErrTXUnconfirmed.Error(), ack.Error)
+	assert.EqualValues(123, ack.Token)
+	assert.Equal([]byte{1, 2, 3, 4}, ack.DownlinkId)
+	assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8}, ack.GatewayId)
+	assert.Equal(0, ts.backend.txAcks.len())
+
+	// a late TXACK does not report the downlink again
+	txAck := packets.TXACKPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     123,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err = txAck.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	select {
+	case ack := <-ts.backend.GetDownlinkTXAckChan():
+		assert.Fail("unexpected tx ack", "%+v", ack)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// reporting an expired downlink does not block after close
+	assert.NoError(ts.backend.Close())
+	done := make(chan struct{})
+	go func() {
+		ts.backend.expireTXAck(124, lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("expire tx ack blocked")
+	}
+}
+
+func (ts *BackendTestSuite) TestVersionChange() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	changes := make(chan VersionChangeEvent, 1)
+	ts.backend.SetVersionChangeFunc(func(e VersionChangeEvent) {
+		changes <- e
+	})
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	sendStats := func(protocolVersion uint8, firmware string) {
+		pushData := packets.PushDataPacket{
+			ProtocolVersion: protocolVersion,
+			RandomToken:     1234,
+			GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			Payload: packets.PushDataPayload{
+				Stat: &packets.Stat{
+					Brand:    "ACME",
+					Model:    "GW1",
+					Firmware: firmware,
+				},
+			},
+		}
+		b, err := pushData.MarshalBinary()
+		assert.NoError(err)
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+		_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		<-ts.backend.GetGatewayStatsChan()
+	}
+
+	// first and unchanged stats
+	sendStats(packets.ProtocolVersion2, "1.0.0")
+	sendStats(packets.ProtocolVersion2, "1.0.0")
+	assert.Len(changes, 0)
+
+	sendStats(packets.ProtocolVersion2, "1.1.0")
+	assert.Equal(VersionChangeEvent{
+		GatewayID:  lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		OldVersion: GatewayVersion{ProtocolVersion: 2, Brand: "ACME", Model: "GW1", Firmware: "1.0.0"},
+		NewVersion: GatewayVersion{ProtocolVersion: 2, Brand: "ACME", Model: "GW1", Firmware: "1.1.0"},
+	}, <-changes)
+
+	sendStats(packets.ProtocolVersion1, "1.1.0")
+	e := <-changes
+	assert.Equal(uint8(2), e.OldVersion.ProtocolVersion)
+	assert.Equal(uint8(1), e.NewVersion.ProtocolVersion)
+}
+
+func (ts *BackendTestSuite) TestRawStats() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.RawStatsBufferSize = 1
+	})
+
+	// PushData with a vendor-specific stat field
+	b := append([]byte{2, 0, 123, 0, 1, 2, 3, 4, 5, 6, 7, 8}, []byte(`{"stat":{"time":"2015-01-12 08:59:28 GMT","rxnb":3,"temp":42.5}}`)...)
+	_, err := ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	raw := <-ts.backend.GetRawStatsChan()
+	assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, raw.GatewayID)
+	assert.JSONEq(`{"time":"2015-01-12 08:59:28 GMT","rxnb":3,"temp":42.5}`, string(raw.Stat))
+
+	// the parsed stats are still sent
+	stats := <-ts.backend.GetGatewayStatsChan()
+	assert.EqualValues(3, stats.RxPacketsReceived)
+
+	// full channel is not blocking
+	ts.backend.rawStatsChan <- RawStats{}
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	<-ts.backend.GetGatewayStatsChan()
+}
+
+func (ts *BackendTestSuite) TestRawUplink() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.RawUplinkBufferSize = 1
+	})
+
+	b := append([]byte{2, 0, 123, 0, 1, 2, 3, 4, 5, 6, 7, 8}, []byte(`{"rxpk":[{"stat":1,"freq":868.1,"datr":"SF7BW125","size":4,"data":"AQIDBA=="}]}`)...)
+	_, err := ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	uf := <-ts.backend.GetUplinkFrameChan()
+	assert.Equal([]byte{1, 2, 3, 4}, uf.PhyPayload)
+
+	raw := <-ts.backend.GetRawUplinkChan()
+	assert.Equal(RawUplink{
+		GatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		UplinkID:  uuid.FromBytesOrNil(uf.RxInfo.UplinkId),
+		Data:      "AQIDBA==",
+	}, raw)
+
+	// full channel is not blocking
+	before := counterValue(rawUplinkDroppedCounter())
+	ts.backend.rawUplinkChan <- RawUplink{}
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	<-ts.backend.GetUplinkFrameChan()
+
+	for i := 0; i < 100 && counterValue(rawUplinkDroppedCounter()) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(before+1, counterValue(rawUplinkDroppedCounter()))
+}
+
+func (ts *BackendTestSuite) TestCloseTimeout() {
+	assert := require.New(ts.T())
+
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.CloseTimeout = 50 * time.Millisecond
+	})
+
+	// a misbehaving uplink filter blocks the packet handler
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ts.backend.SetUplinkFilter(func(gw.UplinkFrame) bool {
+		close(entered)
+		<-release
+		return false
+	})
+	defer close(release)
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	<-entered
+
+	closeErr := make(chan error, 1)
+	go func() {
+		closeErr <- ts.backend.Close()
+	}()
+
+	select {
+	case err := <-closeErr:
+		assert.Equal(ErrCloseTimeout, err)
+	case <-time.After(time.Second):
+		assert.Fail("close did not return")
+	}
+	assert.True(ts.backend.isClosed())
+	assert.Contains(ts.backend.goroutines.list(), "handle udp packet")
+
+	// the backend is closed regardless
+	assert.NoError(ts.backend.Close())
+}
+
+func (ts *BackendTestSuite) TestSetHooksWhileHandling() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	// a slow uplink filter blocks the packet handler
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ts.backend.SetUplinkFilter(func(gw.UplinkFrame) bool {
+		close(entered)
+		<-release
+		return false
+	})
+	defer close(release)
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	<-entered
+
+	// setting a callback neither blocks nor blocks the other packets
+	done := make(chan struct{})
+	go func() {
+		ts.backend.SetAddressChangeFunc(func(AddressChangeEvent) {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("set address change func blocked")
+	}
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err = p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	assert.NoError(ts.gwUDPConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+}
+
+func (ts *BackendTestSuite) TestCloseError() {
+	assert := require.New(ts.T())
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.Listeners = []config.SemtechUDPListener{
+			{ID: "second", Bind: "127.0.0.1:0"},
+		}
+	})
+	assert.Len(ts.backend.conns, 2)
+
+	// closing the first listener fails
+	ts.backend.connsMux.RLock()
+	assert.NoError(ts.backend.conns[0].Close())
+	ts.backend.connsMux.RUnlock()
+
+	err := ts.backend.Close()
+	assert.Error(err)
+	assert.Contains(err.Error(), "close udp listener error")
+
+	// the lock is released and the remaining listener is closed
+	assert.True(ts.backend.isClosed())
+	_, err = ts.backend.conns[1].WriteToUDP([]byte{1}, ts.backendUDPAddr)
+	assert.True(errors.Is(err, net.ErrClosed))
+}
+
+func (ts *BackendTestSuite) TestGatewayLabels() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.BridgeStats = true
+		conf.Backend.SemtechUDP.Gateways = map[string]config.SemtechUDPGateway{
+			"0102030405060708": {Labels: map[string]string{"site": "rooftop-1", "bridge_tx_sent": "label"}},
+		}
+	})
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      gatewayID,
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      gatewayID,
+		Payload: packets.PushDataPayload{
+			Stat: &packets.Stat{},
+		},
+	}
+	b, err = pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	// the bridge stats are not overwritten
+	stats := <-ts.backend.GetGatewayStatsChan()
+	assert.Equal("rooftop-1", stats.MetaData["site"])
+	assert.Equal("0", stats.MetaData["bridge_tx_sent"])
+
+	gws := ts.backend.GetGateways()
+	assert.Len(gws, 1)
+	assert.Equal(map[string]string{"site": "rooftop-1", "bridge_tx_sent": "label"}, gws[0].Labels)
+}
+
+func (ts *BackendTestSuite) TestReboot() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.JITLeadTime = 100 * time.Millisecond
+		conf.Backend.SemtechUDP.RebootTmstThreshold = 5 * time.Second
+	})
+
+	reboots := make(chan RebootEvent, 1)
+	ts.backend.SetRebootFunc(func(e RebootEvent) {
+		reboots <- e
+	})
+
+	assert.NoError(ts.backend.gateways.set(gatewayID, gateway{
+		addr:            ts.gwUDPConn.LocalAddr().(*net.UDPAddr),
+		lastSeen:        time.Now(),
+		protocolVersion: packets.ProtocolVersion2,
+		lastTmst:        100000000,
+		lastTmstTime:    time.Now(),
+	}))
+
+	// timestamped downlink, held by the JIT queue
+	assert.NoError(ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: gatewayID[:],
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_DELAY,
+					TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+						DelayTimingInfo: &gw.DelayTimingInfo{
+							Delay: ptypes.DurationProto(10 * time.Second),
+						},
+					},
+					Context: []byte{0x05, 0xf5, 0xe1, 0x00},
+				},
+			},
+		},
+	}))
+	assert.Equal(1, ts.backend.jit.len())
+
+	// uplink after the counter reset
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      gatewayID,
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{Tmst: 1000, Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1, 2, 3}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	ack := <-ts.backend.GetDownlinkTXAckChan()
+	assert.EqualValues(123, ack.Token)
+	assert.Equal(ErrGatewayRebooted.Error(), ack.Error)
+
+	e := <-reboots
+	assert.Equal(gatewayID, e.GatewayID)
+	assert.EqualValues(1000, e.Tmst)
+	assert.Equal(1, e.DroppedDownlinks)
+	assert.Equal(0, ts.backend.jit.len())
+
+	<-ts.backend.GetUplinkFrameChan()
+}
+
+func (ts *BackendTestSuite) TestMirror() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.MirrorBufferSize = 1
+	})
+
+	pushData := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			Stat: &packets.Stat{RXNb: 3},
+			RXPK: []packets.RXPK{
+				{Stat: 1, Freq: 868.1, DatR: packets.DatR{LoRa: "SF7BW125"}, Data: []byte{1, 2, 3}},
+			},
+		},
+	}
+	b, err := pushData.MarshalBinary()
+	assert.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+		_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		// the primary channels are not blocked by the (full) mirror channels
+		stats := <-ts.backend.GetGatewayStatsChan()
+		assert.EqualValues(3, stats.RxPacketsReceived)
+		uplinkFrame := <-ts.backend.GetUplinkFrameChan()
+		assert.Equal([]byte{1, 2, 3}, uplinkFrame.PhyPayload)
+	}
+
+	uplinkFrame := <-ts.backend.GetMirrorUplinkFrameChan()
+	assert.Equal([]byte{1, 2, 3}, uplinkFrame.PhyPayload)
+	stats := <-ts.backend.GetMirrorGatewayStatsChan()
+	assert.EqualValues(3, stats.RxPacketsReceived)
+
+	// the second items were dropped
+	assert.Len(ts.backend.GetMirrorUplinkFrameChan(), 0)
+	assert.Len(ts.backend.GetMirrorGatewayStatsChan(), 0)
+}
+
+func (ts *BackendTestSuite) TestTXAudit() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.TXAuditBufferSize = 1
+	})
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	err = ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	})
+	assert.NoError(err)
+
+	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	audit := <-ts.backend.GetTXAuditChan()
+	assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, audit.GatewayID)
+	assert.Equal(868.1, audit.TXPK.Freq)
+	assert.Equal(buf[:i], audit.Data)
+}
+
+func (ts *BackendTestSuite) TestMaxTXPower() {
+	gatewayMaxTXPower := 20
+
+	tests := []struct {
+		Name      string
+		GatewayID []byte
+		Policy    string
+		Power     int32
+		Expected  uint8
+		Error     error
+	}{
+		{
+			Name:      "below max tx power",
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Power:     10,
+			Expected:  10,
+		},
+		{
+			Name:      "clamp",
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Power:     27,
+			Expected:  14,
+		},
+		{
+			Name:      "reject",
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Policy:    txPowerPolicyReject,
+			Power:     27,
+			Error:     ErrPowerTooHigh,
+		},
+		{
+			Name:      "gateway override",
+			GatewayID: []byte{8, 7, 6, 5, 4, 3, 2, 1},
+			Power:     20,
+			Expected:  20,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+			ts.setupBackend(func(conf *config.Config) {
+				conf.Backend.SemtechUDP.MaxTXPower = 14
+				conf.Backend.SemtechUDP.TXPowerPolicy = tst.Policy
+				conf.Backend.SemtechUDP.Gateways = map[string]config.SemtechUDPGateway{
+					"0807060504030201": {MaxTXPower: &gatewayMaxTXPower},
+				}
+			})
+
+			pullResp, err := ts.backend.getPullRespPacket(packets.ProtocolVersion2, gw.DownlinkFrame{
+				Token:     123,
+				GatewayId: tst.GatewayID,
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: []byte{1, 2, 3, 4},
+						TxInfo: &gw.DownlinkTXInfo{
+							Frequency:  868100000,
+							Power:      tst.Power,
+							Modulation: common.Modulation_FSK,
+							ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+								FskModulationInfo: &gw.FSKModulationInfo{
+									Datarate: 50000,
+								},
+							},
+							Timing: gw.DownlinkTiming_IMMEDIATELY,
+						},
+					},
+				},
+			}, 0)
+			if tst.Error != nil {
+				assert.Equal(tst.Error, errors.Cause(err))
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tst.Expected, pullResp.Payload.TXPK.Powe)
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestErrorsIs() {
+	assert := require.New(ts.T())
+
+	// the sentinel errors can be matched through the wrapping layers
+	err := ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+		Items:     []*gw.DownlinkFrameItem{{}},
+	})
+	assert.True(errors.Is(err, ErrGatewayUnknown))
+	assert.Equal(ErrGatewayUnknown, errors.Cause(err))
+
+	err = ts.backend.handlePacket(udpPacket{
+		data: []byte{2, 1, 2, 99},
+		addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700},
+	})
+	assert.True(errors.Is(err, ErrUnknownPacketType))
+}
+
+func (ts *BackendTestSuite) TestDownlinkFrequencies() {
+	assert := require.New(ts.T())
+	singleChannel := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.Gateways = map[string]config.SemtechUDPGateway{
+			"0807060504030201": {DownlinkFrequencies: []uint32{869525000}},
+		}
+	})
+
+	assert.NoError(ts.backend.gateways.set(singleChannel, gateway{
+		addr:            ts.gwUDPConn.LocalAddr().(*net.UDPAddr),
+		lastSeen:        time.Now(),
+		protocolVersion: packets.ProtocolVersion2,
+	}))
+
+	getFrame := func(gatewayID lorawan.EUI64, freq uint32) gw.DownlinkFrame {
+		return gw.DownlinkFrame{
+			Token:     123,
+			GatewayId: gatewayID[:],
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: []byte{1, 2, 3, 4},
+					TxInfo: &gw.DownlinkTXInfo{
+						Frequency:  freq,
+						Modulation: common.Modulation_FSK,
+						ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+							FskModulationInfo: &gw.FSKModulationInfo{
+								Datarate: 50000,
+							},
+						},
+						Timing: gw.DownlinkTiming_IMMEDIATELY,
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		Name      string
+		GatewayID lorawan.EUI64
+		Frequency uint32
+		Error     error
+	}{
+		{
+			Name:      "no downlink frequencies configured",
+			GatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			Frequency: 868100000,
+		},
+		{
+			Name:      "supported frequency",
+			GatewayID: singleChannel,
+			Frequency: 869525000,
+		},
+		{
+			Name:      "unsupported frequency",
+			GatewayID: singleChannel,
+			Frequency: 868100000,
+			Error:     ErrFrequencyUnsupported,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			_, err := ts.backend.getPullRespPacket(packets.ProtocolVersion2, getFrame(tst.GatewayID, tst.Frequency), 0)
+			if tst.Error != nil {
+				assert.Equal(tst.Error, errors.Cause(err))
+				return
+			}
+			assert.NoError(err)
+		})
+	}
+
+	ts.T().Run("SendDownlinkFrame", func(t *testing.T) {
+		assert := require.New(t)
+
+		err := ts.backend.SendDownlinkFrame(getFrame(singleChannel, 868100000))
+		assert.Equal(ErrFrequencyUnsupported, errors.Cause(err))
+
+		gws := ts.backend.GetGateways()
+		assert.Len(gws, 1)
+		assert.Len(gws[0].DownlinkErrors, 1)
+	})
+}
+
+func (ts *BackendTestSuite) TestDownlinkReplayWindow() {
+	assert := require.New(ts.T())
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.DownlinkReplayWindow = 100 * time.Millisecond
+		// 0.05% of an hour is 1.8s, which fits a single SF12 downlink
+		conf.Backend.SemtechUDP.DutyCycleSubBands = []config.SemtechUDPDutyCycleSubBand{
+			{FrequencyMin: 869400000, FrequencyMax: 869650000, DutyCycle: 0.05},
+		}
+	})
+	before := counterValue(downlinkReplaySuppressedCounter())
+
+	assert.NoError(ts.backend.gateways.set(gatewayID, gateway{
+		addr:            ts.gwUDPConn.LocalAddr().(*net.UDPAddr),
+		lastSeen:        time.Now(),
+		protocolVersion: packets.ProtocolVersion2,
+	}))
+
+	getFrame := func(token uint32, phy []byte) gw.DownlinkFrame {
+		return gw.DownlinkFrame{
+			Token:     token,
+			GatewayId: gatewayID[:],
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: phy,
+					TxInfo: &gw.DownlinkTXInfo{
+						Frequency:  868100000,
+						Modulation: common.Modulation_FSK,
+						ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+							FskModulationInfo: &gw.FSKModulationInfo{
+								Datarate: 50000,
+							},
+						},
+						Timing: gw.DownlinkTiming_IMMEDIATELY,
+					},
+				},
+			},
+		}
+	}
+
+	assert.NoError(ts.backend.SendDownlinkFrame(getFrame(1, []byte{1, 2, 3})))
+
+	// identical txpk, the token is not compared
+	err := ts.backend.SendDownlinkFrame(getFrame(2, []byte{1, 2, 3}))
+	assert.Equal(ErrDuplicateDownlink, errors.Cause(err))
+	assert.Equal(before+1, counterValue(downlinkReplaySuppressedCounter()))
+
+	// different payload
+	assert.NoError(ts.backend.SendDownlinkFrame(getFrame(3, []byte{4, 5, 6})))
+
+	// after the window
+	time.Sleep(150 * time.Millisecond)
+	assert.NoError(ts.backend.SendDownlinkFrame(getFrame(4, []byte{1, 2, 3})))
+
+	// a rejected downlink is not recorded
+	getLoRaFrame := func(token uint32, phy []byte) gw.DownlinkFrame {
+		frame := getFrame(token, phy)
+		frame.Items[0].TxInfo = &gw.DownlinkTXInfo{
+			Frequency:  869525000,
+			Power:      14,
+			Modulation: common.Modulation_LORA,
+			ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+				LoraModulationInfo: &gw.LoRaModulationInfo{
+					Bandwidth:             125,
+					SpreadingFactor:       12,
+					CodeRate:              "4/5",
+					PolarizationInversion: true,
+				},
+			},
+			Timing: gw.DownlinkTiming_IMMEDIATELY,
+		}
+		return frame
+	}
+
+	assert.NoError(ts.backend.SendDownlinkFrame(getLoRaFrame(5, make([]byte, 13))))
+	err = ts.backend.SendDownlinkFrame(getLoRaFrame(6, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}))
+	assert.Equal(ErrDutyCycleExceeded, errors.Cause(err))
+	err = ts.backend.SendDownlinkFrame(getLoRaFrame(7, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}))
+	assert.Equal(ErrDutyCycleExceeded, errors.Cause(err))
+	assert.Equal(before+1, counterValue(downlinkReplaySuppressedCounter()))
+}
+
+func (ts *BackendTestSuite) TestDownlinkPort() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	// the gateway listens for downlinks on a different port
+	downAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	assert.NoError(err)
+	downConn, err := net.ListenUDP("udp", downAddr)
+	assert.NoError(err)
+	defer downConn.Close()
+	assert.NoError(downConn.SetDeadline(time.Now().Add(time.Second)))
+	ts.setupBackend(func(conf *config.Config) {
+		conf.Backend.SemtechUDP.DownlinkPort = downConn.LocalAddr().(*net.UDPAddr).Port
+	})
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	err = ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	})
+	assert.NoError(err)
+
+	i, _, err := downConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	var pullResp packets.PullRespPacket
+	assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
+	assert.Equal(uint16(123), pullResp.RandomToken)
+}
+
+func (ts *BackendTestSuite) TestRebind() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+	_, _, err = ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	assert.NoError(ts.backend.Rebind([]string{"127.0.0.1:0"}))
+	assert.Len(ts.backend.conns, 1)
+	newAddr, err := net.ResolveUDPAddr("udp", ts.backend.conns[0].LocalAddr().String())
+	assert.NoError(err)
+	assert.NotEqual(ts.backendUDPAddr, newAddr)
+
+	ts.T().Run("Downlink to known gateway", func(t *testing.T) {
+		assert := require.New(t)
+
+		err := ts.backend.SendDownlinkFrame(gw.DownlinkFrame{
+			Token:     123,
+			GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: []byte{1, 2, 3, 4},
+					TxInfo: &gw.DownlinkTXInfo{
+						Frequency:  868100000,
+						Modulation: common.Modulation_FSK,
+						ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+							FskModulationInfo: &gw.FSKModulationInfo{
+								Datarate: 50000,
+							},
+						},
+						Timing: gw.DownlinkTiming_IMMEDIATELY,
+					},
+				},
+			},
+		})
+		assert.NoError(err)
+
+		i, addr, err := ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		assert.Equal(newAddr.Port, addr.Port)
+
+		var pullResp packets.PullRespPacket
+		assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
+		assert.Equal(uint16(123), pullResp.RandomToken)
+	})
+
+	ts.T().Run("PullData on new listener", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err = ts.gwUDPConn.WriteToUDP(b, newAddr)
+		assert.NoError(err)
+
+		i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		var ack packets.PullACKPacket
+		assert.NoError(ack.UnmarshalBinary(buf[:i]))
+		assert.Equal(p.RandomToken, ack.RandomToken)
+	})
+}
+
+func (ts *BackendTestSuite) TestRebindKeepsListener() {
+	assert := require.New(ts.T())
+	buf := make([]byte, 65507)
+
+	// rebinding the current address must not fail with address in use
+	oldConn := ts.backend.conns[0]
+	assert.NoError(ts.backend.Rebind([]string{ts.backendUDPAddr.String(), "127.0.0.1:0"}))
+	assert.Len(ts.backend.conns, 2)
+	assert.True(oldConn == ts.backend.conns[0])
+	assert.False(oldConn == ts.backend.conns[1])
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	var ack packets.PullACKPacket
+	assert.NoError(ack.UnmarshalBinary(buf[:i]))
+	assert.Equal(p.RandomToken, ack.RandomToken)
+
+	// the listener which is no longer used is closed
+	assert.NoError(ts.backend.Rebind([]string{ts.backend.conns[1].LocalAddr().String()}))
+	assert.Len(ts.backend.conns, 1)
+	_, err = oldConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.Error(err)
+}
+
+func (ts *BackendTestSuite) TestSendDownlinkFrame() {
+	assert := require.New(ts.T())
+	id, err := uuid.NewV4()
+	assert.NoError(err)
+
+	tmst := uint32(2000000)
+
+	testTable := []struct {
+		Name          string
+		DownlinkFrame gw.DownlinkFrame
+		GatewayPacket packets.PullRespPacket
+		Error         error
+	}{
+		{
+			Name: "Gateway not registered",
+			DownlinkFrame: gw.DownlinkFrame{
+				Items: []*gw.DownlinkFrameItem{
+					{
+						TxInfo: &gw.DownlinkTXInfo{
+							GatewayId: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+						},
+					},
+				},
+			},
+			Error: errors.New("get gateway error: gateway does not exist"),
+		},
+		{
+			Name: "LORA",
+			DownlinkFrame: gw.DownlinkFrame{
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: []byte{1, 2, 3, 4},
+						TxInfo: &gw.DownlinkTXInfo{
+							Frequency:  868100000,
+							Power:      14,
+							Modulation: common.Modulation_LORA,
+							ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+								LoraModulationInfo: &gw.LoRaModulationInfo{
+									Bandwidth:             125,
+									SpreadingFactor:       7,
+									CodeRate:              "4/5",
+									PolarizationInversion: true,
+								},
+							},
+							Timing: gw.DownlinkTiming_DELAY,
+							TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+								DelayTimingInfo: &gw.DelayTimingInfo{
+									Delay: ptypes.DurationProto(time.Second),
+								},
+							},
+							Board:   1,
+							Antenna: 2,
+							Context: []byte{0x00, 0x0f, 0x42, 0x40},
+						},
+					},
+				},
+				Token:      123,
+				DownlinkId: id[:],
+				GatewayId:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			},
+			GatewayPacket: packets.PullRespPacket{
+				ProtocolVersion: packets.ProtocolVersion2,
+				RandomToken:     123,
+				Payload: packets.PullRespPayload{
+					TXPK: packets.TXPK{
+						Tmst: &tmst,
+						Freq: 868.1,
+						RFCh: 0,
+						Powe: 14,
+						Modu: "LORA",
+						DatR: packets.DatR{
+							LoRa: "SF7BW125",
+						},
+						CodR: "4/5",
+						IPol: true,
+						Size: 4,
+						Data: []byte{1, 2, 3, 4},
+						Brd:  1,
+						Ant:  2,
+					},
+				},
+			},
+		},
+		{
+			Name: "FSK",
+			DownlinkFrame: gw.DownlinkFrame{
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: []byte{1, 2, 3, 4},
+						TxInfo: &gw.DownlinkTXInfo{
+							Frequency:  868100000,
+							Power:      14,
+							Modulation: common.Modulation_FSK,
+							ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+								FskModulationInfo: &gw.FSKModulationInfo{
+									Datarate:           50000,
+									FrequencyDeviation: 25000,
+								},
+							},
+							Board:   1,
+							Antenna: 2,
+							Timing:  gw.DownlinkTiming_DELAY,
+							TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+								DelayTimingInfo: &gw.DelayTimingInfo{
+									Delay: ptypes.DurationProto(time.Second),
+								},
+							},
+							Context: []byte{0x00, 0x0f, 0x42, 0x40},
+						},
+					},
+				},
+				Token:      123,
+				DownlinkId: id[:],
+				GatewayId:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			},
+			GatewayPacket: packets.PullRespPacket{
+				ProtocolVersion: packets.ProtocolVersion2,
+				RandomToken:     123,
+				Payload: packets.PullRespPayload{
+					TXPK: packets.TXPK{
+						Tmst: &tmst,
+						Freq: 868.1,
+						RFCh: 0,
+						Powe: 14,
+						Modu: "FSK",
+						FDev: 25000,
+						DatR: packets.DatR{
+							FSK: 50000,
+						},
+						Size: 4,
+						Data: []byte{1, 2, 3, 4},
+						Brd:  1,
+						Ant:  2,
+					},
+				},
+			},
+		},
+	}
+
+	// register gateway
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	buf := make([]byte, 65507)
+	i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	var ack packets.PullACKPacket
+	assert.NoError(ack.UnmarshalBinary(buf[:i]))
+	assert.Equal(p.RandomToken, ack.RandomToken)
+	assert.Equal(p.ProtocolVersion, ack.ProtocolVersion)
+
+	for _, test := range testTable {
+		ts.T().Run(test.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			err := ts.backend.SendDownlinkFrame(test.DownlinkFrame)
+			if test.Error != nil {
+				assert.Error(err)
+				assert.Equal(test.Error.Error(), err.Error())
+				return
+			}
+			assert.NoError(err)
+
+			i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+			assert.NoError(err)
+
+			var pullResp packets.PullRespPacket
+			assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
+			assert.Equal(test.GatewayPacket, pullResp)
+		})
+	}
+}
+
+func TestNewBackendConfig(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Set   func(c *config.Config)
+		Error string
+	}{
+		{
+			Name: "valid",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.ReadBufferSize = 2048
+				c.Backend.SemtechUDP.SocketReadBuffer = 1024 * 1024
+				c.Backend.SemtechUDP.SocketWriteBuffer = 1024 * 1024
+				c.Backend.SemtechUDP.SocketDSCP = 46
+			},
+		},
+		{
+			Name: "invalid location_validation",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.LocationValidation = "foo"
+			},
+			Error: "invalid location_validation: foo",
+		},
+		{
+			Name: "invalid frequency_stats_max",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.FrequencyStatsMax = -1
+			},
+			Error: "invalid frequency_stats_max: -1",
+		},
+		{
+			Name: "invalid send_retries",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.SendRetries = -1
+			},
+			Error: "invalid send_retries: -1",
+		},
+		{
+			Name: "invalid reboot_tmst_threshold",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.RebootTmstThreshold = -time.Second
+			},
+			Error: "invalid reboot_tmst_threshold: -1s",
+		},
+		{
+			Name: "invalid max_gateways",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.MaxGateways = -1
+			},
+			Error: "invalid max_gateways: -1",
+		},
+		{
+			Name: "invalid suspect_grace",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.SuspectGrace = -time.Second
+			},
+			Error: "invalid suspect_grace: -1s",
+		},
+		{
+			Name: "invalid pull_data_debounce",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.PullDataDebounce = -time.Second
+			},
+			Error: "invalid pull_data_debounce: -1s",
+		},
+		{
+			Name: "invalid jit_lead_time",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.JITLeadTime = -time.Second
+			},
+			Error: "invalid jit_lead_time: -1s",
+		},
+		{
+			Name: "invalid gateway_conflict_policy",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.GatewayConflictPolicy = "foo"
+			},
+			Error: "invalid gateway_conflict_policy: foo",
+		},
+		{
+			Name: "invalid uplink_stall_timeout",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.UplinkStallTimeout = -time.Second
+			},
+			Error: "invalid uplink_stall_timeout: -1s",
+		},
+		{
+			Name: "invalid uplink_stall_policy",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.UplinkStallPolicy = "foo"
+			},
+			Error: "invalid uplink_stall_policy: foo",
+		},
+		{
+			Name: "invalid size_mismatch_policy",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.SizeMismatchPolicy = "foo"
+			},
+			Error: "invalid size_mismatch_policy: foo",
+		},
+		{
+			Name: "invalid subscriber_buffer_size",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.SubscriberBufferSize = -1
+			},
+			Error: "invalid subscriber_buffer_size: -1",
+		},
+		{
+			Name: "invalid subscriber_policy",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.SubscriberPolicy = "foo"
+			},
+			Error: "invalid subscriber_policy: foo",
+		},
+		{
+			Name: "invalid ack_rate_limit",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.ACKRateLimit = -1
+			},
+			Error: "invalid ack_rate_limit: -1",
+		},
+		{
+			Name: "invalid health min_ack_ratio",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.Health.MinACKRatio = 1.5
+			},
+			Error: "invalid health min_ack_ratio: 1.500000",
+		},
+		{
+			Name: "invalid health max_idle_intervals",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.Health.MaxIdleIntervals = -1
+			},
+			Error: "invalid health max_idle_intervals: -1",
+		},
+		{
+			Name: "invalid read_buffer_size",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.ReadBufferSize = 65508
+			},
+			Error: "invalid read_buffer_size: 65508",
+		},
+		{
+			Name: "invalid duty_cycle_sub_bands duty_cycle",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.DutyCycleSubBands = []config.SemtechUDPDutyCycleSubBand{
+					{FrequencyMin: 868000000, FrequencyMax: 868600000, DutyCycle: 0},
+				}
+			},
+			Error: "invalid duty_cycle_sub_bands duty_cycle: 0.000000",
+		},
+		{
+			Name: "check_downlink_payload_size without region",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.CheckDownlinkPayloadSize = true
+			},
+			Error: "check_downlink_payload_size requires a region",
+		},
+		{
+			Name: "check_downlink_data_rate without region",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.CheckDownlinkDataRate = true
+			},
+			Error: "check_downlink_data_rate requires a region",
+		},
+		{
+			Name: "invalid uplink_sample_rate",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.UplinkSampleRate = -1
+			},
+			Error: "invalid uplink_sample_rate: -1",
+		},
+		{
+			Name: "invalid max_ack_latency",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.MaxAckLatency = -time.Second
+			},
+			Error: "invalid max_ack_latency: -1s",
+		},
+		{
+			Name: "invalid downlink_replay_window",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.DownlinkReplayWindow = -time.Second
+			},
+			Error: "invalid downlink_replay_window: -1s",
+		},
+		{
+			Name: "invalid jit_past_margin",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.JITPastMargin = -time.Second
+			},
+			Error: "invalid jit_past_margin: -1s",
+		},
+		{
+			Name: "invalid jit_future_margin",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.JITFutureMargin = -time.Second
+			},
+			Error: "invalid jit_future_margin: -1s",
+		},
+		{
+			Name: "invalid gateway jit_past_margin",
+			Set: func(c *config.Config) {
+				margin := -time.Second
+				c.Backend.SemtechUDP.Gateways = map[string]config.SemtechUDPGateway{
+					"0102030405060708": {JITPastMargin: &margin},
+				}
+			},
+			Error: "invalid jit margins for gateway 0102030405060708",
+		},
+		{
+			Name: "invalid tx_ack_retries",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.TXAckRetries = -1
+			},
+			Error: "invalid tx_ack_retries: -1",
+		},
+		{
+			Name: "tx_ack_retries without tx_ack_timeout",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.TXAckRetries = 2
+			},
+			Error: "invalid tx_ack_timeout: 0s",
+		},
+		{
+			Name: "invalid close_timeout",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.CloseTimeout = -time.Second
+			},
+			Error: "invalid close_timeout: -1s",
+		},
+		{
+			Name: "invalid read_timeout",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.ReadTimeout = -time.Second
+			},
+			Error: "invalid read_timeout: -1s",
+		},
+		{
+			Name: "invalid socket_read_buffer",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.SocketReadBuffer = -1
+			},
+			Error: "socket_read_buffer and socket_write_buffer must not be negative",
+		},
+		{
+			Name: "invalid socket_dscp",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.SocketDSCP = 64
+			},
+			Error: "invalid socket_dscp: 64",
+		},
+		{
+			Name: "listener without id",
+			Set: func(c *config.Config) {
+				c.Backend.SemtechUDP.Listeners = []config.SemtechUDPListener{{Bind: "127.0.0.1:0"}}
+			},
+			Error: "listener id must be set for listener 127.0.0.1:0",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var conf config.Config
+			conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+			tst.Set(&conf)
+
+			b, err := NewBackend(conf)
+			if tst.Error != "" {
+				assert.EqualError(err, tst.Error)
+				return
+			}
+			assert.NoError(err)
+			assert.NoError(b.Close())
+		})
+	}
+}
+
+func TestListeners(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	conf.Backend.SemtechUDP.Listeners = []config.SemtechUDPListener{
+		{ID: "tenant-a", Bind: "127.0.0.1:0"},
+	}
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	defer b.Close()
+	assert.Len(b.conns, 2)
+
+	addrs := b.ListenAddrs()
+	assert.Len(addrs, 2)
+	assert.Equal(addrs[0], b.ListenAddr())
+	for _, addr := range addrs {
+		assert.NotEqual(0, addr.Port)
+	}
+
+	go func() {
+		for {
+			<-b.GetSubscribeEventChan()
+		}
+	}()
+
+	type event struct {
+		listenerID string
+		e          events.Subscribe
+	}
+	eventChan := make(chan event, 2)
+	b.SetGatewayEventFunc(func(listenerID string, e events.Subscribe) {
+		eventChan <- event{listenerID, e}
+	})
+
+	gwConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(err)
+	defer gwConn.Close()
+	assert.NoError(gwConn.SetDeadline(time.Now().Add(time.Second)))
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	pB, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = gwConn.WriteToUDP(pB, b.conns[1].LocalAddr().(*net.UDPAddr))
+	assert.NoError(err)
+	buf := make([]byte, 65507)
+	_, _, err = gwConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	assert.Equal(event{"tenant-a", events.Subscribe{Subscribe: true, GatewayID: p.GatewayMAC}}, <-eventChan)
+
+	assert.NoError(b.SetStaleDuration(time.Nanosecond))
+	time.Sleep(time.Millisecond)
+
+	assert.NoError(b.gateways.cleanup())
+	assert.Equal(event{"tenant-a", events.Subscribe{Subscribe: false, GatewayID: p.GatewayMAC}}, <-eventChan)
+
+	// rebinding with listener IDs keeps the IDs
+	assert.NoError(b.rebind([]string{"127.0.0.1:0", "127.0.0.1:0"}, []string{"", "tenant-a"}))
+	assert.Equal("tenant-a", b.getListenerID(b.conns[1]))
+}
+
+func TestSendRetries(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	conf.Backend.SemtechUDP.SendRetries = 2
+	conf.Backend.SemtechUDP.SendRetryInterval = 100 * time.Millisecond
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	defer b.Close()
+	go func() {
+		for range b.GetSubscribeEventChan() {
+		}
+	}()
+
+	gwConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(err)
+	defer gwConn.Close()
+	assert.NoError(gwConn.SetDeadline(time.Now().Add(time.Second)))
+	gwAddr := gwConn.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, 65507)
+
+	b.connsMux.RLock()
+	oldConn := b.conns[0]
+	b.connsMux.RUnlock()
+
+	t.Run("Destination error", func(t *testing.T) {
+		assert := require.New(t)
+
+		// an IPv6 address can not be written to the IPv4 listener
+		result := make(chan error, 1)
+		b.udpSendChan <- udpPacket{
+			addr:   &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1700},
+			data:   []byte{2, 1, 2, byte(packets.PullACK)},
+			result: result,
+		}
+
+		// the packets to other gateways are sent while the retries are
+		// pending
+		b.udpSendChan <- udpPacket{
+			addr: gwAddr,
+			data: []byte{2, 1, 3, byte(packets.PullACK)},
+		}
+		i, _, err := gwConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{2, 1, 3, byte(packets.PullACK)}, buf[:i])
+		assert.Len(result, 0)
+
+		assert.Error(<-result)
+
+		// the listener is not re-opened
+		b.connsMux.RLock()
+		assert.True(oldConn == b.conns[0])
+		b.connsMux.RUnlock()
+	})
+
+	t.Run("Listener error", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(oldConn.Close())
+
+		result := make(chan error, 1)
+		b.udpSendChan <- udpPacket{
+			addr:   gwAddr,
+			conn:   oldConn,
+			data:   []byte{2, 1, 4, byte(packets.PullACK)},
+			result: result,
+		}
+		assert.NoError(<-result)
+
+		i, _, err := gwConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{2, 1, 4, byte(packets.PullACK)}, buf[:i])
+
+		// the listener has been re-opened on the same address
+		b.connsMux.RLock()
+		newConn := b.conns[0]
+		b.connsMux.RUnlock()
+		assert.True(oldConn != newConn)
+		assert.Equal(oldConn.LocalAddr().String(), newConn.LocalAddr().String())
+
+		// the re-opened listener is used for receiving and sending
+		pullData := packets.PullDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     12345,
+			GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		}
+		pB, err := pullData.MarshalBinary()
+		assert.NoError(err)
+		_, err = gwConn.WriteToUDP(pB, newConn.LocalAddr().(*net.UDPAddr))
+		assert.NoError(err)
+		_, _, err = gwConn.ReadFromUDP(buf)
+		assert.NoError(err)
+	})
+}
+
+func TestIsSocketError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"closed", &net.OpError{Op: "write", Err: net.ErrClosed}, true},
+		{"bad file descriptor", &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EBADF)}, true},
+		{"connection refused", &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.ECONNREFUSED)}, false},
+		{"host unreachable", &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)}, false},
+		{"address error", &net.OpError{Op: "write", Err: &net.AddrError{Err: "non-IPv4 address", Addr: "::1"}}, false},
+		{"other", errors.New("boom"), false},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			assert.Equal(tst.expected, isSocketError(tst.err))
+		})
+	}
+}
+
+func TestStaleDurationAndCleanupInterval(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	defer b.Close()
+	go func() {
+		for range b.GetSubscribeEventChan() {
+		}
+	}()
+
+	assert.Equal(time.Minute, b.GetStaleDuration())
+	assert.Equal(time.Minute, b.GetCleanupInterval())
+
+	assert.NoError(b.SetStaleDuration(10 * time.Minute))
+	assert.NoError(b.SetCleanupInterval(10 * time.Second))
+	assert.Equal(10*time.Minute, b.GetStaleDuration())
+	assert.Equal(10*time.Second, b.GetCleanupInterval())
+
+	assert.EqualError(b.SetStaleDuration(-time.Minute), "invalid stale duration: -1m0s")
+	assert.EqualError(b.SetCleanupInterval(0), "invalid cleanup interval: 0s")
+	assert.Equal(10*time.Minute, b.GetStaleDuration())
+	assert.Equal(10*time.Second, b.GetCleanupInterval())
+}
+
+func TestCleanupAfterClose(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "semtechudp")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	conf.Backend.SemtechUDP.GatewaysFile = filepath.Join(dir, "gateways.json")
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	go func() {
+		for range b.GetSubscribeEventChan() {
+		}
+	}()
+	assert.NoError(b.SetCleanupInterval(10 * time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(b.Close())
+
+	// the cleanup (which saves the gateways) must not run after close
+	assert.NoError(os.Remove(conf.Backend.SemtechUDP.GatewaysFile))
+	time.Sleep(50 * time.Millisecond)
+	_, err = os.Stat(conf.Backend.SemtechUDP.GatewaysFile)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestDownlinkBind(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	conf.Backend.SemtechUDP.DownlinkBind = "127.0.0.1:0"
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	defer b.Close()
+	go func() {
+		for range b.GetSubscribeEventChan() {
+		}
+	}()
+
+	gwConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(err)
+	defer gwConn.Close()
+	assert.NoError(gwConn.SetDeadline(time.Now().Add(time.Second)))
+
+	// the ACK is sent from the listener
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	pB, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = gwConn.WriteToUDP(pB, b.conns[0].LocalAddr().(*net.UDPAddr))
+	assert.NoError(err)
+	buf := make([]byte, 65507)
+	_, addr, err := gwConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	assert.Equal(b.conns[0].LocalAddr().String(), addr.String())
+
+	// the PullResp is sent from the downlink socket
+	assert.NoError(b.SendDownlinkFrame(gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: p.GatewayMAC[:],
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	}))
+	_, addr, err = gwConn.ReadFromUDP(buf)
+	assert.NoError(err)
+	assert.Equal(byte(packets.PullResp), buf[3])
+	assert.Equal(b.downlinkConn.LocalAddr().String(), addr.String())
+	assert.NotEqual(b.conns[0].LocalAddr().String(), addr.String())
+}
+
+func TestReadTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	conf.Backend.SemtechUDP.ReadTimeout = 10 * time.Millisecond
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	go func() {
+		for range b.GetSubscribeEventChan() {
+		}
+	}()
+
+	// let a few reads time out
+	time.Sleep(50 * time.Millisecond)
+
+	gwConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(err)
+	defer gwConn.Close()
+	assert.NoError(gwConn.SetDeadline(time.Now().Add(time.Second)))
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	pB, err := p.MarshalBinary()
+	assert.NoError(err)
+	_, err = gwConn.WriteToUDP(pB, b.conns[0].LocalAddr().(*net.UDPAddr))
+	assert.NoError(err)
+	buf := make([]byte, 65507)
+	_, _, err = gwConn.ReadFromUDP(buf)
+	assert.NoError(err)
+
+	assert.NoError(b.Close())
+}
+
+func TestSendDownlinkFrameClose(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	go func() {
+		for {
+			<-b.GetSubscribeEventChan()
+		}
+	}()
+
+	gwConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(err)
+	defer gwConn.Close()
+
+	assert.NoError(b.gateways.set(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, gateway{
+		addr:            gwConn.LocalAddr().(*net.UDPAddr),
+		lastSeen:        time.Now(),
+		protocolVersion: packets.ProtocolVersion2,
+	}))
+
+	frame := gw.DownlinkFrame{
+		Token:     123,
+		GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+					Timing: gw.DownlinkTiming_IMMEDIATELY,
+				},
+			},
+		},
+	}
+
+	errChan := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				errChan <- b.SendDownlinkFrame(frame)
+			}
+		}()
+	}
+
+	assert.NoError(b.Close())
+
+	for i := 0; i < 100; i++ {
+		if err := <-errChan; err != nil {
+			assert.Equal(ErrBackendClosed, err)
+		}
+	}
+
+	assert.Equal(ErrBackendClosed, b.SendDownlinkFrame(frame))
+}
+
+func TestResolveUDPAddrs(t *testing.T) {
+	assert := require.New(t)
+
+	addrs, err := resolveUDPAddrs([]string{"127.0.0.1:1700", ":1701"})
+	assert.NoError(err)
+	assert.Equal([]string{"127.0.0.1:1700", ":1701"}, addrs)
+
+	_, err = resolveUDPAddrs([]string{"127.0.0.1:foo"})
+	assert.Error(err)
+}
+
+func TestListenUDPDSCP(t *testing.T) {
+	assert := require.New(t)
+
+	conns, err := listenUDP([]string{"127.0.0.1:0"}, udpSocketOptions{dscp: 46})
+	assert.NoError(err)
+	defer closeUDP(conns)
+
+	tos, err := ipv4.NewConn(conns[0]).TOS()
+	assert.NoError(err)
+	assert.Equal(46<<2, tos)
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendTestSuite))
+}
+
+func BenchmarkReadPackets(b *testing.B) {
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+
+	backend, err := NewBackend(conf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for range backend.GetSubscribeEventChan() {
+		}
+	}()
+
+	gwConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer gwConn.Close()
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	data, err := p.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 65507)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := gwConn.WriteToUDP(data, backend.ListenAddr()); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := gwConn.ReadFromUDP(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
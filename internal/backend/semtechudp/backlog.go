@@ -0,0 +1,63 @@
+package semtechudp
+
+import (
+	"sync"
+
+	"github.com/brocaar/lorawan"
+)
+
+// sendBacklog counts the downlinks per gateway which are waiting to be
+// written by the send goroutine.
+type sendBacklog struct {
+	sync.Mutex
+
+	counts map[lorawan.EUI64]int
+}
+
+func newSendBacklog() *sendBacklog {
+	return &sendBacklog{
+		counts: make(map[lorawan.EUI64]int),
+	}
+}
+
+// add adds the given delta to the count of the given gateway.
+func (s *sendBacklog) add(gatewayID lorawan.EUI64, delta int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.counts[gatewayID] += delta
+	if s.counts[gatewayID] <= 0 {
+		delete(s.counts, gatewayID)
+	}
+}
+
+// addTo adds the counts to the given map.
+func (s *sendBacklog) addTo(out map[lorawan.EUI64]int) {
+	s.Lock()
+	defer s.Unlock()
+
+	for gatewayID, count := range s.counts {
+		out[gatewayID] += count
+	}
+}
+
+// sendDownlinkPacket sends the given downlink packet to the send goroutine,
+// accounting it in the send backlog until it is picked up.
+func (b *Backend) sendDownlinkPacket(p udpPacket) {
+	b.sendBacklog.add(*p.downlinkGatewayID, 1)
+	b.udpSendChan <- p
+}
+
+// GetSendBacklog returns the number of queued downlinks per gateway, this
+// includes the downlinks held by the JIT queue (see jit_lead_time) and the
+// downlinks waiting to be written to the UDP socket. The gateways without
+// queued downlinks are omitted. This can be used to back off from congested
+// gateways before downlinks miss their transmit window.
+func (b *Backend) GetSendBacklog() map[lorawan.EUI64]int {
+	out := make(map[lorawan.EUI64]int)
+	if b.jit != nil {
+		out = b.jit.countByGateway()
+	}
+	b.sendBacklog.addTo(out)
+	return out
+}
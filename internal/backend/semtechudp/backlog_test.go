@@ -0,0 +1,43 @@
+package semtechudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestGetSendBacklog(t *testing.T) {
+	assert := require.New(t)
+
+	gatewayA := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+	gatewayB := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+
+	b := Backend{
+		udpSendChan: make(chan udpPacket, 10),
+		sendBacklog: newSendBacklog(),
+	}
+	assert.Len(b.GetSendBacklog(), 0)
+
+	b.sendDownlinkPacket(udpPacket{downlinkGatewayID: &gatewayA})
+	b.sendDownlinkPacket(udpPacket{downlinkGatewayID: &gatewayB})
+	b.sendDownlinkPacket(udpPacket{downlinkGatewayID: &gatewayB})
+	assert.Equal(map[lorawan.EUI64]int{gatewayA: 1, gatewayB: 2}, b.GetSendBacklog())
+
+	// picked up by the send goroutine
+	b.sendBacklog.add(gatewayA, -1)
+	assert.Equal(map[lorawan.EUI64]int{gatewayB: 2}, b.GetSendBacklog())
+
+	t.Run("JIT queue", func(t *testing.T) {
+		assert := require.New(t)
+
+		b.jit = newJITQueue(func(udpPacket) {})
+		defer b.jit.close()
+
+		b.jit.add(time.Now().Add(time.Hour), udpPacket{downlinkGatewayID: &gatewayA})
+		b.jit.add(time.Now().Add(time.Hour), udpPacket{downlinkGatewayID: &gatewayB})
+		assert.Equal(map[lorawan.EUI64]int{gatewayA: 1, gatewayB: 3}, b.GetSendBacklog())
+	})
+}
@@ -0,0 +1,234 @@
+package semtechudp
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// ErrDutyCycleExceeded is returned when sending a downlink would exceed the
+// duty-cycle budget of the sub-band within the rolling window.
+var ErrDutyCycleExceeded = errors.New("duty-cycle exceeded")
+
+// dutyCycleWindow contains the rolling window over which the duty-cycle is
+// accounted.
+const dutyCycleWindow = time.Hour
+
+// Default preamble sizes (in symbols for LoRa, in bytes for FSK) used by the
+// packet-forwarder when the txpk does not set the preamble size.
+const (
+	defaultLoRaPreamble = 8
+	defaultFSKPreamble  = 5
+)
+
+// loRaTimeOnAir returns the time-on-air of a LoRa packet with explicit
+// header, following the formula of the Semtech SX1276 datasheet. The
+// bandwidth is in kHz and the coding rate is 1 (4/5) to 4 (4/8).
+func loRaTimeOnAir(sf, bandwidth, codingRate, preamble, size int, crc bool) time.Duration {
+	tSym := math.Pow(2, float64(sf)) / float64(bandwidth*1000)
+
+	// low data-rate optimization is required when the symbol time exceeds
+	// 16ms
+	var de float64
+	if tSym > 0.016 {
+		de = 1
+	}
+
+	var crcBits float64
+	if crc {
+		crcBits = 16
+	}
+
+	tPreamble := (float64(preamble) + 4.25) * tSym
+	payloadSymbols := 8 + math.Max(math.Ceil((8*float64(size)-4*float64(sf)+28+crcBits)/(4*(float64(sf)-2*de)))*float64(codingRate+4), 0)
+
+	return time.Duration(math.Round((tPreamble + payloadSymbols*tSym) * float64(time.Second)))
+}
+
+// fskTimeOnAir returns the time-on-air of a FSK packet (preamble, 3 bytes
+// sync-word, 1 byte length, payload and 2 bytes CRC). The bitrate is in
+// bits per second.
+func fskTimeOnAir(bitrate, preamble, size int, crc bool) time.Duration {
+	bytes := preamble + 3 + 1 + size
+	if crc {
+		bytes += 2
+	}
+
+	return time.Duration(math.Round(float64(bytes*8) / float64(bitrate) * float64(time.Second)))
+}
+
+// getTimeOnAir returns the estimated time-on-air of the given txpk.
+func getTimeOnAir(txpk packets.TXPK) (time.Duration, error) {
+	switch txpk.Modu {
+	case "LORA":
+		var sf, bw int
+		if _, err := fmt.Sscanf(txpk.DatR.LoRa, "SF%dBW%d", &sf, &bw); err != nil {
+			return 0, fmt.Errorf("invalid lora data-rate: %s", txpk.DatR.LoRa)
+		}
+		if sf < 6 || sf > 12 || bw <= 0 {
+			return 0, fmt.Errorf("invalid lora data-rate: %s", txpk.DatR.LoRa)
+		}
+
+		cr := 1
+		if txpk.CodR != "" {
+			var denominator int
+			if _, err := fmt.Sscanf(txpk.CodR, "4/%d", &denominator); err != nil || denominator < 5 || denominator > 8 {
+				return 0, fmt.Errorf("invalid lora coding-rate: %s", txpk.CodR)
+			}
+			cr = denominator - 4
+		}
+
+		preamble := defaultLoRaPreamble
+		if txpk.Prea != 0 {
+			preamble = int(txpk.Prea)
+		}
+
+		return loRaTimeOnAir(sf, bw, cr, preamble, int(txpk.Size), !txpk.NCRC), nil
+	case "FSK":
+		if txpk.DatR.FSK == 0 {
+			return 0, errors.New("invalid fsk data-rate: 0")
+		}
+
+		preamble := defaultFSKPreamble
+		if txpk.Prea != 0 {
+			preamble = int(txpk.Prea)
+		}
+
+		return fskTimeOnAir(int(txpk.DatR.FSK), preamble, int(txpk.Size), !txpk.NCRC), nil
+	default:
+		return 0, fmt.Errorf("invalid modulation: %s", txpk.Modu)
+	}
+}
+
+type dutyCycleKey struct {
+	gatewayID lorawan.EUI64
+	subBand   int
+}
+
+type dutyCycleUsage struct {
+	time    time.Time
+	airtime time.Duration
+}
+
+// dutyCycleReservation identifies the time-on-air accounted by reserve, so
+// that it can be released when the downlink was not transmitted.
+type dutyCycleReservation struct {
+	key   dutyCycleKey
+	usage *dutyCycleUsage
+}
+
+// dutyCycleTracker tracks the time-on-air of the downlinks per gateway and
+// sub-band within the rolling window.
+type dutyCycleTracker struct {
+	sync.Mutex
+
+	subBands []config.SemtechUDPDutyCycleSubBand
+	usage    map[dutyCycleKey][]*dutyCycleUsage
+}
+
+func newDutyCycleTracker(subBands []config.SemtechUDPDutyCycleSubBand) *dutyCycleTracker {
+	return &dutyCycleTracker{
+		subBands: subBands,
+		usage:    make(map[dutyCycleKey][]*dutyCycleUsage),
+	}
+}
+
+// reserve accounts the given time-on-air for the given gateway and frequency
+// (Hz). It returns ErrDutyCycleExceeded (without accounting) when this would
+// exceed the budget of the sub-band. Frequencies outside the configured
+// sub-bands are not accounted, in which case the returned reservation is nil.
+func (t *dutyCycleTracker) reserve(gatewayID lorawan.EUI64, frequency uint32, airtime time.Duration, now time.Time) (*dutyCycleReservation, error) {
+	subBand := -1
+	for i, sb := range t.subBands {
+		if frequency >= sb.FrequencyMin && frequency <= sb.FrequencyMax {
+			subBand = i
+			break
+		}
+	}
+	if subBand == -1 {
+		return nil, nil
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	key := dutyCycleKey{gatewayID: gatewayID, subBand: subBand}
+
+	// remove the usage which is outside the window
+	usage := t.usage[key]
+	for len(usage) != 0 && !usage[0].time.After(now.Add(-dutyCycleWindow)) {
+		usage = usage[1:]
+	}
+
+	var used time.Duration
+	for _, u := range usage {
+		used += u.airtime
+	}
+
+	budget := time.Duration(float64(dutyCycleWindow) * t.subBands[subBand].DutyCycle / 100)
+	if used+airtime > budget {
+		t.usage[key] = usage
+		return nil, ErrDutyCycleExceeded
+	}
+
+	u := &dutyCycleUsage{time: now, airtime: airtime}
+	t.usage[key] = append(usage, u)
+	return &dutyCycleReservation{key: key, usage: u}, nil
+}
+
+// release releases the time-on-air of the given reservation (which may be
+// nil), e.g. when the gateway reported that the downlink was not
+// transmitted.
+func (t *dutyCycleTracker) release(r *dutyCycleReservation) {
+	if r == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	usage := t.usage[r.key]
+	for i, u := range usage {
+		if u == r.usage {
+			t.usage[r.key] = append(usage[:i:i], usage[i+1:]...)
+			return
+		}
+	}
+}
+
+// reserveTXPK accounts the estimated time-on-air of the given txpk, see
+// reserve.
+func (t *dutyCycleTracker) reserveTXPK(gatewayID lorawan.EUI64, txpk packets.TXPK, now time.Time) (*dutyCycleReservation, error) {
+	airtime, err := getTimeOnAir(txpk)
+	if err != nil {
+		return nil, errors.Wrap(err, "get time-on-air error")
+	}
+
+	return t.reserve(gatewayID, uint32(math.Round(txpk.Freq*1000000)), airtime, now)
+}
+
+// releaseDutyCycle releases the time-on-air accounted for the PullResp with
+// the given token, see queueDownlink.
+func (b *Backend) releaseDutyCycle(token uint16) {
+	if b.dutyCycle == nil {
+		return
+	}
+
+	key := fmt.Sprintf("%d:dutycycle", token)
+	v, ok := b.cache.Get(key)
+	if !ok {
+		return
+	}
+	b.cache.Delete(key)
+
+	if r, ok := v.(*dutyCycleReservation); ok {
+		b.dutyCycle.release(r)
+	}
+}
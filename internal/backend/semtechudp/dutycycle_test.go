@@ -0,0 +1,115 @@
+package semtechudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestGetTimeOnAir(t *testing.T) {
+	tests := []struct {
+		Name    string
+		TXPK    packets.TXPK
+		Airtime time.Duration
+		Error   string
+	}{
+		{
+			Name:    "SF7BW125",
+			TXPK:    packets.TXPK{Modu: "LORA", DatR: packets.DatR{LoRa: "SF7BW125"}, CodR: "4/5", Size: 13},
+			Airtime: 46336 * time.Microsecond,
+		},
+		{
+			Name:    "SF12BW125 (low data-rate optimization)",
+			TXPK:    packets.TXPK{Modu: "LORA", DatR: packets.DatR{LoRa: "SF12BW125"}, CodR: "4/5", Size: 13},
+			Airtime: 1155072 * time.Microsecond,
+		},
+		{
+			Name:    "SF9BW125 no crc",
+			TXPK:    packets.TXPK{Modu: "LORA", DatR: packets.DatR{LoRa: "SF9BW125"}, CodR: "4/5", Size: 13, NCRC: true},
+			Airtime: 144384 * time.Microsecond,
+		},
+		{
+			Name:    "FSK",
+			TXPK:    packets.TXPK{Modu: "FSK", DatR: packets.DatR{FSK: 50000}, Size: 13},
+			Airtime: 3840 * time.Microsecond,
+		},
+		{
+			Name:  "invalid data-rate",
+			TXPK:  packets.TXPK{Modu: "LORA", DatR: packets.DatR{LoRa: "foo"}},
+			Error: "invalid lora data-rate: foo",
+		},
+		{
+			Name:  "invalid coding-rate",
+			TXPK:  packets.TXPK{Modu: "LORA", DatR: packets.DatR{LoRa: "SF7BW125"}, CodR: "4/9"},
+			Error: "invalid lora coding-rate: 4/9",
+		},
+		{
+			Name:  "invalid modulation",
+			TXPK:  packets.TXPK{},
+			Error: "invalid modulation: ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			airtime, err := getTimeOnAir(test.TXPK)
+			if test.Error != "" {
+				assert.EqualError(err, test.Error)
+				return
+			}
+
+			assert.NoError(err)
+			assert.Equal(test.Airtime, airtime)
+		})
+	}
+}
+
+func TestDutyCycleTracker(t *testing.T) {
+	assert := require.New(t)
+
+	tracker := newDutyCycleTracker([]config.SemtechUDPDutyCycleSubBand{
+		{FrequencyMin: 868000000, FrequencyMax: 868600000, DutyCycle: 1},
+	})
+	now := time.Now()
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	reserve := func(gatewayID lorawan.EUI64, frequency uint32, airtime time.Duration, now time.Time) error {
+		_, err := tracker.reserve(gatewayID, frequency, airtime, now)
+		return err
+	}
+
+	// the budget is 36s per hour
+	assert.NoError(reserve(gatewayID, 868100000, 30*time.Second, now))
+	assert.Equal(ErrDutyCycleExceeded, reserve(gatewayID, 868100000, 10*time.Second, now.Add(time.Minute)))
+	assert.NoError(reserve(gatewayID, 868100000, 6*time.Second, now.Add(time.Minute)))
+
+	// the budget is per gateway
+	assert.NoError(reserve(lorawan.EUI64{1}, 868100000, 30*time.Second, now))
+
+	// frequencies outside the sub-bands are not accounted
+	r, err := tracker.reserve(gatewayID, 869525000, time.Hour, now)
+	assert.NoError(err)
+	assert.Nil(r)
+	tracker.release(r)
+
+	// usage outside the rolling window is released
+	assert.Equal(ErrDutyCycleExceeded, reserve(gatewayID, 868100000, 30*time.Second, now.Add(time.Hour-time.Second)))
+	assert.NoError(reserve(gatewayID, 868100000, 30*time.Second, now.Add(time.Hour)))
+
+	// released usage is not accounted
+	r, err = tracker.reserve(lorawan.EUI64{2}, 868100000, 30*time.Second, now)
+	assert.NoError(err)
+	assert.NotNil(r)
+	assert.Equal(ErrDutyCycleExceeded, reserve(lorawan.EUI64{2}, 868100000, 30*time.Second, now))
+	tracker.release(r)
+	tracker.release(r)
+	assert.NoError(reserve(lorawan.EUI64{2}, 868100000, 30*time.Second, now))
+	assert.Equal(ErrDutyCycleExceeded, reserve(lorawan.EUI64{2}, 868100000, 30*time.Second, now))
+}
@@ -0,0 +1,112 @@
+package semtechudp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/lorawan"
+)
+
+// logFramesEnabled returns true when the decoded frames must be logged.
+func (b *Backend) logFramesEnabled() bool {
+	return b.logFrames && log.IsLevelEnabled(log.DebugLevel)
+}
+
+// logUplinkFrame logs the decoded uplink frame (see log_frames).
+func (b *Backend) logUplinkFrame(frame gw.UplinkFrame) {
+	if !b.logFramesEnabled() {
+		return
+	}
+
+	txInfo := frame.GetTxInfo()
+	rxInfo := frame.GetRxInfo()
+
+	fields := log.Fields{
+		"gateway_id": hex.EncodeToString(rxInfo.GetGatewayId()),
+		"uplink_id":  uuid.FromBytesOrNil(rxInfo.GetUplinkId()),
+		"frequency":  txInfo.GetFrequency(),
+		"modulation": txInfo.GetModulation(),
+		"rssi":       rxInfo.GetRssi(),
+		"lora_snr":   rxInfo.GetLoraSnr(),
+		"channel":    rxInfo.GetChannel(),
+		"rf_chain":   rxInfo.GetRfChain(),
+		"board":      rxInfo.GetBoard(),
+		"antenna":    rxInfo.GetAntenna(),
+		"crc_status": rxInfo.GetCrcStatus(),
+	}
+
+	if modInfo := txInfo.GetLoraModulationInfo(); modInfo != nil {
+		fields["spreading_factor"] = modInfo.GetSpreadingFactor()
+		fields["bandwidth"] = modInfo.GetBandwidth()
+		fields["code_rate"] = modInfo.GetCodeRate()
+	}
+	if modInfo := txInfo.GetFskModulationInfo(); modInfo != nil {
+		fields["datarate"] = modInfo.GetDatarate()
+	}
+
+	b.addPHYPayloadFields(fields, frame.PhyPayload)
+
+	log.WithFields(fields).Debug("backend/semtechudp: uplink frame")
+}
+
+// logDownlinkFrame logs the decoded downlink txpk (see log_frames).
+func (b *Backend) logDownlinkFrame(gatewayID lorawan.EUI64, txpk packets.TXPK) {
+	if !b.logFramesEnabled() {
+		return
+	}
+
+	fields := log.Fields{
+		"gateway_id": gatewayID,
+		"frequency":  txpk.Freq,
+		"modulation": txpk.Modu,
+		"power":      txpk.Powe,
+		"rf_chain":   txpk.RFCh,
+		"board":      txpk.Brd,
+		"antenna":    txpk.Ant,
+		"immediate":  txpk.Imme,
+	}
+	if txpk.DatR.LoRa != "" {
+		fields["datr"] = txpk.DatR.LoRa
+	} else {
+		fields["datr"] = txpk.DatR.FSK
+	}
+	if txpk.Tmst != nil {
+		fields["tmst"] = *txpk.Tmst
+	}
+	if txpk.Tmms != nil {
+		fields["tmms"] = *txpk.Tmms
+	}
+
+	b.addPHYPayloadFields(fields, txpk.Data)
+
+	log.WithFields(fields).Debug("backend/semtechudp: downlink frame")
+}
+
+// addPHYPayloadFields adds the MType and device identifiers of the given
+// PHYPayload to the log fields. The payload itself is only added when
+// log_frames_redact is disabled.
+func (b *Backend) addPHYPayloadFields(fields log.Fields, phyPayload []byte) {
+	if !b.logFramesRedact {
+		fields["data_base64"] = base64.StdEncoding.EncodeToString(phyPayload)
+	}
+
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(phyPayload); err != nil {
+		return
+	}
+
+	fields["mtype"] = phy.MHDR.MType
+	switch pl := phy.MACPayload.(type) {
+	case *lorawan.MACPayload:
+		fields["dev_addr"] = pl.FHDR.DevAddr
+		fields["f_cnt"] = pl.FHDR.FCnt
+	case *lorawan.JoinRequestPayload:
+		fields["join_eui"] = pl.JoinEUI
+		fields["dev_eui"] = pl.DevEUI
+	}
+}
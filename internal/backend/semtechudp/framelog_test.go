@@ -0,0 +1,93 @@
+package semtechudp
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/lorawan"
+)
+
+func TestLogFrames(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{
+				DevAddr: lorawan.DevAddr{1, 2, 3, 4},
+				FCnt:    10,
+			},
+		},
+	}
+	phyB, err := phy.MarshalBinary()
+	require.NoError(t, err)
+
+	frame := gw.UplinkFrame{
+		PhyPayload: phyB,
+		TxInfo: &gw.UplinkTXInfo{
+			Frequency: 868100000,
+		},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Rssi:      -60,
+		},
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		assert := require.New(t)
+		hook.Reset()
+
+		var b Backend
+		b.logUplinkFrame(frame)
+		assert.Len(hook.AllEntries(), 0)
+	})
+
+	t.Run("Uplink", func(t *testing.T) {
+		assert := require.New(t)
+		hook.Reset()
+
+		b := Backend{logFrames: true}
+		b.logUplinkFrame(frame)
+
+		e := hook.LastEntry()
+		assert.NotNil(e)
+		assert.Equal("0102030405060708", e.Data["gateway_id"])
+		assert.Equal(uint32(868100000), e.Data["frequency"])
+		assert.Equal(int32(-60), e.Data["rssi"])
+		assert.Equal(lorawan.UnconfirmedDataUp, e.Data["mtype"])
+		assert.Equal(lorawan.DevAddr{1, 2, 3, 4}, e.Data["dev_addr"])
+		assert.Contains(e.Data, "data_base64")
+	})
+
+	t.Run("Downlink redacted", func(t *testing.T) {
+		assert := require.New(t)
+		hook.Reset()
+
+		b := Backend{logFrames: true, logFramesRedact: true}
+		b.logDownlinkFrame(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, packets.TXPK{
+			Freq: 868.1,
+			DatR: packets.DatR{LoRa: "SF7BW125"},
+			Data: phyB,
+		})
+
+		e := hook.LastEntry()
+		assert.NotNil(e)
+		assert.Equal(868.1, e.Data["frequency"])
+		assert.Equal("SF7BW125", e.Data["datr"])
+		assert.Equal(lorawan.DevAddr{1, 2, 3, 4}, e.Data["dev_addr"])
+		assert.NotContains(e.Data, "data_base64")
+	})
+}
@@ -0,0 +1,106 @@
+package semtechudp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// goroutineGroup is like a sync.WaitGroup, but it keeps track of the names
+// of the running goroutines, so that the goroutines with a given name can be
+// waited for and so that these can be logged when waiting times out.
+type goroutineGroup struct {
+	mux     sync.Mutex
+	running map[string]int
+
+	// changed is closed (and reset) when a goroutine returns.
+	changed chan struct{}
+}
+
+// add must be called before starting the goroutine with the given name.
+func (g *goroutineGroup) add(name string) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if g.running == nil {
+		g.running = make(map[string]int)
+	}
+	g.running[name]++
+}
+
+// done must be called by the goroutine with the given name when it returns.
+func (g *goroutineGroup) done(name string) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	g.running[name]--
+	if g.running[name] <= 0 {
+		delete(g.running, name)
+	}
+
+	if g.changed != nil {
+		close(g.changed)
+		g.changed = nil
+	}
+}
+
+// wait waits for the goroutines with the given names to return, or for all
+// goroutines when no names are given. When the timeout is not 0, it returns
+// false when the goroutines did not return within the timeout.
+func (g *goroutineGroup) wait(timeout time.Duration, names ...string) bool {
+	var timeoutChan <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	for {
+		g.mux.Lock()
+		running := g.isRunning(names)
+		if g.changed == nil {
+			g.changed = make(chan struct{})
+		}
+		changed := g.changed
+		g.mux.Unlock()
+
+		if !running {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-timeoutChan:
+			return false
+		}
+	}
+}
+
+// isRunning returns true when one of the goroutines with the given names
+// (or any goroutine when no names are given) is running. The caller must
+// hold the lock.
+func (g *goroutineGroup) isRunning(names []string) bool {
+	if len(names) == 0 {
+		return len(g.running) != 0
+	}
+
+	for _, name := range names {
+		if g.running[name] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the (sorted) names of the running goroutines.
+func (g *goroutineGroup) list() []string {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	var out []string
+	for name := range g.running {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,109 @@
+package semtechudp
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/lorawan"
+)
+
+// Health metrics.
+const (
+	HealthMetricACKRatio  = "ack_ratio"
+	HealthMetricRXOKRatio = "rx_ok_ratio"
+	HealthMetricIdle      = "idle_intervals"
+)
+
+// HealthEvent is emitted when a health metric of a gateway starts failing.
+type HealthEvent struct {
+	GatewayID lorawan.EUI64
+	Metric    string
+	Value     float64
+	Threshold float64
+}
+
+// HealthFunc defines the function signature of the health event handler.
+type HealthFunc func(HealthEvent)
+
+// healthConfig contains the health thresholds. A zero value disables the
+// threshold.
+type healthConfig struct {
+	minACKRatio      float64
+	minRXOKRatio     float64
+	maxIdleIntervals int
+}
+
+func (c healthConfig) enabled() bool {
+	return c.minACKRatio != 0 || c.minRXOKRatio != 0 || c.maxIdleIntervals != 0
+}
+
+// SetHealthFunc sets the function which is called when a health metric of a
+// gateway starts failing. It is called once per failing metric, until the
+// metric has recovered. Like the uplink filter, it is called from the packet
+// handler goroutine. Set it to nil to disable.
+func (b *Backend) SetHealthFunc(fn HealthFunc) {
+	b.hooksMux.Lock()
+	defer b.hooksMux.Unlock()
+	b.hooks.healthFunc = fn
+}
+
+// evaluateHealth evaluates the given stats against the health thresholds.
+func (b *Backend) evaluateHealth(gatewayID lorawan.EUI64, stat packets.Stat) {
+	if !b.health.enabled() {
+		return
+	}
+
+	var evs []HealthEvent
+
+	_ = b.gateways.update(gatewayID, func(gw *gateway) {
+		if gw.failingHealth == nil {
+			gw.failingHealth = make(map[string]bool)
+		}
+
+		check := func(metric string, failing, skip bool, value, threshold float64) {
+			if skip {
+				return
+			}
+			if failing && !gw.failingHealth[metric] {
+				evs = append(evs, HealthEvent{
+					GatewayID: gatewayID,
+					Metric:    metric,
+					Value:     value,
+					Threshold: threshold,
+				})
+			}
+			gw.failingHealth[metric] = failing
+		}
+
+		if stat.RXFW == 0 {
+			gw.idleIntervals++
+		} else {
+			gw.idleIntervals = 0
+		}
+
+		// the ack ratio is only meaningful when packets were forwarded
+		ackRatio := stat.ACKR / 100
+		check(HealthMetricACKRatio, ackRatio < b.health.minACKRatio, b.health.minACKRatio == 0 || stat.RXFW == 0, ackRatio, b.health.minACKRatio)
+
+		var rxOKRatio float64
+		if stat.RXNb != 0 {
+			rxOKRatio = float64(stat.RXOK) / float64(stat.RXNb)
+		}
+		check(HealthMetricRXOKRatio, rxOKRatio < b.health.minRXOKRatio, b.health.minRXOKRatio == 0 || stat.RXNb == 0, rxOKRatio, b.health.minRXOKRatio)
+
+		check(HealthMetricIdle, gw.idleIntervals >= b.health.maxIdleIntervals, b.health.maxIdleIntervals == 0, float64(gw.idleIntervals), float64(b.health.maxIdleIntervals))
+	})
+
+	for _, e := range evs {
+		log.WithFields(log.Fields{
+			"gateway_id": e.GatewayID,
+			"metric":     e.Metric,
+			"value":      e.Value,
+			"threshold":  e.Threshold,
+		}).Warning("backend/semtechudp: gateway health degraded")
+
+		if fn := b.getHooks().healthFunc; fn != nil {
+			fn(e)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package semtechudp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestEvaluateHealth(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	conf.Backend.SemtechUDP.Health.MinACKRatio = 0.9
+	conf.Backend.SemtechUDP.Health.MinRXOKRatio = 0.5
+	conf.Backend.SemtechUDP.Health.MaxIdleIntervals = 2
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	defer b.Close()
+	go func() {
+		for range b.GetSubscribeEventChan() {
+		}
+	}()
+
+	var evs []HealthEvent
+	b.SetHealthFunc(func(e HealthEvent) {
+		evs = append(evs, e)
+	})
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.NoError(b.gateways.set(gatewayID, gateway{
+		addr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700},
+		lastSeen: time.Now(),
+	}))
+
+	tests := []struct {
+		Name   string
+		Stat   packets.Stat
+		Events []HealthEvent
+	}{
+		{
+			Name: "healthy",
+			Stat: packets.Stat{RXNb: 10, RXOK: 10, RXFW: 10, ACKR: 100},
+		},
+		{
+			Name: "ack ratio and rx ok ratio failing",
+			Stat: packets.Stat{RXNb: 10, RXOK: 4, RXFW: 4, ACKR: 50},
+			Events: []HealthEvent{
+				{GatewayID: gatewayID, Metric: HealthMetricACKRatio, Value: 0.5, Threshold: 0.9},
+				{GatewayID: gatewayID, Metric: HealthMetricRXOKRatio, Value: 0.4, Threshold: 0.5},
+			},
+		},
+		{
+			Name: "still failing",
+			Stat: packets.Stat{RXNb: 10, RXOK: 4, RXFW: 4, ACKR: 50},
+		},
+		{
+			Name: "recovered",
+			Stat: packets.Stat{RXNb: 10, RXOK: 10, RXFW: 10, ACKR: 100},
+		},
+		{
+			Name: "first idle interval",
+			Stat: packets.Stat{},
+		},
+		{
+			Name: "second idle interval",
+			Stat: packets.Stat{},
+			Events: []HealthEvent{
+				{GatewayID: gatewayID, Metric: HealthMetricIdle, Value: 2, Threshold: 2},
+			},
+		},
+		{
+			Name: "ack ratio failing again, idle recovered",
+			Stat: packets.Stat{RXNb: 10, RXOK: 10, RXFW: 10, ACKR: 80},
+			Events: []HealthEvent{
+				{GatewayID: gatewayID, Metric: HealthMetricACKRatio, Value: 0.8, Threshold: 0.9},
+			},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			evs = nil
+			b.evaluateHealth(gatewayID, tst.Stat)
+			assert.Equal(tst.Events, evs)
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/lorawan"
+)
+
+// ErrTooLate is returned when the transmit time of a timestamped downlink
+// has already passed (see jit_lead_time and jit_past_margin).
+var ErrTooLate = errors.New("downlink transmit time has passed")
+
+// ErrGatewayRebooted is reported for the timestamped downlinks which were
+// dropped from the JIT queue, because the gateway rebooted (see
+// reboot_tmst_threshold).
+var ErrGatewayRebooted = errors.New("gateway rebooted")
+
+// ErrTooEarly is returned when the transmit time of a timestamped downlink
+// is too far in the future (see jit_future_margin).
+var ErrTooEarly = errors.New("downlink transmit time too far in the future")
+
+// maxTmstEstimateAge defines the max. age of the last uplink tmst used for
+// estimating the gateway counter. The 32 bit (microsecond) counter wraps
+// around every ~71 minutes.
+const maxTmstEstimateAge = 30 * time.Minute
+
+// minTmstDriftInterval defines the min. interval over which the counter
+// drift is measured, so that the network jitter is negligible. Measurements
+// exceeding maxTmstDrift (e.g. because the concentrator was restarted) are
+// ignored.
+const (
+	minTmstDriftInterval = time.Minute
+	maxTmstDrift         = 0.001
+)
+
+type jitItem struct {
+	releaseAt time.Time
+	packet    udpPacket
+}
+
+// jitQueue holds the timestamped downlinks until just before their transmit
+// time, ordered by release time.
+type jitQueue struct {
+	sync.Mutex
+
+	items []jitItem
+	timer *time.Timer
+	send  func(udpPacket)
+}
+
+func newJITQueue(send func(udpPacket)) *jitQueue {
+	return &jitQueue{
+		send: send,
+	}
+}
+
+// add adds the packet to the queue, to be sent at the given time.
+func (q *jitQueue) add(releaseAt time.Time, p udpPacket) {
+	q.Lock()
+	defer q.Unlock()
+
+	i := sort.Search(len(q.items), func(i int) bool {
+		return q.items[i].releaseAt.After(releaseAt)
+	})
+	q.items = append(q.items, jitItem{})
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = jitItem{releaseAt: releaseAt, packet: p}
+
+	q.resetTimer()
+}
+
+// resetTimer must be called with the lock held.
+func (q *jitQueue) resetTimer() {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+
+	if len(q.items) != 0 {
+		q.timer = time.AfterFunc(time.Until(q.items[0].releaseAt), q.flush)
+	}
+}
+
+// flush sends all the packets of which the release time has passed.
+func (q *jitQueue) flush() {
+	q.Lock()
+	var due []udpPacket
+	now := time.Now()
+	for len(q.items) != 0 && !q.items[0].releaseAt.After(now) {
+		due = append(due, q.items[0].packet)
+		q.items = q.items[1:]
+	}
+	q.resetTimer()
+	q.Unlock()
+
+	for _, p := range due {
+		q.send(p)
+	}
+}
+
+// close stops the queue. The pending packets are dropped.
+func (q *jitQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, item := range q.items {
+		if item.packet.result != nil {
+			item.packet.result <- ErrBackendClosed
+		}
+	}
+	q.items = nil
+	q.resetTimer()
+}
+
+// removeGateway removes and returns the queued packets for the given
+// gateway.
+func (q *jitQueue) removeGateway(gatewayID lorawan.EUI64) []udpPacket {
+	q.Lock()
+	defer q.Unlock()
+
+	var removed []udpPacket
+	items := q.items[:0]
+	for _, item := range q.items {
+		if item.packet.downlinkGatewayID != nil && *item.packet.downlinkGatewayID == gatewayID {
+			removed = append(removed, item.packet)
+			continue
+		}
+		items = append(items, item)
+	}
+	q.items = items
+	q.resetTimer()
+
+	return removed
+}
+
+// len returns the number of queued packets.
+func (q *jitQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
+}
+
+// countByGateway returns the number of queued packets per gateway.
+func (q *jitQueue) countByGateway() map[lorawan.EUI64]int {
+	q.Lock()
+	defer q.Unlock()
+
+	out := make(map[lorawan.EUI64]int)
+	for _, item := range q.items {
+		if item.packet.downlinkGatewayID != nil {
+			out[*item.packet.downlinkGatewayID]++
+		}
+	}
+	return out
+}
+
+// getJITReleaseTime returns the time at which the downlink with the given
+// tmst must be sent to the gateway. The gateway counter is estimated using
+// the tmst of the last uplink, corrected by the estimated drift of the
+// counter. When there is no (recent) estimate, the downlink is released
+// immediately. Downlinks of which the transmit time passed more than the past
+// margin ago, or is more than the future margin (when set) ahead, are
+// rejected.
+func (b *Backend) getJITReleaseTime(gc gatewayConfig, gw gateway, tmst uint32, now time.Time) (time.Time, error) {
+	if gw.lastTmstTime.IsZero() || now.Sub(gw.lastTmstTime) > maxTmstEstimateAge {
+		return now, nil
+	}
+
+	elapsed := float64(now.Sub(gw.lastTmstTime)/time.Microsecond) * (1 + gw.tmstDrift)
+	gwNow := gw.lastTmst + uint32(elapsed)
+	delta := time.Duration(int32(tmst-gwNow)) * time.Microsecond
+	if delta <= -gc.jitPastMargin {
+		return time.Time{}, ErrTooLate
+	}
+
+	if gc.jitFutureMargin > 0 && delta > gc.jitFutureMargin {
+		return time.Time{}, ErrTooEarly
+	}
+
+	if delta <= b.jitLeadTime {
+		return now, nil
+	}
+
+	return now.Add(delta - b.jitLeadTime), nil
+}
+
+// updateTmstDrift updates the drift estimate of the concentrator counter of
+// the given gateway, using the tmst of an uplink received at the given time.
+// The estimate is a moving average of the measurements over (at least)
+// minTmstDriftInterval.
+func updateTmstDrift(gw *gateway, tmst uint32, now time.Time) {
+	elapsed := now.Sub(gw.driftTmstTime)
+	if gw.driftTmstTime.IsZero() || elapsed > maxTmstEstimateAge {
+		gw.driftTmst = tmst
+		gw.driftTmstTime = now
+		return
+	}
+
+	if elapsed < minTmstDriftInterval {
+		return
+	}
+
+	expected := uint32(elapsed / time.Microsecond)
+	drift := float64(int32(tmst-gw.driftTmst-expected)) / float64(expected)
+	if drift >= -maxTmstDrift && drift <= maxTmstDrift {
+		if gw.tmstDrift == 0 {
+			gw.tmstDrift = drift
+		} else {
+			gw.tmstDrift = (7*gw.tmstDrift + drift) / 8
+		}
+	}
+
+	gw.driftTmst = tmst
+	gw.driftTmstTime = now
+}
+
+// getTmstReset returns the estimated counter value and true when the given
+// tmst (received at the given time) is more than the threshold behind the
+// counter as estimated from the last uplink of the gateway, e.g. because the
+// gateway rebooted. Unlike the JIT estimate, the wrap-around of the counter
+// is not treated as a jump.
+func getTmstReset(gw gateway, tmst uint32, now time.Time, threshold time.Duration) (uint32, bool) {
+	if gw.lastTmstTime.IsZero() || now.Sub(gw.lastTmstTime) > maxTmstEstimateAge {
+		return 0, false
+	}
+
+	expected := int64(gw.lastTmst) + int64(now.Sub(gw.lastTmstTime)/time.Microsecond)
+	actual := int64(tmst)
+	if expected > math.MaxUint32 {
+		// the counter wrapped around since the last uplink
+		actual += math.MaxUint32 + 1
+	}
+
+	if time.Duration(expected-actual)*time.Microsecond <= threshold {
+		return 0, false
+	}
+
+	return uint32(expected), true
+}
+
+// handleReboot drops the timestamped downlinks for the rebooted gateway
+// from the JIT queue and calls the reboot function.
+func (b *Backend) handleReboot(e RebootEvent) {
+	var dropped []udpPacket
+	if b.jit != nil {
+		dropped = b.jit.removeGateway(e.GatewayID)
+	}
+	e.DroppedDownlinks = len(dropped)
+
+	log.WithFields(log.Fields{
+		"gateway_id":        e.GatewayID,
+		"expected_tmst":     e.ExpectedTmst,
+		"tmst":              e.Tmst,
+		"dropped_downlinks": e.DroppedDownlinks,
+	}).Warning("backend/semtechudp: gateway reboot detected")
+	rebootCounter().Inc()
+
+	for _, p := range dropped {
+		p.setResult(ErrGatewayRebooted)
+
+		if pt, err := packets.GetPacketType(p.data); err != nil || pt != packets.PullResp {
+			continue
+		}
+
+		token := binary.LittleEndian.Uint16(p.data[1:3])
+		if b.txAcks != nil {
+			b.txAcks.ack(token)
+		}
+		if b.dutyCycle != nil {
+			b.dutyCycle.release(p.dutyCycle)
+		}
+		if _, ok := b.cache.Get(fmt.Sprintf("%d:frame", token)); ok {
+			b.sendTXAckError(token, e.GatewayID, ErrGatewayRebooted)
+		}
+	}
+
+	if fn := b.getHooks().rebootFunc; fn != nil {
+		fn(e)
+	}
+}
+
+// sendJITPacket sends the packet released by the JIT queue.
+func (b *Backend) sendJITPacket(p udpPacket) {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.isClosed() {
+		if p.result != nil {
+			p.result <- ErrBackendClosed
+		}
+		return
+	}
+
+	b.sendDownlinkPacket(p)
+}
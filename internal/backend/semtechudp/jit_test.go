@@ -0,0 +1,226 @@
+package semtechudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestJITQueue(t *testing.T) {
+	assert := require.New(t)
+
+	sent := make(chan udpPacket, 3)
+	q := newJITQueue(func(p udpPacket) {
+		sent <- p
+	})
+
+	now := time.Now()
+	q.add(now.Add(60*time.Millisecond), udpPacket{data: []byte{3}})
+	q.add(now.Add(20*time.Millisecond), udpPacket{data: []byte{1}})
+	q.add(now.Add(40*time.Millisecond), udpPacket{data: []byte{2}})
+	assert.Equal(3, q.len())
+
+	for _, exp := range []byte{1, 2, 3} {
+		p := <-sent
+		assert.Equal([]byte{exp}, p.data)
+	}
+	assert.Equal(0, q.len())
+
+	t.Run("Close", func(t *testing.T) {
+		assert := require.New(t)
+
+		result := make(chan error, 1)
+		q.add(time.Now().Add(time.Hour), udpPacket{result: result})
+		q.close()
+
+		assert.Equal(ErrBackendClosed, <-result)
+		assert.Equal(0, q.len())
+	})
+
+	t.Run("Remove gateway", func(t *testing.T) {
+		assert := require.New(t)
+
+		gatewayA := lorawan.EUI64{1}
+		gatewayB := lorawan.EUI64{2}
+		q.add(time.Now().Add(time.Hour), udpPacket{data: []byte{1}, downlinkGatewayID: &gatewayA})
+		q.add(time.Now().Add(time.Hour), udpPacket{data: []byte{2}, downlinkGatewayID: &gatewayB})
+		q.add(time.Now().Add(time.Hour), udpPacket{data: []byte{3}, downlinkGatewayID: &gatewayA})
+
+		removed := q.removeGateway(gatewayA)
+		assert.Len(removed, 2)
+		assert.Equal([]byte{1}, removed[0].data)
+		assert.Equal([]byte{3}, removed[1].data)
+		assert.Equal(1, q.len())
+		q.close()
+	})
+}
+
+func TestGetJITReleaseTime(t *testing.T) {
+	now := time.Now()
+	b := Backend{jitLeadTime: 100 * time.Millisecond}
+
+	tests := []struct {
+		Name      string
+		Config    gatewayConfig
+		Gateway   gateway
+		Tmst      uint32
+		ReleaseAt time.Time
+		Error     error
+	}{
+		{
+			Name:      "no estimate",
+			Tmst:      5000000,
+			ReleaseAt: now,
+		},
+		{
+			Name:      "outdated estimate",
+			Gateway:   gateway{lastTmst: 1000000, lastTmstTime: now.Add(-time.Hour)},
+			Tmst:      5000000,
+			ReleaseAt: now,
+		},
+		{
+			Name:      "release before transmit time",
+			Gateway:   gateway{lastTmst: 1000000, lastTmstTime: now.Add(-time.Second)},
+			Tmst:      4000000,
+			ReleaseAt: now.Add(2*time.Second - 100*time.Millisecond),
+		},
+		{
+			Name:      "within lead time",
+			Gateway:   gateway{lastTmst: 1000000, lastTmstTime: now.Add(-time.Second)},
+			Tmst:      2050000,
+			ReleaseAt: now,
+		},
+		{
+			Name:      "counter wrap-around",
+			Gateway:   gateway{lastTmst: 4294967000, lastTmstTime: now},
+			Tmst:      999704,
+			ReleaseAt: now.Add(900 * time.Millisecond),
+		},
+		{
+			Name:    "too late",
+			Gateway: gateway{lastTmst: 1000000, lastTmstTime: now.Add(-time.Second)},
+			Tmst:    1500000,
+			Error:   ErrTooLate,
+		},
+		{
+			Name:      "within past margin",
+			Config:    gatewayConfig{jitPastMargin: time.Second},
+			Gateway:   gateway{lastTmst: 1000000, lastTmstTime: now.Add(-time.Second)},
+			Tmst:      1500000,
+			ReleaseAt: now,
+		},
+		{
+			Name:    "exceeds future margin",
+			Config:  gatewayConfig{jitFutureMargin: time.Second},
+			Gateway: gateway{lastTmst: 1000000, lastTmstTime: now.Add(-time.Second)},
+			Tmst:    4000000,
+			Error:   ErrTooEarly,
+		},
+		{
+			Name: "drift",
+			// the gateway counter runs 10% fast, it is at 2100000 instead
+			// of 2000000
+			Gateway: gateway{lastTmst: 1000000, lastTmstTime: now.Add(-time.Second), tmstDrift: 0.1},
+			Tmst:    2050000,
+			Error:   ErrTooLate,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			releaseAt, err := b.getJITReleaseTime(tst.Config, tst.Gateway, tst.Tmst, now)
+			assert.Equal(tst.Error, err)
+			assert.True(tst.ReleaseAt.Equal(releaseAt), "expected %s, got %s", tst.ReleaseAt, releaseAt)
+		})
+	}
+}
+
+func TestGetTmstReset(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		Name     string
+		Gateway  gateway
+		Tmst     uint32
+		Expected uint32
+		Reset    bool
+	}{
+		{
+			Name: "no estimate",
+			Tmst: 1000,
+		},
+		{
+			Name:    "outdated estimate",
+			Gateway: gateway{lastTmst: 100000000, lastTmstTime: now.Add(-time.Hour)},
+			Tmst:    1000,
+		},
+		{
+			Name:    "counter incremented",
+			Gateway: gateway{lastTmst: 100000000, lastTmstTime: now.Add(-time.Second)},
+			Tmst:    101000000,
+		},
+		{
+			Name:    "within threshold",
+			Gateway: gateway{lastTmst: 100000000, lastTmstTime: now.Add(-time.Second)},
+			Tmst:    96000000,
+		},
+		{
+			Name:    "counter wrap-around",
+			Gateway: gateway{lastTmst: 4294967000, lastTmstTime: now.Add(-time.Second)},
+			Tmst:    999704,
+		},
+		{
+			Name:     "counter reset",
+			Gateway:  gateway{lastTmst: 100000000, lastTmstTime: now.Add(-time.Second)},
+			Tmst:     1000,
+			Expected: 101000000,
+			Reset:    true,
+		},
+		{
+			Name:     "counter reset after estimated wrap-around",
+			Gateway:  gateway{lastTmst: 4294967000, lastTmstTime: now.Add(-time.Minute)},
+			Tmst:     1000,
+			Expected: 59999704,
+			Reset:    true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			expected, reset := getTmstReset(tst.Gateway, tst.Tmst, now, 5*time.Second)
+			assert.Equal(tst.Reset, reset)
+			assert.Equal(tst.Expected, expected)
+		})
+	}
+}
+
+func TestUpdateTmstDrift(t *testing.T) {
+	assert := require.New(t)
+	now := time.Now()
+
+	var gw gateway
+	updateTmstDrift(&gw, 1000000, now)
+	assert.Equal(uint32(1000000), gw.driftTmst)
+	assert.EqualValues(0, gw.tmstDrift)
+
+	// within the min. interval
+	updateTmstDrift(&gw, 2000000, now.Add(time.Second))
+	assert.Equal(uint32(1000000), gw.driftTmst)
+
+	// 20 ppm fast
+	updateTmstDrift(&gw, 1000000+60001200, now.Add(time.Minute))
+	assert.InDelta(0.00002, gw.tmstDrift, 0.000001)
+	assert.Equal(uint32(61001200), gw.driftTmst)
+
+	// counter reset, the measurement is ignored
+	updateTmstDrift(&gw, 5, now.Add(2*time.Minute))
+	assert.InDelta(0.00002, gw.tmstDrift, 0.000001)
+	assert.Equal(uint32(5), gw.driftTmst)
+}
@@ -0,0 +1,380 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/lorawan"
+)
+
+// LoadConfig contains the configuration of the synthetic gateway load (see
+// GenerateLoad).
+type LoadConfig struct {
+	// Number of fake gateways.
+	Gateways int
+
+	// Duration of the load.
+	Duration time.Duration
+
+	// Interval of the PullData keepalives of each gateway (default 5s).
+	KeepaliveInterval time.Duration
+
+	// Number of PushData packets per second, per gateway. Set to 0 to only
+	// send keepalives.
+	PushDataRate float64
+
+	// Number of RXPK per PushData packet (default 1).
+	RXPKPerPushData int
+
+	// Size of the random PHYPayload of each RXPK (default 16).
+	PayloadSize int
+
+	// Time to wait for the outstanding ACKs after the load (default 1s).
+	AckWait time.Duration
+
+	// Seed of the random RXPK, each gateway uses Seed + its index.
+	Seed int64
+}
+
+// LoadStats contains the statistics of the synthetic gateway load.
+type LoadStats struct {
+	// Duration of the load (excluding the AckWait).
+	Duration time.Duration
+
+	// Number of packets sent.
+	PullDataSent int
+	PushDataSent int
+	RXPKSent     int
+
+	// Number of ACKs received.
+	PullACKReceived int
+	PushACKReceived int
+
+	// Number of send and receive errors.
+	Errors int
+
+	// The ACK latency (from sending the packet until receiving its ACK).
+	AckLatencyAvg time.Duration
+	AckLatencyMax time.Duration
+}
+
+// PushDataPerSecond returns the PushData throughput.
+func (s LoadStats) PushDataPerSecond() float64 {
+	if s.Duration == 0 {
+		return 0
+	}
+	return float64(s.PushDataSent) / s.Duration.Seconds()
+}
+
+// RXPKPerSecond returns the RXPK (uplink) throughput.
+func (s LoadStats) RXPKPerSecond() float64 {
+	if s.Duration == 0 {
+		return 0
+	}
+	return float64(s.RXPKSent) / s.Duration.Seconds()
+}
+
+// GenerateLoad generates a synthetic gateway load against the backend
+// listening on addr (see Backend.ListenAddr), e.g. to validate performance
+// work. It spins up the configured number of fake gateways, each using its
+// own UDP socket and sending PullData keepalives and PushData packets with
+// random RXPK, and blocks until the load has finished.
+//
+// Note that the backend must be consumed (e.g. GetUplinkFrameChan), else
+// it will block on forwarding the uplinks.
+func GenerateLoad(addr *net.UDPAddr, conf LoadConfig) (LoadStats, error) {
+	if conf.Gateways < 1 {
+		return LoadStats{}, errors.New("at least one gateway is required")
+	}
+	if conf.KeepaliveInterval == 0 {
+		conf.KeepaliveInterval = 5 * time.Second
+	}
+	if conf.RXPKPerPushData == 0 {
+		conf.RXPKPerPushData = 1
+	}
+	if conf.PayloadSize == 0 {
+		conf.PayloadSize = 16
+	}
+	if conf.AckWait == 0 {
+		conf.AckWait = time.Second
+	}
+
+	var gws []*loadGateway
+	defer func() {
+		for _, g := range gws {
+			g.close()
+		}
+	}()
+
+	for i := 0; i < conf.Gateways; i++ {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return LoadStats{}, errors.Wrap(err, "dial udp error")
+		}
+
+		g := &loadGateway{
+			conn:    conn,
+			conf:    conf,
+			rand:    rand.New(rand.NewSource(conf.Seed + int64(i))),
+			pending: make(map[uint16]time.Time),
+		}
+		g.gatewayID[0] = 0xff
+		g.gatewayID[1] = 0xfe
+		binary.BigEndian.PutUint32(g.gatewayID[4:], uint32(i))
+		gws = append(gws, g)
+	}
+
+	var readers sync.WaitGroup
+	var writers sync.WaitGroup
+	start := time.Now()
+	stop := time.After(conf.Duration)
+	stopChan := make(chan struct{})
+
+	for _, g := range gws {
+		readers.Add(1)
+		go func(g *loadGateway) {
+			defer readers.Done()
+			g.readACKs()
+		}(g)
+
+		writers.Add(1)
+		go func(g *loadGateway) {
+			defer writers.Done()
+			g.sendPackets(stopChan)
+		}(g)
+	}
+
+	<-stop
+	close(stopChan)
+	writers.Wait()
+	duration := time.Since(start)
+
+	// wait for the outstanding ACKs, closing the sockets stops the readers
+	time.Sleep(conf.AckWait)
+	for _, g := range gws {
+		g.close()
+	}
+	readers.Wait()
+
+	stats := LoadStats{Duration: duration}
+	var latencySum time.Duration
+	var latencyCount int
+	for _, g := range gws {
+		stats.PullDataSent += g.stats.PullDataSent
+		stats.PushDataSent += g.stats.PushDataSent
+		stats.RXPKSent += g.stats.RXPKSent
+		stats.PullACKReceived += g.stats.PullACKReceived
+		stats.PushACKReceived += g.stats.PushACKReceived
+		stats.Errors += g.stats.Errors
+		if g.stats.AckLatencyMax > stats.AckLatencyMax {
+			stats.AckLatencyMax = g.stats.AckLatencyMax
+		}
+		latencySum += g.latencySum
+		latencyCount += g.stats.PullACKReceived + g.stats.PushACKReceived
+	}
+	if latencyCount != 0 {
+		stats.AckLatencyAvg = latencySum / time.Duration(latencyCount)
+	}
+
+	return stats, nil
+}
+
+// loadGateway is a fake gateway of the synthetic gateway load.
+type loadGateway struct {
+	sync.Mutex
+
+	conn      *net.UDPConn
+	conf      LoadConfig
+	rand      *rand.Rand
+	gatewayID lorawan.EUI64
+	token     uint16
+	tmst      uint32
+	closed    bool
+
+	// the send time of the packets waiting for an ACK, by token
+	pending    map[uint16]time.Time
+	stats      LoadStats
+	latencySum time.Duration
+}
+
+func (g *loadGateway) sendPackets(stop chan struct{}) {
+	keepalive := time.NewTicker(g.conf.KeepaliveInterval)
+	defer keepalive.Stop()
+
+	var pushData <-chan time.Time
+	if g.conf.PushDataRate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / g.conf.PushDataRate))
+		defer t.Stop()
+		pushData = t.C
+	}
+
+	// like a packet-forwarder, start with a keepalive
+	g.sendPullData()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-keepalive.C:
+			g.sendPullData()
+		case <-pushData:
+			g.sendPushData()
+		}
+	}
+}
+
+func (g *loadGateway) sendPullData() {
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     g.nextToken(),
+		GatewayMAC:      g.gatewayID,
+	}
+	b, err := p.MarshalBinary()
+	if err != nil {
+		g.addError()
+		return
+	}
+
+	if g.send(p.RandomToken, b) {
+		g.Lock()
+		g.stats.PullDataSent++
+		g.Unlock()
+	}
+}
+
+func (g *loadGateway) sendPushData() {
+	p := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     g.nextToken(),
+		GatewayMAC:      g.gatewayID,
+	}
+	for i := 0; i < g.conf.RXPKPerPushData; i++ {
+		p.Payload.RXPK = append(p.Payload.RXPK, g.randomRXPK())
+	}
+	b, err := p.MarshalBinary()
+	if err != nil {
+		g.addError()
+		return
+	}
+
+	if g.send(p.RandomToken, b) {
+		g.Lock()
+		g.stats.PushDataSent++
+		g.stats.RXPKSent += len(p.Payload.RXPK)
+		g.Unlock()
+	}
+}
+
+func (g *loadGateway) randomRXPK() packets.RXPK {
+	frequencies := []float64{868.1, 868.3, 868.5, 867.1, 867.3, 867.5, 867.7, 867.9}
+
+	g.tmst += uint32(g.rand.Intn(1000000))
+	size := g.conf.PayloadSize
+	data := make([]byte, size)
+	g.rand.Read(data)
+
+	return packets.RXPK{
+		Tmst: g.tmst,
+		Chan: uint8(g.rand.Intn(len(frequencies))),
+		Stat: 1,
+		Freq: frequencies[g.rand.Intn(len(frequencies))],
+		RSSI: int16(-120 + g.rand.Intn(90)),
+		Size: uint16(size),
+		DatR: packets.DatR{LoRa: fmt.Sprintf("SF%dBW125", 7+g.rand.Intn(6))},
+		Modu: "LORA",
+		CodR: "4/5",
+		LSNR: float64(-200+g.rand.Intn(300)) / 10,
+		Data: data,
+	}
+}
+
+func (g *loadGateway) nextToken() uint16 {
+	g.Lock()
+	defer g.Unlock()
+	g.token++
+	return g.token
+}
+
+// send sends the given packet, registering its token as pending. It returns
+// false on error.
+func (g *loadGateway) send(token uint16, b []byte) bool {
+	g.Lock()
+	g.pending[token] = time.Now()
+	g.Unlock()
+
+	if _, err := g.conn.Write(b); err != nil {
+		g.Lock()
+		delete(g.pending, token)
+		g.Unlock()
+		g.addError()
+		return false
+	}
+	return true
+}
+
+func (g *loadGateway) close() {
+	g.Lock()
+	defer g.Unlock()
+
+	if !g.closed {
+		g.closed = true
+		g.conn.Close()
+	}
+}
+
+func (g *loadGateway) addError() {
+	g.Lock()
+	g.stats.Errors++
+	g.Unlock()
+}
+
+// readACKs reads the ACKs until the socket is closed.
+func (g *loadGateway) readACKs() {
+	buf := make([]byte, 65507)
+	for {
+		n, err := g.conn.Read(buf)
+		if err != nil {
+			g.Lock()
+			closed := g.closed
+			g.Unlock()
+			if closed {
+				return
+			}
+			g.addError()
+			continue
+		}
+		if n < 4 {
+			continue
+		}
+
+		now := time.Now()
+		token := binary.LittleEndian.Uint16(buf[1:3])
+
+		g.Lock()
+		sent, ok := g.pending[token]
+		if ok {
+			delete(g.pending, token)
+
+			switch packets.PacketType(buf[3]) {
+			case packets.PullACK:
+				g.stats.PullACKReceived++
+			case packets.PushACK:
+				g.stats.PushACKReceived++
+			}
+
+			latency := now.Sub(sent)
+			g.latencySum += latency
+			if latency > g.stats.AckLatencyMax {
+				g.stats.AckLatencyMax = latency
+			}
+		}
+		g.Unlock()
+	}
+}
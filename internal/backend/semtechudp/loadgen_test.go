@@ -0,0 +1,63 @@
+package semtechudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+func TestGenerateLoad(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	defer b.Close()
+
+	uplinks := make(chan struct{}, 1000)
+	go func() {
+		for range b.GetSubscribeEventChan() {
+		}
+	}()
+	go func() {
+		for range b.GetUplinkFrameChan() {
+			uplinks <- struct{}{}
+		}
+	}()
+
+	stats, err := GenerateLoad(b.ListenAddr(), LoadConfig{
+		Gateways:          3,
+		Duration:          200 * time.Millisecond,
+		KeepaliveInterval: 50 * time.Millisecond,
+		PushDataRate:      50,
+		RXPKPerPushData:   2,
+		AckWait:           100 * time.Millisecond,
+	})
+	assert.NoError(err)
+
+	assert.Equal(0, stats.Errors)
+	assert.True(stats.PullDataSent >= 3)
+	assert.True(stats.PushDataSent > 0)
+	assert.Equal(2*stats.PushDataSent, stats.RXPKSent)
+	assert.Equal(stats.PullDataSent, stats.PullACKReceived)
+	assert.Equal(stats.PushDataSent, stats.PushACKReceived)
+	assert.True(stats.AckLatencyMax >= stats.AckLatencyAvg)
+	assert.True(stats.RXPKPerSecond() > 0)
+	assert.Len(b.GetGateways(), 3)
+
+	for i := 0; i < stats.RXPKSent; i++ {
+		select {
+		case <-uplinks:
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d uplinks, got %d", stats.RXPKSent, i)
+		}
+	}
+
+	_, err = GenerateLoad(b.ListenAddr(), LoadConfig{})
+	assert.Error(err)
+}
@@ -1,44 +1,480 @@
 package semtechudp
 
 import (
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/brocaar/lorawan"
+)
+
+// MetricsSink defines the interface for emitting the metrics of the backend,
+// e.g. to Prometheus (the default, see PrometheusMetricsSink) or statsd. The
+// name is the Prometheus style metric name, labels is nil for metrics
+// without labels.
+type MetricsSink interface {
+	IncCounter(name string, labels map[string]string)
+	AddCounter(name string, labels map[string]string, value float64)
+	SetGauge(name string, labels map[string]string, value float64)
+	ObserveHistogram(name string, labels map[string]string, value float64)
+}
+
+// PrometheusMetricsSink implements MetricsSink using the Prometheus metrics
+// registered by this package.
+type PrometheusMetricsSink struct{}
+
+// IncCounter implements MetricsSink.
+func (PrometheusMetricsSink) IncCounter(name string, labels map[string]string) {
+	if vec, ok := promCounters[name]; ok {
+		vec.With(labels).Inc()
+	}
+}
+
+// AddCounter implements MetricsSink.
+func (PrometheusMetricsSink) AddCounter(name string, labels map[string]string, value float64) {
+	if vec, ok := promCounters[name]; ok {
+		vec.With(labels).Add(value)
+	}
+}
+
+// SetGauge implements MetricsSink.
+func (PrometheusMetricsSink) SetGauge(name string, labels map[string]string, value float64) {
+	if vec, ok := promGauges[name]; ok {
+		vec.With(labels).Set(value)
+	}
+}
+
+// ObserveHistogram implements MetricsSink.
+func (PrometheusMetricsSink) ObserveHistogram(name string, labels map[string]string, value float64) {
+	if vec, ok := promHistograms[name]; ok {
+		vec.With(labels).Observe(value)
+	}
+}
+
+// NoopMetricsSink implements MetricsSink, discarding all metrics.
+type NoopMetricsSink struct{}
+
+// IncCounter implements MetricsSink.
+func (NoopMetricsSink) IncCounter(name string, labels map[string]string) {}
+
+// AddCounter implements MetricsSink.
+func (NoopMetricsSink) AddCounter(name string, labels map[string]string, value float64) {}
+
+// SetGauge implements MetricsSink.
+func (NoopMetricsSink) SetGauge(name string, labels map[string]string, value float64) {}
+
+// ObserveHistogram implements MetricsSink.
+func (NoopMetricsSink) ObserveHistogram(name string, labels map[string]string, value float64) {}
+
+var (
+	metricsSinkMux sync.RWMutex
+	metricsSink    MetricsSink = PrometheusMetricsSink{}
 )
 
+// SetMetricsSink sets the sink to which the metrics of all Semtech UDP
+// backends are emitted. Set it to nil to discard the metrics.
+func SetMetricsSink(s MetricsSink) {
+	if s == nil {
+		s = NoopMetricsSink{}
+	}
+
+	metricsSinkMux.Lock()
+	defer metricsSinkMux.Unlock()
+	metricsSink = s
+}
+
+func getMetricsSink() MetricsSink {
+	metricsSinkMux.RLock()
+	defer metricsSinkMux.RUnlock()
+	return metricsSink
+}
+
+// counter is a counter metric which is emitted to the metrics sink.
+type counter struct {
+	name   string
+	labels map[string]string
+}
+
+// Inc increments the counter by 1.
+func (c counter) Inc() {
+	getMetricsSink().IncCounter(c.name, c.labels)
+}
+
+// Add adds the given value to the counter.
+func (c counter) Add(v float64) {
+	getMetricsSink().AddCounter(c.name, c.labels, v)
+}
+
+// histogram is a histogram metric which is emitted to the metrics sink.
+type histogram struct {
+	name   string
+	labels map[string]string
+}
+
+// Observe adds an observation to the histogram.
+func (h histogram) Observe(v float64) {
+	getMetricsSink().ObserveHistogram(h.name, h.labels, v)
+}
+
 var (
-	uwc = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "backend_semtechudp_udp_sent_count",
-		Help: "The number of UDP packets sent by the backend (per packet_type).",
-	}, []string{"packet_type"})
-
-	urc = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "backend_semtechudp_udp_received_count",
-		Help: "The number of UDP packets received by the backend (per packet_type).",
-	}, []string{"packet_type"})
-
-	gwc = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "backend_semtechudp_gateway_connect_count",
-		Help: "The number of gateway connections received by the backend.",
-	})
-
-	gwd = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "backend_semtechudp_gateway_diconnect_count",
-		Help: "The number of gateways that disconnected from the backend.",
-	})
+	promCounters   = make(map[string]*prometheus.CounterVec)
+	promGauges     = make(map[string]*prometheus.GaugeVec)
+	promHistograms = make(map[string]*prometheus.HistogramVec)
+)
+
+// newCounter registers the Prometheus counter and returns its name.
+func newCounter(name, help string, labels ...string) string {
+	promCounters[name] = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, labels)
+	return name
+}
+
+// newHistogram registers the Prometheus histogram and returns its name.
+func newHistogram(name, help string, buckets []float64, labels ...string) string {
+	promHistograms[name] = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help,
+		Buckets: buckets,
+	}, labels)
+	return name
+}
+
+var (
+	uwc = newCounter(
+		"backend_semtechudp_udp_sent_count",
+		"The number of UDP packets sent by the backend (per packet_type).",
+		"packet_type",
+	)
+
+	urc = newCounter(
+		"backend_semtechudp_udp_received_count",
+		"The number of UDP packets received by the backend (per packet_type).",
+		"packet_type",
+	)
+
+	gwc = newCounter(
+		"backend_semtechudp_gateway_connect_count",
+		"The number of gateway connections received by the backend.",
+	)
+
+	gwd = newCounter(
+		"backend_semtechudp_gateway_diconnect_count",
+		"The number of gateways that disconnected from the backend.",
+	)
+
+	utc = newCounter(
+		"backend_semtechudp_udp_truncated_count",
+		"The number of UDP packets dropped because they are too short (per direction).",
+		"direction",
+	)
+
+	udc = newCounter(
+		"backend_semtechudp_udp_denied_count",
+		"The number of UDP packets dropped because the source network is not allowed.",
+	)
+
+	grc = newCounter(
+		"backend_semtechudp_gateway_rejected_count",
+		"The number of PullData packets rejected because the max. number of gateways was reached.",
+	)
+
+	gsc = newCounter(
+		"backend_semtechudp_gateway_suspect_count",
+		"The number of gateways marked as suspect because of inactivity.",
+	)
+
+	gcc = newCounter(
+		"backend_semtechudp_gateway_conflict_count",
+		"The number of PullData packets of a known gateway received from a different IP within the conflict window.",
+	)
+
+	gac = newCounter(
+		"backend_semtechudp_gateway_address_change_count",
+		"The number of times a gateway changed its source address.",
+	)
+
+	gbc = newCounter(
+		"backend_semtechudp_gateway_bytes_count",
+		"The number of UDP bytes received from and sent to the gateway, including ACKs (per gateway_id and direction).",
+		"gateway_id", "direction",
+	)
+
+	gbr = newCounter(
+		"backend_semtechudp_gateway_reboot_count",
+		"The number of gateway reboots detected because of a backwards jump of the concentrator counter.",
+	)
+
+	gvc = newCounter(
+		"backend_semtechudp_gateway_version_change_count",
+		"The number of times the version reported in the stats of a gateway changed.",
+	)
+
+	gal = newHistogram(
+		"backend_semtechudp_gateway_ack_latency_seconds",
+		"The round-trip time between sending a downlink and receiving its TXACK.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	)
+
+	drs = newCounter(
+		"backend_semtechudp_downlink_replay_suppressed_count",
+		"The number of downlinks dropped because an identical downlink was queued within the downlink replay window.",
+	)
+
+	glh = newCounter(
+		"backend_semtechudp_downlink_latency_too_high_count",
+		"The number of timestamped downlinks rejected because the ack latency of the gateway exceeds the max. ack latency.",
+	)
+
+	dce = newCounter(
+		"backend_semtechudp_downlink_duty_cycle_exceeded_count",
+		"The number of downlinks rejected because the duty-cycle of the sub-band would be exceeded.",
+	)
+
+	tar = newCounter(
+		"backend_semtechudp_tx_ack_retry_count",
+		"The number of downlinks sent again because no TXACK was received within the tx_ack_timeout.",
+	)
+
+	tau = newCounter(
+		"backend_semtechudp_tx_ack_unconfirmed_count",
+		"The number of downlinks for which no TXACK was received after all retries.",
+	)
+
+	tdv = newCounter(
+		"backend_semtechudp_tx_ack_deviation_count",
+		"The number of TXACKs reporting a TX power or frequency deviating from the PullResp (per type).",
+		"type",
+	)
+
+	tad = newCounter(
+		"backend_semtechudp_tx_audit_dropped_count",
+		"The number of TX audit items dropped because the audit channel was full.",
+	)
+
+	rsd = newCounter(
+		"backend_semtechudp_raw_stats_dropped_count",
+		"The number of raw stats dropped because the raw stats channel was full.",
+	)
+
+	rud = newCounter(
+		"backend_semtechudp_raw_uplink_dropped_count",
+		"The number of raw uplinks dropped because the raw uplink channel was full.",
+	)
+
+	mdc = newCounter(
+		"backend_semtechudp_mirror_dropped_count",
+		"The number of mirrored items dropped because the mirror channel was full (per type).",
+		"type",
+	)
+
+	sdc = newCounter(
+		"backend_semtechudp_subscriber_dropped_count",
+		"The number of uplinks dropped for a subscriber because its buffer was full.",
+	)
+
+	tdc = newCounter(
+		"backend_semtechudp_traffic_dropped_count",
+		"The number of traffic records dropped because the traffic sink could not keep up.",
+	)
+
+	acd = newCounter(
+		"backend_semtechudp_ack_dropped_count",
+		"The number of ACKs that were not sent (per reason).",
+		"reason",
+	)
+
+	ufc = newCounter(
+		"backend_semtechudp_uplink_filtered_count",
+		"The number of uplinks dropped by the uplink filter function.",
+	)
+
+	udr = newCounter(
+		"backend_semtechudp_uplink_dropped_count",
+		"The number of uplinks dropped because the uplink channel was full.",
+	)
+
+	ust = newCounter(
+		"backend_semtechudp_uplink_stalled_count",
+		"The number of uplinks which could not be sent to the uplink channel within the uplink_stall_timeout.",
+	)
+
+	usm = newCounter(
+		"backend_semtechudp_uplink_size_mismatch_count",
+		"The number of uplinks of which the size does not match the length of the decoded payload.",
+	)
+
+	udi = newCounter(
+		"backend_semtechudp_uplink_discarded_count",
+		"The number of uplinks discarded because discard_uplinks is enabled.",
+	)
+
+	usc = newCounter(
+		"backend_semtechudp_uplink_sampled_count",
+		"The number of uplinks dropped because of the uplink sample rate.",
+	)
+
+	ubt = newCounter(
+		"backend_semtechudp_uplink_below_threshold_count",
+		"The number of uplinks dropped because of the min. RSSI or SNR (per threshold).",
+		"threshold",
+	)
+
+	upm = newCounter(
+		"backend_semtechudp_udp_malformed_count",
+		"The number of UDP packets dropped because they could not be decoded (per packet_type and reason).",
+		"packet_type", "reason",
+	)
+
+	ude = newCounter(
+		"backend_semtechudp_uplink_decode_error_count",
+		"The number of uplinks that could not be decoded (per field).",
+		"field",
+	)
 )
 
-func udpWriteCounter(pt string) prometheus.Counter {
-	return uwc.With(prometheus.Labels{"packet_type": pt})
+func udpWriteCounter(pt string) counter {
+	return counter{name: uwc, labels: map[string]string{"packet_type": pt}}
+}
+
+func udpReadCounter(pt string) counter {
+	return counter{name: urc, labels: map[string]string{"packet_type": pt}}
+}
+
+func udpTruncatedCounter(direction string) counter {
+	return counter{name: utc, labels: map[string]string{"direction": direction}}
+}
+
+func udpDeniedCounter() counter {
+	return counter{name: udc}
+}
+
+func malformedPacketCounter(pt, reason string) counter {
+	return counter{name: upm, labels: map[string]string{"packet_type": pt, "reason": reason}}
+}
+
+func uplinkDecodeErrorCounter(field string) counter {
+	return counter{name: ude, labels: map[string]string{"field": field}}
+}
+
+func uplinkBelowThresholdCounter(threshold string) counter {
+	return counter{name: ubt, labels: map[string]string{"threshold": threshold}}
+}
+
+func uplinkDroppedCounter() counter {
+	return counter{name: udr}
+}
+
+func uplinkStalledCounter() counter {
+	return counter{name: ust}
+}
+
+func uplinkSizeMismatchCounter() counter {
+	return counter{name: usm}
+}
+
+func uplinkDiscardedCounter() counter {
+	return counter{name: udi}
+}
+
+func uplinkSampledCounter() counter {
+	return counter{name: usc}
+}
+
+func uplinkFilteredCounter() counter {
+	return counter{name: ufc}
+}
+
+func connectCounter() counter {
+	return counter{name: gwc}
+}
+
+func disconnectCounter() counter {
+	return counter{name: gwd}
+}
+
+func ackLatencyHistogram() histogram {
+	return histogram{name: gal}
+}
+
+func downlinkReplaySuppressedCounter() counter {
+	return counter{name: drs}
+}
+
+func gatewayLatencyTooHighCounter() counter {
+	return counter{name: glh}
+}
+
+func dutyCycleExceededCounter() counter {
+	return counter{name: dce}
+}
+
+func txAckRetryCounter() counter {
+	return counter{name: tar}
+}
+
+func txAckUnconfirmedCounter() counter {
+	return counter{name: tau}
+}
+
+func txAckDeviationCounter(typ string) counter {
+	return counter{name: tdv, labels: map[string]string{"type": typ}}
+}
+
+func txAuditDroppedCounter() counter {
+	return counter{name: tad}
+}
+
+func rawStatsDroppedCounter() counter {
+	return counter{name: rsd}
+}
+
+func rawUplinkDroppedCounter() counter {
+	return counter{name: rud}
+}
+
+func mirrorDroppedCounter(typ string) counter {
+	return counter{name: mdc, labels: map[string]string{"type": typ}}
+}
+
+func subscriberDroppedCounter() counter {
+	return counter{name: sdc}
+}
+
+func trafficDroppedCounter() counter {
+	return counter{name: tdc}
+}
+
+func gatewayRejectedCounter() counter {
+	return counter{name: grc}
+}
+
+func suspectCounter() counter {
+	return counter{name: gsc}
+}
+
+func gatewayConflictCounter() counter {
+	return counter{name: gcc}
+}
+
+func addressChangeCounter() counter {
+	return counter{name: gac}
+}
+
+func gatewayBytesCounter(gatewayID lorawan.EUI64, direction string) counter {
+	return counter{name: gbc, labels: map[string]string{"gateway_id": gatewayID.String(), "direction": direction}}
 }
 
-func udpReadCounter(pt string) prometheus.Counter {
-	return urc.With(prometheus.Labels{"packet_type": pt})
+func rebootCounter() counter {
+	return counter{name: gbr}
 }
 
-func connectCounter() prometheus.Counter {
-	return gwc
+func versionChangeCounter() counter {
+	return counter{name: gvc}
 }
 
-func disconnectCounter() prometheus.Counter {
-	return gwd
+func ackDroppedCounter(reason string) counter {
+	return counter{name: acd, labels: map[string]string{"reason": reason}}
 }
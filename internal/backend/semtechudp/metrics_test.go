@@ -0,0 +1,43 @@
+package semtechudp
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// counterValue returns the value of the Prometheus counter.
+func counterValue(c counter) float64 {
+	return testutil.ToFloat64(promCounters[c.name].With(c.labels))
+}
+
+type recordingMetricsSink struct {
+	NoopMetricsSink
+	counters []string
+}
+
+func (s *recordingMetricsSink) IncCounter(name string, labels map[string]string) {
+	s.counters = append(s.counters, name)
+}
+
+func TestMetricsSink(t *testing.T) {
+	assert := require.New(t)
+	defer SetMetricsSink(PrometheusMetricsSink{})
+
+	before := counterValue(udpDeniedCounter())
+
+	var sink recordingMetricsSink
+	SetMetricsSink(&sink)
+	udpDeniedCounter().Inc()
+	assert.Equal([]string{"backend_semtechudp_udp_denied_count"}, sink.counters)
+	assert.Equal(before, counterValue(udpDeniedCounter()))
+
+	SetMetricsSink(nil)
+	udpDeniedCounter().Inc()
+	assert.Len(sink.counters, 1)
+
+	SetMetricsSink(PrometheusMetricsSink{})
+	udpDeniedCounter().Inc()
+	assert.Equal(before+1, counterValue(udpDeniedCounter()))
+}
@@ -31,12 +31,39 @@ const (
 // Errors
 var (
 	ErrInvalidProtocolVersion = errors.New("gateway: invalid protocol version")
+	ErrTooShort               = errors.New("gateway: at least 4 bytes of data are expected")
 )
 
+// HeaderError is returned when the binary header of a packet is invalid
+// (e.g. the packet is too short or the identifier does not match).
+type HeaderError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e *HeaderError) Error() string {
+	return e.Err.Error()
+}
+
+// PayloadError is returned when the JSON payload of a packet could not be
+// decoded.
+type PayloadError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e *PayloadError) Error() string {
+	return "backend/semtechudp/packets: decode json payload error: " + e.Err.Error()
+}
+
+// minPacketSize defines the minimum packet size (protocol version, random
+// token and packet identifier).
+const minPacketSize = 4
+
 // GetPacketType returns the packet type for the given packet data.
 func GetPacketType(data []byte) (PacketType, error) {
-	if len(data) < 4 {
-		return PacketType(0), errors.New("gateway: at least 4 bytes of data are expected")
+	if len(data) < minPacketSize {
+		return PacketType(0), ErrTooShort
 	}
 
 	if !protocolSupported(data[0]) {
@@ -1,7 +1,6 @@
 package packets
 
 import (
-	"errors"
 	"testing"
 	"time"
 
@@ -81,9 +80,21 @@ func TestGetPacketType(t *testing.T) {
 		PacketType PacketType
 		Error      error
 	}{
+		{
+			Bytes: nil,
+			Error: ErrTooShort,
+		},
 		{
 			Bytes: []byte{},
-			Error: errors.New("gateway: at least 4 bytes of data are expected"),
+			Error: ErrTooShort,
+		},
+		{
+			Bytes: []byte{2},
+			Error: ErrTooShort,
+		},
+		{
+			Bytes: []byte{2, 1, 3},
+			Error: ErrTooShort,
 		},
 		{
 			Bytes: []byte{3, 1, 3, 4},
@@ -25,10 +25,10 @@ func (p PullDataPacket) MarshalBinary() ([]byte, error) {
 // UnmarshalBinary decodes the object from binary form.
 func (p *PullDataPacket) UnmarshalBinary(data []byte) error {
 	if len(data) != 12 {
-		return errors.New("gateway: 12 bytes of data are expected")
+		return &HeaderError{Err: errors.New("gateway: 12 bytes of data are expected")}
 	}
 	if data[3] != byte(PullData) {
-		return errors.New("gateway: identifier mismatch (PULL_DATA expected)")
+		return &HeaderError{Err: errors.New("gateway: identifier mismatch (PULL_DATA expected)")}
 	}
 
 	if !protocolSupported(data[0]) {
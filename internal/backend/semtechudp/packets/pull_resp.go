@@ -55,6 +55,37 @@ func (p *PullRespPacket) UnmarshalBinary(data []byte) error {
 	return json.Unmarshal(data[4:], &p.Payload)
 }
 
+// RawPullRespPacket is a PullRespPacket of which the txpk object has already
+// been marshaled, e.g. to send vendor-specific txpk fields.
+type RawPullRespPacket struct {
+	ProtocolVersion uint8
+	RandomToken     uint16
+	TXPK            json.RawMessage
+}
+
+// MarshalBinary marshals the object in binary form.
+func (p RawPullRespPacket) MarshalBinary() ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(p.TXPK, &obj); err != nil {
+		return nil, errors.Wrap(err, "txpk must be a json object")
+	}
+
+	pb, err := json.Marshal(map[string]json.RawMessage{"txpk": p.TXPK})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 4, 4+len(pb))
+	out[0] = p.ProtocolVersion
+
+	if p.ProtocolVersion != ProtocolVersion1 {
+		// these two bytes are unused in ProtocolVersion1
+		binary.LittleEndian.PutUint16(out[1:3], p.RandomToken)
+	}
+	out[3] = byte(PullResp)
+	out = append(out, pb...)
+	return out, nil
+}
+
 // PullRespPayload represents the downstream JSON data structure.
 type PullRespPayload struct {
 	TXPK TXPK `json:"txpk"`
@@ -132,9 +163,18 @@ func GetPullRespPacket(protoVersion uint8, randomToken uint16, frame gw.Downlink
 
 	switch txInfo.GetTiming() {
 	case gw.DownlinkTiming_IMMEDIATELY:
+		// a timing info would make the scheduling mode ambiguous
+		if txInfo.GetTimingInfo() != nil {
+			return packet, errors.New("timing_info must not be set for IMMEDIATELY timing")
+		}
+
 		packet.Payload.TXPK.Imme = true
 
 	case gw.DownlinkTiming_DELAY:
+		if txInfo.GetGpsEpochTimingInfo() != nil {
+			return packet, errors.New("gps_epoch_timing_info must not be set for DELAY timing")
+		}
+
 		timingInfo := txInfo.GetDelayTimingInfo()
 		if timingInfo == nil {
 			return packet, errors.New("delay_timing_info must not be nil")
@@ -153,6 +193,10 @@ func GetPullRespPacket(protoVersion uint8, randomToken uint16, frame gw.Downlink
 		packet.Payload.TXPK.Tmst = &timestamp
 
 	case gw.DownlinkTiming_GPS_EPOCH:
+		if txInfo.GetDelayTimingInfo() != nil {
+			return packet, errors.New("delay_timing_info must not be set for GPS_EPOCH timing")
+		}
+
 		timingInfo := txInfo.GetGpsEpochTimingInfo()
 		if timingInfo == nil {
 			return packet, errors.New("gps_epoch_timing must not be nil")
@@ -43,6 +43,23 @@ func TestPullResp(t *testing.T) {
 	}
 }
 
+func TestRawPullResp(t *testing.T) {
+	assert := require.New(t)
+
+	p := RawPullRespPacket{
+		ProtocolVersion: ProtocolVersion2,
+		RandomToken:     123,
+		TXPK:            []byte(`{"imme":true,"foo":"bar"}`),
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+	assert.Equal(append([]byte{2, 123, 0, 3}, []byte(`{"txpk":{"imme":true,"foo":"bar"}}`)...), b)
+
+	p.TXPK = []byte(`[1, 2]`)
+	_, err = p.MarshalBinary()
+	assert.Error(err)
+}
+
 func TestGetPullRespPacket(t *testing.T) {
 	timestamp := uint32(2000000)
 	timeSinceGPSEpoch := int64(5 * time.Second / time.Millisecond)
@@ -51,7 +68,7 @@ func TestGetPullRespPacket(t *testing.T) {
 		Name           string
 		DownlinkFrame  gw.DownlinkFrame
 		PullRespPacket PullRespPacket
-		Error          error
+		Error          string
 	}{
 		{
 			Name: "delay timing - lora",
@@ -263,6 +280,90 @@ func TestGetPullRespPacket(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "immediately with timing info",
+			DownlinkFrame: gw.DownlinkFrame{
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: []byte{1, 2, 3, 4},
+						TxInfo: &gw.DownlinkTXInfo{
+							Frequency:  868100000,
+							Modulation: common.Modulation_LORA,
+							ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+								LoraModulationInfo: &gw.LoRaModulationInfo{
+									SpreadingFactor: 12,
+									Bandwidth:       125,
+									CodeRate:        "4/5",
+								},
+							},
+							Timing: gw.DownlinkTiming_IMMEDIATELY,
+							TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+								DelayTimingInfo: &gw.DelayTimingInfo{
+									Delay: ptypes.DurationProto(time.Second),
+								},
+							},
+						},
+					},
+				},
+			},
+			Error: "timing_info must not be set for IMMEDIATELY timing",
+		},
+		{
+			Name: "delay with gps epoch timing info",
+			DownlinkFrame: gw.DownlinkFrame{
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: []byte{1, 2, 3, 4},
+						TxInfo: &gw.DownlinkTXInfo{
+							Frequency:  868100000,
+							Modulation: common.Modulation_LORA,
+							ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+								LoraModulationInfo: &gw.LoRaModulationInfo{
+									SpreadingFactor: 12,
+									Bandwidth:       125,
+									CodeRate:        "4/5",
+								},
+							},
+							Timing: gw.DownlinkTiming_DELAY,
+							TimingInfo: &gw.DownlinkTXInfo_GpsEpochTimingInfo{
+								GpsEpochTimingInfo: &gw.GPSEpochTimingInfo{
+									TimeSinceGpsEpoch: ptypes.DurationProto(5 * time.Second),
+								},
+							},
+						},
+					},
+				},
+			},
+			Error: "gps_epoch_timing_info must not be set for DELAY timing",
+		},
+		{
+			Name: "gps epoch with delay timing info",
+			DownlinkFrame: gw.DownlinkFrame{
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: []byte{1, 2, 3, 4},
+						TxInfo: &gw.DownlinkTXInfo{
+							Frequency:  868100000,
+							Modulation: common.Modulation_LORA,
+							ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+								LoraModulationInfo: &gw.LoRaModulationInfo{
+									SpreadingFactor: 12,
+									Bandwidth:       125,
+									CodeRate:        "4/5",
+								},
+							},
+							Timing: gw.DownlinkTiming_GPS_EPOCH,
+							TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+								DelayTimingInfo: &gw.DelayTimingInfo{
+									Delay: ptypes.DurationProto(time.Second),
+								},
+							},
+						},
+					},
+				},
+			},
+			Error: "delay_timing_info must not be set for GPS_EPOCH timing",
+		},
 	}
 
 	for _, tst := range tests {
@@ -270,10 +371,11 @@ func TestGetPullRespPacket(t *testing.T) {
 			assert := require.New(t)
 
 			resp, err := GetPullRespPacket(ProtocolVersion2, 1234, tst.DownlinkFrame, 0)
-			assert.Equal(tst.Error, err)
-			if err != nil {
+			if tst.Error != "" {
+				assert.EqualError(err, tst.Error)
 				return
 			}
+			assert.NoError(err)
 
 			assert.Equal(tst.PullRespPacket, resp)
 		})
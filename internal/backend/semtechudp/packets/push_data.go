@@ -1,10 +1,12 @@
 package packets
 
 import (
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
-	"regexp"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -16,8 +18,40 @@ import (
 	"github.com/brocaar/lorawan"
 )
 
-// loRaDataRateRegex contains a regexp for parsing the data-rate string.
-var loRaDataRateRegex = regexp.MustCompile(`SF(\d+)BW(\d+)`)
+// UplinkFrameError is returned when a RXPK could not be converted into an
+// uplink frame. It contains the context of the RXPK and the name of the
+// field that could not be decoded.
+type UplinkFrameError struct {
+	GatewayID lorawan.EUI64
+	Frequency float64
+	DataRate  string
+	Size      uint16
+	Field     string
+	Err       error
+}
+
+func newUplinkFrameError(gatewayID []byte, rxpk RXPK, field string, err error) *UplinkFrameError {
+	e := UplinkFrameError{
+		Frequency: rxpk.Freq,
+		Size:      rxpk.Size,
+		Field:     field,
+		Err:       err,
+	}
+	copy(e.GatewayID[:], gatewayID)
+
+	if rxpk.DatR.LoRa != "" {
+		e.DataRate = rxpk.DatR.LoRa
+	} else {
+		e.DataRate = strconv.FormatUint(uint64(rxpk.DatR.FSK), 10)
+	}
+
+	return &e
+}
+
+// Error implements the error interface.
+func (e *UplinkFrameError) Error() string {
+	return fmt.Sprintf("backend/semtechudp/packets: decode rxpk field '%s' error (gateway_id: %s, freq: %.6f, datr: %s, size: %d): %s", e.Field, e.GatewayID, e.Frequency, e.DataRate, e.Size, e.Err)
+}
 
 // PushDataPacket type is used by the gateway mainly to forward the RF packets
 // received, and associated metadata, to the server.
@@ -88,7 +122,16 @@ func (p PushDataPacket) GetGatewayStats() (*gw.GatewayStats, error) {
 
 // GetUplinkFrames returns a slice of gw.UplinkFrame.
 func (p PushDataPacket) GetUplinkFrames(skipCRCCheck bool, FakeRxInfoTime bool) ([]gw.UplinkFrame, error) {
+	frames, _, err := p.GetUplinkFramesWithRXPK(skipCRCCheck, FakeRxInfoTime)
+	return frames, err
+}
+
+// GetUplinkFramesWithRXPK returns the uplink frames (see GetUplinkFrames)
+// and for each frame the RXPK it was decoded from, e.g. to access the
+// verbatim data (see RXPK.RawData).
+func (p PushDataPacket) GetUplinkFramesWithRXPK(skipCRCCheck bool, FakeRxInfoTime bool) ([]gw.UplinkFrame, []RXPK, error) {
 	var frames []gw.UplinkFrame
+	var rxpks []RXPK
 
 	for i := range p.Payload.RXPK {
 		// validate CRC
@@ -96,41 +139,43 @@ func (p PushDataPacket) GetUplinkFrames(skipCRCCheck bool, FakeRxInfoTime bool)
 			continue
 		}
 
-		if len(p.Payload.RXPK[i].RSig) == 0 {
+		if !p.Payload.useRSig(p.Payload.RXPK[i]) {
 			frame, err := getUplinkFrame(p.GatewayMAC[:], p.Payload.RXPK[i], FakeRxInfoTime)
 			if err != nil {
-				return nil, errors.Wrap(err, "backend/semtechudp/packets: get uplink frame error")
+				return nil, nil, errors.Wrap(err, "backend/semtechudp/packets: get uplink frame error")
 			}
 
 			// add random uplink id
 			uplinkID, err := uuid.NewV4()
 			if err != nil {
-				return nil, errors.Wrap(err, "backend/semtechudp/packets: get random uplink id error")
+				return nil, nil, errors.Wrap(err, "backend/semtechudp/packets: get random uplink id error")
 			}
 			frame.RxInfo.UplinkId = uplinkID[:]
 
 			frames = append(frames, frame)
+			rxpks = append(rxpks, p.Payload.RXPK[i])
 		} else {
 			for j := range p.Payload.RXPK[i].RSig {
 				frame, err := getUplinkFrame(p.GatewayMAC[:], p.Payload.RXPK[i], FakeRxInfoTime)
 				if err != nil {
-					return nil, errors.Wrap(err, "backend/semtechudp/packets: get uplink frame error")
+					return nil, nil, errors.Wrap(err, "backend/semtechudp/packets: get uplink frame error")
 				}
 				frame = setUplinkFrameRSig(frame, p.Payload.RXPK[i], p.Payload.RXPK[i].RSig[j])
 
 				// add random uplink id
 				uplinkID, err := uuid.NewV4()
 				if err != nil {
-					return nil, errors.Wrap(err, "backend/semtechudp/packets: get random uplink id error")
+					return nil, nil, errors.Wrap(err, "backend/semtechudp/packets: get random uplink id error")
 				}
 				frame.RxInfo.UplinkId = uplinkID[:]
 
 				frames = append(frames, frame)
+				rxpks = append(rxpks, p.Payload.RXPK[i])
 			}
 		}
 	}
 
-	return frames, nil
+	return frames, rxpks, nil
 }
 
 func setUplinkFrameRSig(frame gw.UplinkFrame, rxPK RXPK, rSig RSig) gw.UplinkFrame {
@@ -147,11 +192,35 @@ func setUplinkFrameRSig(frame gw.UplinkFrame, rxPK RXPK, rSig RSig) gw.UplinkFra
 				AesKeyIndex: uint32(rxPK.AESK),
 			},
 		}
+	} else if rSig.FTime != nil {
+		setUplinkFramePlainFineTimestamp(frame, rxPK, *rSig.FTime)
 	}
 
 	return frame
 }
 
+// setUplinkFramePlainFineTimestamp sets the plain fine timestamp, using the
+// seconds of the rxpk time and the given ftime as nanoseconds. As the ftime
+// is relative to the rxpk time, it is ignored when the time is not set or
+// when it is out of range.
+func setUplinkFramePlainFineTimestamp(frame gw.UplinkFrame, rxPK RXPK, fTime uint32) {
+	if rxPK.Time == nil || time.Time(*rxPK.Time).IsZero() || fTime > 999999999 {
+		return
+	}
+
+	ts, err := ptypes.TimestampProto(time.Time(*rxPK.Time).Truncate(time.Second).Add(time.Duration(fTime)))
+	if err != nil {
+		return
+	}
+
+	frame.RxInfo.FineTimestampType = gw.FineTimestampType_PLAIN
+	frame.RxInfo.FineTimestamp = &gw.UplinkRXInfo_PlainFineTimestamp{
+		PlainFineTimestamp: &gw.PlainFineTimestamp{
+			Time: ts,
+		},
+	}
+}
+
 func getUplinkFrame(gatewayID []byte, rxpk RXPK, FakeRxInfoTime bool) (gw.UplinkFrame, error) {
 	frame := gw.UplinkFrame{
 		PhyPayload: rxpk.Data,
@@ -185,7 +254,7 @@ func getUplinkFrame(gatewayID []byte, rxpk RXPK, FakeRxInfoTime bool) (gw.Uplink
 	if rxpk.Time != nil && !time.Time(*rxpk.Time).IsZero() {
 		ts, err := ptypes.TimestampProto(time.Time(*rxpk.Time))
 		if err != nil {
-			return frame, errors.Wrap(err, "backend/semtechudp/packets: timestamp proto error")
+			return frame, newUplinkFrameError(gatewayID, rxpk, "time", err)
 		}
 		frame.RxInfo.Time = ts
 	} else if FakeRxInfoTime {
@@ -193,6 +262,11 @@ func getUplinkFrame(gatewayID []byte, rxpk RXPK, FakeRxInfoTime bool) (gw.Uplink
 		frame.RxInfo.Time = ts
 	}
 
+	// Fine timestamp
+	if rxpk.FTime != nil {
+		setUplinkFramePlainFineTimestamp(frame, rxpk, *rxpk.FTime)
+	}
+
 	// Time since GPS epoch
 	if rxpk.Tmms != nil {
 		d := time.Duration(*rxpk.Tmms) * time.Millisecond
@@ -203,21 +277,21 @@ func getUplinkFrame(gatewayID []byte, rxpk RXPK, FakeRxInfoTime bool) (gw.Uplink
 	if rxpk.DatR.LoRa != "" {
 		frame.TxInfo.Modulation = common.Modulation_LORA
 
-		match := loRaDataRateRegex.FindStringSubmatch(rxpk.DatR.LoRa)
 		// parse e.g. SF12BW250 into separate variables
-		if len(match) != 3 {
-			return frame, errors.New("backend/semtechudp/packets: could not parse LoRa data-rate")
+		sfStr, bwStr, ok := matchLoRaDataRate(rxpk.DatR.LoRa)
+		if !ok {
+			return frame, newUplinkFrameError(gatewayID, rxpk, "datr", errors.New("could not parse LoRa data-rate"))
 		}
 
 		// cast variables to ints
-		sf, err := strconv.Atoi(match[1])
+		sf, err := strconv.Atoi(sfStr)
 		if err != nil {
-			return frame, errors.Wrap(err, "backend/semtechudp/packets: could not convert sf to int")
+			return frame, newUplinkFrameError(gatewayID, rxpk, "datr", errors.Wrap(err, "could not convert sf to int"))
 		}
 
-		bw, err := strconv.Atoi(match[2])
+		bw, err := strconv.Atoi(bwStr)
 		if err != nil {
-			return frame, errors.Wrap(err, "backend/semtechudp/packets: could not parse bandwidth to int")
+			return frame, newUplinkFrameError(gatewayID, rxpk, "datr", errors.Wrap(err, "could not parse bandwidth to int"))
 		}
 
 		frame.TxInfo.ModulationInfo = &gw.UplinkTXInfo_LoraModulationInfo{
@@ -246,10 +320,10 @@ func getUplinkFrame(gatewayID []byte, rxpk RXPK, FakeRxInfoTime bool) (gw.Uplink
 // UnmarshalBinary decodes the packet from Semtech UDP binary form.
 func (p *PushDataPacket) UnmarshalBinary(data []byte) error {
 	if len(data) < 13 {
-		return errors.New("backend/semtechudp/packets: at least 13 bytes are expected")
+		return &HeaderError{Err: errors.New("backend/semtechudp/packets: at least 13 bytes are expected")}
 	}
 	if data[3] != byte(PushData) {
-		return errors.New("backend/semtechudp/packets: identifier mismatch (PUSH_DATA expected)")
+		return &HeaderError{Err: errors.New("backend/semtechudp/packets: identifier mismatch (PUSH_DATA expected)")}
 	}
 
 	if !protocolSupported(data[0]) {
@@ -262,15 +336,52 @@ func (p *PushDataPacket) UnmarshalBinary(data []byte) error {
 		p.GatewayMAC[i] = data[4+i]
 	}
 
-	return json.Unmarshal(data[12:], &p.Payload)
+	if err := json.Unmarshal(data[12:], &p.Payload); err != nil {
+		return &PayloadError{Err: err}
+	}
+	return nil
 }
 
+// JSON versions of the PushData payload (see PushDataPayload.JVer).
+const (
+	// JSONVersionLegacy uses a single RSSI and SNR per RXPK.
+	JSONVersionLegacy = 1
+
+	// JSONVersionRSig uses the rsig array, containing the RSSI and SNR per
+	// antenna.
+	JSONVersionRSig = 2
+)
+
 // PushDataPayload represents the upstream JSON data structure.
 type PushDataPayload struct {
+	JVer *int   `json:"jver,omitempty"` // JSON version of the rxpk and stat objects (Optional)
 	RXPK []RXPK `json:"rxpk,omitempty"`
 	Stat *Stat  `json:"stat,omitempty"`
 }
 
+// JSONVersion returns the JSON version of the payload, defaulting to
+// JSONVersionLegacy when jver is absent.
+func (p PushDataPayload) JSONVersion() int {
+	if p.JVer == nil {
+		return JSONVersionLegacy
+	}
+	return *p.JVer
+}
+
+// useRSig returns true when the given RXPK must be handled using the rsig
+// array layout. When present, the jver selects the layout. Else this falls
+// back to the presence of the rsig array, as not all forwarders sending the
+// rsig array set the jver.
+func (p PushDataPayload) useRSig(rxpk RXPK) bool {
+	if len(rxpk.RSig) == 0 {
+		return false
+	}
+	if p.JVer == nil {
+		return true
+	}
+	return *p.JVer >= JSONVersionRSig
+}
+
 // Stat contains the status of the gateway.
 type Stat struct {
 	Time ExpandedTime `json:"time"` // UTC 'system' time of the gateway, ISO 8601 'expanded' format (e.g 2014-01-12 08:59:28 GMT)
@@ -283,27 +394,70 @@ type Stat struct {
 	ACKR float64      `json:"ackr"` // Percentage of upstream datagrams that were acknowledged
 	DWNb uint32       `json:"dwnb"` // Number of downlink datagrams received (unsigned integer)
 	TXNb uint32       `json:"txnb"` // Number of packets emitted (unsigned integer)
+
+	// Optional, not sent by all packet-forwarders.
+	Pfrm     string `json:"pfrm,omitempty"`     // Platform definition
+	Brand    string `json:"brand,omitempty"`    // Gateway brand
+	Model    string `json:"model,omitempty"`    // Gateway model
+	Firmware string `json:"firmware,omitempty"` // Gateway / packet-forwarder firmware version
 }
 
 // RXPK contain a RF packet and associated metadata.
 type RXPK struct {
-	Time *CompactTime `json:"time"` // UTC time of pkt RX, us precision, ISO 8601 'compact' format (e.g. 2013-03-31T16:21:17.528002Z)
-	Tmms *int64       `json:"tmms"` // GPS time of pkt RX, number of milliseconds since 06.Jan.1980
-	Tmst uint32       `json:"tmst"` // Internal timestamp of "RX finished" event (32b unsigned)
-	AESK uint8        `json:"aesk"` //AES key index used for encrypting fine timestamps
-	Chan uint8        `json:"chan"` // Concentrator "IF" channel used for RX (unsigned integer)
-	RFCh uint8        `json:"rfch"` // Concentrator "RF chain" used for RX (unsigned integer)
-	Stat int8         `json:"stat"` // CRC status: 1 = OK, -1 = fail, 0 = no CRC
-	Freq float64      `json:"freq"` // RX central frequency in MHz (unsigned float, Hz precision)
-	Brd  uint32       `json:"brd"`  // Concentrator board used for RX (unsigned integer)
-	RSSI int16        `json:"rssi"` // RSSI in dBm (signed integer, 1 dB precision)
-	Size uint16       `json:"size"` // RF packet payload size in bytes (unsigned integer)
-	DatR DatR         `json:"datr"` // LoRa datarate identifier (eg. SF12BW500) || FSK datarate (unsigned, in bits per second)
-	Modu string       `json:"modu"` // Modulation identifier "LORA" or "FSK"
-	CodR string       `json:"codr"` // LoRa ECC coding rate identifier
-	LSNR float64      `json:"lsnr"` // Lora SNR ratio in dB (signed float, 0.1 dB precision)
-	Data []byte       `json:"data"` // Base64 encoded RF packet payload, padded
-	RSig []RSig       `json:"rsig"` // Received signal information, per antenna (Optional)
+	Time  *CompactTime `json:"time"`  // UTC time of pkt RX, us precision, ISO 8601 'compact' format (e.g. 2013-03-31T16:21:17.528002Z)
+	Tmms  *int64       `json:"tmms"`  // GPS time of pkt RX, number of milliseconds since 06.Jan.1980
+	Tmst  uint32       `json:"tmst"`  // Internal timestamp of "RX finished" event (32b unsigned)
+	AESK  uint8        `json:"aesk"`  //AES key index used for encrypting fine timestamps
+	FTime *uint32      `json:"ftime"` // Fine timestamp, ns precision [0..999999999] (Optional)
+	FOff  *int32       `json:"foff"`  // Frequency offset in Hz [-125 kHz..+125 kHz] (Optional)
+	Chan  uint8        `json:"chan"`  // Concentrator "IF" channel used for RX (unsigned integer)
+	RFCh  uint8        `json:"rfch"`  // Concentrator "RF chain" used for RX (unsigned integer)
+	Stat  int8         `json:"stat"`  // CRC status: 1 = OK, -1 = fail, 0 = no CRC
+	Freq  float64      `json:"freq"`  // RX central frequency in MHz (unsigned float, Hz precision)
+	Brd   uint32       `json:"brd"`   // Concentrator board used for RX (unsigned integer)
+	RSSI  int16        `json:"rssi"`  // RSSI in dBm (signed integer, 1 dB precision)
+	Size  uint16       `json:"size"`  // RF packet payload size in bytes (unsigned integer)
+	DatR  DatR         `json:"datr"`  // LoRa datarate identifier (eg. SF12BW500) || FSK datarate (unsigned, in bits per second)
+	Modu  string       `json:"modu"`  // Modulation identifier "LORA" or "FSK"
+	CodR  string       `json:"codr"`  // LoRa ECC coding rate identifier
+	LSNR  float64      `json:"lsnr"`  // Lora SNR ratio in dB (signed float, 0.1 dB precision)
+	Data  []byte       `json:"data"`  // Base64 encoded RF packet payload, padded
+	RSig  []RSig       `json:"rsig"`  // Received signal information, per antenna (Optional)
+
+	// RawData contains the data as sent by the gateway (base64), as
+	// re-encoding Data might differ (e.g. in padding). It is set on
+	// unmarshal and is not marshaled.
+	RawData string `json:"-"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, setting both
+// Data and RawData.
+func (r *RXPK) UnmarshalJSON(data []byte) error {
+	type rxpk RXPK
+	v := struct {
+		*rxpk
+		Data *string `json:"data"`
+	}{
+		rxpk: (*rxpk)(r),
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	r.Data = nil
+	r.RawData = ""
+	if v.Data == nil {
+		return nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(*v.Data)
+	if err != nil {
+		return err
+	}
+	r.Data = b
+	r.RawData = *v.Data
+
+	return nil
 }
 
 // RSig contains the received signal information per antenna.
@@ -313,4 +467,35 @@ type RSig struct {
 	RSSIC int16   `json:"rssic"` // RSSI in dBm of the channel (signed integer, 1 dB precision)
 	LSNR  float64 `json:"lsnr"`  // Lora SNR ratio in dB (signed float, 0.1 dB precision)
 	ETime []byte  `json:"etime"` // Encrypted 'main' fine timestamp, ns precision [0..999999999] (Optional)
+	FTime *uint32 `json:"ftime"` // Fine timestamp, ns precision [0..999999999] (Optional)
+	FOff  *int32  `json:"foff"`  // Frequency offset in Hz [-125 kHz..+125 kHz] (Optional)
+}
+
+// matchLoRaDataRate returns the spreading-factor and bandwidth of the given
+// LoRa data-rate string (e.g. SF12BW250). This is equivalent to matching
+// SF(\d+)BW(\d+), but without allocating on the hot path.
+func matchLoRaDataRate(datr string) (sf, bw string, ok bool) {
+	digits := func(s string) int {
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		return n
+	}
+
+	for off := 0; ; {
+		i := strings.Index(datr[off:], "SF")
+		if i == -1 {
+			return "", "", false
+		}
+		off += i + 2
+
+		sfLen := digits(datr[off:])
+		if sfLen != 0 && strings.HasPrefix(datr[off+sfLen:], "BW") {
+			bwStart := off + sfLen + 2
+			if bwLen := digits(datr[bwStart:]); bwLen != 0 {
+				return datr[off : off+sfLen], datr[bwStart : bwStart+bwLen], true
+			}
+		}
+	}
 }
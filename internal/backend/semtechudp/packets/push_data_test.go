@@ -1,10 +1,12 @@
 package packets
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -45,6 +47,21 @@ func TestPushDataTest(t *testing.T) {
 	}
 }
 
+func TestPushDataUnmarshalError(t *testing.T) {
+	assert := require.New(t)
+
+	var p PushDataPacket
+
+	err := p.UnmarshalBinary([]byte{2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	assert.IsType(&HeaderError{}, err)
+
+	err = p.UnmarshalBinary([]byte{2, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 123, 125})
+	assert.IsType(&HeaderError{}, err)
+
+	err = p.UnmarshalBinary([]byte{2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 123, 34})
+	assert.IsType(&PayloadError{}, err)
+}
+
 func TestGetGatewayStats(t *testing.T) {
 	assert := assert.New(t)
 
@@ -151,6 +168,12 @@ func TestGetUplinkFrame(t *testing.T) {
 	assert.Nil(err)
 
 	tmms := int64(10 * time.Minute / time.Millisecond)
+	jverLegacy := JSONVersionLegacy
+
+	fTime := uint32(123456789)
+	fOff := int32(-125)
+	pbFineTime, err := ptypes.TimestampProto(now.Add(123456789 * time.Nanosecond))
+	assert.Nil(err)
 
 	testTable := []struct {
 		Name           string
@@ -417,6 +440,201 @@ func TestGetUplinkFrame(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "uplink with multiple antennas and legacy jver",
+			PushDataPacket: PushDataPacket{
+				GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+				ProtocolVersion: ProtocolVersion2,
+				Payload: PushDataPayload{
+					JVer: &jverLegacy,
+					RXPK: []RXPK{
+						{
+							Time: &ctNow,
+							Tmms: &tmms,
+							Tmst: 1000000,
+							Freq: 868.3,
+							Brd:  2,
+							Chan: 1,
+							RFCh: 3,
+							Stat: 1,
+							Modu: "LORA",
+							DatR: DatR{LoRa: "SF12BW500"},
+							CodR: "4/5",
+							RSSI: -60,
+							LSNR: 5.5,
+							Size: 5,
+							Data: []byte{1, 2, 3, 4, 5},
+							RSig: []RSig{
+								{
+									Ant:   8,
+									Chan:  9,
+									LSNR:  6.6,
+									RSSIC: -70,
+								},
+							},
+						},
+					},
+				},
+			},
+			UplinkFrames: []gw.UplinkFrame{
+				{
+					PhyPayload: []byte{1, 2, 3, 4, 5},
+					TxInfo: &gw.UplinkTXInfo{
+						Frequency:  868300000,
+						Modulation: common.Modulation_LORA,
+						ModulationInfo: &gw.UplinkTXInfo_LoraModulationInfo{
+							LoraModulationInfo: &gw.LoRaModulationInfo{
+								Bandwidth:             500,
+								SpreadingFactor:       12,
+								CodeRate:              "4/5",
+								PolarizationInversion: false,
+							},
+						},
+					},
+					RxInfo: &gw.UplinkRXInfo{
+						GatewayId:         []byte{1, 2, 3, 4, 5, 6, 7, 8},
+						Time:              pbTime,
+						TimeSinceGpsEpoch: ptypes.DurationProto(10 * time.Minute),
+						Rssi:              -60,
+						LoraSnr:           5.5,
+						Channel:           1,
+						RfChain:           3,
+						Board:             2,
+						Antenna:           0,
+						Context:           []byte{0x00, 0x0f, 0x42, 0x40},
+						CrcStatus:         gw.CRCStatus_CRC_OK,
+					},
+				},
+			},
+		},
+		{
+			Name: "uplink with fine timestamp",
+			PushDataPacket: PushDataPacket{
+				GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+				ProtocolVersion: ProtocolVersion2,
+				Payload: PushDataPayload{
+					RXPK: []RXPK{
+						{
+							Time:  &ctNow,
+							Tmst:  1000000,
+							Freq:  868.3,
+							Chan:  1,
+							Stat:  1,
+							Modu:  "LORA",
+							DatR:  DatR{LoRa: "SF12BW500"},
+							CodR:  "4/5",
+							RSSI:  -60,
+							LSNR:  5.5,
+							Size:  5,
+							Data:  []byte{1, 2, 3, 4, 5},
+							FTime: &fTime,
+							FOff:  &fOff,
+						},
+					},
+				},
+			},
+			UplinkFrames: []gw.UplinkFrame{
+				{
+					PhyPayload: []byte{1, 2, 3, 4, 5},
+					TxInfo: &gw.UplinkTXInfo{
+						Frequency:  868300000,
+						Modulation: common.Modulation_LORA,
+						ModulationInfo: &gw.UplinkTXInfo_LoraModulationInfo{
+							LoraModulationInfo: &gw.LoRaModulationInfo{
+								Bandwidth:             500,
+								SpreadingFactor:       12,
+								CodeRate:              "4/5",
+								PolarizationInversion: false,
+							},
+						},
+					},
+					RxInfo: &gw.UplinkRXInfo{
+						GatewayId:         []byte{1, 2, 3, 4, 5, 6, 7, 8},
+						Time:              pbTime,
+						Rssi:              -60,
+						LoraSnr:           5.5,
+						Channel:           1,
+						Antenna:           0,
+						FineTimestampType: gw.FineTimestampType_PLAIN,
+						FineTimestamp: &gw.UplinkRXInfo_PlainFineTimestamp{
+							PlainFineTimestamp: &gw.PlainFineTimestamp{
+								Time: pbFineTime,
+							},
+						},
+						Context:   []byte{0x00, 0x0f, 0x42, 0x40},
+						CrcStatus: gw.CRCStatus_CRC_OK,
+					},
+				},
+			},
+		},
+		{
+			Name: "uplink with multiple antennas and fine timestamp",
+			PushDataPacket: PushDataPacket{
+				GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+				ProtocolVersion: ProtocolVersion2,
+				Payload: PushDataPayload{
+					RXPK: []RXPK{
+						{
+							Time: &ctNow,
+							Tmst: 1000000,
+							Freq: 868.3,
+							Chan: 1,
+							Stat: 1,
+							Modu: "LORA",
+							DatR: DatR{LoRa: "SF12BW500"},
+							CodR: "4/5",
+							RSSI: -60,
+							LSNR: 5.5,
+							Size: 5,
+							Data: []byte{1, 2, 3, 4, 5},
+							RSig: []RSig{
+								{
+									Ant:   8,
+									Chan:  9,
+									LSNR:  6.6,
+									RSSIC: -70,
+									FTime: &fTime,
+									FOff:  &fOff,
+								},
+							},
+						},
+					},
+				},
+			},
+			UplinkFrames: []gw.UplinkFrame{
+				{
+					PhyPayload: []byte{1, 2, 3, 4, 5},
+					TxInfo: &gw.UplinkTXInfo{
+						Frequency:  868300000,
+						Modulation: common.Modulation_LORA,
+						ModulationInfo: &gw.UplinkTXInfo_LoraModulationInfo{
+							LoraModulationInfo: &gw.LoRaModulationInfo{
+								Bandwidth:             500,
+								SpreadingFactor:       12,
+								CodeRate:              "4/5",
+								PolarizationInversion: false,
+							},
+						},
+					},
+					RxInfo: &gw.UplinkRXInfo{
+						GatewayId:         []byte{1, 2, 3, 4, 5, 6, 7, 8},
+						Time:              pbTime,
+						Rssi:              -70,
+						LoraSnr:           6.6,
+						Channel:           9,
+						Antenna:           8,
+						FineTimestampType: gw.FineTimestampType_PLAIN,
+						FineTimestamp: &gw.UplinkRXInfo_PlainFineTimestamp{
+							PlainFineTimestamp: &gw.PlainFineTimestamp{
+								Time: pbFineTime,
+							},
+						},
+						Context:   []byte{0x00, 0x0f, 0x42, 0x40},
+						CrcStatus: gw.CRCStatus_CRC_OK,
+					},
+				},
+			},
+		},
 	}
 
 	for _, test := range testTable {
@@ -434,3 +652,153 @@ func TestGetUplinkFrame(t *testing.T) {
 		})
 	}
 }
+
+func TestPushDataPayloadJSONVersion(t *testing.T) {
+	assert := require.New(t)
+
+	var p PushDataPayload
+	assert.NoError(json.Unmarshal([]byte(`{"rxpk":[]}`), &p))
+	assert.Nil(p.JVer)
+	assert.Equal(JSONVersionLegacy, p.JSONVersion())
+
+	assert.NoError(json.Unmarshal([]byte(`{"jver":2,"rxpk":[]}`), &p))
+	assert.Equal(JSONVersionRSig, p.JSONVersion())
+}
+
+func TestRXPKRawData(t *testing.T) {
+	assert := require.New(t)
+
+	var rxpk RXPK
+	assert.NoError(json.Unmarshal([]byte(`{"stat":1,"datr":"SF7BW125","data":"AQIDBA=="}`), &rxpk))
+	assert.Equal([]byte{1, 2, 3, 4}, rxpk.Data)
+	assert.Equal("AQIDBA==", rxpk.RawData)
+	assert.Equal("SF7BW125", rxpk.DatR.LoRa)
+	assert.EqualValues(1, rxpk.Stat)
+
+	// the raw data is not marshaled
+	b, err := json.Marshal(rxpk)
+	assert.NoError(err)
+	assert.NotContains(string(b), "RawData")
+
+	assert.Error(json.Unmarshal([]byte(`{"data":"AQ$D"}`), &rxpk))
+
+	t.Run("GetUplinkFramesWithRXPK", func(t *testing.T) {
+		assert := require.New(t)
+
+		p := PushDataPacket{
+			Payload: PushDataPayload{
+				RXPK: []RXPK{
+					{Stat: -1, DatR: DatR{LoRa: "SF7BW125"}, Data: []byte{1}, RawData: "AQ=="},
+					{Stat: 1, DatR: DatR{LoRa: "SF7BW125"}, Data: []byte{2}, RawData: "Ag=="},
+				},
+			},
+		}
+
+		frames, rxpks, err := p.GetUplinkFramesWithRXPK(false, false)
+		assert.NoError(err)
+		assert.Len(frames, 1)
+		assert.Len(rxpks, 1)
+		assert.Equal("Ag==", rxpks[0].RawData)
+	})
+}
+
+func TestGetUplinkFrameError(t *testing.T) {
+	assert := require.New(t)
+
+	p := PushDataPacket{
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		ProtocolVersion: ProtocolVersion2,
+		Payload: PushDataPayload{
+			RXPK: []RXPK{
+				{
+					Freq: 868.3,
+					Stat: 1,
+					Modu: "LORA",
+					DatR: DatR{LoRa: "SF12"},
+					Size: 5,
+					Data: []byte{1, 2, 3, 4, 5},
+				},
+			},
+		},
+	}
+
+	_, err := p.GetUplinkFrames(false, false)
+	assert.Error(err)
+
+	decodeErr, ok := errors.Cause(err).(*UplinkFrameError)
+	assert.True(ok)
+	assert.Equal("datr", decodeErr.Field)
+	assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, decodeErr.GatewayID)
+	assert.Equal("SF12", decodeErr.DataRate)
+	assert.Equal("backend/semtechudp/packets: decode rxpk field 'datr' error (gateway_id: 0102030405060708, freq: 868.300000, datr: SF12, size: 5): could not parse LoRa data-rate", decodeErr.Error())
+}
+
+func TestMatchLoRaDataRate(t *testing.T) {
+	tests := []struct {
+		DatR string
+		SF   string
+		BW   string
+		OK   bool
+	}{
+		{DatR: "SF12BW125", SF: "12", BW: "125", OK: true},
+		{DatR: "SF7BW500", SF: "7", BW: "500", OK: true},
+		{DatR: "xSFSF9BW250x", SF: "9", BW: "250", OK: true},
+		{DatR: "SF12"},
+		{DatR: "SFBW125"},
+		{DatR: "SF12BW"},
+		{DatR: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.DatR, func(t *testing.T) {
+			assert := require.New(t)
+
+			sf, bw, ok := matchLoRaDataRate(test.DatR)
+			assert.Equal(test.OK, ok)
+			assert.Equal(test.SF, sf)
+			assert.Equal(test.BW, bw)
+		})
+	}
+}
+
+func BenchmarkPushDataUnmarshalBinary(b *testing.B) {
+	p := PushDataPacket{
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		ProtocolVersion: ProtocolVersion2,
+		Payload: PushDataPayload{
+			RXPK: []RXPK{
+				{
+					Tmst: 708016819,
+					Freq: 868.5,
+					Chan: 2,
+					RFCh: 1,
+					Stat: 1,
+					Modu: "LORA",
+					DatR: DatR{LoRa: "SF7BW125"},
+					CodR: "4/5",
+					RSSI: -51,
+					LSNR: 7,
+					Size: 16,
+					Data: []byte{64, 1, 2, 3, 4, 128, 1, 0, 1, 2, 3, 4, 5, 6, 7, 8},
+				},
+			},
+		},
+	}
+	data, err := p.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var p PushDataPacket
+		if err := p.UnmarshalBinary(data); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := p.GetUplinkFrames(false, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
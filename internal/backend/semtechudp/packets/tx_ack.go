@@ -41,10 +41,10 @@ func (p TXACKPacket) MarshalBinary() ([]byte, error) {
 // UnmarshalBinary decodes the object from binary form.
 func (p *TXACKPacket) UnmarshalBinary(data []byte) error {
 	if len(data) < 12 {
-		return errors.New("gateway: at least 12 bytes of data are expected")
+		return &HeaderError{Err: errors.New("gateway: at least 12 bytes of data are expected")}
 	}
 	if data[3] != byte(TXACK) {
-		return errors.New("gateway: identifier mismatch (TXACK expected)")
+		return &HeaderError{Err: errors.New("gateway: identifier mismatch (TXACK expected)")}
 	}
 	if !protocolSupported(data[0]) {
 		return ErrInvalidProtocolVersion
@@ -56,7 +56,9 @@ func (p *TXACKPacket) UnmarshalBinary(data []byte) error {
 	}
 	if len(data) > 13 { // the min payload + the length of at least "{}"
 		p.Payload = &TXACKPayload{}
-		return json.Unmarshal(data[12:], p.Payload)
+		if err := json.Unmarshal(data[12:], p.Payload); err != nil {
+			return &PayloadError{Err: err}
+		}
 	}
 	return nil
 }
@@ -70,4 +72,20 @@ type TXACKPayload struct {
 // packet.
 type TXPKACK struct {
 	Error string `json:"error"`
+
+	// Optional, not sent by all packet-forwarders. On a TX_POWER warning,
+	// Value contains the TX power (dBm) actually used. Freq contains the TX
+	// central frequency (MHz) actually used.
+	Warn  string   `json:"warn,omitempty"`
+	Value *int     `json:"value,omitempty"`
+	Freq  *float64 `json:"freq,omitempty"`
+}
+
+// ActualPower returns the TX power actually used, as reported by a TX_POWER
+// warning. It returns false when not reported.
+func (a TXPKACK) ActualPower() (int, bool) {
+	if a.Warn != "TX_POWER" || a.Value == nil {
+		return 0, false
+	}
+	return *a.Value, true
 }
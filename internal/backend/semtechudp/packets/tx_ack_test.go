@@ -1,11 +1,28 @@
 package packets
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func TestTXPKACKActualPower(t *testing.T) {
+	assert := require.New(t)
+
+	var ack TXPKACK
+	assert.NoError(json.Unmarshal([]byte(`{"error":"NONE"}`), &ack))
+	_, ok := ack.ActualPower()
+	assert.False(ok)
+
+	assert.NoError(json.Unmarshal([]byte(`{"warn":"TX_POWER","value":12,"freq":868.1}`), &ack))
+	powe, ok := ack.ActualPower()
+	assert.True(ok)
+	assert.Equal(12, powe)
+	assert.Equal(868.1, *ack.Freq)
+}
+
 func TestTXACK(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1,29 +1,236 @@
 package semtechudp
 
 import (
-	"errors"
+	"encoding/json"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/lorawan"
 )
 
 // errors
 var (
-	errGatewayDoesNotExist = errors.New("gateway does not exist")
+	// ErrGatewayUnknown is returned when the gateway has never been seen (or
+	// expired longer than the expired grace duration ago).
+	ErrGatewayUnknown = errors.New("gateway does not exist")
+
+	// ErrGatewayExpired is returned when the gateway was seen, but has been
+	// cleaned up from the registry because of inactivity. The gateway might
+	// re-appear.
+	ErrGatewayExpired = errors.New("gateway has expired")
+
+	// ErrTooManyGateways is returned when a new gateway can not be added
+	// because the registry contains the max. number of gateways.
+	ErrTooManyGateways = errors.New("max. number of gateways reached")
 )
 
-// gatewayCleanupDuration contains the duration after which the gateway is
-// cleaned up from the registry after no activity
-var gatewayCleanupDuration = -1 * time.Minute
+// defaultGatewayStaleDuration contains the default duration after which the
+// gateway is cleaned up from the registry after no activity.
+const defaultGatewayStaleDuration = time.Minute
+
+// defaultGatewayCleanupInterval contains the default interval of the
+// registry cleanup.
+const defaultGatewayCleanupInterval = time.Minute
+
+// gatewayExpiredGraceDuration contains the duration during which a cleaned
+// up gateway is reported as expired instead of unknown.
+var gatewayExpiredGraceDuration = time.Hour
+
+// gatewaysSaveInterval contains the min. interval between saving the
+// gateways file after gateways were added to or removed from the registry.
+var gatewaysSaveInterval = 5 * time.Second
+
+// downlinkErrorHistorySize defines the number of downlink errors tracked per
+// gateway.
+const downlinkErrorHistorySize = 10
+
+// GatewayEventFunc defines the function signature of the gateway
+// (dis)connect event handler.
+type GatewayEventFunc func(listenerID string, e events.Subscribe)
+
+// GatewaySubscriberFunc defines the function signature of a gateway connect
+// or disconnect subscriber (see OnGatewayNew and OnGatewayDelete).
+type GatewaySubscriberFunc func(listenerID string, gatewayID lorawan.EUI64) error
 
 // gateway contains a connection and meta-data for a gateway connection.
 type gateway struct {
 	addr            *net.UDPAddr
+	conn            *net.UDPConn
+	listenerID      string
 	lastSeen        time.Time
 	protocolVersion uint8
+
+	// firstSeen contains the time when the gateway was added to the registry.
+	firstSeen time.Time
+
+	// lastPullData contains the time of the last fully handled PullData
+	// (see pull_data_debounce).
+	lastPullData time.Time
+
+	// pullDataAddr contains the address of the last fully handled PullData.
+	pullDataAddr *net.UDPAddr
+
+	// lastStats contains the time of the last stats sent by the gateway.
+	lastStats time.Time
+
+	// counters contains the bridge-side counters since the last stats.
+	counters gatewayCounters
+
+	// ackLatency contains the estimated downlink / TXACK round-trip time.
+	ackLatency time.Duration
+
+	// uplinkSNR contains the moving average of the LoRa SNR of the uplinks
+	// received by the gateway. This is only valid when hasUplinkSNR is set.
+	uplinkSNR    float64
+	hasUplinkSNR bool
+
+	// idleIntervals contains the number of consecutive stats intervals
+	// without forwarded uplinks and failingHealth the health metrics which
+	// are currently failing (see evaluateHealth).
+	idleIntervals int
+	failingHealth map[string]bool
+
+	// lastTmst contains the concentrator counter of the last uplink and
+	// lastTmstTime the time at which it was received.
+	lastTmst     uint32
+	lastTmstTime time.Time
+
+	// tmstDrift contains the estimated drift of the concentrator counter
+	// relative to the wall time (e.g. 0.00002 for 20 ppm fast), measured
+	// since driftTmst / driftTmstTime (see updateTmstDrift).
+	tmstDrift     float64
+	driftTmst     uint32
+	driftTmstTime time.Time
+
+	// suspect is set when the gateway has been inactive longer than the
+	// cleanup duration, but not longer than the suspect grace duration.
+	suspect bool
+
+	// rxpkBatchLast contains the number of RXPK in the last PushData
+	// containing uplinks and rxpkBatchMax the max. since the gateway was
+	// added to the registry.
+	rxpkBatchLast int
+	rxpkBatchMax  int
+
+	// version contains the version reported in the last stats, it is nil
+	// until the first stats.
+	version *GatewayVersion
+
+	// downlinkErrors contains the last downlink errors, oldest first. It is
+	// replaced on every update, as the gateway is copied by value.
+	downlinkErrors []DownlinkError
+
+	// bytesIn and bytesOut contain the number of UDP bytes received from and
+	// sent to the gateway since it was added to the registry.
+	bytesIn  uint64
+	bytesOut uint64
+
+	// forwardRatio contains the moving average of the rxfw / rxnb ratio of
+	// the stats (see updateForwardRatio), it is nil until the first stats
+	// with received packets.
+	forwardRatio *float64
+
+	// jsonVersion contains the jver of the last PushData (see
+	// packets.PushDataPayload.JSONVersion).
+	jsonVersion int
+}
+
+// gatewayCounters contains the packet counters of a gateway as seen by the
+// backend.
+type gatewayCounters struct {
+	rxReceived  uint32
+	rxForwarded uint32
+	txSent      uint32
+	txAckOK     uint32
+	txAckFailed uint32
+	bytesIn     uint64
+	bytesOut    uint64
+
+	// rxFrequencies contains the number of received uplinks per frequency
+	// (Hz). Uplinks on frequencies exceeding the max. number of tracked
+	// frequencies are counted in rxFrequencyOther.
+	rxFrequencies    map[uint32]uint32
+	rxFrequencyOther uint32
+}
+
+// addRXFrequency counts an uplink received on the given frequency (Hz),
+// tracking at most max frequencies.
+func (c *gatewayCounters) addRXFrequency(freq uint32, max int) {
+	if _, ok := c.rxFrequencies[freq]; !ok && len(c.rxFrequencies) >= max {
+		c.rxFrequencyOther++
+		return
+	}
+
+	if c.rxFrequencies == nil {
+		c.rxFrequencies = make(map[uint32]uint32)
+	}
+	c.rxFrequencies[freq]++
+}
+
+// addToMetaData adds the counters to the given (stats) meta-data.
+func (c gatewayCounters) addToMetaData(md map[string]string) {
+	md["bridge_rx_received"] = strconv.FormatUint(uint64(c.rxReceived), 10)
+	md["bridge_rx_forwarded"] = strconv.FormatUint(uint64(c.rxForwarded), 10)
+	md["bridge_tx_sent"] = strconv.FormatUint(uint64(c.txSent), 10)
+	md["bridge_tx_ack_ok"] = strconv.FormatUint(uint64(c.txAckOK), 10)
+	md["bridge_tx_ack_failed"] = strconv.FormatUint(uint64(c.txAckFailed), 10)
+	md["bridge_bytes_in"] = strconv.FormatUint(c.bytesIn, 10)
+	md["bridge_bytes_out"] = strconv.FormatUint(c.bytesOut, 10)
+}
+
+// addRXPKBatchToMetaData adds the RXPK batch sizes of the gateway to the
+// given (stats) meta-data.
+func (g gateway) addRXPKBatchToMetaData(md map[string]string) {
+	md["bridge_rxpk_batch_last"] = strconv.Itoa(g.rxpkBatchLast)
+	md["bridge_rxpk_batch_max"] = strconv.Itoa(g.rxpkBatchMax)
+}
+
+// addForwardRatioToMetaData adds the forward ratio of the gateway (if known)
+// to the given (stats) meta-data.
+func (g gateway) addForwardRatioToMetaData(md map[string]string) {
+	if g.forwardRatio != nil {
+		md["bridge_rx_forward_ratio"] = strconv.FormatFloat(*g.forwardRatio, 'f', 3, 64)
+	}
+}
+
+// updateForwardRatio updates the forward ratio of the given gateway with the
+// rxnb and rxfw counters of a stats interval. The ratio is smoothed using a
+// moving average, intervals without received packets are ignored. As the
+// packet-forwarder might also forward packets with a CRC error, rxfw is
+// capped at rxnb.
+func updateForwardRatio(gw *gateway, rxnb, rxfw uint32) {
+	if rxnb == 0 {
+		return
+	}
+	if rxfw > rxnb {
+		rxfw = rxnb
+	}
+
+	ratio := float64(rxfw) / float64(rxnb)
+	if gw.forwardRatio != nil {
+		ratio = (7**gw.forwardRatio + ratio) / 8
+	}
+	gw.forwardRatio = &ratio
+}
+
+// addFrequenciesToMetaData adds the per frequency uplink counters to the
+// given (stats) meta-data.
+func (c gatewayCounters) addFrequenciesToMetaData(md map[string]string) {
+	for freq, count := range c.rxFrequencies {
+		md["bridge_rx_freq_"+strconv.FormatUint(uint64(freq), 10)] = strconv.FormatUint(uint64(count), 10)
+	}
+	if c.rxFrequencyOther != 0 {
+		md["bridge_rx_freq_other"] = strconv.FormatUint(uint64(c.rxFrequencyOther), 10)
+	}
 }
 
 // gateways contains the gateways registry.
@@ -32,6 +239,135 @@ type gateways struct {
 	gateways map[lorawan.EUI64]gateway
 
 	subscribeEventChan chan events.Subscribe
+
+	// gatewayEventFunc (optional) is called on gateway (dis)connect.
+	gatewayEventFunc GatewayEventFunc
+
+	// onNew and onDelete contain the gateway connect and disconnect
+	// subscribers, which are called in order after the gatewayEventFunc.
+	// When abortOnSubscriberError is set, the remaining subscribers are
+	// skipped after the first error.
+	onNew                  []GatewaySubscriberFunc
+	onDelete               []GatewaySubscriberFunc
+	abortOnSubscriberError bool
+
+	// now returns the current time. When nil, time.Now is used.
+	now func() time.Time
+
+	// expired contains the gateways that have been cleaned up, with the
+	// time of cleanup.
+	expired map[lorawan.EUI64]time.Time
+
+	// pending contains the new gateways of which the connect subscribers
+	// are being called (see set). The channel is closed once the gateway
+	// has been added to the registry.
+	pending map[lorawan.EUI64]chan struct{}
+
+	// maxGateways (optional) limits the number of gateways in the registry.
+	maxGateways int
+
+	// changed (optional) receives a value, without blocking, when a gateway
+	// is added to or removed from the registry, or when its persisted
+	// connection details have changed (see save).
+	changed chan struct{}
+
+	// suspectGrace (optional) contains the duration during which inactive
+	// gateways are marked as suspect before they are removed.
+	suspectGrace time.Duration
+
+	// staleDuration (optional) contains the duration of inactivity after
+	// which a gateway is removed and cleanupInterval the interval of the
+	// cleanup. When 0, defaultGatewayStaleDuration and
+	// defaultGatewayCleanupInterval are used.
+	staleDuration   time.Duration
+	cleanupInterval time.Duration
+}
+
+// getStaleDuration returns the stale duration. The caller must hold the
+// lock.
+func (c *gateways) getStaleDuration() time.Duration {
+	if c.staleDuration == 0 {
+		return defaultGatewayStaleDuration
+	}
+	return c.staleDuration
+}
+
+// getCleanupInterval returns the cleanup interval. The caller must hold the
+// lock.
+func (c *gateways) getCleanupInterval() time.Duration {
+	if c.cleanupInterval == 0 {
+		return defaultGatewayCleanupInterval
+	}
+	return c.cleanupInterval
+}
+
+// isStale returns true when the given gateway has been inactive longer than
+// the stale duration. The caller must hold the lock.
+func (c *gateways) isStale(gw gateway, now time.Time) bool {
+	return gw.lastSeen.Before(now.Add(-c.getStaleDuration()))
+}
+
+// notFoundError returns the error for a gateway that is not in the registry.
+// The caller must hold the lock.
+func (c *gateways) notFoundError(gatewayID lorawan.EUI64) error {
+	if _, ok := c.expired[gatewayID]; ok {
+		return ErrGatewayExpired
+	}
+	return ErrGatewayUnknown
+}
+
+// getNotifyFunc returns the function calling the gateway event function and
+// the connect or disconnect subscribers for the given event. The returned
+// function does not access the registry, thus it can be called after
+// releasing the lock. The caller must hold the lock.
+func (c *gateways) getNotifyFunc(listenerID string, e events.Subscribe) func() {
+	eventFunc := c.gatewayEventFunc
+	abort := c.abortOnSubscriberError
+
+	subscribers := c.onDelete
+	if e.Subscribe {
+		subscribers = c.onNew
+	}
+
+	return func() {
+		if eventFunc != nil {
+			eventFunc(listenerID, e)
+		}
+
+		for _, fn := range subscribers {
+			if err := fn(listenerID, e.GatewayID); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"gateway_id": e.GatewayID,
+					"subscribe":  e.Subscribe,
+				}).Error("backend/semtechudp: gateway subscriber error")
+
+				if abort {
+					return
+				}
+			}
+		}
+	}
+}
+
+// getNow returns the current time.
+func (c *gateways) getNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// list returns the Gateway IDs and gateway objects of all gateways in the
+// registry.
+func (c *gateways) list() map[lorawan.EUI64]gateway {
+	c.RLock()
+	defer c.RUnlock()
+
+	out := make(map[lorawan.EUI64]gateway, len(c.gateways))
+	for k, v := range c.gateways {
+		out[k] = v
+	}
+	return out
 }
 
 // get returns the gateway object for the given MAC.
@@ -41,7 +377,7 @@ func (c *gateways) get(mac lorawan.EUI64) (gateway, error) {
 
 	gw, ok := c.gateways[mac]
 	if !ok {
-		return gw, errGatewayDoesNotExist
+		return gw, c.notFoundError(mac)
 	}
 
 	return gw, nil
@@ -51,30 +387,262 @@ func (c *gateways) get(mac lorawan.EUI64) (gateway, error) {
 // Note that set must only be called for PullData frames! The UDP Packet
 // Forwarded uses two UDP sockets and the socket responsible for sending the
 // PullData is used for receiving downlink data.
+//
+// The connect subscribers of a new gateway are called without holding the
+// lock, so that a slow subscriber does not block the registry. Concurrent
+// calls for the same new gateway wait until it has been added, after which
+// these update the gateway.
 func (c *gateways) set(gatewayID lorawan.EUI64, gw gateway) error {
+	c.Lock()
+	for {
+		done, ok := c.pending[gatewayID]
+		if !ok {
+			break
+		}
+
+		c.Unlock()
+		<-done
+		c.Lock()
+	}
+
+	existing, ok := c.gateways[gatewayID]
+	if ok {
+		defer c.Unlock()
+
+		if existing.addr.String() != gw.addr.String() || existing.protocolVersion != gw.protocolVersion {
+			c.notifyChanged()
+		}
+
+		// only update the connection details of a known gateway, so that the
+		// state tracked in between PullData packets is not lost
+		existing.addr = gw.addr
+		existing.conn = gw.conn
+		existing.listenerID = gw.listenerID
+		existing.lastSeen = gw.lastSeen
+		existing.lastPullData = gw.lastPullData
+		existing.pullDataAddr = gw.pullDataAddr
+		existing.protocolVersion = gw.protocolVersion
+		existing.suspect = false
+
+		c.subscribeEventChan <- events.Subscribe{Subscribe: true, GatewayID: gatewayID}
+		c.gateways[gatewayID] = existing
+		delete(c.expired, gatewayID)
+		return nil
+	}
+
+	if c.maxGateways > 0 && len(c.gateways)+len(c.pending) >= c.maxGateways {
+		c.Unlock()
+		return ErrTooManyGateways
+	}
+
+	if c.pending == nil {
+		c.pending = make(map[lorawan.EUI64]chan struct{})
+	}
+	done := make(chan struct{})
+	c.pending[gatewayID] = done
+
+	gw.firstSeen = gw.lastSeen
+	connectCounter().Inc()
+	notify := c.getNotifyFunc(gw.listenerID, events.Subscribe{Subscribe: true, GatewayID: gatewayID})
+	c.Unlock()
+
+	notify()
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.subscribeEventChan <- events.Subscribe{Subscribe: true, GatewayID: gatewayID}
+	c.gateways[gatewayID] = gw
+	delete(c.expired, gatewayID)
+	delete(c.pending, gatewayID)
+	close(done)
+	c.notifyChanged()
+	return nil
+}
+
+// notifyChanged signals that the registry has changed (see changed). The
+// caller must hold the lock.
+func (c *gateways) notifyChanged() {
+	if c.changed == nil {
+		return
+	}
+
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// update calls the given function with the gateway for the given Gateway ID
+// so that it can update its state. It returns ErrGatewayUnknown or
+// ErrGatewayExpired when the gateway is not in the registry.
+func (c *gateways) update(gatewayID lorawan.EUI64, fn func(gw *gateway)) error {
 	c.Lock()
 	defer c.Unlock()
 
-	_, ok := c.gateways[gatewayID]
+	gw, ok := c.gateways[gatewayID]
 	if !ok {
-		connectCounter().Inc()
+		return c.notFoundError(gatewayID)
 	}
 
-	c.subscribeEventChan <- events.Subscribe{Subscribe: true, GatewayID: gatewayID}
+	fn(&gw)
 	c.gateways[gatewayID] = gw
 	return nil
 }
 
+// addDownlinkError adds the given downlink error to the downlink error
+// history of the given gateway. Errors of unknown gateways are not tracked.
+func (c *gateways) addDownlinkError(gatewayID lorawan.EUI64, err error, now time.Time) {
+	_ = c.update(gatewayID, func(gw *gateway) {
+		errs := gw.downlinkErrors
+		if len(errs) >= downlinkErrorHistorySize {
+			errs = errs[len(errs)-downlinkErrorHistorySize+1:]
+		}
+
+		out := make([]DownlinkError, 0, len(errs)+1)
+		out = append(out, errs...)
+		gw.downlinkErrors = append(out, DownlinkError{Time: now, Error: err.Error()})
+	})
+}
+
+// updateCounters calls the given function with the counters of the given
+// gateway. Counters of unknown gateways are not tracked.
+func (c *gateways) updateCounters(gatewayID lorawan.EUI64, fn func(c *gatewayCounters)) {
+	_ = c.update(gatewayID, func(gw *gateway) {
+		fn(&gw.counters)
+	})
+}
+
+// resetCounters returns the counters of the given gateway and resets them.
+func (c *gateways) resetCounters(gatewayID lorawan.EUI64) gatewayCounters {
+	var out gatewayCounters
+	c.updateCounters(gatewayID, func(c *gatewayCounters) {
+		out = *c
+		*c = gatewayCounters{}
+	})
+	return out
+}
+
+// persistedGateway contains the gateway fields that are persisted to disk.
+type persistedGateway struct {
+	GatewayID       lorawan.EUI64 `json:"gateway_id"`
+	Addr            string        `json:"addr"`
+	LastSeen        time.Time     `json:"last_seen"`
+	ProtocolVersion uint8         `json:"protocol_version"`
+}
+
+// save writes the gateways in the registry to the given file. The file is
+// replaced atomically.
+func (c *gateways) save(path string) error {
+	c.RLock()
+	var out []persistedGateway
+	for gatewayID, gw := range c.gateways {
+		out = append(out, persistedGateway{
+			GatewayID:       gatewayID,
+			Addr:            gw.addr.String(),
+			LastSeen:        gw.lastSeen,
+			ProtocolVersion: gw.protocolVersion,
+		})
+	}
+	c.RUnlock()
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// loadGateways reads the gateways from the given file, as written by save.
+// Gateways that would have been cleaned up at the given time, thus were not
+// seen within the given stale duration and suspect grace, are discarded. A
+// missing file results in an empty map.
+func loadGateways(path string, now time.Time, staleDuration, suspectGrace time.Duration) (map[lorawan.EUI64]gateway, error) {
+	out := make(map[lorawan.EUI64]gateway)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return nil, err
+	}
+
+	var gws []persistedGateway
+	if err := json.Unmarshal(b, &gws); err != nil {
+		return nil, err
+	}
+
+	for _, gw := range gws {
+		if gw.LastSeen.Before(now.Add(-staleDuration - suspectGrace)) {
+			continue
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", gw.Addr)
+		if err != nil {
+			return nil, err
+		}
+
+		out[gw.GatewayID] = gateway{
+			addr:            addr,
+			lastSeen:        gw.LastSeen,
+			firstSeen:       gw.LastSeen,
+			protocolVersion: gw.ProtocolVersion,
+		}
+	}
+
+	return out, nil
+}
+
 // cleanup removes inactive gateways from the registry.
 func (c *gateways) cleanup() error {
 	c.Lock()
 	defer c.Unlock()
 
-	for gatewayID := range c.gateways {
-		if c.gateways[gatewayID].lastSeen.Before(time.Now().Add(gatewayCleanupDuration)) {
+	now := c.getNow()
+
+	for gatewayID, expiredAt := range c.expired {
+		if expiredAt.Before(now.Add(-gatewayExpiredGraceDuration)) {
+			delete(c.expired, gatewayID)
+		}
+	}
+
+	for gatewayID, gw := range c.gateways {
+		if c.isStale(gw, now) {
+			if !gw.lastSeen.Before(now.Add(-c.getStaleDuration() - c.suspectGrace)) {
+				if !gw.suspect {
+					suspectCounter().Inc()
+					gw.suspect = true
+					c.gateways[gatewayID] = gw
+				}
+				continue
+			}
+
 			disconnectCounter().Inc()
+			c.getNotifyFunc(gw.listenerID, events.Subscribe{Subscribe: false, GatewayID: gatewayID})()
 			c.subscribeEventChan <- events.Subscribe{Subscribe: false, GatewayID: gatewayID}
 			delete(c.gateways, gatewayID)
+			c.notifyChanged()
+
+			if c.expired == nil {
+				c.expired = make(map[lorawan.EUI64]time.Time)
+			}
+			c.expired[gatewayID] = now
 		}
 	}
 	return nil
@@ -0,0 +1,467 @@
+package semtechudp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/lorawan"
+)
+
+func TestGatewaysCleanup(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	gws := gateways{
+		gateways:           make(map[lorawan.EUI64]gateway),
+		subscribeEventChan: make(chan events.Subscribe, 10),
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: gws.getNow()}))
+	now = now.Add(30 * time.Second)
+	assert.NoError(gws.set(lorawan.EUI64{2}, gateway{lastSeen: gws.getNow()}))
+
+	tests := []struct {
+		Name     string
+		Advance  time.Duration
+		Expected []lorawan.EUI64
+	}{
+		{
+			Name:     "no gateway expired",
+			Advance:  29 * time.Second,
+			Expected: []lorawan.EUI64{{1}, {2}},
+		},
+		{
+			Name:     "first gateway expired",
+			Advance:  2 * time.Second,
+			Expected: []lorawan.EUI64{{2}},
+		},
+		{
+			Name:    "all gateways expired",
+			Advance: 30 * time.Second,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+			now = now.Add(tst.Advance)
+			assert.NoError(gws.cleanup())
+
+			var ids []lorawan.EUI64
+			for _, id := range []lorawan.EUI64{{1}, {2}} {
+				if _, err := gws.get(id); err == nil {
+					ids = append(ids, id)
+				}
+			}
+			assert.Equal(tst.Expected, ids)
+		})
+	}
+}
+
+func TestGatewaysSaveLoad(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "gateways.json")
+
+	t.Run("Missing file", func(t *testing.T) {
+		assert := require.New(t)
+		gws, err := loadGateways(path, time.Now(), time.Minute, 0)
+		assert.NoError(err)
+		assert.Len(gws, 0)
+	})
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	gws := gateways{
+		gateways: map[lorawan.EUI64]gateway{
+			{1}: {
+				addr:            &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1700},
+				lastSeen:        now,
+				protocolVersion: 2,
+			},
+			{2}: {
+				addr:     &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1700},
+				lastSeen: now.Add(-2 * time.Minute),
+			},
+		},
+	}
+	assert.NoError(gws.save(path))
+
+	t.Run("Load", func(t *testing.T) {
+		assert := require.New(t)
+		loaded, err := loadGateways(path, now.Add(30*time.Second), time.Minute, 0)
+		assert.NoError(err)
+		assert.Len(loaded, 1)
+
+		gw := loaded[lorawan.EUI64{1}]
+		assert.Equal("10.0.0.1:1700", gw.addr.String())
+		assert.True(now.Equal(gw.lastSeen))
+		assert.True(now.Equal(gw.firstSeen))
+		assert.Equal(uint8(2), gw.protocolVersion)
+	})
+
+	t.Run("Load with suspect grace", func(t *testing.T) {
+		assert := require.New(t)
+		loaded, err := loadGateways(path, now.Add(30*time.Second), time.Minute, 2*time.Minute)
+		assert.NoError(err)
+		assert.Len(loaded, 2)
+	})
+}
+
+func TestGatewaysChanged(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	gws := gateways{
+		gateways:           make(map[lorawan.EUI64]gateway),
+		subscribeEventChan: make(chan events.Subscribe, 10),
+		changed:            make(chan struct{}, 1),
+		now: func() time.Time {
+			return now
+		},
+	}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1700}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1700}
+
+	// new gateway
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{addr: addrA, lastSeen: now}))
+	assert.Len(gws.changed, 1)
+	<-gws.changed
+
+	// only the last-seen timestamp changed
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{addr: addrA, lastSeen: now.Add(time.Second)}))
+	assert.Len(gws.changed, 0)
+
+	// address changed
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{addr: addrB, lastSeen: now.Add(time.Second)}))
+	assert.Len(gws.changed, 1)
+	<-gws.changed
+
+	// removed
+	now = now.Add(2 * time.Minute)
+	assert.NoError(gws.cleanup())
+	assert.Len(gws.changed, 1)
+}
+
+func TestGatewaysNotFoundError(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	gws := gateways{
+		gateways:           make(map[lorawan.EUI64]gateway),
+		subscribeEventChan: make(chan events.Subscribe, 10),
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	_, err := gws.get(lorawan.EUI64{1})
+	assert.Equal(ErrGatewayUnknown, err)
+
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: gws.getNow()}))
+	now = now.Add(2 * time.Minute)
+	assert.NoError(gws.cleanup())
+
+	_, err = gws.get(lorawan.EUI64{1})
+	assert.Equal(ErrGatewayExpired, err)
+	assert.Equal(ErrGatewayExpired, gws.update(lorawan.EUI64{1}, func(gw *gateway) {}))
+
+	t.Run("Gateway re-appears", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: gws.getNow()}))
+		_, err := gws.get(lorawan.EUI64{1})
+		assert.NoError(err)
+
+		now = now.Add(2 * time.Minute)
+		assert.NoError(gws.cleanup())
+	})
+
+	t.Run("Grace duration passed", func(t *testing.T) {
+		assert := require.New(t)
+
+		now = now.Add(gatewayExpiredGraceDuration + time.Second)
+		assert.NoError(gws.cleanup())
+
+		_, err := gws.get(lorawan.EUI64{1})
+		assert.Equal(ErrGatewayUnknown, err)
+	})
+}
+
+func TestGatewaysStaleDuration(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	gws := gateways{
+		gateways:           make(map[lorawan.EUI64]gateway),
+		subscribeEventChan: make(chan events.Subscribe, 10),
+		now: func() time.Time {
+			return now
+		},
+		staleDuration: 5 * time.Minute,
+	}
+
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: gws.getNow()}))
+	<-gws.subscribeEventChan
+
+	// within the stale duration
+	now = now.Add(2 * time.Minute)
+	assert.NoError(gws.cleanup())
+	_, err := gws.get(lorawan.EUI64{1})
+	assert.NoError(err)
+
+	// the default stale duration is used when it is reset
+	gws.staleDuration = 0
+	assert.NoError(gws.cleanup())
+	_, err = gws.get(lorawan.EUI64{1})
+	assert.Equal(ErrGatewayExpired, err)
+}
+
+func TestGatewaysMaxGateways(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	gws := gateways{
+		gateways:           make(map[lorawan.EUI64]gateway),
+		subscribeEventChan: make(chan events.Subscribe, 10),
+		maxGateways:        2,
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: gws.getNow()}))
+	assert.NoError(gws.set(lorawan.EUI64{2}, gateway{lastSeen: gws.getNow()}))
+	assert.Equal(ErrTooManyGateways, gws.set(lorawan.EUI64{3}, gateway{lastSeen: gws.getNow()}))
+
+	// known gateways can still be updated
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: gws.getNow()}))
+
+	// after cleanup, new gateways are accepted again
+	now = now.Add(2 * time.Minute)
+	assert.NoError(gws.cleanup())
+	assert.NoError(gws.set(lorawan.EUI64{3}, gateway{lastSeen: gws.getNow()}))
+}
+
+func TestGatewaysSuspectGrace(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	gws := gateways{
+		gateways:           make(map[lorawan.EUI64]gateway),
+		subscribeEventChan: make(chan events.Subscribe, 10),
+		suspectGrace:       10 * time.Minute,
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: gws.getNow()}))
+	assert.Equal(events.Subscribe{Subscribe: true, GatewayID: lorawan.EUI64{1}}, <-gws.subscribeEventChan)
+
+	t.Run("Suspect", func(t *testing.T) {
+		assert := require.New(t)
+
+		now = now.Add(2 * time.Minute)
+		assert.NoError(gws.cleanup())
+		assert.Len(gws.subscribeEventChan, 0)
+
+		gw, err := gws.get(lorawan.EUI64{1})
+		assert.NoError(err)
+		assert.True(gw.suspect)
+	})
+
+	t.Run("Gateway re-appears", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: gws.getNow()}))
+		assert.Equal(events.Subscribe{Subscribe: true, GatewayID: lorawan.EUI64{1}}, <-gws.subscribeEventChan)
+
+		gw, err := gws.get(lorawan.EUI64{1})
+		assert.NoError(err)
+		assert.False(gw.suspect)
+	})
+
+	t.Run("Suspect grace passed", func(t *testing.T) {
+		assert := require.New(t)
+
+		now = now.Add(5 * time.Minute)
+		assert.NoError(gws.cleanup())
+		_, err := gws.get(lorawan.EUI64{1})
+		assert.NoError(err)
+
+		now = now.Add(10 * time.Minute)
+		assert.NoError(gws.cleanup())
+		assert.Equal(events.Subscribe{Subscribe: false, GatewayID: lorawan.EUI64{1}}, <-gws.subscribeEventChan)
+
+		_, err = gws.get(lorawan.EUI64{1})
+		assert.Equal(ErrGatewayExpired, err)
+	})
+}
+
+func TestGatewaysSubscribers(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	gws := gateways{
+		gateways:           make(map[lorawan.EUI64]gateway),
+		subscribeEventChan: make(chan events.Subscribe, 10),
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	var calls []string
+	subscriber := func(name string, err error) GatewaySubscriberFunc {
+		return func(listenerID string, gatewayID lorawan.EUI64) error {
+			calls = append(calls, name+":"+gatewayID.String())
+			return err
+		}
+	}
+
+	gws.gatewayEventFunc = func(listenerID string, e events.Subscribe) {
+		calls = append(calls, "event")
+	}
+	gws.onNew = []GatewaySubscriberFunc{subscriber("a", errors.New("boom")), subscriber("b", nil)}
+	gws.onDelete = []GatewaySubscriberFunc{subscriber("c", nil)}
+
+	t.Run("Errors are logged", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: gws.getNow()}))
+		assert.Equal([]string{"event", "a:0100000000000000", "b:0100000000000000"}, calls)
+
+		calls = nil
+		now = now.Add(2 * time.Minute)
+		assert.NoError(gws.cleanup())
+		assert.Equal([]string{"event", "c:0100000000000000"}, calls)
+	})
+
+	t.Run("Abort on error", func(t *testing.T) {
+		assert := require.New(t)
+
+		calls = nil
+		gws.abortOnSubscriberError = true
+		assert.NoError(gws.set(lorawan.EUI64{2}, gateway{lastSeen: gws.getNow()}))
+		assert.Equal([]string{"event", "a:0200000000000000"}, calls)
+
+		// the gateway is added regardless of the error
+		_, err := gws.get(lorawan.EUI64{2})
+		assert.NoError(err)
+	})
+
+}
+
+func TestGatewaysSlowSubscriber(t *testing.T) {
+	assert := require.New(t)
+
+	gws := gateways{
+		gateways:           make(map[lorawan.EUI64]gateway),
+		subscribeEventChan: make(chan events.Subscribe, 10),
+	}
+	assert.NoError(gws.set(lorawan.EUI64{1}, gateway{lastSeen: time.Now()}))
+
+	var calls int32
+	called := make(chan struct{}, 1)
+	release := make(chan struct{})
+	gws.onNew = []GatewaySubscriberFunc{func(listenerID string, gatewayID lorawan.EUI64) error {
+		if gatewayID == (lorawan.EUI64{2}) {
+			atomic.AddInt32(&calls, 1)
+			called <- struct{}{}
+			<-release
+		}
+		return nil
+	}}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- gws.set(lorawan.EUI64{2}, gateway{lastSeen: time.Now()})
+		}()
+	}
+	<-called
+
+	// the registry is not blocked by the subscriber
+	_, err := gws.get(lorawan.EUI64{1})
+	assert.NoError(err)
+	assert.NoError(gws.set(lorawan.EUI64{3}, gateway{lastSeen: time.Now()}))
+
+	// the gateway is added once the subscriber returns
+	_, err = gws.get(lorawan.EUI64{2})
+	assert.Equal(ErrGatewayUnknown, err)
+
+	close(release)
+	assert.NoError(<-errs)
+	assert.NoError(<-errs)
+
+	_, err = gws.get(lorawan.EUI64{2})
+	assert.NoError(err)
+	assert.EqualValues(1, atomic.LoadInt32(&calls))
+}
+
+func TestGatewaysDownlinkErrors(t *testing.T) {
+	assert := require.New(t)
+	now := time.Now()
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	gws := gateways{
+		gateways:           make(map[lorawan.EUI64]gateway),
+		subscribeEventChan: make(chan events.Subscribe, 1),
+	}
+	assert.NoError(gws.set(gatewayID, gateway{lastSeen: now}))
+
+	// errors of unknown gateways are ignored
+	gws.addDownlinkError(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, errors.New("boom"), now)
+	assert.Len(gws.list(), 1)
+
+	for i := 0; i < downlinkErrorHistorySize+2; i++ {
+		gws.addDownlinkError(gatewayID, fmt.Errorf("error %d", i), now.Add(time.Duration(i)*time.Second))
+	}
+
+	gw, err := gws.get(gatewayID)
+	assert.NoError(err)
+	assert.Len(gw.downlinkErrors, downlinkErrorHistorySize)
+	assert.Equal("error 2", gw.downlinkErrors[0].Error)
+	assert.True(now.Add(2 * time.Second).Equal(gw.downlinkErrors[0].Time))
+	assert.Equal(fmt.Sprintf("error %d", downlinkErrorHistorySize+1), gw.downlinkErrors[downlinkErrorHistorySize-1].Error)
+}
+
+func TestUpdateForwardRatio(t *testing.T) {
+	assert := require.New(t)
+
+	var gw gateway
+	md := make(map[string]string)
+
+	// no received packets
+	updateForwardRatio(&gw, 0, 0)
+	assert.Nil(gw.forwardRatio)
+	gw.addForwardRatioToMetaData(md)
+	assert.Len(md, 0)
+
+	updateForwardRatio(&gw, 10, 5)
+	assert.Equal(0.5, *gw.forwardRatio)
+
+	// smoothed, rxfw is capped at rxnb
+	updateForwardRatio(&gw, 10, 12)
+	assert.Equal(0.5625, *gw.forwardRatio)
+
+	// ignored
+	updateForwardRatio(&gw, 0, 0)
+	assert.Equal(0.5625, *gw.forwardRatio)
+
+	gw.addForwardRatioToMetaData(md)
+	assert.Equal(map[string]string{"bridge_rx_forward_ratio": "0.562"}, md)
+}
@@ -0,0 +1,155 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+)
+
+// Replay records are encoded as:
+//   - timestamp (8 bytes, big-endian, unix nanoseconds)
+//   - length    (4 bytes, big-endian)
+//   - data      (length bytes, the UDP payload)
+const replayHeaderSize = 12
+
+// ReplayStats contains the statistics of a replay.
+type ReplayStats struct {
+	// Number of packets read.
+	Packets int
+
+	// Number of packets that could not be handled.
+	Errors int
+
+	// Number of packets per packet-type.
+	PacketTypes map[packets.PacketType]int
+}
+
+// WriteReplayRecord writes the given packet as replay record to w.
+func WriteReplayRecord(w io.Writer, ts time.Time, data []byte) error {
+	header := make([]byte, replayHeaderSize)
+	binary.BigEndian.PutUint64(header[0:8], uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(data)))
+
+	if _, err := w.Write(header); err != nil {
+		return errors.Wrap(err, "write header error")
+	}
+	if _, err := w.Write(data); err != nil {
+		return errors.Wrap(err, "write data error")
+	}
+	return nil
+}
+
+// InjectPushData handles the given PushData packet as if it was received
+// from the given address. It runs the same handling path (including the
+// filters and policies) as received UDP packets. Note that the PushACK is
+// sent to the given address.
+func (b *Backend) InjectPushData(addr *net.UDPAddr, p packets.PushDataPacket) error {
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "marshal push data packet error")
+	}
+
+	return b.handlePacket(udpPacket{addr: addr, data: data})
+}
+
+// InjectPullData handles the given PullData packet as if it was received
+// from the given address. See InjectPushData.
+func (b *Backend) InjectPullData(addr *net.UDPAddr, p packets.PullDataPacket) error {
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "marshal pull data packet error")
+	}
+
+	return b.handlePacket(udpPacket{addr: addr, data: data})
+}
+
+// Replay reads the replay records from r and handles each packet as if it
+// was received from the given address. When realTime is set, the original
+// time in between the packets is respected, else the packets are handled as
+// fast as possible. Note that the packets are handled synchronously, thus
+// the uplink and stats channels must be consumed.
+func (b *Backend) Replay(r io.Reader, addr *net.UDPAddr, realTime bool) (ReplayStats, error) {
+	stats := ReplayStats{
+		PacketTypes: make(map[packets.PacketType]int),
+	}
+
+	var prevTS time.Time
+	header := make([]byte, replayHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return stats, nil
+			}
+			return stats, errors.Wrap(err, "read header error")
+		}
+
+		ts := time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8])))
+		size := binary.BigEndian.Uint32(header[8:12])
+		if size > maxUDPDataSize {
+			return stats, errors.Errorf("packet size %d exceeds max packet size", size)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return stats, errors.Wrap(err, "read data error")
+		}
+
+		if realTime && !prevTS.IsZero() && ts.After(prevTS) {
+			time.Sleep(ts.Sub(prevTS))
+		}
+		prevTS = ts
+
+		b.replayPacket(&stats, addr, data)
+	}
+}
+
+// ReplayTraffic reads the traffic records (see WriteTrafficRecord) from r and
+// handles each received packet as if it was received from the given address.
+// Sent packets are skipped. See Replay.
+func (b *Backend) ReplayTraffic(r io.Reader, addr *net.UDPAddr, realTime bool) (ReplayStats, error) {
+	stats := ReplayStats{
+		PacketTypes: make(map[packets.PacketType]int),
+	}
+
+	var prevTS time.Time
+
+	for {
+		rec, err := ReadTrafficRecord(r)
+		if err != nil {
+			if err == io.EOF {
+				return stats, nil
+			}
+			return stats, err
+		}
+
+		if rec.Direction != TrafficIn {
+			continue
+		}
+
+		if realTime && !prevTS.IsZero() && rec.Time.After(prevTS) {
+			time.Sleep(rec.Time.Sub(prevTS))
+		}
+		prevTS = rec.Time
+
+		b.replayPacket(&stats, addr, rec.Data)
+	}
+}
+
+func (b *Backend) replayPacket(stats *ReplayStats, addr *net.UDPAddr, data []byte) {
+	stats.Packets++
+	if pt, err := packets.GetPacketType(data); err == nil {
+		stats.PacketTypes[pt]++
+	}
+
+	if err := b.handlePacket(udpPacket{addr: addr, data: data}); err != nil {
+		stats.Errors++
+		log.WithError(err).WithField("addr", addr).Debug("backend/semtechudp: handle replayed packet error")
+	}
+}
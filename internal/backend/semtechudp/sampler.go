@@ -0,0 +1,58 @@
+package semtechudp
+
+import (
+	"sync"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
+	"github.com/brocaar/lorawan"
+)
+
+// maxUplinkSamplerKeys limits the number of (DevAddr, gateway) pairs tracked
+// by the uplink sampler. When reached, the counters are reset.
+const maxUplinkSamplerKeys = 100000
+
+type uplinkSamplerKey struct {
+	gatewayID lorawan.EUI64
+	devAddr   lorawan.DevAddr
+}
+
+// uplinkSampler forwards only 1 in n unconfirmed data uplinks per DevAddr
+// and gateway. All other frames (e.g. join-requests and confirmed data
+// uplinks) are always forwarded.
+type uplinkSampler struct {
+	sync.Mutex
+
+	n      int
+	counts map[uplinkSamplerKey]int
+}
+
+func newUplinkSampler(n int) *uplinkSampler {
+	return &uplinkSampler{
+		n:      n,
+		counts: make(map[uplinkSamplerKey]int),
+	}
+}
+
+// forward returns true when the given uplink must be forwarded.
+func (s *uplinkSampler) forward(gatewayID lorawan.EUI64, phyPayload []byte) bool {
+	mType, err := filters.GetMType(phyPayload)
+	if err != nil || mType != lorawan.UnconfirmedDataUp || len(phyPayload) < 5 {
+		return true
+	}
+
+	key := uplinkSamplerKey{gatewayID: gatewayID}
+	if err := key.devAddr.UnmarshalBinary(phyPayload[1:5]); err != nil {
+		return true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	count, ok := s.counts[key]
+	if !ok && len(s.counts) >= maxUplinkSamplerKeys {
+		s.counts = make(map[uplinkSamplerKey]int)
+	}
+	s.counts[key] = (count + 1) % s.n
+
+	return count == 0
+}
@@ -0,0 +1,38 @@
+package semtechudp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestUplinkSampler(t *testing.T) {
+	assert := require.New(t)
+
+	s := newUplinkSampler(3)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// MHDR + DevAddr (little-endian) + FCtrl + FCnt + MIC
+	unconfirmed := []byte{0x40, 4, 3, 2, 1, 0, 0, 0, 1, 2, 3, 4}
+	unconfirmedOther := []byte{0x40, 5, 3, 2, 1, 0, 0, 0, 1, 2, 3, 4}
+	confirmed := []byte{0x80, 4, 3, 2, 1, 0, 0, 0, 1, 2, 3, 4}
+	joinRequest := make([]byte, 23)
+
+	var forwarded []bool
+	for i := 0; i < 6; i++ {
+		forwarded = append(forwarded, s.forward(gatewayID, unconfirmed))
+	}
+	assert.Equal([]bool{true, false, false, true, false, false}, forwarded)
+
+	// the sampling is per DevAddr and gateway
+	assert.True(s.forward(gatewayID, unconfirmedOther))
+	assert.True(s.forward(lorawan.EUI64{1}, unconfirmed))
+
+	// confirmed uplinks and join-requests are always forwarded
+	for i := 0; i < 3; i++ {
+		assert.True(s.forward(gatewayID, confirmed))
+		assert.True(s.forward(gatewayID, joinRequest))
+	}
+}
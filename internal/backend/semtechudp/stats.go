@@ -0,0 +1,129 @@
+package semtechudp
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BackendStats contains the aggregated statistics of the backend since it
+// was started.
+type BackendStats struct {
+	// Number of gateways in the registry.
+	GatewaysConnected int
+
+	// Number of uplink rxpk received, forwarded and dropped (e.g. because of
+	// a decode error, filters or a full uplink channel). An rxpk received by
+	// multiple antennas is forwarded when at least one of its frames is
+	// forwarded.
+	RXReceived  uint64
+	RXForwarded uint64
+	RXDropped   uint64
+
+	// Number of downlinks (PULL_RESP) queued, written to the gateway and
+	// failed (write or TXACK error).
+	DownlinksQueued uint64
+	DownlinksSent   uint64
+	DownlinksFailed uint64
+
+	// Number of packets with an unknown protocol version or packet-type.
+	UnknownPackets uint64
+
+	// Number of packets which could not be handled.
+	HandleErrors uint64
+
+	// Number of UDP bytes received and sent.
+	BytesIn  uint64
+	BytesOut uint64
+
+	// Uptime of the backend.
+	Uptime time.Duration
+}
+
+// backendCounters contains the counters of the backend. The fields must be
+// accessed using the sync/atomic package.
+type backendCounters struct {
+	rxReceived      uint64
+	rxForwarded     uint64
+	downlinksQueued uint64
+	downlinksSent   uint64
+	downlinksFailed uint64
+	unknownPackets  uint64
+	handleErrors    uint64
+	bytesIn         uint64
+	bytesOut        uint64
+}
+
+// Stats returns the aggregated statistics of the backend.
+func (b *Backend) Stats() BackendStats {
+	c := b.counters
+
+	// forwarded is loaded before received, as the uplinks in-flight are
+	// already counted as received
+	forwarded := atomic.LoadUint64(&c.rxForwarded)
+	received := atomic.LoadUint64(&c.rxReceived)
+
+	var dropped uint64
+	if received > forwarded {
+		dropped = received - forwarded
+	}
+
+	return BackendStats{
+		GatewaysConnected: len(b.gateways.list()),
+		RXReceived:        received,
+		RXForwarded:       forwarded,
+		RXDropped:         dropped,
+		DownlinksQueued:   atomic.LoadUint64(&c.downlinksQueued),
+		DownlinksSent:     atomic.LoadUint64(&c.downlinksSent),
+		DownlinksFailed:   atomic.LoadUint64(&c.downlinksFailed),
+		UnknownPackets:    atomic.LoadUint64(&c.unknownPackets),
+		HandleErrors:      atomic.LoadUint64(&c.handleErrors),
+		BytesIn:           atomic.LoadUint64(&c.bytesIn),
+		BytesOut:          atomic.LoadUint64(&c.bytesOut),
+		Uptime:            time.Since(b.startTime),
+	}
+}
+
+// summaryLogLoop periodically logs a summary of the backend statistics since
+// the previous summary.
+func (b *Backend) summaryLogLoop(interval time.Duration) {
+	prev := b.Stats()
+
+	for {
+		time.Sleep(interval)
+		if b.isClosed() {
+			return
+		}
+
+		stats := b.Stats()
+		log.WithFields(getSummaryFields(prev, stats)).Info("backend/semtechudp: summary")
+		prev = stats
+	}
+}
+
+// getSummaryFields returns the log fields of the summary of the statistics
+// between prev and stats.
+func getSummaryFields(prev, stats BackendStats) log.Fields {
+	// the previous summary counted the in-flight uplinks as received, these
+	// might have been forwarded within this interval
+	received := stats.RXReceived - prev.RXReceived
+	forwarded := stats.RXForwarded - prev.RXForwarded
+	var dropped uint64
+	if received > forwarded {
+		dropped = received - forwarded
+	}
+
+	return log.Fields{
+		"interval":           stats.Uptime - prev.Uptime,
+		"gateways_connected": stats.GatewaysConnected,
+		"rx_received":        received,
+		"rx_forwarded":       forwarded,
+		"rx_dropped":         dropped,
+		"tx_queued":          stats.DownlinksQueued - prev.DownlinksQueued,
+		"tx_sent":            stats.DownlinksSent - prev.DownlinksSent,
+		"tx_failed":          stats.DownlinksFailed - prev.DownlinksFailed,
+		"unknown_packets":    stats.UnknownPackets - prev.UnknownPackets,
+		"errors":             stats.HandleErrors - prev.HandleErrors,
+	}
+}
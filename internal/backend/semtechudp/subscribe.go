@@ -0,0 +1,102 @@
+package semtechudp
+
+import (
+	"sync"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+)
+
+// subscriber policies
+const (
+	subscriberPolicyDrop  = "drop"
+	subscriberPolicyBlock = "block"
+)
+
+// uplinkSubscriber is a subscriber of the uplink frames (see Subscribe).
+type uplinkSubscriber struct {
+	frames chan gw.UplinkFrame
+
+	// done is closed on cancel, so that a blocked publish returns
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// uplinkSubscribers fans out the uplink frames to the subscribers.
+type uplinkSubscribers struct {
+	sync.RWMutex
+
+	bufferSize  int
+	policy      string
+	subscribers map[*uplinkSubscriber]struct{}
+}
+
+func newUplinkSubscribers(bufferSize int, policy string) *uplinkSubscribers {
+	return &uplinkSubscribers{
+		bufferSize:  bufferSize,
+		policy:      policy,
+		subscribers: make(map[*uplinkSubscriber]struct{}),
+	}
+}
+
+// subscribe adds a subscriber and returns its channel and cancel function.
+func (s *uplinkSubscribers) subscribe() (<-chan gw.UplinkFrame, func()) {
+	sub := &uplinkSubscriber{
+		frames: make(chan gw.UplinkFrame, s.bufferSize),
+		done:   make(chan struct{}),
+	}
+
+	s.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.Unlock()
+
+	cancel := func() {
+		sub.closeOnce.Do(func() {
+			// first unblock a publish to this subscriber, which holds the
+			// read lock
+			close(sub.done)
+
+			s.Lock()
+			delete(s.subscribers, sub)
+			s.Unlock()
+
+			close(sub.frames)
+		})
+	}
+
+	return sub.frames, cancel
+}
+
+// publish sends the given frame to all subscribers, applying the subscriber
+// policy to the subscribers of which the buffer is full.
+func (s *uplinkSubscribers) publish(frame gw.UplinkFrame) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for sub := range s.subscribers {
+		if s.policy == subscriberPolicyBlock {
+			select {
+			case sub.frames <- frame:
+			case <-sub.done:
+			}
+			continue
+		}
+
+		select {
+		case sub.frames <- frame:
+		default:
+			subscriberDroppedCounter().Inc()
+		}
+	}
+}
+
+// Subscribe returns a new channel receiving every uplink frame that is
+// forwarded, next to the uplink frame channel (see GetUplinkFrameChan), so
+// that multiple independent consumers can receive the uplinks. Each
+// subscriber has its own buffer (see subscriber_buffer_size). When it is
+// full, the frame is dropped for this subscriber or the forwarding blocks
+// until there is space, depending on the subscriber_policy. The returned
+// function cancels the subscription and closes the channel. Note that the
+// frames are shared between the subscribers, they must not be modified.
+func (b *Backend) Subscribe() (<-chan gw.UplinkFrame, func()) {
+	return b.uplinkSubscribers.subscribe()
+}
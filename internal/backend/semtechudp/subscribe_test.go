@@ -0,0 +1,70 @@
+package semtechudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+)
+
+func TestUplinkSubscribers(t *testing.T) {
+	t.Run("Drop", func(t *testing.T) {
+		assert := require.New(t)
+
+		s := newUplinkSubscribers(1, subscriberPolicyDrop)
+		a, cancelA := s.subscribe()
+		b, cancelB := s.subscribe()
+		defer cancelB()
+
+		before := counterValue(subscriberDroppedCounter())
+		s.publish(gw.UplinkFrame{PhyPayload: []byte{1}})
+		s.publish(gw.UplinkFrame{PhyPayload: []byte{2}})
+		assert.Equal(before+2, counterValue(subscriberDroppedCounter()))
+
+		assert.Equal([]byte{1}, (<-a).PhyPayload)
+		assert.Equal([]byte{1}, (<-b).PhyPayload)
+
+		// the channel is closed on cancel and no longer receives frames
+		cancelA()
+		cancelA()
+		_, ok := <-a
+		assert.False(ok)
+
+		s.publish(gw.UplinkFrame{PhyPayload: []byte{3}})
+		assert.Equal([]byte{3}, (<-b).PhyPayload)
+		assert.Len(s.subscribers, 1)
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		assert := require.New(t)
+
+		s := newUplinkSubscribers(0, subscriberPolicyBlock)
+		a, cancelA := s.subscribe()
+
+		published := make(chan struct{})
+		go func() {
+			s.publish(gw.UplinkFrame{PhyPayload: []byte{1}})
+			close(published)
+		}()
+
+		select {
+		case <-published:
+			t.Fatal("publish did not block")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		assert.Equal([]byte{1}, (<-a).PhyPayload)
+		<-published
+
+		// cancel unblocks a pending publish
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancelA()
+		}()
+		s.publish(gw.UplinkFrame{PhyPayload: []byte{2}})
+		_, ok := <-a
+		assert.False(ok)
+	})
+}
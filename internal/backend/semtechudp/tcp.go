@@ -0,0 +1,158 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The TCP listener accepts Semtech UDP datagrams tunneled over TCP (e.g. by
+// a cloud relay). Each datagram is prefixed by its length (2 bytes,
+// big-endian), replies are written back on the same connection.
+const tcpFrameHeaderSize = 2
+
+// tcpListener keeps track of the TCP connections, by remote address.
+type tcpListener struct {
+	sync.RWMutex
+
+	listener net.Listener
+	conns    map[string]net.Conn
+}
+
+func listenTCP(bind string) (*tcpListener, error) {
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen tcp error")
+	}
+
+	log.WithField("addr", l.Addr()).Info("backend/semtechudp: starting tcp listener")
+
+	return &tcpListener{
+		listener: l,
+		conns:    make(map[string]net.Conn),
+	}, nil
+}
+
+// getConn returns the TCP connection for the given address or nil when the
+// address is not a TCP connection.
+func (l *tcpListener) getConn(addr *net.UDPAddr) net.Conn {
+	l.RLock()
+	defer l.RUnlock()
+	return l.conns[addr.String()]
+}
+
+func (l *tcpListener) addConn(addr *net.UDPAddr, conn net.Conn) {
+	l.Lock()
+	defer l.Unlock()
+	l.conns[addr.String()] = conn
+}
+
+func (l *tcpListener) removeConn(addr *net.UDPAddr) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.conns, addr.String())
+}
+
+// close closes the listener and all TCP connections.
+func (l *tcpListener) close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+
+	return l.listener.Close()
+}
+
+// acceptTCP accepts the TCP connections until the listener is closed.
+func (b *Backend) acceptTCP() {
+	for {
+		conn, err := b.tcp.listener.Accept()
+		if err != nil {
+			if !b.isClosed() {
+				log.WithError(err).Error("backend/semtechudp: accept tcp connection error")
+			}
+			return
+		}
+
+		go b.readTCP(conn)
+	}
+}
+
+// readTCP reads the datagrams from the given TCP connection. The remote
+// address of the connection is used as source address, like for UDP.
+func (b *Backend) readTCP(conn net.Conn) {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		conn.Close()
+		return
+	}
+	addr := &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+
+	b.tcp.addConn(addr, conn)
+	defer func() {
+		b.tcp.removeConn(addr)
+		conn.Close()
+	}()
+
+	log.WithField("addr", addr).Info("backend/semtechudp: tcp connection accepted")
+
+	header := make([]byte, tcpFrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF && !b.isClosed() {
+				log.WithError(err).WithField("addr", addr).Error("backend/semtechudp: read tcp frame error")
+			}
+			return
+		}
+
+		size := int(binary.BigEndian.Uint16(header))
+		if size > b.readBufferSize {
+			log.WithFields(log.Fields{
+				"addr": addr,
+				"size": size,
+			}).Error("backend/semtechudp: tcp frame exceeds read buffer size, closing connection")
+			return
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			if !b.isClosed() {
+				log.WithError(err).WithField("addr", addr).Error("backend/semtechudp: read tcp frame error")
+			}
+			return
+		}
+
+		b.handleReceivedPacket(udpPacket{data: data, addr: addr})
+	}
+}
+
+// writeTCP writes the given datagram to the TCP connection.
+func writeTCP(conn net.Conn, data []byte) error {
+	if len(data) > maxUDPDataSize {
+		return errors.New("datagram exceeds max. size")
+	}
+
+	b := make([]byte, tcpFrameHeaderSize+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(data)))
+	copy(b[tcpFrameHeaderSize:], data)
+
+	if _, err := conn.Write(b); err != nil {
+		return errors.Wrap(err, "write tcp frame error")
+	}
+	return nil
+}
+
+// getTCPConn returns the TCP connection for the given address, or nil when
+// the TCP listener is disabled or when the address is not a TCP connection.
+func (b *Backend) getTCPConn(addr *net.UDPAddr) net.Conn {
+	if b.tcp == nil || addr == nil {
+		return nil
+	}
+	return b.tcp.getConn(addr)
+}
@@ -0,0 +1,94 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestTCPListener(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	conf.Backend.SemtechUDP.TCPBind = "127.0.0.1:0"
+	conf.Backend.SemtechUDP.DownlinkPort = 1701
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	defer b.Close()
+	go func() {
+		for range b.GetSubscribeEventChan() {
+		}
+	}()
+
+	conn, err := net.Dial("tcp", b.tcp.listener.Addr().String())
+	assert.NoError(err)
+	defer conn.Close()
+	assert.NoError(conn.SetDeadline(time.Now().Add(time.Second)))
+
+	writeFrame := func(data []byte) {
+		assert.NoError(writeTCP(conn, data))
+	}
+
+	readFrame := func() []byte {
+		header := make([]byte, tcpFrameHeaderSize)
+		_, err := io.ReadFull(conn, header)
+		assert.NoError(err)
+		data := make([]byte, binary.BigEndian.Uint16(header))
+		_, err = io.ReadFull(conn, data)
+		assert.NoError(err)
+		return data
+	}
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	t.Run("PullData", func(t *testing.T) {
+		assert := require.New(t)
+
+		p := packets.PullDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     12345,
+			GatewayMAC:      gatewayID,
+		}
+		pB, err := p.MarshalBinary()
+		assert.NoError(err)
+		writeFrame(pB)
+
+		var ack packets.PullACKPacket
+		assert.NoError(ack.UnmarshalBinary(readFrame()))
+		assert.Equal(uint16(12345), ack.RandomToken)
+
+		gw, err := b.gateways.get(gatewayID)
+		assert.NoError(err)
+		assert.Equal(conn.LocalAddr().String(), gw.addr.String())
+	})
+
+	t.Run("Downlink", func(t *testing.T) {
+		assert := require.New(t)
+
+		// the downlink_port must not be applied to TCP connections
+		assert.NoError(b.SendRaw(gatewayID, json.RawMessage(`{"imme":true}`)))
+
+		pt, err := packets.GetPacketType(readFrame())
+		assert.NoError(err)
+		assert.Equal(packets.PullResp, pt)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(b.Close())
+		_, err := conn.Read(make([]byte, 1))
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,210 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// trafficSinkBufferSize defines the number of traffic records that can be
+// buffered before records are dropped.
+const trafficSinkBufferSize = 1024
+
+// Traffic records are encoded as:
+//   - timestamp (8 bytes, big-endian, unix nanoseconds)
+//   - direction (1 byte, see TrafficDirection)
+//   - ip        (16 bytes, IPv4 addresses are IPv4-mapped IPv6 addresses)
+//   - port      (2 bytes, big-endian)
+//   - length    (4 bytes, big-endian)
+//   - data      (length bytes, the UDP payload)
+const trafficHeaderSize = 31
+
+// TrafficDirection defines the direction of a traffic record.
+type TrafficDirection uint8
+
+// Traffic directions.
+const (
+	TrafficIn  TrafficDirection = 0
+	TrafficOut TrafficDirection = 1
+)
+
+// TrafficRecord contains a single UDP datagram received from or sent to a
+// gateway.
+type TrafficRecord struct {
+	Time      time.Time
+	Direction TrafficDirection
+	Addr      *net.UDPAddr
+	Data      []byte
+}
+
+// WriteTrafficRecord writes the given traffic record to w. The record is
+// written using a single Write call.
+func WriteTrafficRecord(w io.Writer, rec TrafficRecord) error {
+	b := make([]byte, trafficHeaderSize+len(rec.Data))
+	binary.BigEndian.PutUint64(b[0:8], uint64(rec.Time.UnixNano()))
+	b[8] = byte(rec.Direction)
+	if rec.Addr != nil {
+		copy(b[9:25], rec.Addr.IP.To16())
+		binary.BigEndian.PutUint16(b[25:27], uint16(rec.Addr.Port))
+	}
+	binary.BigEndian.PutUint32(b[27:31], uint32(len(rec.Data)))
+	copy(b[trafficHeaderSize:], rec.Data)
+
+	if _, err := w.Write(b); err != nil {
+		return errors.Wrap(err, "write traffic record error")
+	}
+	return nil
+}
+
+// ReadTrafficRecord reads a single traffic record from r. It returns io.EOF
+// when there are no more records.
+func ReadTrafficRecord(r io.Reader) (TrafficRecord, error) {
+	var rec TrafficRecord
+	header := make([]byte, trafficHeaderSize)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return rec, err
+		}
+		return rec, errors.Wrap(err, "read header error")
+	}
+
+	size := binary.BigEndian.Uint32(header[27:31])
+	if size > maxUDPDataSize {
+		return rec, errors.Errorf("packet size %d exceeds max packet size", size)
+	}
+
+	rec.Time = time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8])))
+	rec.Direction = TrafficDirection(header[8])
+	rec.Addr = &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), header[9:25]...)),
+		Port: int(binary.BigEndian.Uint16(header[25:27])),
+	}
+	rec.Data = make([]byte, size)
+	if _, err := io.ReadFull(r, rec.Data); err != nil {
+		return rec, errors.Wrap(err, "read data error")
+	}
+
+	return rec, nil
+}
+
+// trafficSink writes the traffic records to a writer in the background, so
+// that a slow writer does not affect the gateway traffic. Records are
+// dropped when the buffer is full.
+type trafficSink struct {
+	w       io.Writer
+	records chan TrafficRecord
+	done    chan struct{}
+}
+
+func newTrafficSink(w io.Writer) *trafficSink {
+	s := trafficSink{
+		w:       w,
+		records: make(chan TrafficRecord, trafficSinkBufferSize),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		for rec := range s.records {
+			if err := WriteTrafficRecord(s.w, rec); err != nil {
+				log.WithError(err).Error("backend/semtechudp: write traffic record error")
+			}
+		}
+	}()
+
+	return &s
+}
+
+func (s *trafficSink) record(dir TrafficDirection, addr *net.UDPAddr, data []byte) {
+	select {
+	case s.records <- TrafficRecord{Time: time.Now(), Direction: dir, Addr: addr, Data: data}:
+	default:
+		trafficDroppedCounter().Inc()
+	}
+}
+
+// close closes the sink after all buffered records have been written.
+func (s *trafficSink) close() {
+	close(s.records)
+	<-s.done
+}
+
+// rotatingFile implements an io.WriteCloser which rotates the file (to
+// path.1) when it would exceed the max. size.
+type rotatingFile struct {
+	sync.Mutex
+
+	path    string
+	maxSize int64
+	size    int64
+	f       *os.File
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file error")
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "stat file error")
+	}
+
+	return &rotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		size:    fi.Size(),
+		f:       f,
+	}, nil
+}
+
+// Write implements io.Writer.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return errors.Wrap(err, "close file error")
+	}
+
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return errors.Wrap(err, "rename file error")
+	}
+
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return errors.Wrap(err, "open file error")
+	}
+	r.f = f
+	r.size = 0
+
+	return nil
+}
+
+// Close implements io.Closer.
+func (r *rotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,100 @@
+package semtechudp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficRecord(t *testing.T) {
+	assert := require.New(t)
+
+	recs := []TrafficRecord{
+		{
+			Time:      time.Unix(0, 1234),
+			Direction: TrafficIn,
+			Addr:      &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700},
+			Data:      []byte{1, 2, 3},
+		},
+		{
+			Time:      time.Unix(0, 5678),
+			Direction: TrafficOut,
+			Addr:      &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1701},
+			Data:      []byte{4, 5},
+		},
+	}
+
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		assert.NoError(WriteTrafficRecord(&buf, rec))
+	}
+	assert.Equal(2*trafficHeaderSize+5, buf.Len())
+
+	for _, exp := range recs {
+		rec, err := ReadTrafficRecord(&buf)
+		assert.NoError(err)
+		assert.True(exp.Time.Equal(rec.Time))
+		assert.Equal(exp.Direction, rec.Direction)
+		assert.Equal(exp.Addr.String(), rec.Addr.String())
+		assert.Equal(exp.Data, rec.Data)
+	}
+
+	_, err := ReadTrafficRecord(&buf)
+	assert.Equal(io.EOF, err)
+}
+
+func TestRotatingFile(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "traffic.bin")
+	f, err := openRotatingFile(path, 10)
+	assert.NoError(err)
+
+	_, err = f.Write([]byte{1, 2, 3, 4, 5, 6})
+	assert.NoError(err)
+	_, err = f.Write([]byte{7, 8, 9, 10})
+	assert.NoError(err)
+
+	// this would exceed the max. size
+	_, err = f.Write([]byte{11})
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	b, err := ioutil.ReadFile(path + ".1")
+	assert.NoError(err)
+	assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, b)
+
+	b, err = ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal([]byte{11}, b)
+}
+
+// lockedBuffer is a bytes.Buffer which is safe for concurrent use.
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Len()
+}
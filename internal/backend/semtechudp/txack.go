@@ -0,0 +1,300 @@
+package semtechudp
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/lorawan"
+)
+
+// ErrTXUnconfirmed is reported (as the error of the downlink tx ack) when
+// the gateway did not send a TXACK for a PullResp, after all the retries
+// (see tx_ack_timeout and tx_ack_retries).
+var ErrTXUnconfirmed = errors.New("tx unconfirmed")
+
+type pendingTXAck struct {
+	token     uint16
+	gatewayID lorawan.EUI64
+	data      []byte
+	retries   int
+	timer     *time.Timer
+}
+
+// txAckTracker tracks the PullResp packets which have not been acknowledged
+// by the gateway. When there is no TXACK within the timeout, the PullResp
+// is retried up to the max. number of retries, after which it expires.
+type txAckTracker struct {
+	sync.Mutex
+
+	timeout time.Duration
+	retries int
+	pending map[uint16]*pendingTXAck
+
+	retry  func(gatewayID lorawan.EUI64, data []byte) error
+	expire func(token uint16, gatewayID lorawan.EUI64)
+}
+
+func newTXAckTracker(timeout time.Duration, retries int, retry func(lorawan.EUI64, []byte) error, expire func(uint16, lorawan.EUI64)) *txAckTracker {
+	return &txAckTracker{
+		timeout: timeout,
+		retries: retries,
+		pending: make(map[uint16]*pendingTXAck),
+		retry:   retry,
+		expire:  expire,
+	}
+}
+
+// add adds the given PullResp, it must be called before the PullResp is
+// queued. This replaces the pending PullResp with the same token (e.g. when
+// sending the next downlink frame item).
+func (t *txAckTracker) add(token uint16, gatewayID lorawan.EUI64, data []byte) {
+	t.Lock()
+	defer t.Unlock()
+
+	if p, ok := t.pending[token]; ok && p.timer != nil {
+		p.timer.Stop()
+	}
+
+	t.pending[token] = &pendingTXAck{
+		token:     token,
+		gatewayID: gatewayID,
+		data:      data,
+	}
+}
+
+// sent starts the timeout of the pending PullResp with the given token (if
+// any). It is called after each write of the PullResp, so that the timeout
+// does not include the time the PullResp was queued (e.g. by the JIT queue).
+func (t *txAckTracker) sent(token uint16) {
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.pending[token]
+	if !ok {
+		return
+	}
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = time.AfterFunc(t.timeout, func() {
+		t.handleTimeout(p)
+	})
+}
+
+// ack removes the pending PullResp with the given token. It returns false
+// when there was no pending PullResp.
+func (t *txAckTracker) ack(token uint16) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.pending[token]
+	if !ok {
+		return false
+	}
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(t.pending, token)
+
+	return true
+}
+
+func (t *txAckTracker) handleTimeout(p *pendingTXAck) {
+	t.Lock()
+	// the PullResp has been acknowledged or replaced in the meantime
+	if t.pending[p.token] != p {
+		t.Unlock()
+		return
+	}
+
+	if p.retries >= t.retries {
+		delete(t.pending, p.token)
+		t.Unlock()
+		t.expire(p.token, p.gatewayID)
+		return
+	}
+
+	p.retries++
+	p.timer = nil
+	t.Unlock()
+
+	if err := t.retry(p.gatewayID, p.data); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": p.gatewayID,
+			"token":      p.token,
+		}).Error("backend/semtechudp: retry unacknowledged downlink error")
+
+		if t.ack(p.token) {
+			t.expire(p.token, p.gatewayID)
+		}
+	}
+}
+
+// close stops the tracker. The pending PullResp packets are dropped.
+func (t *txAckTracker) close() {
+	t.Lock()
+	defer t.Unlock()
+
+	for token, p := range t.pending {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		delete(t.pending, token)
+	}
+}
+
+// len returns the number of pending PullResp packets.
+func (t *txAckTracker) len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.pending)
+}
+
+// getTXAckDeviation returns the deviation between the given txpk (as sent)
+// and the TX power and frequency reported in the TXACK. It returns false when
+// there is no deviation.
+func getTXAckDeviation(txpk packets.TXPK, ack packets.TXPKACK) (TXAckDeviationEvent, bool) {
+	e := TXAckDeviationEvent{
+		RequestedPower:     int(txpk.Powe),
+		RequestedFrequency: uint32(math.Round(txpk.Freq * 1000000)),
+	}
+
+	if powe, ok := ack.ActualPower(); ok && powe != e.RequestedPower {
+		e.ActualPower = &powe
+	}
+
+	if ack.Freq != nil {
+		if freq := uint32(math.Round(*ack.Freq * 1000000)); freq != e.RequestedFrequency {
+			e.ActualFrequency = &freq
+		}
+	}
+
+	return e, e.ActualPower != nil || e.ActualFrequency != nil
+}
+
+// handleTXAckDeviation logs and counts the TX power and frequency deviations
+// reported by the given TXACK and calls the deviation function.
+func (b *Backend) handleTXAckDeviation(p packets.TXACKPacket, frame gw.DownlinkFrame) {
+	v, ok := b.cache.Get(fmt.Sprintf("%d:txpk", p.RandomToken))
+	if !ok {
+		return
+	}
+	txpk, ok := v.(packets.TXPK)
+	if !ok {
+		return
+	}
+
+	e, ok := getTXAckDeviation(txpk, p.Payload.TXPKACK)
+	if !ok {
+		return
+	}
+	e.GatewayID = p.GatewayMAC
+	e.Token = p.RandomToken
+	e.DownlinkID = frame.DownlinkId
+
+	logFields := log.Fields{
+		"gateway_id":          p.GatewayMAC,
+		"token":               p.RandomToken,
+		"requested_power":     e.RequestedPower,
+		"requested_frequency": e.RequestedFrequency,
+	}
+	if e.ActualPower != nil {
+		txAckDeviationCounter("power").Inc()
+		logFields["actual_power"] = *e.ActualPower
+	}
+	if e.ActualFrequency != nil {
+		txAckDeviationCounter("frequency").Inc()
+		logFields["actual_frequency"] = *e.ActualFrequency
+	}
+	log.WithFields(logFields).Warning("backend/semtechudp: tx ack reports a deviating tx power or frequency")
+
+	if fn := b.getHooks().txAckDeviationFunc; fn != nil {
+		fn(e)
+	}
+}
+
+// retryPullResp sends the given PullResp again to the gateway.
+func (b *Backend) retryPullResp(gatewayID lorawan.EUI64, data []byte) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.isClosed() {
+		return ErrBackendClosed
+	}
+
+	gw, err := b.gateways.get(gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get gateway error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"addr":       gw.addr,
+	}).Warning("backend/semtechudp: no tx ack received, retrying downlink")
+	txAckRetryCounter().Inc()
+
+	b.sendDownlinkPacket(udpPacket{
+		data: data,
+		addr: b.getDownlinkAddr(gw.addr),
+		conn: gw.conn,
+
+		downlinkGatewayID: &gatewayID,
+	})
+
+	return nil
+}
+
+// expireTXAck reports the downlink with the given token as unconfirmed.
+func (b *Backend) expireTXAck(token uint16, gatewayID lorawan.EUI64) {
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"token":      token,
+	}).Error("backend/semtechudp: no tx ack received after retries")
+	txAckUnconfirmedCounter().Inc()
+	b.sendTXAckError(token, gatewayID, ErrTXUnconfirmed)
+}
+
+// sendTXAckError reports the downlink with the given token as failed with
+// the given error.
+func (b *Backend) sendTXAckError(token uint16, gatewayID lorawan.EUI64, err error) {
+	atomic.AddUint64(&b.counters.downlinksFailed, 1)
+
+	ack := gw.DownlinkTXAck{
+		GatewayId: gatewayID[:],
+		Token:     uint32(token),
+		Error:     err.Error(),
+	}
+
+	if v, ok := b.cache.Get(fmt.Sprintf("%d:frame", token)); ok {
+		if frame, ok := v.(gw.DownlinkFrame); ok {
+			ack.DownlinkId = frame.DownlinkId
+		}
+	}
+	if v, ok := b.cache.Get(fmt.Sprintf("%d:ack", token)); ok {
+		if items, ok := v.([]*gw.DownlinkTXAckItem); ok {
+			ack.Items = items
+		}
+	}
+
+	// the downlink has been reported, a late TXACK must not report it again
+	for _, key := range []string{"frame", "index", "ack", "sent"} {
+		b.cache.Delete(fmt.Sprintf("%d:%s", token, key))
+	}
+
+	// this is called from timer goroutines, which must not block after the
+	// backend has been closed
+	select {
+	case b.downlinkTXAckChan <- ack:
+	case <-b.done:
+	}
+}
@@ -0,0 +1,64 @@
+package semtechudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestTXAckTracker(t *testing.T) {
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	retried := make(chan []byte, 3)
+	expired := make(chan uint16, 1)
+
+	tr := newTXAckTracker(20*time.Millisecond, 2, func(id lorawan.EUI64, data []byte) error {
+		retried <- data
+		return nil
+	}, func(token uint16, id lorawan.EUI64) {
+		expired <- token
+	})
+
+	t.Run("Retries and expires", func(t *testing.T) {
+		assert := require.New(t)
+
+		tr.add(123, gatewayID, []byte{1, 2, 3})
+		assert.Equal(1, tr.len())
+
+		// the timeout starts once the PullResp has been sent
+		tr.sent(123)
+		assert.Equal([]byte{1, 2, 3}, <-retried)
+		tr.sent(123)
+		assert.Equal([]byte{1, 2, 3}, <-retried)
+		tr.sent(123)
+		assert.EqualValues(123, <-expired)
+		assert.Equal(0, tr.len())
+	})
+
+	t.Run("Acknowledged", func(t *testing.T) {
+		assert := require.New(t)
+
+		tr.add(124, gatewayID, []byte{1, 2, 3})
+		tr.sent(124)
+		assert.True(tr.ack(124))
+		assert.False(tr.ack(124))
+
+		time.Sleep(40 * time.Millisecond)
+		assert.Len(retried, 0)
+		assert.Len(expired, 0)
+	})
+
+	t.Run("Not sent", func(t *testing.T) {
+		assert := require.New(t)
+
+		tr.add(125, gatewayID, []byte{1, 2, 3})
+		time.Sleep(40 * time.Millisecond)
+		assert.Len(retried, 0)
+		assert.Equal(1, tr.len())
+
+		tr.close()
+		assert.Equal(0, tr.len())
+	})
+}
@@ -21,8 +21,111 @@ type Config struct {
 
 		SemtechUDP struct {
 			UDPBind      string `mapstructure:"udp_bind"`
+			TCPBind      string `mapstructure:"tcp_bind"`
 			SkipCRCCheck bool   `mapstructure:"skip_crc_check"`
 			FakeRxTime   bool   `mapstructure:"fake_rx_time"`
+
+			IgnoreStatsTime bool `mapstructure:"ignore_stats_time"`
+
+			LocationValidation string `mapstructure:"location_validation"`
+			BridgeStats        bool   `mapstructure:"bridge_stats"`
+			FrequencyStatsMax  int    `mapstructure:"frequency_stats_max"`
+			DownlinkPort       int    `mapstructure:"downlink_port"`
+			DownlinkBind       string `mapstructure:"downlink_bind"`
+
+			AllowedNetworks []string      `mapstructure:"allowed_networks"`
+			MaxGateways     int           `mapstructure:"max_gateways"`
+			SuspectGrace    time.Duration `mapstructure:"suspect_grace"`
+			RequirePullData bool          `mapstructure:"require_pull_data"`
+			ACKRateLimit    int           `mapstructure:"ack_rate_limit"`
+
+			PullDataDebounce time.Duration `mapstructure:"pull_data_debounce"`
+
+			PushDataACKAfterProcessing bool `mapstructure:"push_data_ack_after_processing"`
+
+			GatewayConflictWindow time.Duration `mapstructure:"gateway_conflict_window"`
+			GatewayConflictPolicy string        `mapstructure:"gateway_conflict_policy"`
+
+			UplinkBufferSize   int           `mapstructure:"uplink_buffer_size"`
+			UplinkDropWhenFull bool          `mapstructure:"uplink_drop_when_full"`
+			UplinkStallTimeout time.Duration `mapstructure:"uplink_stall_timeout"`
+			UplinkStallPolicy  string        `mapstructure:"uplink_stall_policy"`
+			DiscardUplinks     bool          `mapstructure:"discard_uplinks"`
+			UplinkSampleRate   int           `mapstructure:"uplink_sample_rate"`
+
+			ReadBufferSize    int           `mapstructure:"read_buffer_size"`
+			ReadTimeout       time.Duration `mapstructure:"read_timeout"`
+			CloseTimeout      time.Duration `mapstructure:"close_timeout"`
+			SocketReadBuffer  int           `mapstructure:"socket_read_buffer"`
+			SocketWriteBuffer int           `mapstructure:"socket_write_buffer"`
+			SocketDSCP        int           `mapstructure:"socket_dscp"`
+
+			SendRetries       int           `mapstructure:"send_retries"`
+			SendRetryInterval time.Duration `mapstructure:"send_retry_interval"`
+
+			JITLeadTime     time.Duration `mapstructure:"jit_lead_time"`
+			JITPastMargin   time.Duration `mapstructure:"jit_past_margin"`
+			JITFutureMargin time.Duration `mapstructure:"jit_future_margin"`
+
+			RebootTmstThreshold time.Duration `mapstructure:"reboot_tmst_threshold"`
+
+			TXAckTimeout time.Duration `mapstructure:"tx_ack_timeout"`
+			TXAckRetries int           `mapstructure:"tx_ack_retries"`
+
+			MaxAckLatency time.Duration `mapstructure:"max_ack_latency"`
+
+			DownlinkReplayWindow time.Duration `mapstructure:"downlink_replay_window"`
+
+			Region                   string `mapstructure:"region"`
+			CheckDownlinkPayloadSize bool   `mapstructure:"check_downlink_payload_size"`
+			CheckDownlinkDataRate    bool   `mapstructure:"check_downlink_data_rate"`
+
+			Listeners           []SemtechUDPListener `mapstructure:"listeners"`
+			BindResolveInterval time.Duration        `mapstructure:"bind_resolve_interval"`
+
+			TXAuditBufferSize   int `mapstructure:"tx_audit_buffer_size"`
+			RawStatsBufferSize  int `mapstructure:"raw_stats_buffer_size"`
+			RawUplinkBufferSize int `mapstructure:"raw_uplink_buffer_size"`
+			MirrorBufferSize    int `mapstructure:"mirror_buffer_size"`
+
+			SubscriberBufferSize int    `mapstructure:"subscriber_buffer_size"`
+			SubscriberPolicy     string `mapstructure:"subscriber_policy"`
+
+			MaxTXPower    int    `mapstructure:"max_tx_power"`
+			TXPowerPolicy string `mapstructure:"tx_power_policy"`
+
+			MinRSSI *int     `mapstructure:"min_rssi"`
+			MinSNR  *float64 `mapstructure:"min_snr"`
+
+			SizeMismatchPolicy string `mapstructure:"size_mismatch_policy"`
+
+			SyntheticStatsInterval time.Duration `mapstructure:"synthetic_stats_interval"`
+			SummaryLogInterval     time.Duration `mapstructure:"summary_log_interval"`
+
+			GatewaysFile string `mapstructure:"gateways_file"`
+
+			TrafficLogFile    string `mapstructure:"traffic_log_file"`
+			TrafficLogMaxSize int64  `mapstructure:"traffic_log_max_size"`
+
+			LogFrames       bool `mapstructure:"log_frames"`
+			LogFramesRedact bool `mapstructure:"log_frames_redact"`
+
+			AdminServer struct {
+				Bind        string `mapstructure:"bind"`
+				BearerToken string `mapstructure:"bearer_token"`
+			} `mapstructure:"admin_server"`
+
+			Health struct {
+				MinACKRatio      float64 `mapstructure:"min_ack_ratio"`
+				MinRXOKRatio     float64 `mapstructure:"min_rx_ok_ratio"`
+				MaxIdleIntervals int     `mapstructure:"max_idle_intervals"`
+			} `mapstructure:"health"`
+
+			TXRFChains []SemtechUDPTXRFChain `mapstructure:"tx_rf_chains"`
+
+			DutyCycleSubBands []SemtechUDPDutyCycleSubBand `mapstructure:"duty_cycle_sub_bands"`
+
+			Gateways map[string]SemtechUDPGateway `mapstructure:"gateways"`
 		} `mapstructure:"semtech_udp"`
 
 		BasicStation struct {
@@ -126,6 +229,48 @@ type Config struct {
 	} `mapstructure:"commands"`
 }
 
+// SemtechUDPTXRFChain holds the frequency range and the (optional) max. TX
+// power covered by a TX capable RF chain.
+type SemtechUDPTXRFChain struct {
+	RFChain      uint8  `mapstructure:"rf_chain"`
+	FrequencyMin uint32 `mapstructure:"frequency_min"`
+	FrequencyMax uint32 `mapstructure:"frequency_max"`
+	MaxPower     int    `mapstructure:"max_power"`
+}
+
+// SemtechUDPDutyCycleSubBand holds the frequency range and the max. duty-cycle
+// (in percent) of a sub-band.
+type SemtechUDPDutyCycleSubBand struct {
+	FrequencyMin uint32  `mapstructure:"frequency_min"`
+	FrequencyMax uint32  `mapstructure:"frequency_max"`
+	DutyCycle    float64 `mapstructure:"duty_cycle"`
+}
+
+// SemtechUDPListener holds the configuration of an additional UDP listener.
+type SemtechUDPListener struct {
+	ID   string `mapstructure:"id"`
+	Bind string `mapstructure:"bind"`
+}
+
+// SemtechUDPGateway holds the per-gateway configuration overrides. Unset
+// values fall back to the global Semtech UDP configuration.
+type SemtechUDPGateway struct {
+	Disabled     bool     `mapstructure:"disabled"`
+	SkipCRCCheck *bool    `mapstructure:"skip_crc_check"`
+	FakeRxTime   *bool    `mapstructure:"fake_rx_time"`
+	MaxTXPower   *int     `mapstructure:"max_tx_power"`
+	IgnoreRxTime bool     `mapstructure:"ignore_rx_time"`
+	MinRSSI      *int     `mapstructure:"min_rssi"`
+	MinSNR       *float64 `mapstructure:"min_snr"`
+
+	JITPastMargin   *time.Duration `mapstructure:"jit_past_margin"`
+	JITFutureMargin *time.Duration `mapstructure:"jit_future_margin"`
+
+	DownlinkFrequencies []uint32 `mapstructure:"downlink_frequencies"`
+
+	Labels map[string]string `mapstructure:"labels"`
+}
+
 // BasicStationConcentrator holds the configuration for a BasicStation concentrator.
 type BasicStationConcentrator struct {
 	MultiSF BasicStationConcentratorMultiSF `mapstructure:"multi_sf"`
@@ -155,3 +155,20 @@ func filterRejoinRequest(phy lorawan.PHYPayload) bool {
 		return true
 	}
 }
+
+// GetMType returns the message-type of the given LoRaWAN frame, e.g.
+// lorawan.JoinRequest, lorawan.UnconfirmedDataUp or lorawan.ConfirmedDataUp.
+// Only the MHDR is decoded, so that consumers can route join traffic
+// differently without decoding the full PHYPayload.
+func GetMType(b []byte) (lorawan.MType, error) {
+	if len(b) == 0 {
+		return 0, errors.New("empty phypayload")
+	}
+
+	var mhdr lorawan.MHDR
+	if err := mhdr.UnmarshalBinary(b[:1]); err != nil {
+		return 0, errors.Wrap(err, "unmarshal mhdr error")
+	}
+
+	return mhdr.MType, nil
+}
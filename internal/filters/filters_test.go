@@ -234,3 +234,47 @@ func TestFilters(t *testing.T) {
 		})
 	}
 }
+
+func TestGetMType(t *testing.T) {
+	tests := []struct {
+		Name       string
+		PHYPayload []byte
+		MType      lorawan.MType
+		Error      string
+	}{
+		{
+			Name:       "join-request",
+			PHYPayload: []byte{0x00, 0x01, 0x02},
+			MType:      lorawan.JoinRequest,
+		},
+		{
+			Name:       "unconfirmed data-up",
+			PHYPayload: []byte{0x40, 0x01, 0x02},
+			MType:      lorawan.UnconfirmedDataUp,
+		},
+		{
+			Name:       "confirmed data-up",
+			PHYPayload: []byte{0x80, 0x01, 0x02},
+			MType:      lorawan.ConfirmedDataUp,
+		},
+		{
+			Name:  "empty phypayload",
+			Error: "empty phypayload",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			mType, err := GetMType(tst.PHYPayload)
+			if tst.Error != "" {
+				assert.EqualError(err, tst.Error)
+				return
+			}
+
+			assert.NoError(err)
+			assert.Equal(tst.MType, mType)
+		})
+	}
+}